@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 
 	"github.com/sirupsen/logrus"
@@ -29,6 +30,12 @@ func main() {
 		if _, paused := wodby1.AsMigrationPaused(err); paused {
 			os.Exit(exitCodeExternalActionRequired)
 		}
+		// Monitoring commands such as "cert report" choose their own status,
+		// for example Nagios warning (1) and critical (2).
+		var exitErr interface{ ExitCode() int }
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
 		os.Exit(1)
 	}
 
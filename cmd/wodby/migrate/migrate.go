@@ -132,7 +132,8 @@ func newWodby1InstanceCommand() *cobra.Command {
 		Long: `Migrate exactly one Wodby 1 app instance. The default command is a
 read-only preview. Add --apply to create the target and import data, then test
 the target using its technical route. Change DNS only after testing succeeds,
-and rerun the same command with --verify to validate the completed migration.
+confirm the change with "wodby instance dns-check TARGET_INSTANCE_ID", and
+rerun the same command with --verify to validate the completed migration.
 
 The migration exports only the selected
 instance and its parent app metadata, then creates a new Wodby 2 app containing
@@ -2816,7 +2817,7 @@ func printMigrationResult(
 	printImportStatuses(cmd, plan, "completed")
 	if action == "apply" {
 		fmt.Fprintln(cmd.OutOrStdout(), "Test the app using its Wodby 2 technical route before changing DNS.")
-		fmt.Fprintln(cmd.OutOrStdout(), "After DNS points to Wodby 2, rerun the same command with --verify.")
+		fmt.Fprintln(cmd.OutOrStdout(), "After DNS points to Wodby 2 (check with \"wodby instance dns-check\"), rerun the same command with --verify.")
 		fmt.Fprintf(cmd.OutOrStdout(), "Temporary plan file: %s\n", planPath)
 		fmt.Fprintf(cmd.OutOrStdout(), "Temporary resume-state file: %s\n", statePath)
 	} else {
@@ -2948,7 +2949,7 @@ func printServerMigrationResult(
 	printImportStatuses(cmd, plan, "completed")
 	if action == "apply" {
 		fmt.Fprintln(cmd.OutOrStdout(), "Test every app using its Wodby 2 technical route before changing DNS.")
-		fmt.Fprintln(cmd.OutOrStdout(), "After DNS points to Wodby 2, rerun the same command with --verify.")
+		fmt.Fprintln(cmd.OutOrStdout(), "After DNS points to Wodby 2 (check with \"wodby instance dns-check\"), rerun the same command with --verify.")
 		if viper.GetBool("verbose") {
 			fmt.Fprintf(cmd.OutOrStdout(), "Temporary plan file: %s\n", planPath)
 		}
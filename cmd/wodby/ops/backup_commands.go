@@ -0,0 +1,581 @@
+package ops
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+	"go.yaml.in/yaml/v3"
+)
+
+var backupComponents = map[string]bool{"db": true, "files": true}
+
+type backupDownload struct {
+	url      string
+	fileName string
+	size     int64
+	checksum transferChecksum
+}
+
+func newBackupDownloadCommand(out outputOptions) *cobra.Command {
+	var component, outPath string
+	var retries int
+	var decompress, force bool
+	cmd := &cobra.Command{
+		Use:   "download ID",
+		Short: "Download a backup archive",
+		Long: "Download a backup archive through a signed URL.\n\n" +
+			"Data is written to PATH.part first. An interrupted transfer is resumed with an HTTP Range request, both within --retries and when the command is run again. " +
+			"The finished file is checked against the size and checksum reported by the API before it is moved to PATH.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if component != "" && !backupComponents[component] {
+				return errors.Errorf("unsupported --component %q; use db or files", component)
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			download, err := fetchBackupDownload(cmd.Context(), client, args[0], component)
+			if err != nil {
+				return err
+			}
+			target := outPath
+			if target == "" {
+				target = download.fileName
+			} else if info, err := os.Stat(target); err == nil && info.IsDir() {
+				target = filepath.Join(target, download.fileName)
+			}
+			if _, err := os.Stat(target); err == nil && !force {
+				return errors.Errorf("%s already exists; use --force to overwrite", target)
+			}
+
+			partPath := target + ".part"
+			label := "backup " + args[0]
+			if component != "" {
+				label += " " + component
+			}
+			for attempt := 0; ; attempt++ {
+				var progress *transferProgress
+				err = downloadToPartFile(cmd.Context(), download.url, partPath, func(offset int64) io.Writer {
+					progress = newTransferProgress(cmd.ErrOrStderr(), label, download.size, offset)
+					return progress
+				})
+				if progress != nil {
+					progress.Finish()
+				}
+				if err == nil || attempt >= retries || cmd.Context().Err() != nil {
+					break
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "%v; resuming (%d/%d)\n", err, attempt+1, retries)
+				time.Sleep(transferRetryDelay)
+				// Signed URLs are short-lived, so every retry asks for a fresh one.
+				if download, err = fetchBackupDownload(cmd.Context(), client, args[0], component); err != nil {
+					return err
+				}
+			}
+			if err != nil {
+				return errors.Wrapf(err, "download stopped; run the command again to resume from %s", partPath)
+			}
+
+			checksum, err := verifyBackupDownload(partPath, download)
+			if err != nil {
+				return err
+			}
+			if err := os.Rename(partPath, target); err != nil {
+				return errors.WithStack(err)
+			}
+			if decompress {
+				if target, err = gunzipFile(target); err != nil {
+					return err
+				}
+			}
+
+			info, err := os.Stat(target)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			result := map[string]interface{}{"path": target, "size": info.Size(), "checksum": checksum, "verified": download.checksum.value != ""}
+			if outputFormat(cmd, out) == outputJSON {
+				return printJSON(cmd, result)
+			}
+			verified := "size verified"
+			if download.checksum.value != "" {
+				verified = download.checksum.algorithm + " verified"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Downloaded %s to %s (%s, %s)\n", label, target, formatByteSize(info.Size()), verified)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&component, "component", "", "Backup component: db or files")
+	cmd.Flags().StringVar(&outPath, "out", "", "Destination file or directory; defaults to the archive name in the current directory")
+	cmd.Flags().IntVar(&retries, "retries", 3, "Number of times to resume an interrupted transfer")
+	cmd.Flags().BoolVar(&decompress, "decompress", false, "Decompress a gzip archive after verification")
+	cmd.Flags().BoolVar(&force, "force", false, "Overwrite an existing destination file")
+	return cmd
+}
+
+func fetchBackupDownload(ctx context.Context, client *rest.Client, backupID string, component string) (backupDownload, error) {
+	query := url.Values{}
+	addQuery(query, "component", component)
+	var result interface{}
+	if err := client.Get(ctx, escapedPath("/backups/%s/download", backupID), query, &result); err != nil {
+		return backupDownload{}, err
+	}
+	row := cloneFirstRow(normalizeItem(result))
+	if row == nil {
+		return backupDownload{}, errors.New("backup download response did not include an item")
+	}
+	download := backupDownload{
+		url:      firstScalarPath(row, "url", "signedUrl", "downloadUrl"),
+		fileName: firstScalarPath(row, "fileName", "filename"),
+		checksum: parseTransferChecksum(firstScalarPath(row, "checksum", "sha256", "md5"), firstScalarPath(row, "checksumAlgorithm")),
+	}
+	if download.url == "" {
+		return backupDownload{}, errors.New("backup download response did not include a url")
+	}
+	if download.checksum.algorithm == "" {
+		switch {
+		case firstScalarPath(row, "sha256") != "":
+			download.checksum.algorithm = "sha256"
+		case firstScalarPath(row, "md5") != "":
+			download.checksum.algorithm = "md5"
+		}
+	}
+	if size := firstScalarPath(row, "size", "sizeBytes", "contentLength"); size != "" {
+		parsed, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return backupDownload{}, errors.Wrapf(err, "invalid backup size %q", size)
+		}
+		download.size = parsed
+	}
+	if download.fileName == "" {
+		if parsed, err := url.Parse(download.url); err == nil {
+			download.fileName = path.Base(parsed.Path)
+		}
+	}
+	if download.fileName == "" || download.fileName == "." || download.fileName == "/" {
+		download.fileName = "backup-" + backupID
+		if component != "" {
+			download.fileName += "-" + component
+		}
+		download.fileName += ".tar.gz"
+	}
+	download.fileName = filepath.Base(download.fileName)
+	return download, nil
+}
+
+func verifyBackupDownload(partPath string, download backupDownload) (string, error) {
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if download.size > 0 && info.Size() != download.size {
+		return "", errors.Errorf("downloaded %d bytes, want %d; remove %s and download again", info.Size(), download.size, partPath)
+	}
+	algorithm := download.checksum.algorithm
+	if download.checksum.value == "" {
+		algorithm = "sha256"
+	}
+	sum, err := fileChecksum(partPath, algorithm)
+	if err != nil {
+		return "", err
+	}
+	if download.checksum.value != "" && sum != download.checksum.value {
+		_ = os.Remove(partPath)
+		return "", errors.Errorf("%s checksum mismatch: got %s, want %s", algorithm, sum, download.checksum.value)
+	}
+	return algorithm + ":" + sum, nil
+}
+
+// gunzipFile replaces a .gz file with its decompressed content and returns
+// the new path.
+func gunzipFile(source string) (string, error) {
+	target := strings.TrimSuffix(source, ".gz")
+	if strings.HasSuffix(source, ".tgz") {
+		target = strings.TrimSuffix(source, ".tgz") + ".tar"
+	}
+	if target == source {
+		return "", errors.Errorf("%s is not a gzip archive", source)
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer in.Close()
+	reader, err := gzip.NewReader(in)
+	if err != nil {
+		return "", errors.Wrap(err, "decompress")
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		_ = out.Close()
+		return "", errors.Wrap(err, "decompress")
+	}
+	if err := out.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := os.Remove(source); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return target, nil
+}
+
+const defaultBackupPolicyFile = ".wodby/backup-policy.yaml"
+
+var backupPruneColumns = []string{"id", "name", "service", "createdAt", "action", "reason"}
+
+// backupRetention is a grandfather-father-son rule: keep the newest KeepLast
+// backups plus the newest backup of each of the last KeepDaily days and
+// KeepWeekly ISO weeks. Rules apply to each service of the instance.
+type backupRetention struct {
+	Instance   string `json:"instance" yaml:"instance"`
+	KeepLast   int    `json:"keepLast,omitempty" yaml:"keepLast,omitempty"`
+	KeepDaily  int    `json:"keepDaily,omitempty" yaml:"keepDaily,omitempty"`
+	KeepWeekly int    `json:"keepWeekly,omitempty" yaml:"keepWeekly,omitempty"`
+}
+
+type backupPolicyFile struct {
+	Policies []backupRetention `json:"policies" yaml:"policies"`
+}
+
+type backupPruneItem struct {
+	row     map[string]interface{}
+	created time.Time
+	keep    bool
+	reasons []string
+}
+
+func (r backupRetention) empty() bool {
+	return r.KeepLast == 0 && r.KeepDaily == 0 && r.KeepWeekly == 0
+}
+
+func (r backupRetention) String() string {
+	return fmt.Sprintf("keep last %d, daily %d, weekly %d", r.KeepLast, r.KeepDaily, r.KeepWeekly)
+}
+
+func newBackupPruneCommand(out outputOptions) *cobra.Command {
+	var rule backupRetention
+	var policyFile string
+	var dryRun, yes bool
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete backups outside a retention policy",
+		Long: "Delete backups outside a grandfather-father-son retention policy.\n\n" +
+			"For every service of the instance the newest --keep-last backups are kept, plus the newest backup of each of the last --keep-daily days and --keep-weekly ISO weeks. " +
+			"Backups that are not finished successfully are never deleted. " +
+			"Without --instance, every policy saved with \"wodby backup policy set\" is enforced and --keep-* flags are rejected; without --keep-* flags the saved policy of --instance is used.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if rule.Instance == "" {
+				for _, name := range []string{"keep-last", "keep-daily", "keep-weekly"} {
+					if cmd.Flags().Changed(name) {
+						return errors.Errorf("--%s requires --instance; without it the saved policies are enforced", name)
+					}
+				}
+			}
+			rules := []backupRetention{rule}
+			if rule.Instance == "" || rule.empty() {
+				policies, err := readBackupPolicyFile(policyFile)
+				if err != nil {
+					return err
+				}
+				rules = policies.forInstance(rule.Instance)
+				if len(rules) == 0 {
+					if rule.Instance == "" {
+						return errors.Errorf("--instance is required when %s has no policies", policyFile)
+					}
+					return errors.Errorf("no --keep-* flags given and %s has no policy for app instance %s", policyFile, rule.Instance)
+				}
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				if rule.empty() {
+					return errors.Errorf("retention policy for app instance %s keeps nothing; set at least one --keep-* value", rule.Instance)
+				}
+				if err := pruneInstanceBackups(cmd, client, out, rule, dryRun, yes); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	addBackupRetentionFlags(cmd, &rule)
+	cmd.Flags().StringVar(&policyFile, "policy-file", defaultBackupPolicyFile, "Retention policy file")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show which backups would be deleted")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Confirm without prompting")
+	return cmd
+}
+
+func newBackupPolicyCommand(out outputOptions) *cobra.Command {
+	var policyFile string
+	cmd := &cobra.Command{
+		Use:     "policy",
+		Aliases: []string{"policies"},
+		Short:   "Manage backup retention policies",
+		Long: "Manage backup retention policies saved in a local file.\n\n" +
+			"Commit the file to the repository and run \"wodby backup prune --yes\" from a scheduled CI job to enforce it.",
+	}
+	cmd.PersistentFlags().StringVar(&policyFile, "policy-file", defaultBackupPolicyFile, "Retention policy file")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List backup retention policies",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policies, err := readBackupPolicyFile(policyFile)
+			if err != nil {
+				return err
+			}
+			rows := make([]map[string]interface{}, 0, len(policies.Policies))
+			for _, policy := range policies.Policies {
+				rows = append(rows, map[string]interface{}{
+					"instance":   policy.Instance,
+					"keepLast":   policy.KeepLast,
+					"keepDaily":  policy.KeepDaily,
+					"keepWeekly": policy.KeepWeekly,
+				})
+			}
+			return printResult(cmd, out, rows, []string{"instance", "keepLast", "keepDaily", "keepWeekly"})
+		},
+	}
+
+	var rule backupRetention
+	setCmd := &cobra.Command{
+		Use:   "set",
+		Short: "Save the retention policy of an app instance",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(rule.Instance, "--instance"); err != nil {
+				return err
+			}
+			if rule.empty() {
+				return errors.New("set at least one of --keep-last, --keep-daily, or --keep-weekly")
+			}
+			policies, err := readBackupPolicyFile(policyFile)
+			if err != nil {
+				return err
+			}
+			policies.set(rule)
+			if err := writeBackupPolicyFile(policyFile, policies); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Saved backup policy for app instance %s to %s: %s\n", rule.Instance, policyFile, rule)
+			return nil
+		},
+	}
+	addBackupRetentionFlags(setCmd, &rule)
+
+	var removeInstance string
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove the retention policy of an app instance",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(removeInstance, "--instance"); err != nil {
+				return err
+			}
+			policies, err := readBackupPolicyFile(policyFile)
+			if err != nil {
+				return err
+			}
+			if !policies.remove(removeInstance) {
+				return errors.Errorf("%s has no policy for app instance %s", policyFile, removeInstance)
+			}
+			if err := writeBackupPolicyFile(policyFile, policies); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed backup policy for app instance %s from %s\n", removeInstance, policyFile)
+			return nil
+		},
+	}
+	removeCmd.Flags().StringVarP(&removeInstance, "instance", "i", "", "App instance ID")
+
+	defaultToList(cmd, listCmd)
+	cmd.AddCommand(listCmd, setCmd, removeCmd)
+	return cmd
+}
+
+func addBackupRetentionFlags(cmd *cobra.Command, rule *backupRetention) {
+	cmd.Flags().StringVarP(&rule.Instance, "instance", "i", "", "App instance ID")
+	cmd.Flags().IntVar(&rule.KeepLast, "keep-last", 0, "Number of newest backups to keep")
+	cmd.Flags().IntVar(&rule.KeepDaily, "keep-daily", 0, "Number of days to keep the newest backup of")
+	cmd.Flags().IntVar(&rule.KeepWeekly, "keep-weekly", 0, "Number of ISO weeks to keep the newest backup of")
+}
+
+func readBackupPolicyFile(path string) (*backupPolicyFile, error) {
+	policies := &backupPolicyFile{}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return policies, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := yaml.Unmarshal(content, policies); err != nil {
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+	return policies, nil
+}
+
+func writeBackupPolicyFile(path string, policies *backupPolicyFile) error {
+	content, err := yaml.Marshal(policies)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return writeTextOutput(path, string(content))
+}
+
+func (f *backupPolicyFile) forInstance(instanceID string) []backupRetention {
+	if instanceID == "" {
+		return f.Policies
+	}
+	for _, policy := range f.Policies {
+		if policy.Instance == instanceID {
+			return []backupRetention{policy}
+		}
+	}
+	return nil
+}
+
+func (f *backupPolicyFile) set(rule backupRetention) {
+	for i, policy := range f.Policies {
+		if policy.Instance == rule.Instance {
+			f.Policies[i] = rule
+			return
+		}
+	}
+	f.Policies = append(f.Policies, rule)
+	sort.SliceStable(f.Policies, func(i, j int) bool { return f.Policies[i].Instance < f.Policies[j].Instance })
+}
+
+func (f *backupPolicyFile) remove(instanceID string) bool {
+	for i, policy := range f.Policies {
+		if policy.Instance == instanceID {
+			f.Policies = append(f.Policies[:i], f.Policies[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func pruneInstanceBackups(cmd *cobra.Command, client *rest.Client, out outputOptions, rule backupRetention, dryRun bool, yes bool) error {
+	rows, err := fetchRows(cmd.Context(), client, "/backups", url.Values{"appInstanceId": []string{rule.Instance}})
+	if err != nil {
+		return err
+	}
+	items := planBackupRetention(rows, rule)
+
+	display := make([]map[string]interface{}, 0, len(items))
+	deletions := make([]backupPruneItem, 0)
+	for _, item := range items {
+		row := cloneRow(item.row)
+		row["action"] = "keep"
+		if !item.keep {
+			row["action"] = "delete"
+			deletions = append(deletions, item)
+		}
+		row["reason"] = strings.Join(item.reasons, ", ")
+		display = append(display, row)
+	}
+	if outputFormat(cmd, out) != outputJSON {
+		fmt.Fprintf(cmd.OutOrStdout(), "App instance %s: %s\n", rule.Instance, rule)
+	}
+	if err := printClientResult(cmd, client, out, display, backupPruneColumns); err != nil {
+		return err
+	}
+	if dryRun || len(deletions) == 0 {
+		return nil
+	}
+	if err := confirm(cmd, yes, fmt.Sprintf("Delete %s of app instance %s and keep %d?", pluralizeCount(len(deletions), "backup", "backups"), rule.Instance, len(items)-len(deletions))); err != nil {
+		return err
+	}
+	for _, item := range deletions {
+		id := firstScalarPath(item.row, "id")
+		if err := client.Delete(cmd.Context(), "/backups/"+url.PathEscape(id), nil, nil); err != nil {
+			return errors.Wrapf(err, "delete backup %s", id)
+		}
+	}
+	if outputFormat(cmd, out) != outputJSON {
+		fmt.Fprintf(cmd.OutOrStdout(), "Deleted %s\n", pluralizeCount(len(deletions), "backup", "backups"))
+	}
+	return nil
+}
+
+// planBackupRetention marks each backup as kept or deleted, newest first.
+// Backups that have not finished successfully or whose creation time is
+// unknown are always kept.
+func planBackupRetention(rows []map[string]interface{}, rule backupRetention) []backupPruneItem {
+	items := make([]backupPruneItem, 0, len(rows))
+	for _, row := range rows {
+		created, _ := parseDisplayTime(firstNonNilPath(row, "createdAt", "startedAt"))
+		items = append(items, backupPruneItem{row: row, created: created})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].created.After(items[j].created) })
+
+	type bucketCounts struct {
+		last  int
+		days  map[string]bool
+		weeks map[string]bool
+	}
+	groups := map[string]*bucketCounts{}
+	for i := range items {
+		item := &items[i]
+		status := strings.ToLower(formatValue(item.row["status"]))
+		if !successfulStatuses[status] {
+			item.keep = true
+			item.reasons = append(item.reasons, "not finished")
+			continue
+		}
+		if item.created.IsZero() {
+			item.keep = true
+			item.reasons = append(item.reasons, "unknown creation time")
+			continue
+		}
+		group := firstRelationID(item.row, relationColumns["service"]) + "/" + firstScalarPath(item.row, "databaseDbId", "databaseDb.id")
+		counts := groups[group]
+		if counts == nil {
+			counts = &bucketCounts{days: map[string]bool{}, weeks: map[string]bool{}}
+			groups[group] = counts
+		}
+
+		created := item.created.Local()
+		if counts.last < rule.KeepLast {
+			counts.last++
+			item.reasons = append(item.reasons, fmt.Sprintf("last %d", counts.last))
+		}
+		if day := created.Format("2006-01-02"); !counts.days[day] && len(counts.days) < rule.KeepDaily {
+			counts.days[day] = true
+			item.reasons = append(item.reasons, "daily "+day)
+		}
+		year, week := created.ISOWeek()
+		if key := fmt.Sprintf("%d-W%02d", year, week); !counts.weeks[key] && len(counts.weeks) < rule.KeepWeekly {
+			counts.weeks[key] = true
+			item.reasons = append(item.reasons, "weekly "+key)
+		}
+		item.keep = len(item.reasons) != 0
+	}
+	return items
+}
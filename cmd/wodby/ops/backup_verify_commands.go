@@ -0,0 +1,526 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	backupVerifyPass = "pass"
+	backupVerifyFail = "fail"
+	backupVerifySkip = "skip"
+)
+
+var backupVerifyColumns = []string{"name", "kind", "status", "duration", "message"}
+
+// backupVerifyChecks is the checks file of backup verify. A check either runs
+// a service action of the target instance and matches its task logs, or
+// probes an HTTP path on the target instance routes.
+type backupVerifyChecks struct {
+	Checks []backupVerifyCheck `json:"checks" yaml:"checks"`
+}
+
+type backupVerifyCheck struct {
+	Name string `json:"name" yaml:"name"`
+
+	// Service action checks.
+	Service string   `json:"service,omitempty" yaml:"service,omitempty"`
+	Action  string   `json:"action,omitempty" yaml:"action,omitempty"`
+	Expect  string   `json:"expect,omitempty" yaml:"expect,omitempty"`
+	Min     *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+
+	// HTTP checks.
+	URL      string `json:"url,omitempty" yaml:"url,omitempty"`
+	Path     string `json:"path,omitempty" yaml:"path,omitempty"`
+	Host     string `json:"host,omitempty" yaml:"host,omitempty"`
+	Scheme   string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	Status   int    `json:"status,omitempty" yaml:"status,omitempty"`
+	Contains string `json:"contains,omitempty" yaml:"contains,omitempty"`
+}
+
+type backupVerifyResult struct {
+	Name     string  `json:"name"`
+	Kind     string  `json:"kind"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+type backupVerifyReport struct {
+	BackupID   string               `json:"backupId"`
+	InstanceID string               `json:"instanceId"`
+	ImportID   string               `json:"importId,omitempty"`
+	Passed     bool                 `json:"passed"`
+	StartedAt  time.Time            `json:"startedAt"`
+	Results    []backupVerifyResult `json:"results"`
+}
+
+func newBackupVerifyCommand(out outputOptions) *cobra.Command {
+	var into, service, databaseDBID, checksFile, report, reportOut string
+	var probes []string
+	var timeout time.Duration
+	var yes bool
+	cmd := &cobra.Command{
+		Use:   "verify ID --into INSTANCE_ID",
+		Short: "Restore a backup into another instance and run checks against it",
+		Long: "Restore a backup into a scratch or QA app instance, wait for the import task, then run checks against the restored data.\n\n" +
+			"Checks are read from --checks, a YAML or JSON file with a \"checks\" list. A service action check runs ACTION on the named service of the target instance and matches its task logs against the \"expect\" regular expression; \"min\" and \"max\" bound the number captured by its first group, for example a row count printed by a SQL query action. " +
+			"An HTTP check requests \"path\" on the main route of the target instance, or \"url\", and expects \"status\" (default 200) and optionally a body that \"contains\" a string. --http adds HTTP checks from the command line.\n\n" +
+			"Write a JUnit report with --report junit --out FILE for CI systems, or use -o json. The command fails when any check fails.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(into, "--into"); err != nil {
+				return err
+			}
+			if report != "" && report != "junit" && report != outputJSON {
+				return errors.Errorf("unsupported --report %q; use junit or json", report)
+			}
+			checks := backupVerifyChecks{}
+			if checksFile != "" {
+				content, err := readTextFileOrStdin(cmd, checksFile)
+				if err != nil {
+					return err
+				}
+				if err := yaml.Unmarshal([]byte(content), &checks); err != nil {
+					return errors.Wrapf(err, "read %s", checksFile)
+				}
+			}
+			for _, probe := range probes {
+				checks.Checks = append(checks.Checks, backupVerifyCheck{Name: "http " + probe, Path: probe})
+			}
+			for i, check := range checks.Checks {
+				if err := check.validate(); err != nil {
+					return errors.Wrapf(err, "check %d", i+1)
+				}
+			}
+
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			var backup interface{}
+			if err := client.Get(cmd.Context(), "/backups/"+url.PathEscape(args[0]), nil, &backup); err != nil {
+				return err
+			}
+			backupRow := cloneFirstRow(normalizeItem(backup))
+			if backupRow == nil {
+				return errors.New("backup response did not include an item")
+			}
+			if status := strings.ToLower(formatValue(backupRow["status"])); !successfulStatuses[status] {
+				return errors.Errorf("backup %s has status %q; only finished backups can be verified", args[0], status)
+			}
+			serviceID, err := backupVerifyTargetService(cmd.Context(), client, backupRow, service, into)
+			if err != nil {
+				return err
+			}
+			if err := confirm(cmd, yes, fmt.Sprintf("Restore backup %s into app instance %s? Existing data of service %s will be replaced.", args[0], into, serviceID)); err != nil {
+				return err
+			}
+
+			result := &backupVerifyReport{BackupID: args[0], InstanceID: into, StartedAt: time.Now().UTC()}
+			importResult := runBackupVerifyImport(cmd.Context(), client, result, args[0], serviceID, databaseDBID, timeout)
+			result.Results = append(result.Results, importResult)
+			var routes []map[string]interface{}
+			for _, check := range checks.Checks {
+				if importResult.Status != backupVerifyPass {
+					result.Results = append(result.Results, backupVerifyResult{Name: check.Name, Kind: check.kind(), Status: backupVerifySkip, Message: "restore failed"})
+					continue
+				}
+				if check.kind() == "http" && routes == nil && check.URL == "" {
+					if routes, err = fetchRows(cmd.Context(), client, "/app-routes", url.Values{"appInstanceId": []string{into}}); err != nil {
+						return err
+					}
+				}
+				result.Results = append(result.Results, runBackupVerifyCheck(cmd.Context(), client, check, into, routes, timeout))
+			}
+			result.Passed = true
+			failed := 0
+			for _, item := range result.Results {
+				if item.Status != backupVerifyPass {
+					result.Passed = false
+					failed++
+				}
+			}
+
+			if err := writeBackupVerifyReport(cmd, out, result, report, reportOut); err != nil {
+				return err
+			}
+			if !result.Passed {
+				cmd.SilenceUsage = true
+				return errors.Errorf("backup %s verification failed: %d of %d checks did not pass", args[0], failed, len(result.Results))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&into, "into", "", "Scratch or QA app instance ID to restore the backup into")
+	cmd.Flags().StringVar(&service, "service", "", "Target app service ID or name; defaults to the service with the backup's service name")
+	cmd.Flags().StringVar(&databaseDBID, "database-db", "", "Target DB ID")
+	cmd.Flags().StringVar(&checksFile, "checks", "", "YAML or JSON checks file, or - for stdin")
+	cmd.Flags().StringArrayVar(&probes, "http", nil, "HTTP path to probe on the main route of the target instance; repeatable")
+	cmd.Flags().StringVar(&report, "report", "", "Report format: junit or json; defaults to the output format")
+	cmd.Flags().StringVar(&reportOut, "out", "", "Write the report to a file instead of stdout")
+	cmd.Flags().DurationVar(&timeout, "timeout", 30*time.Minute, "Maximum time to wait for the import and each check")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Confirm without prompting")
+	return cmd
+}
+
+func (c backupVerifyCheck) kind() string {
+	if c.Action != "" {
+		return "action"
+	}
+	return "http"
+}
+
+func (c backupVerifyCheck) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if c.Action != "" {
+		if c.Service == "" {
+			return errors.Errorf("%s: service is required for an action check", c.Name)
+		}
+		if c.Expect == "" && (c.Min != nil || c.Max != nil) {
+			return errors.Errorf("%s: min and max need an expect pattern", c.Name)
+		}
+		if _, err := regexp.Compile(c.Expect); err != nil {
+			return errors.Wrapf(err, "%s: invalid expect pattern", c.Name)
+		}
+		return nil
+	}
+	if c.URL == "" && c.Path == "" {
+		return errors.Errorf("%s: set action, url, or path", c.Name)
+	}
+	return nil
+}
+
+// backupVerifyTargetService picks the app service of the target instance
+// that receives the backup: --service when set, otherwise the service named
+// like the one the backup was taken from.
+func backupVerifyTargetService(ctx context.Context, client *rest.Client, backup map[string]interface{}, service string, instanceID string) (string, error) {
+	if service == "" {
+		sourceID := firstRelationID(backup, relationColumns["service"])
+		if sourceID == "" {
+			return "", errors.New("backup does not reference an app service; use --service")
+		}
+		var source interface{}
+		if err := client.Get(ctx, "/app-services/"+url.PathEscape(sourceID), nil, &source); err != nil {
+			return "", err
+		}
+		service = firstScalarPath(cloneFirstRow(normalizeItem(source)), "name")
+		if service == "" {
+			return "", errors.Errorf("app service %s has no name; use --service", sourceID)
+		}
+	}
+	return resolveImportServiceID(ctx, client, service, instanceID)
+}
+
+func runBackupVerifyImport(ctx context.Context, client *rest.Client, report *backupVerifyReport, backupID string, serviceID string, databaseDBID string, timeout time.Duration) backupVerifyResult {
+	started := time.Now()
+	result := backupVerifyResult{Name: "restore backup " + backupID, Kind: "import", Status: backupVerifyFail}
+
+	requestBody := bodyFromMap(map[string]interface{}{
+		"appServiceId": optionalInt(serviceID),
+		"databaseDbId": optionalInt(databaseDBID),
+		"import": bodyFromMap(map[string]interface{}{
+			"source":   "backup",
+			"backupId": optionalInt(backupID),
+		}),
+	})
+	var created interface{}
+	if err := client.Post(ctx, "/imports", nil, requestBody, &created); err != nil {
+		result.Message = err.Error()
+		result.Duration = time.Since(started).Seconds()
+		return result
+	}
+	report.ImportID = firstCreatedResourceID(created)
+	taskID := firstTaskID(created)
+	if taskID == "" {
+		result.Message = "import response did not include a task"
+		result.Duration = time.Since(started).Seconds()
+		return result
+	}
+	if _, err := waitForTask(ctx, client, taskID, timeout); err != nil {
+		result.Message = fmt.Sprintf("import task %s: %v", taskID, err)
+		result.Duration = time.Since(started).Seconds()
+		return result
+	}
+	result.Status = backupVerifyPass
+	result.Message = "import task " + taskID + " finished"
+	result.Duration = time.Since(started).Seconds()
+	return result
+}
+
+func runBackupVerifyCheck(ctx context.Context, client *rest.Client, check backupVerifyCheck, instanceID string, routes []map[string]interface{}, timeout time.Duration) backupVerifyResult {
+	started := time.Now()
+	result := backupVerifyResult{Name: check.Name, Kind: check.kind(), Status: backupVerifyPass}
+	var err error
+	if check.kind() == "action" {
+		result.Message, err = runBackupVerifyAction(ctx, client, check, instanceID, timeout)
+	} else {
+		result.Message, err = runBackupVerifyProbe(ctx, check, routes, timeout)
+	}
+	if err != nil {
+		result.Status = backupVerifyFail
+		result.Message = err.Error()
+	}
+	result.Duration = time.Since(started).Seconds()
+	return result
+}
+
+func runBackupVerifyAction(ctx context.Context, client *rest.Client, check backupVerifyCheck, instanceID string, timeout time.Duration) (string, error) {
+	serviceID, err := resolveImportServiceID(ctx, client, check.Service, instanceID)
+	if err != nil {
+		return "", err
+	}
+	var created interface{}
+	if err := client.Post(ctx, escapedPath("/app-services/%s/actions/%s", serviceID, check.Action), nil, nil, &created); err != nil {
+		return "", err
+	}
+	taskID := firstTaskID(created)
+	if taskID == "" {
+		return "", errors.Errorf("action %s did not start a task", check.Action)
+	}
+	task, err := waitForTask(ctx, client, taskID, timeout)
+	if err != nil {
+		return "", errors.Wrapf(err, "action %s task %s", check.Action, taskID)
+	}
+	if check.Expect == "" {
+		return fmt.Sprintf("action %s finished", check.Action), nil
+	}
+
+	logs, err := fetchTaskJobLogs(ctx, client, taskLogJobs(task))
+	if err != nil {
+		return "", err
+	}
+	lines := make([]string, 0)
+	for _, job := range logs {
+		steps, _ := job.(map[string]interface{})["steps"].([]interface{})
+		for _, step := range steps {
+			if stepMap, ok := step.(map[string]interface{}); ok {
+				lines = append(lines, logLines(stepMap["logs"])...)
+			}
+		}
+	}
+	return matchBackupVerifyOutput(check, strings.Join(lines, "\n"))
+}
+
+// matchBackupVerifyOutput applies the expect pattern of an action check to
+// its task logs and bounds the number captured by the first group.
+func matchBackupVerifyOutput(check backupVerifyCheck, output string) (string, error) {
+	pattern := regexp.MustCompile(check.Expect)
+	match := pattern.FindStringSubmatch(output)
+	if match == nil {
+		return "", errors.Errorf("output did not match %q", check.Expect)
+	}
+	if check.Min == nil && check.Max == nil {
+		return fmt.Sprintf("output matched %q", check.Expect), nil
+	}
+	captured := match[0]
+	if len(match) > 1 {
+		captured = match[1]
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(captured), 64)
+	if err != nil {
+		return "", errors.Errorf("captured %q is not a number", captured)
+	}
+	if check.Min != nil && value < *check.Min {
+		return "", errors.Errorf("value %s is below the minimum %s", formatValue(value), formatValue(*check.Min))
+	}
+	if check.Max != nil && value > *check.Max {
+		return "", errors.Errorf("value %s is above the maximum %s", formatValue(value), formatValue(*check.Max))
+	}
+	return fmt.Sprintf("value %s is within bounds", formatValue(value)), nil
+}
+
+func runBackupVerifyProbe(ctx context.Context, check backupVerifyCheck, routes []map[string]interface{}, timeout time.Duration) (string, error) {
+	target := check.URL
+	if target == "" {
+		host := check.Host
+		if host == "" {
+			host = backupVerifyMainHost(routes)
+		}
+		if host == "" {
+			return "", errors.New("target app instance has no routes; set host or url")
+		}
+		scheme := check.Scheme
+		if scheme == "" {
+			scheme = "https"
+		}
+		target = scheme + "://" + host + "/" + strings.TrimPrefix(check.Path, "/")
+	}
+	want := check.Status
+	if want == 0 {
+		want = http.StatusOK
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, min(timeout, time.Minute))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "GET %s", target)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", errors.Wrapf(err, "GET %s", target)
+	}
+	if resp.StatusCode != want {
+		return "", errors.Errorf("GET %s returned status %d, want %d", target, resp.StatusCode, want)
+	}
+	if check.Contains != "" && !strings.Contains(string(body), check.Contains) {
+		return "", errors.Errorf("GET %s response does not contain %q", target, check.Contains)
+	}
+	return fmt.Sprintf("GET %s returned %d", target, resp.StatusCode), nil
+}
+
+func backupVerifyMainHost(routes []map[string]interface{}) string {
+	host := ""
+	for _, route := range routes {
+		if formatYesNo(route["disabled"]) == "yes" || scalarString(route["host"]) == "" {
+			continue
+		}
+		if formatYesNo(route["main"]) == "yes" || formatYesNo(route["primary"]) == "yes" {
+			return scalarString(route["host"])
+		}
+		if host == "" {
+			host = scalarString(route["host"])
+		}
+	}
+	return host
+}
+
+func writeBackupVerifyReport(cmd *cobra.Command, out outputOptions, report *backupVerifyReport, format string, path string) error {
+	if format == "" {
+		format = outputFormat(cmd, out)
+	}
+	switch format {
+	case "junit":
+		content, err := backupVerifyJUnit(report)
+		if err != nil {
+			return err
+		}
+		return writeBackupVerifyOutput(cmd, path, content)
+	case outputJSON:
+		if path == "" {
+			return printJSON(cmd, report)
+		}
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return writeBackupVerifyOutput(cmd, path, string(content)+"\n")
+	}
+
+	rows := make([]map[string]interface{}, 0, len(report.Results))
+	for _, item := range report.Results {
+		rows = append(rows, map[string]interface{}{
+			"name":     item.Name,
+			"kind":     item.Kind,
+			"status":   item.Status,
+			"duration": (time.Duration(item.Duration*float64(time.Second)) / time.Millisecond * time.Millisecond).String(),
+			"message":  item.Message,
+		})
+	}
+	if err := printResult(cmd, out, rows, backupVerifyColumns); err != nil {
+		return err
+	}
+	verdict := "PASSED"
+	if !report.Passed {
+		verdict = "FAILED"
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "\nBackup %s restore into app instance %s: %s\n", report.BackupID, report.InstanceID, verdict)
+	return nil
+}
+
+func writeBackupVerifyOutput(cmd *cobra.Command, path string, content string) error {
+	if path == "" {
+		fmt.Fprint(cmd.OutOrStdout(), content)
+		return nil
+	}
+	if err := writeTextOutput(path, content); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Wrote report to %s\n", path)
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func backupVerifyJUnit(report *backupVerifyReport) (string, error) {
+	suite := junitTestSuite{
+		Name:      fmt.Sprintf("backup %s restore into app instance %s", report.BackupID, report.InstanceID),
+		Timestamp: report.StartedAt.Format(time.RFC3339),
+	}
+	var total float64
+	for _, item := range report.Results {
+		testCase := junitTestCase{
+			Name:      item.Name,
+			ClassName: "wodby.backup.verify." + item.Kind,
+			Time:      strconv.FormatFloat(item.Duration, 'f', 3, 64),
+		}
+		switch item.Status {
+		case backupVerifyFail:
+			testCase.Failure = &junitMessage{Message: item.Message}
+			suite.Failures++
+		case backupVerifySkip:
+			testCase.Skipped = &junitMessage{Message: item.Message}
+			suite.Skipped++
+		default:
+			testCase.SystemOut = item.Message
+		}
+		total += item.Duration
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Tests = len(suite.Cases)
+	suite.Time = strconv.FormatFloat(total, 'f', 3, 64)
+	content, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return xml.Header + string(content) + "\n", nil
+}
@@ -0,0 +1,193 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+var buildPromoteColumns = []string{"service", "sourceServiceId", "targetServiceId", "image"}
+
+func newBuildPromoteCommand(out outputOptions) *cobra.Command {
+	wait := waitOptions{}
+	var to string
+	var services []string
+	var yes bool
+	cmd := &cobra.Command{
+		Use:   "promote BUILD_ID --to INSTANCE_ID",
+		Short: "Deploy the images of a build to another app instance",
+		Long: "Deploy the exact images of a build to another app instance of the same app, without building again.\n\n" +
+			"Both instances must run the same stack revision, and every promoted service must exist in the target instance. " +
+			"Services are matched by name.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(to, "--to"); err != nil {
+				return err
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			var build interface{}
+			if err := client.Get(cmd.Context(), "/app-builds/"+url.PathEscape(args[0]), nil, &build); err != nil {
+				return err
+			}
+			buildRow := cloneFirstRow(normalizeItem(build))
+			if buildRow == nil {
+				return errors.New("build response did not include an item")
+			}
+			if status := strings.ToLower(formatValue(buildRow["status"])); !successfulStatuses[status] {
+				return errors.Errorf("build %s has status %q; only finished builds can be promoted", args[0], status)
+			}
+			sourceID := firstRelationID(buildRow, relationColumns["instance"])
+			if sourceID == "" {
+				return errors.Errorf("build %s does not reference an app instance", args[0])
+			}
+			if sourceID == to {
+				return errors.Errorf("build %s was built for app instance %s; use \"wodby build deploy\" to deploy it there", args[0], to)
+			}
+
+			rows, inputs, err := planBuildPromotion(cmd.Context(), client, buildRow, sourceID, to, services)
+			if err != nil {
+				return err
+			}
+			jsonOutput := outputFormat(cmd, out) == outputJSON
+			if !jsonOutput {
+				fmt.Fprintf(cmd.OutOrStdout(), "Promoting build %s from app instance %s to app instance %s\n\n", args[0], sourceID, to)
+				if err := printResult(cmd, out, rows, buildPromoteColumns); err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout())
+			}
+			if err := confirm(cmd, yes, fmt.Sprintf("Deploy %s of build %s to app instance %s?", pluralizeCount(len(inputs), "image", "images"), args[0], to)); err != nil {
+				return err
+			}
+
+			result, handled, err := createServiceBuildDeployment(cmd, client, out, wait, inputs)
+			if handled || err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(cmd, map[string]interface{}{"build": args[0], "source": sourceID, "target": to, "services": rows, "deployment": result})
+			}
+			return printClientResult(cmd, client, out, result, deploymentColumns)
+		},
+	}
+	addWaitFlags(cmd, &wait)
+	cmd.Flags().StringVar(&to, "to", "", "Target app instance ID")
+	cmd.Flags().StringSliceVar(&services, "services", nil, "Service names to promote; defaults to all services of the build")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Confirm without prompting")
+	return cmd
+}
+
+// planBuildPromotion checks that the source and target instances are
+// compatible and maps each service build to the target service of the same
+// name.
+func planBuildPromotion(ctx context.Context, client *rest.Client, build map[string]interface{}, sourceID string, targetID string, filter []string) ([]map[string]interface{}, []map[string]interface{}, error) {
+	instances := make([]map[string]interface{}, 0, 2)
+	for _, id := range []string{sourceID, targetID} {
+		var instance interface{}
+		if err := client.Get(ctx, "/app-instances/"+url.PathEscape(id), nil, &instance); err != nil {
+			return nil, nil, err
+		}
+		instances = append(instances, cloneFirstRow(normalizeItem(instance)))
+	}
+	source, target := instances[0], instances[1]
+	if sourceApp, targetApp := firstRelationID(source, relationColumns["app"]), firstRelationID(target, relationColumns["app"]); sourceApp != targetApp {
+		return nil, nil, errors.Errorf("app instance %s belongs to app %s, not app %s of the build", targetID, targetApp, sourceApp)
+	}
+	stackRevPaths := []string{"stackRevId", "stackRev.id", "stackRevisionId", "stackRevision.id"}
+	if sourceRev, targetRev := firstScalarPath(source, stackRevPaths...), firstScalarPath(target, stackRevPaths...); sourceRev != targetRev {
+		return nil, nil, errors.Errorf("app instance %s runs stack revision %s but the build was made for stack revision %s; upgrade the stack first", targetID, targetRev, sourceRev)
+	}
+
+	sourceServices, err := fetchRows(ctx, client, "/app-services", url.Values{"appInstanceId": []string{sourceID}})
+	if err != nil {
+		return nil, nil, err
+	}
+	targetServices, err := fetchRows(ctx, client, "/app-services", url.Values{"appInstanceId": []string{targetID}})
+	if err != nil {
+		return nil, nil, err
+	}
+	sourceNames := map[string]string{}
+	for _, row := range sourceServices {
+		sourceNames[firstScalarPath(row, "id")] = firstScalarPath(row, "name")
+	}
+	targetIDs := map[string]string{}
+	for _, row := range targetServices {
+		targetIDs[firstScalarPath(row, "name")] = firstScalarPath(row, "id")
+	}
+
+	wanted := stringSet(filter)
+	found := map[string]bool{}
+	missing := make([]string, 0)
+	rows := make([]map[string]interface{}, 0)
+	inputs := make([]map[string]interface{}, 0)
+	for _, serviceBuild := range asRows(firstNonNilPath(build, "appServiceBuilds", "serviceBuilds", "services")) {
+		image := imageReference(serviceBuild)
+		serviceID := firstRelationID(serviceBuild, relationColumns["service"])
+		name := sourceNames[serviceID]
+		if image == "" || name == "" || (len(wanted) != 0 && !wanted[name]) {
+			continue
+		}
+		found[name] = true
+		targetServiceID := targetIDs[name]
+		if targetServiceID == "" {
+			missing = append(missing, name)
+			continue
+		}
+		buildID := firstScalarPath(serviceBuild, "id", "appServiceBuildId", "serviceBuildId")
+		rows = append(rows, map[string]interface{}{
+			"service":         name,
+			"sourceServiceId": serviceID,
+			"targetServiceId": targetServiceID,
+			"image":           image,
+		})
+		inputs = append(inputs, map[string]interface{}{"appServiceId": optionalInt(targetServiceID), "appServiceBuildId": optionalInt(buildID)})
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, nil, errors.Errorf("app instance %s has no service %s", targetID, strings.Join(missing, ", "))
+	}
+	for name := range wanted {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, nil, errors.Errorf("build has no image for service %s", strings.Join(missing, ", "))
+	}
+	if len(inputs) == 0 {
+		return nil, nil, errors.New("build has no service images to promote")
+	}
+	return rows, inputs, nil
+}
+
+// createServiceBuildDeployment deploys service builds by ID and streams the
+// deployment logs like "wodby deployment create". handled reports whether the
+// logs were streamed and the result was already printed.
+func createServiceBuildDeployment(cmd *cobra.Command, client *rest.Client, out outputOptions, wait waitOptions, services []map[string]interface{}) (interface{}, bool, error) {
+	var result interface{}
+	if err := client.Post(cmd.Context(), "/app-deployments", nil, map[string]interface{}{"services": services}, &result); err != nil {
+		return nil, false, errors.Wrap(err, "create deployment")
+	}
+	if handled, err := printDeploymentTaskLogs(cmd.Context(), cmd, client, out, result); handled || err != nil {
+		return result, true, err
+	}
+	if wait.wait {
+		if deploymentID := firstID(result); deploymentID != "" {
+			var err error
+			if result, err = waitForDeployment(cmd.Context(), client, deploymentID, wait.timeout); err != nil {
+				return result, false, err
+			}
+		}
+	}
+	return result, false, nil
+}
@@ -0,0 +1,433 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	capacityClusterColumns   = []string{"cluster", "instances", "services", "cpu", "memory", "storage", "cpuCapacity", "memoryCapacity", "cpuFree", "memoryFree"}
+	capacityInstanceColumns  = []string{"instance", "cluster", "services", "cpu", "memory", "storage"}
+	capacityUnlimitedColumns = []string{"instance", "service", "missingLimits"}
+)
+
+// capacityUsage sums container resources in the units of the API: CPU in
+// millicores, memory in Mi and volume sizes in Gi.
+type capacityUsage struct {
+	requestCPU int64
+	limitCPU   int64
+	requestMem int64
+	limitMem   int64
+	storage    int64
+}
+
+func (u *capacityUsage) add(other capacityUsage) {
+	u.requestCPU += other.requestCPU
+	u.limitCPU += other.limitCPU
+	u.requestMem += other.requestMem
+	u.limitMem += other.limitMem
+	u.storage += other.storage
+}
+
+type capacityInstance struct {
+	id        string
+	title     string
+	clusterID string
+	services  int
+	usage     capacityUsage
+	unlimited []map[string]interface{}
+}
+
+type capacityCluster struct {
+	id        string
+	title     string
+	instances int
+	services  int
+	usage     capacityUsage
+	cpu       int64
+	memory    int64
+}
+
+func newCapacityCommand() *cobra.Command {
+	out := outputOptions{}
+	var orgID, clusterID, instanceID string
+	var top, concurrency int
+	cmd := &cobra.Command{
+		Use:   "capacity",
+		Short: "Sum the resources that app instances request from clusters",
+		Long: "Sum the CPU and memory requests and limits of the containers and the volume sizes of the enabled app services, per app instance and per cluster.\n\n" +
+			"Container resources are multiplied by the service replicas and shown as request/limit, CPU in cores. The report lists the cluster totals, the biggest app instances and the services that run without CPU or memory limits. " +
+			"When the API exposes the allocatable CPU and memory of a cluster or its nodes, the report also shows what is still free.",
+		Example: `  wodby capacity
+  wodby capacity --cluster 3
+  wodby capacity --instance 21 -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if clusterID != "" && instanceID != "" {
+				return errors.New("use either --cluster or --instance")
+			}
+			if concurrency < 1 {
+				return errors.New("--concurrency must be at least 1")
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			fetcher := newInventoryFetcher(client, concurrency, 0, false)
+
+			var instances []map[string]interface{}
+			if instanceID != "" {
+				instance, err := fetcher.get(cmd.Context(), "/app-instances/"+url.PathEscape(instanceID), nil)
+				if err != nil {
+					return err
+				}
+				instances = responseRows(normalizeItem(instance))
+			} else {
+				resolvedOrgID, err := inferOrgID(cmd.Context(), client, orgID)
+				if err != nil {
+					return err
+				}
+				all, err := fetcher.rows(cmd.Context(), "/app-instances", url.Values{"orgId": []string{resolvedOrgID}, "clusterApp": []string{"false"}})
+				if err != nil {
+					return err
+				}
+				for _, instance := range all {
+					if clusterID == "" || firstRelationID(instance, relationColumns["cluster"]) == clusterID {
+						instances = append(instances, instance)
+					}
+				}
+			}
+
+			details, err := fetchCapacityInstances(cmd.Context(), fetcher, instances)
+			if err != nil {
+				return err
+			}
+			clusters, err := fetchCapacityClusters(cmd.Context(), fetcher, details, clusterID)
+			if err != nil {
+				return err
+			}
+			return printCapacity(cmd, out, clusters, details, top)
+		},
+	}
+	addOutputFlag(cmd, &out)
+	cmd.Flags().StringVar(&orgID, "org", "", "Organization ID; inferred when current credentials expose one org")
+	cmd.Flags().StringVar(&clusterID, "cluster", "", "Only count the app instances of this cluster")
+	cmd.Flags().StringVar(&instanceID, "instance", "", "Only count this app instance")
+	cmd.Flags().IntVar(&top, "top", 10, "Number of biggest app instances to list")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 8, "Maximum number of concurrent API requests")
+	return cmd
+}
+
+func fetchCapacityInstances(ctx context.Context, fetcher *inventoryFetcher, instances []map[string]interface{}) ([]*capacityInstance, error) {
+	details := make([]*capacityInstance, len(instances))
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, instance := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			details[i], errs[i] = fetchCapacityInstance(ctx, fetcher, instance)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return details, nil
+}
+
+func fetchCapacityInstance(ctx context.Context, fetcher *inventoryFetcher, instance map[string]interface{}) (*capacityInstance, error) {
+	detail := &capacityInstance{
+		id:        firstScalarPath(instance, "id"),
+		title:     firstScalarPath(instance, "title", "name"),
+		clusterID: firstRelationID(instance, relationColumns["cluster"]),
+	}
+	services, err := fetcher.rows(ctx, "/app-services", url.Values{"appInstanceId": []string{detail.id}})
+	if err != nil {
+		return nil, err
+	}
+	enabled := make([]map[string]interface{}, 0, len(services))
+	for _, service := range services {
+		if !truthyPath(service, "disabled") {
+			enabled = append(enabled, service)
+		}
+	}
+	containers, err := fetchServiceChildren(ctx, fetcher, "/app-services", enabled, "containers")
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := fetchServiceChildren(ctx, fetcher, "/app-services", enabled, "volumes")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, service := range enabled {
+		serviceID := firstScalarPath(service, "id")
+		usage, missing := capacityServiceUsage(service, containers[serviceID], volumes[serviceID])
+		detail.services++
+		detail.usage.add(usage)
+		if len(missing) != 0 {
+			detail.unlimited = append(detail.unlimited, map[string]interface{}{
+				"instance":      detail.title,
+				"instanceId":    detail.id,
+				"service":       firstScalarPath(service, "title", "name"),
+				"serviceId":     serviceID,
+				"missingLimits": strings.Join(missing, ", "),
+			})
+		}
+	}
+	return detail, nil
+}
+
+// capacityServiceUsage sums the resources of one app service and returns
+// which limits any of its containers lack. Volumes that reuse the volume of
+// another service do not add storage.
+func capacityServiceUsage(service map[string]interface{}, containers []map[string]interface{}, volumes []map[string]interface{}) (capacityUsage, []string) {
+	replicas, ok := capacityInt(service, "replicas")
+	if !ok {
+		replicas = 1
+	}
+	usage := capacityUsage{}
+	missingCPU, missingMem := false, false
+	for _, container := range containers {
+		requestCPU, _ := capacityInt(container, "requestCPU")
+		requestMem, _ := capacityInt(container, "requestMem")
+		limitCPU, hasLimitCPU := capacityInt(container, "limitCPU")
+		limitMem, hasLimitMem := capacityInt(container, "limitMem")
+		usage.requestCPU += requestCPU * replicas
+		usage.requestMem += requestMem * replicas
+		usage.limitCPU += limitCPU * replicas
+		usage.limitMem += limitMem * replicas
+		missingCPU = missingCPU || !hasLimitCPU || limitCPU == 0
+		missingMem = missingMem || !hasLimitMem || limitMem == 0
+	}
+	for _, volume := range volumes {
+		if firstScalarPath(volume, "fromVolumeId", "storageAppServiceId") != "" {
+			continue
+		}
+		size, _ := capacityInt(volume, "size")
+		usage.storage += size
+	}
+
+	missing := make([]string, 0, 2)
+	if missingCPU {
+		missing = append(missing, "cpu")
+	}
+	if missingMem {
+		missing = append(missing, "memory")
+	}
+	return usage, missing
+}
+
+// fetchCapacityClusters totals the instances per cluster. A cluster selected
+// with --cluster is listed even when nothing runs on it yet.
+func fetchCapacityClusters(ctx context.Context, fetcher *inventoryFetcher, details []*capacityInstance, selected string) ([]*capacityCluster, error) {
+	byID := map[string]*capacityCluster{}
+	clusters := make([]*capacityCluster, 0)
+	lookup := func(id string) *capacityCluster {
+		if byID[id] == nil {
+			byID[id] = &capacityCluster{id: id}
+			clusters = append(clusters, byID[id])
+		}
+		return byID[id]
+	}
+	if selected != "" {
+		lookup(selected)
+	}
+	for _, detail := range details {
+		cluster := lookup(detail.clusterID)
+		cluster.instances++
+		cluster.services += detail.services
+		cluster.usage.add(detail.usage)
+	}
+
+	for _, cluster := range clusters {
+		if cluster.id == "" {
+			continue
+		}
+		result, err := fetcher.get(ctx, "/clusters/"+url.PathEscape(cluster.id), nil)
+		if err != nil {
+			return nil, err
+		}
+		row := cloneFirstRow(normalizeItem(result))
+		cluster.title = firstScalarPath(row, "title", "name")
+		cluster.cpu, cluster.memory = clusterAllocatable(row)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool { return clusters[i].title < clusters[j].title })
+	return clusters, nil
+}
+
+// clusterAllocatable returns the CPU in millicores and the memory in Mi that
+// the cluster or the sum of its nodes can schedule, or zero when the API does
+// not say.
+func clusterAllocatable(cluster map[string]interface{}) (int64, int64) {
+	cpuPaths := []string{"allocatableCPU", "allocatable.cpu", "capacityCPU", "capacity.cpu"}
+	memPaths := []string{"allocatableMem", "allocatable.memory", "capacityMem", "capacity.memory"}
+	cpu, _ := capacityInt(cluster, cpuPaths...)
+	memory, _ := capacityInt(cluster, memPaths...)
+	if cpu != 0 || memory != 0 {
+		return cpu, memory
+	}
+	for _, node := range asRows(firstNonNilPath(cluster, "nodes")) {
+		nodeCPU, _ := capacityInt(node, cpuPaths...)
+		nodeMemory, _ := capacityInt(node, memPaths...)
+		cpu += nodeCPU
+		memory += nodeMemory
+	}
+	return cpu, memory
+}
+
+func capacityInt(row map[string]interface{}, paths ...string) (int64, bool) {
+	value := firstScalarPath(row, paths...)
+	if value == "" {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(math.Round(number)), true
+}
+
+func printCapacity(cmd *cobra.Command, out outputOptions, clusters []*capacityCluster, details []*capacityInstance, top int) error {
+	clusterRows := make([]map[string]interface{}, 0, len(clusters))
+	for _, cluster := range clusters {
+		row := capacityUsageRow(cluster.usage)
+		row["cluster"] = cluster.title
+		row["clusterId"] = cluster.id
+		row["instances"] = cluster.instances
+		row["services"] = cluster.services
+		if cluster.cpu != 0 {
+			row["cpuCapacity"] = formatCPUMillicores(cluster.cpu)
+			row["cpuFree"] = formatCPUMillicores(cluster.cpu-cluster.usage.requestCPU) + " (" + formatCapacityShare(cluster.cpu-cluster.usage.requestCPU, cluster.cpu) + ")"
+		}
+		if cluster.memory != 0 {
+			row["memoryCapacity"] = formatMemoryMi(cluster.memory)
+			row["memoryFree"] = formatMemoryMi(cluster.memory-cluster.usage.requestMem) + " (" + formatCapacityShare(cluster.memory-cluster.usage.requestMem, cluster.memory) + ")"
+		}
+		clusterRows = append(clusterRows, row)
+	}
+
+	clusterTitles := map[string]string{}
+	for _, cluster := range clusters {
+		clusterTitles[cluster.id] = cluster.title
+	}
+	biggest := biggestCapacityInstances(details)
+	if top >= 0 && len(biggest) > top {
+		biggest = biggest[:top]
+	}
+	instanceRows := make([]map[string]interface{}, 0, len(biggest))
+	for _, detail := range biggest {
+		row := capacityUsageRow(detail.usage)
+		row["instance"] = detail.title
+		row["instanceId"] = detail.id
+		row["cluster"] = clusterTitles[detail.clusterID]
+		row["services"] = detail.services
+		instanceRows = append(instanceRows, row)
+	}
+	unlimitedRows := make([]map[string]interface{}, 0)
+	for _, detail := range details {
+		unlimitedRows = append(unlimitedRows, detail.unlimited...)
+	}
+	sort.SliceStable(unlimitedRows, func(i, j int) bool {
+		left, right := formatValue(unlimitedRows[i]["instance"])+"\n"+formatValue(unlimitedRows[i]["service"]), formatValue(unlimitedRows[j]["instance"])+"\n"+formatValue(unlimitedRows[j]["service"])
+		return left < right
+	})
+
+	if outputFormat(cmd, out) == outputJSON {
+		return printJSON(cmd, map[string]interface{}{
+			"clusters":              clusterRows,
+			"biggestInstances":      instanceRows,
+			"servicesWithoutLimits": unlimitedRows,
+		})
+	}
+	sections := []struct {
+		title   string
+		rows    []map[string]interface{}
+		columns []string
+	}{
+		{"Clusters", clusterRows, capacityClusterColumns},
+		{"Biggest app instances", instanceRows, capacityInstanceColumns},
+		{"Services without limits", unlimitedRows, capacityUnlimitedColumns},
+	}
+	for i, section := range sections {
+		if i != 0 {
+			fmt.Fprintln(cmd.OutOrStdout())
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), section.title+":")
+		if len(section.rows) == 0 {
+			fmt.Fprintln(cmd.OutOrStdout(), "  none")
+			continue
+		}
+		if err := printResult(cmd, out, section.rows, section.columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// biggestCapacityInstances orders instances by their share of the requested
+// CPU plus their share of the requested memory, so that neither unit wins
+// only because its numbers are larger.
+func biggestCapacityInstances(details []*capacityInstance) []*capacityInstance {
+	total := capacityUsage{}
+	for _, detail := range details {
+		total.add(detail.usage)
+	}
+	share := func(usage capacityUsage) float64 {
+		value := 0.0
+		if total.requestCPU != 0 {
+			value += float64(usage.requestCPU) / float64(total.requestCPU)
+		}
+		if total.requestMem != 0 {
+			value += float64(usage.requestMem) / float64(total.requestMem)
+		}
+		return value
+	}
+	sorted := append([]*capacityInstance{}, details...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		left, right := share(sorted[i].usage), share(sorted[j].usage)
+		if left != right {
+			return left > right
+		}
+		return sorted[i].title < sorted[j].title
+	})
+	return sorted
+}
+
+func capacityUsageRow(usage capacityUsage) map[string]interface{} {
+	return map[string]interface{}{
+		"cpu":     formatCPUMillicores(usage.requestCPU) + "/" + formatCPUMillicores(usage.limitCPU),
+		"memory":  formatMemoryMi(usage.requestMem) + "/" + formatMemoryMi(usage.limitMem),
+		"storage": strconv.FormatInt(usage.storage, 10) + "Gi",
+	}
+}
+
+// formatCPUMillicores prints CPU as cores, for example 1500 as "1.5".
+func formatCPUMillicores(value int64) string {
+	return strconv.FormatFloat(float64(value)/1000, 'f', -1, 64)
+}
+
+// formatMemoryMi prints memory below 1Gi in Mi and above it in Gi with at
+// most one decimal, for example 1536 as "1.5Gi".
+func formatMemoryMi(value int64) string {
+	if value > -1024 && value < 1024 {
+		return strconv.FormatInt(value, 10) + "Mi"
+	}
+	return strconv.FormatFloat(math.Round(float64(value)/1024*10)/10, 'f', -1, 64) + "Gi"
+}
+
+func formatCapacityShare(value int64, total int64) string {
+	return strconv.FormatInt(int64(math.Round(float64(value)*100/float64(total))), 10) + "%"
+}
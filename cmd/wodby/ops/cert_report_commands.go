@@ -0,0 +1,305 @@
+package ops
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Nagios plugin exit statuses.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+const (
+	certReportExpired  = "expired"
+	certReportCritical = "critical"
+	certReportWarning  = "warning"
+	certReportUnknown  = "unknown"
+	certReportOK       = "ok"
+)
+
+var certReportOrder = []string{certReportExpired, certReportCritical, certReportWarning, certReportUnknown, certReportOK}
+
+var certReportColumns = []string{"report", "host", "instance", "expiresAt", "days", "status", "reason"}
+
+// exitCodeError ends a command with a specific exit status after its output
+// has been printed; main exits with ExitCode instead of 1.
+type exitCodeError struct {
+	code    int
+	message string
+}
+
+func (e *exitCodeError) Error() string {
+	return e.message
+}
+
+func (e *exitCodeError) ExitCode() int {
+	return e.code
+}
+
+type certReportItem struct {
+	row       map[string]interface{}
+	report    string
+	expiresAt time.Time
+	reason    string
+}
+
+func newCertReportCommand(out outputOptions) *cobra.Command {
+	var orgID, warn, critical, prometheus string
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Report certificates that expire soon or fail to renew",
+		Long: "Report certificates of all app instances grouped by expiry status, for monitoring.\n\n" +
+			"The command exits like a Nagios plugin: 0 when all certificates are fine, 1 when one expires within --warn or failed to renew, and 2 when one expires within --critical or has expired, and 3 when the expiry of one is unknown and nothing is worse. " +
+			"--prometheus writes metrics in the Prometheus text format for the node exporter textfile collector.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			warnAfter, err := parseDayDuration(warn)
+			if err != nil {
+				return errors.Wrap(err, "invalid --warn")
+			}
+			criticalAfter, err := parseDayDuration(critical)
+			if err != nil {
+				return errors.Wrap(err, "invalid --critical")
+			}
+			if criticalAfter > warnAfter {
+				return errors.New("--critical must not be longer than --warn")
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			query := url.Values{}
+			addQuery(query, "orgId", orgID)
+			rows, err := fetchRows(cmd.Context(), client, "/certs", query)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			items := make([]certReportItem, 0, len(rows))
+			for _, row := range rows {
+				items = append(items, classifyCert(row, now, warnAfter, criticalAfter))
+			}
+			sortCertReport(items)
+			code, summary := certReportSummary(items)
+
+			if prometheus != "" {
+				if err := writeCertPrometheus(cmd, prometheus, items, code, now); err != nil {
+					return err
+				}
+			}
+			if prometheus != "-" {
+				if err := printCertReport(cmd, out, items, code, summary, now); err != nil {
+					return err
+				}
+			}
+			if code == nagiosOK {
+				return nil
+			}
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			return &exitCodeError{code: code, message: summary}
+		},
+	}
+	cmd.Flags().StringVar(&orgID, "org", "", "Organization ID")
+	cmd.Flags().StringVar(&warn, "warn", "21d", "Warn about certificates that expire within this time")
+	cmd.Flags().StringVar(&critical, "critical", "7d", "Report certificates that expire within this time as critical")
+	cmd.Flags().StringVar(&prometheus, "prometheus", "", "Write Prometheus metrics to this file, or - for stdout")
+	return cmd
+}
+
+// parseDayDuration accepts Go durations and whole days such as "21d".
+func parseDayDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, errors.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, errors.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+func classifyCert(row map[string]interface{}, now time.Time, warnAfter time.Duration, criticalAfter time.Duration) certReportItem {
+	item := certReportItem{row: row, report: certReportOK}
+	expiresAt, ok := parseDisplayTime(certTimeColumnValue(row, "expiresAt"))
+	status := strings.ToLower(firstScalarPath(row, "status"))
+	renewalFailed := failedStatuses[status] || strings.Contains(status, "fail") || strings.Contains(status, "error")
+	if ok {
+		item.expiresAt = expiresAt
+	}
+	left := expiresAt.Sub(now)
+	switch {
+	case !ok && renewalFailed:
+		item.report, item.reason = certReportWarning, "status "+status
+	case !ok:
+		item.report, item.reason = certReportUnknown, "no expiry date"
+	case left <= 0:
+		item.report, item.reason = certReportExpired, "expired"
+	case left <= criticalAfter:
+		item.report, item.reason = certReportCritical, "expires within "+formatDisplayDuration(criticalAfter)
+	case left <= warnAfter:
+		item.report, item.reason = certReportWarning, "expires within "+formatDisplayDuration(warnAfter)
+	case renewalFailed:
+		item.report, item.reason = certReportWarning, "status "+status
+	}
+	if renewalFailed && item.reason != "status "+status {
+		item.reason += ", status " + status
+	}
+	return item
+}
+
+func sortCertReport(items []certReportItem) {
+	rank := map[string]int{}
+	for i, report := range certReportOrder {
+		rank[report] = i
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if rank[items[i].report] != rank[items[j].report] {
+			return rank[items[i].report] < rank[items[j].report]
+		}
+		return items[i].expiresAt.Before(items[j].expiresAt)
+	})
+}
+
+// certReportSummary returns the Nagios exit status and status line.
+func certReportSummary(items []certReportItem) (int, string) {
+	counts := map[string]int{}
+	for _, item := range items {
+		counts[item.report]++
+	}
+	code, label := nagiosOK, "OK"
+	switch {
+	case counts[certReportExpired]+counts[certReportCritical] > 0:
+		code, label = nagiosCritical, "CRITICAL"
+	case counts[certReportWarning] > 0:
+		code, label = nagiosWarning, "WARNING"
+	case counts[certReportUnknown] > 0:
+		code, label = nagiosUnknown, "UNKNOWN"
+	}
+	parts := make([]string, 0, len(certReportOrder))
+	for _, report := range certReportOrder {
+		if counts[report] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[report], report))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "no certificates")
+	}
+	return code, fmt.Sprintf("CERT %s - %s", label, strings.Join(parts, ", "))
+}
+
+func certReportRow(item certReportItem, now time.Time) map[string]interface{} {
+	row := map[string]interface{}{
+		"id":       firstScalarPath(item.row, "id"),
+		"report":   item.report,
+		"host":     firstScalarPath(item.row, "host", "hostname", "domain", "commonName"),
+		"instance": formatRelationColumn(item.row, relationColumns["instance"]),
+		"status":   firstScalarPath(item.row, "status"),
+		"reason":   item.reason,
+	}
+	if !item.expiresAt.IsZero() {
+		row["expiresAt"] = item.expiresAt.UTC().Format(time.RFC3339)
+		row["days"] = int(item.expiresAt.Sub(now).Hours() / 24)
+	}
+	return row
+}
+
+func printCertReport(cmd *cobra.Command, out outputOptions, items []certReportItem, code int, summary string, now time.Time) error {
+	rows := make([]map[string]interface{}, 0, len(items))
+	groups := map[string][]map[string]interface{}{}
+	for _, item := range items {
+		row := certReportRow(item, now)
+		rows = append(rows, row)
+		groups[item.report] = append(groups[item.report], row)
+	}
+	if outputFormat(cmd, out) == outputJSON {
+		return printJSON(cmd, map[string]interface{}{"status": code, "summary": summary, "groups": groups})
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), summary)
+	if len(rows) == 0 {
+		return nil
+	}
+	fmt.Fprintln(cmd.OutOrStdout())
+	return printResult(cmd, out, rows, certReportColumns)
+}
+
+func writeCertPrometheus(cmd *cobra.Command, path string, items []certReportItem, code int, now time.Time) error {
+	statusValue := map[string]int{certReportOK: nagiosOK, certReportUnknown: nagiosUnknown, certReportWarning: nagiosWarning, certReportCritical: nagiosCritical, certReportExpired: nagiosCritical}
+	var b strings.Builder
+	b.WriteString("# HELP wodby_cert_expiry_timestamp_seconds Certificate expiry time as a Unix timestamp.\n")
+	b.WriteString("# TYPE wodby_cert_expiry_timestamp_seconds gauge\n")
+	for _, item := range items {
+		if !item.expiresAt.IsZero() {
+			fmt.Fprintf(&b, "wodby_cert_expiry_timestamp_seconds%s %d\n", certPrometheusLabels(item), item.expiresAt.Unix())
+		}
+	}
+	b.WriteString("# HELP wodby_cert_status Certificate report status: 0 ok, 1 warning, 2 critical, 3 unknown.\n")
+	b.WriteString("# TYPE wodby_cert_status gauge\n")
+	for _, item := range items {
+		fmt.Fprintf(&b, "wodby_cert_status%s %d\n", certPrometheusLabels(item), statusValue[item.report])
+	}
+	b.WriteString("# HELP wodby_cert_report_status Overall certificate report status: 0 ok, 1 warning, 2 critical, 3 unknown.\n")
+	b.WriteString("# TYPE wodby_cert_report_status gauge\n")
+	fmt.Fprintf(&b, "wodby_cert_report_status %d\n", code)
+	b.WriteString("# HELP wodby_cert_report_timestamp_seconds Time the certificate report ran as a Unix timestamp.\n")
+	b.WriteString("# TYPE wodby_cert_report_timestamp_seconds gauge\n")
+	fmt.Fprintf(&b, "wodby_cert_report_timestamp_seconds %d\n", now.Unix())
+
+	if path == "-" {
+		fmt.Fprint(cmd.OutOrStdout(), b.String())
+		return nil
+	}
+	// The textfile collector may read at any time, so replace the file
+	// atomically instead of writing it in place.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), path))
+}
+
+func certPrometheusLabels(item certReportItem) string {
+	labels := []struct{ name, value string }{
+		{"id", firstScalarPath(item.row, "id")},
+		{"host", firstScalarPath(item.row, "host", "hostname", "domain", "commonName")},
+		{"instance_id", firstRelationID(item.row, relationColumns["instance"])},
+	}
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label.value)
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, label.name, value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
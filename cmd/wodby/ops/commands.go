@@ -120,6 +120,10 @@ func Commands() []*cobra.Command {
 		newBackupCommand(),
 		newImportCommand(),
 		newTaskCommand(),
+		newInventoryCommand(),
+		newReportCommand(),
+		newCapacityCommand(),
+		newManifestCommand(),
 	}
 }
 
@@ -2017,6 +2021,8 @@ func newStackCommand() *cobra.Command {
 		newCatalogImportFromGitCommand("import", "Import stacks from Git", "/stacks/actions/import", operationColumns, out),
 		newManifestValidateCommand("stack", out),
 		newManifestCreateCommand("stack", out, stackColumns),
+		newManifestExportCommand("stack", out),
+		newManifestApplyCommand("stack", out, stackColumns),
 		newStackSettingsCommand(out),
 		newStackRevisionCommand(out),
 		newStackPublishDraftCommand(out),
@@ -2239,12 +2245,14 @@ func newStackRevisionCommand(out outputOptions) *cobra.Command {
 	cmd.AddCommand(
 		newGetCommand("get ID", "Get stack revision", "/stack-revisions/", stackRevisionColumns, out),
 		servicesCmd,
+		newStackRevisionDiffCommand(out),
 	)
 	return cmd
 }
 
 func newStackPublishDraftCommand(out outputOptions) *cobra.Command {
 	wait := waitOptions{}
+	var preview bool
 	cmd := &cobra.Command{
 		Use:   "publish-draft ID",
 		Short: "Publish stack draft",
@@ -2254,6 +2262,9 @@ func newStackPublishDraftCommand(out outputOptions) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if preview {
+				return previewStackDraft(cmd, client, out, args[0])
+			}
 			var result interface{}
 			if err := client.Post(cmd.Context(), "/stacks/"+url.PathEscape(args[0])+"/actions/publish-draft", nil, nil, &result); err != nil {
 				return err
@@ -2268,6 +2279,7 @@ func newStackPublishDraftCommand(out outputOptions) *cobra.Command {
 			return printClientResult(cmd, client, out, result, stackColumns)
 		},
 	}
+	cmd.Flags().BoolVar(&preview, "preview", false, "Show what the draft changes compared with the current revision without publishing it")
 	addWaitFlags(cmd, &wait)
 	return cmd
 }
@@ -3601,7 +3613,7 @@ func newStackServiceCronScheduleCommand(out outputOptions) *cobra.Command {
 	}
 	cmd.AddCommand(
 		newServiceChildListCommand("list SERVICE_ID", "List stack service cron schedules", "/stack-services/%s/cron-schedules", stackServiceCronScheduleColumns, out),
-		newServiceChildCreateCommand("create SERVICE_ID", "Create stack service cron schedule", "/stack-services/%s/cron-schedules", stackServiceCronScheduleColumns, out, []jsonFlagSpec{
+		withCrontabValidation(newServiceChildCreateCommand("create SERVICE_ID", "Create stack service cron schedule", "/stack-services/%s/cron-schedules", stackServiceCronScheduleColumns, out, []jsonFlagSpec{
 			stringJSONFlag("name", "name", "Cron schedule machine name", true),
 			stringJSONFlag("title", "title", "Cron schedule title", true),
 			stringJSONFlag("crontab", "crontab", "Crontab expression", true),
@@ -3609,15 +3621,15 @@ func newStackServiceCronScheduleCommand(out outputOptions) *cobra.Command {
 			stringJSONFlag("workload", "workload", "Workload name", false),
 			boolJSONFlag("disabled", "disabled", "Create the schedule disabled", false),
 			stringJSONFlag("env-type", "envType", "Environment type", false),
-		}),
-		newServiceChildUpdateCommand("update ID", "Update stack service cron schedule", "/stack-service-cron-schedules/%s", stackServiceCronScheduleColumns, out, []jsonFlagSpec{
+		})),
+		withCrontabValidation(newServiceChildUpdateCommand("update ID", "Update stack service cron schedule", "/stack-service-cron-schedules/%s", stackServiceCronScheduleColumns, out, []jsonFlagSpec{
 			boolJSONFlag("disabled", "disabled", "Set disabled state", false),
 			stringJSONFlag("title", "title", "Cron schedule title", false),
 			stringJSONFlag("crontab", "crontab", "Crontab expression", false),
 			stringJSONFlag("command", "command", "Command to run", false),
 			stringJSONFlag("workload", "workload", "Workload name", false),
 			stringJSONFlag("env-type", "envType", "Environment type", false),
-		}),
+		})),
 		newServiceChildDeleteCommand("Delete stack service cron schedule", "/stack-service-cron-schedules/%s", out),
 	)
 	return cmd
@@ -3642,6 +3654,8 @@ func newServiceCommand() *cobra.Command {
 		newCatalogImportFromGitCommand("import", "Import services from Git", "/services/actions/import", operationColumns, out),
 		newManifestValidateCommand("service", out),
 		newManifestCreateCommand("service", out, catalogServiceColumns),
+		newManifestExportCommand("service", out),
+		newManifestApplyCommand("service", out, catalogServiceColumns),
 		newServiceSettingsCommand(out),
 		newGetCommand("revision ID", "Get service revision", "/service-revisions/", serviceRevisionColumns, out),
 		newServiceOptionsCommand(out),
@@ -4014,6 +4028,11 @@ func newAppInstanceCommand(use string, short string) *cobra.Command {
 		newAppInstanceSettingsCommand(out),
 		newAppInstanceCICDSettingsCommand(out),
 		newAppInstanceUpgradeStackCommand(out),
+		newAppInstanceExportCommand(out),
+		newAppInstanceImportConfigCommand(out),
+		newAppInstanceDiffCommand(out),
+		newAppInstanceCloneCommand(out),
+		newAppInstanceDNSCheckCommand(out),
 		newGetCommand("upgrade-stack-changelog ID", "Preview app instance stack upgrade", "/app-instance-stack-upgrade-changelogs/", appInstanceStackChangelogColumns, out),
 		newAppAccessCommand(out),
 	)
@@ -4391,11 +4410,32 @@ func newAppInstanceCICDSettingsUpdateCommand(out outputOptions) *cobra.Command {
 func newAppInstanceUpgradeStackCommand(out outputOptions) *cobra.Command {
 	body := bodyOptions{}
 	wait := waitOptions{}
+	bulk := bulkUpgradeOptions{}
 	cmd := &cobra.Command{
-		Use:   "upgrade-stack ID",
+		Use:   "upgrade-stack [ID]",
 		Short: "Upgrade app instance stack",
-		Args:  cobra.ExactArgs(1),
+		Long: "Upgrade the stack of one app instance, or of every app instance selected with --all, --app, --env or --name-glob.\n\n" +
+			"A bulk upgrade previews the selected instances and each service change with its changelog entries, asks for one confirmation and then upgrades up to --concurrency instances at a time, " +
+			"printing progress to stderr and a result table at the end. Instances that are already up to date are skipped. " +
+			"With -o json the preview is not printed, so a bulk upgrade also needs --yes.",
+		Example: `  wodby instance upgrade-stack 21 --wait
+  wodby instance upgrade-stack --name-glob 'dev-*' --concurrency 8 --wait
+  wodby instance upgrade-stack --app shop --env qa --stop-on-failure -y`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 1 && bulk.selected() {
+				return errors.New("use either an app instance ID or --all, --app, --env or --name-glob")
+			}
+			if len(args) == 0 && !bulk.selected() {
+				return errors.New("an app instance ID or one of --all, --app, --env or --name-glob is required")
+			}
+			if len(args) == 1 {
+				for _, name := range []string{"yes", "concurrency", "stop-on-failure"} {
+					if cmd.Flags().Changed(name) {
+						return errors.Errorf("--%s only applies to bulk upgrades with --all, --app, --env or --name-glob", name)
+					}
+				}
+			}
 			requestBody, hasBody, err := readBody(body)
 			if err != nil {
 				return err
@@ -4403,6 +4443,9 @@ func newAppInstanceUpgradeStackCommand(out outputOptions) *cobra.Command {
 			if !hasBody {
 				requestBody = stackUpgradeSettings(cmd, "", true)
 			}
+			if len(args) == 0 {
+				return runBulkStackUpgrade(cmd, out, bulk, wait, requestBody)
+			}
 			client, err := newRESTClient()
 			if err != nil {
 				return err
@@ -4425,6 +4468,7 @@ func newAppInstanceUpgradeStackCommand(out outputOptions) *cobra.Command {
 	addBodyFlags(cmd, &body)
 	addWaitFlags(cmd, &wait)
 	addStackUpgradeFlags(cmd, "", true)
+	addBulkUpgradeFlags(cmd, &bulk)
 	return cmd
 }
 
@@ -4841,7 +4885,7 @@ func newInstanceBuildCommand() *cobra.Command {
 	addOutputFlag(cmd, &out)
 	listCmd := newInstancePaginatedListCommand("list INSTANCE_ID", "List builds", "/app-builds", buildListColumns, out)
 	defaultToList(cmd, listCmd)
-	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get build", "/app-builds/", buildColumns, out), newBuildDeployCommand(out))
+	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get build", "/app-builds/", buildColumns, out), newBuildDeployCommand(out), newBuildPromoteCommand(out))
 	return cmd
 }
 
@@ -4875,7 +4919,7 @@ func newInstanceDeploymentCommand() *cobra.Command {
 
 	listCmd := newInstancePaginatedListCommand("list INSTANCE_ID", "List deployments", "/app-deployments", deploymentListColumns, out)
 	defaultToList(cmd, listCmd)
-	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get deployment", "/app-deployments/", deploymentColumns, out), waitCmd, newDeploymentCreateCommand(out), newDeploymentRedeployCommand(out))
+	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get deployment", "/app-deployments/", deploymentColumns, out), waitCmd, newDeploymentCreateCommand(out), newDeploymentRedeployCommand(out), newDeploymentRollbackCommand(out))
 	return cmd
 }
 
@@ -4889,7 +4933,7 @@ func newInstanceBackupCommand() *cobra.Command {
 	addOutputFlag(cmd, &out)
 	listCmd := newInstanceFilteredListCommand("list INSTANCE_ID", "List backups", "/backups", backupColumns, out, true)
 	defaultToList(cmd, listCmd)
-	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get backup", "/backups/", backupColumns, out), newBackupCreateCommand(out))
+	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get backup", "/backups/", backupColumns, out), newBackupCreateCommand(out), newBackupDownloadCommand(out))
 	return cmd
 }
 
@@ -5196,6 +5240,8 @@ func newAppServiceEnvVarCommand(out outputOptions) *cobra.Command {
 			boolJSONFlag("build", "build", "Expose during builds", false),
 		}),
 		newServiceChildDeleteCommand("Delete app service environment variable", "/app-service-env-vars/%s", out),
+		newAppServiceEnvVarImportCommand(out),
+		newAppServiceEnvVarExportCommand(),
 	)
 	return cmd
 }
@@ -5380,23 +5426,24 @@ func newAppServiceCronScheduleCommand(out outputOptions) *cobra.Command {
 		Short:   "Manage app service cron schedules",
 	}
 	cmd.AddCommand(
-		newServiceChildListCommand("list SERVICE_ID", "List app service cron schedules", "/app-services/%s/cron-schedules", appServiceCronScheduleColumns, out),
-		newServiceChildCreateCommand("create SERVICE_ID", "Create app service cron schedule", "/app-services/%s/cron-schedules", appServiceCronScheduleColumns, out, []jsonFlagSpec{
+		newAppServiceCronScheduleListCommand(out),
+		withCrontabValidation(newServiceChildCreateCommand("create SERVICE_ID", "Create app service cron schedule", "/app-services/%s/cron-schedules", appServiceCronScheduleColumns, out, []jsonFlagSpec{
 			stringJSONFlag("name", "name", "Stable cron schedule name", false),
 			stringJSONFlag("title", "title", "Cron schedule title", true),
 			stringJSONFlag("crontab", "crontab", "Crontab expression", true),
 			stringJSONFlag("command", "command", "Command to run", true),
 			stringJSONFlag("workload", "workload", "Workload name", false),
-		}),
-		newServiceChildUpdateCommand("update ID", "Update app service cron schedule", "/app-service-cron-schedules/%s", appServiceCronScheduleColumns, out, []jsonFlagSpec{
+		})),
+		withCrontabValidation(newServiceChildUpdateCommand("update ID", "Update app service cron schedule", "/app-service-cron-schedules/%s", appServiceCronScheduleColumns, out, []jsonFlagSpec{
 			boolJSONFlag("disabled", "disabled", "Set disabled state", false),
 			stringJSONFlag("title", "title", "Cron schedule title", false),
 			stringJSONFlag("crontab", "crontab", "Crontab expression", false),
 			stringJSONFlag("command", "command", "Command to run", false),
 			stringJSONFlag("workload", "workload", "Workload name", false),
-		}),
+		})),
 		newServiceChildDeleteCommand("Delete app service cron schedule", "/app-service-cron-schedules/%s", out),
 		newAppServiceCronScheduleRunCommand(out),
+		newAppServiceCronScheduleNextCommand(out),
 	)
 	return cmd
 }
@@ -5557,7 +5604,7 @@ func newAppRouteCommand(use string, aliases []string, short string, mode instanc
 		},
 	}
 
-	cmd.AddCommand(listCmd, getCmd, newAppRouteCreateCommand(out), newAppRouteUpdateCommand(out), newDeleteCommand("delete ID", "Delete app route", "/app-routes/", routeColumns, out))
+	cmd.AddCommand(listCmd, getCmd, newAppRouteCreateCommand(out), newAppRouteUpdateCommand(out), newDeleteCommand("delete ID", "Delete app route", "/app-routes/", routeColumns, out), newAppRouteCheckCommand(out, mode))
 	return cmd
 }
 
@@ -5657,6 +5704,9 @@ func newAppCertCommand(use string, aliases []string, short string, mode instance
 		listCmd,
 		newGetCommand("get ID", "Get app certificate", "/certs/", certColumns, out),
 	)
+	if mode == instanceFilterFlag {
+		cmd.AddCommand(newCertReportCommand(out))
+	}
 	return cmd
 }
 
@@ -5909,7 +5959,7 @@ func newBuildCommand() *cobra.Command {
 		},
 	}
 
-	cmd.AddCommand(listCmd, getCmd, newBuildCreateCommand(out), newBuildDeployCommand(out))
+	cmd.AddCommand(listCmd, getCmd, newBuildCreateCommand(out), newBuildDeployCommand(out), newBuildPromoteCommand(out))
 	return cmd
 }
 
@@ -6064,7 +6114,7 @@ func newDeploymentCommand() *cobra.Command {
 	}
 	waitCmd.Flags().Duration("timeout", 10*time.Minute, "Maximum time to wait")
 
-	cmd.AddCommand(listCmd, getCmd, waitCmd, newDeploymentCreateCommand(out), newDeploymentRedeployCommand(out))
+	cmd.AddCommand(listCmd, getCmd, waitCmd, newDeploymentCreateCommand(out), newDeploymentRedeployCommand(out), newDeploymentRollbackCommand(out))
 	return cmd
 }
 
@@ -6177,7 +6227,7 @@ func newBackupCommand() *cobra.Command {
 	addOutputFlag(cmd, &out)
 	listCmd := newFilteredListCommand("list", "List backups", "/backups", backupColumns, out, true)
 	defaultToList(cmd, listCmd)
-	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get backup", "/backups/", backupColumns, out), newBackupCreateCommand(out))
+	cmd.AddCommand(listCmd, newGetCommand("get ID", "Get backup", "/backups/", backupColumns, out), newBackupCreateCommand(out), newBackupDownloadCommand(out), newBackupPruneCommand(out), newBackupPolicyCommand(out), newBackupVerifyCommand(out))
 	return cmd
 }
 
@@ -6256,40 +6306,68 @@ func newImportCommand() *cobra.Command {
 func newImportCreateCommand(out outputOptions) *cobra.Command {
 	body := bodyOptions{}
 	wait := waitOptions{}
-	var serviceID, databaseDBID, source, importURL, importName, backupID string
+	var instanceID, serviceID, databaseDBID, source, importURL, importName, backupID, upload, kind string
+	var retries int
 	cmd := &cobra.Command{
 		Use:   "create",
 		Short: "Create import",
+		Long: "Create import.\n\n" +
+			"Use --upload to import a local database dump or files archive: the file is uploaded through signed URLs with a checksum, and an interrupted upload resumes when the command is run again. " +
+			"--service accepts a name when --instance is set.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			requestBody, hasBody, err := readBody(body)
 			if err != nil {
 				return err
 			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
 			if !hasBody {
+				if upload != "" && source == "" {
+					source = importSourceUpload
+				}
 				if err := requireFlag(source, "--source"); err != nil {
 					return err
 				}
+				resolvedServiceID, err := resolveImportServiceID(cmd.Context(), client, serviceID, instanceID)
+				if err != nil {
+					return err
+				}
+				var uploadID string
+				if upload != "" {
+					if kind == "" {
+						kind = importUploadKind(upload)
+					}
+					if !backupComponents[kind] {
+						return errors.Errorf("unsupported --kind %q; use db or files", kind)
+					}
+					if uploadID, err = uploadImportFile(cmd.Context(), cmd, client, upload, kind, resolvedServiceID, retries); err != nil {
+						return err
+					}
+				}
 				requestBody = bodyFromMap(map[string]interface{}{
-					"appServiceId": optionalInt(serviceID),
+					"appServiceId": optionalInt(resolvedServiceID),
 					"databaseDbId": optionalInt(databaseDBID),
 					"import": bodyFromMap(map[string]interface{}{
 						"source":     source,
 						"url":        importURL,
 						"importName": importName,
 						"backupId":   optionalInt(backupID),
+						"uploadId":   uploadID,
 					}),
 				})
 			}
-			client, err := newRESTClient()
-			if err != nil {
-				return err
-			}
 			var result interface{}
 			if err := client.Post(cmd.Context(), "/imports", nil, requestBody, &result); err != nil {
 				return err
 			}
 			columns := operationColumns
 			if wait.wait && firstTaskID(result) != "" {
+				if outputFormat(cmd, out) != outputJSON {
+					fmt.Fprintf(cmd.OutOrStdout(), "Import started. Streaming task logs for task %s.\n\n", firstTaskID(result))
+					return streamTaskLogs(cmd.Context(), cmd, client, firstTaskID(result), wait.timeout)
+				}
 				result, err = waitForTask(cmd.Context(), client, firstTaskID(result), wait.timeout)
 				if err != nil {
 					return err
@@ -6301,12 +6379,16 @@ func newImportCreateCommand(out outputOptions) *cobra.Command {
 	}
 	addBodyFlags(cmd, &body)
 	addWaitFlags(cmd, &wait)
-	cmd.Flags().StringVar(&serviceID, "service", "", "App service ID")
+	cmd.Flags().StringVar(&instanceID, "instance", "", "App instance ID for resolving --service by name")
+	cmd.Flags().StringVar(&serviceID, "service", "", "App service ID or name")
 	cmd.Flags().StringVar(&databaseDBID, "database-db", "", "DB ID")
-	cmd.Flags().StringVar(&source, "source", "", "Import source")
+	cmd.Flags().StringVar(&source, "source", "", "Import source; defaults to upload with --upload")
 	cmd.Flags().StringVar(&importURL, "url", "", "Import archive URL")
 	cmd.Flags().StringVar(&importName, "name", "", "Import name")
 	cmd.Flags().StringVar(&backupID, "backup", "", "Backup ID")
+	cmd.Flags().StringVar(&upload, "upload", "", "Local database dump or files archive to upload")
+	cmd.Flags().StringVar(&kind, "kind", "", "Uploaded data kind: db or files; inferred from the file name")
+	cmd.Flags().IntVar(&retries, "retries", 3, "Number of times to retry a failed upload part")
 	return cmd
 }
 
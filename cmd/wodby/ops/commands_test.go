@@ -2,16 +2,23 @@ package ops
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -50,6 +57,10 @@ func TestCommandsExposeTopLevelOperationalSurface(t *testing.T) {
 		"backup",
 		"import",
 		"task",
+		"inventory",
+		"report",
+		"capacity",
+		"manifest",
 	} {
 		if !names[name] {
 			t.Fatalf("missing command %q", name)
@@ -2744,9 +2755,9 @@ func TestSchemaAddedCommandSurfaceIsExposed(t *testing.T) {
 		}
 	}
 	assertChildren(t, newProviderCommand(), "get-by-name", "revision")
-	assertChildren(t, newHelmCommand(), "inspect", "scaffold-service", "scaffold-stack")
-	assertChildren(t, newStackCommand(), "get-by-name", "import", "validate-manifest", "create-from-manifest", "settings", "revision", "publish-draft", "update-from-git", "update-service-revisions", "service-update-changelog", "origin-sync-changelog", "duplicate", "sync-origin")
-	assertChildren(t, newServiceCommand(), "get-by-name", "import", "validate-manifest", "create-from-manifest", "settings", "revision", "options")
+	assertChildren(t, newHelmCommand(), "inspect", "scaffold-service", "scaffold-stack", "diff")
+	assertChildren(t, newStackCommand(), "get-by-name", "import", "validate-manifest", "create-from-manifest", "export-manifest", "apply-manifest", "settings", "revision", "publish-draft", "update-from-git", "update-service-revisions", "service-update-changelog", "origin-sync-changelog", "duplicate", "sync-origin")
+	assertChildren(t, newServiceCommand(), "get-by-name", "import", "validate-manifest", "create-from-manifest", "export-manifest", "apply-manifest", "settings", "revision", "options")
 }
 
 func TestStackActionCommandsUseRESTEndpoints(t *testing.T) {
@@ -2929,6 +2940,461 @@ func TestCreateFromManifestUsesStackEndpoint(t *testing.T) {
 	}
 }
 
+func TestExportManifestRoundTripsThroughCreateFromManifest(t *testing.T) {
+	var created map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/stack-revisions":
+			if r.URL.Query().Get("stackId") != "12" {
+				t.Errorf("query = %s", r.URL.RawQuery)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"id": 120, "number": 2}, {"id": 130, "number": 3}}})
+		case "GET /v1/stack-revisions/130":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":       130,
+				"number":   3,
+				"manifest": `{"name":"php-stack","title":"PHP","version":"1.0","services":[{"name":"nginx","options":[{"version":"1.27","default":true}],"config":"templates/nginx.conf"},{"name":"php","options":[{"version":"8.3"}],"labels":{"tier":"app","on":"true"}}]}`,
+				"files":    map[string]interface{}{"templates/nginx.conf": "server {\n  listen 80;\n}\n"},
+			})
+		case "GET /v1/services/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "redis", "revId": 70})
+		case "GET /v1/service-revisions/70":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 70, "number": 1, "manifest": map[string]interface{}{"name": "redis", "raw": `{"name":"redis","type":"datastore"}`}})
+		case "POST /v1/stacks/actions/create-from-manifest":
+			if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+				t.Errorf("Decode() error = %v", err)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99, "name": "php-stack"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	dir := filepath.Join(t.TempDir(), "export")
+	var out bytes.Buffer
+	cmd := newStackCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"export-manifest", "12", "--rev", "3", "--out", dir})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := os.ReadFile(filepath.Join(dir, "stack.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantManifest := `name: php-stack
+title: PHP
+version: "1.0"
+services:
+  - name: nginx
+    options:
+      - version: "1.27"
+        default: true
+    config: templates/nginx.conf
+  - name: php
+    options:
+      - version: "8.3"
+    labels:
+      tier: app
+      on: "true"
+`
+	if string(manifest) != wantManifest {
+		t.Fatalf("manifest =\n%s", manifest)
+	}
+	if !strings.Contains(out.String(), "wodby stack create-from-manifest stack.yml --include templates/nginx.conf") {
+		t.Fatalf("output should show how to recreate the stack:\n%s", out.String())
+	}
+
+	t.Chdir(dir)
+	var lintOut bytes.Buffer
+	cmd = newManifestCommand()
+	cmd.SetOut(&lintOut)
+	cmd.SetErr(&lintOut)
+	cmd.SetArgs([]string{"lint", "stack.yml", "--include", "templates/nginx.conf"})
+	if err := cmd.Execute(); err != nil || lintOut.String() != "1 manifest OK\n" {
+		t.Fatalf("lint of exported manifest = %v:\n%s", err, lintOut.String())
+	}
+
+	cmd = newStackCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetArgs([]string{"create-from-manifest", "stack.yml", "--include", "templates/nginx.conf", "--org", "2"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(created["manifestYaml"] == wantManifest, created["files"]); got != "true map[templates/nginx.conf:server {\n  listen 80;\n}\n]" {
+		t.Fatalf("create body = %#v", created)
+	}
+
+	out.Reset()
+	cmd = newServiceCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"export-manifest", "7"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "name: redis\ntype: datastore\n" {
+		t.Fatalf("service manifest =\n%s", out.String())
+	}
+}
+
+func TestCurrentRevisionIDIgnoresLatestRevision(t *testing.T) {
+	for _, tc := range []struct {
+		kind string
+		row  map[string]interface{}
+		want string
+	}{
+		{kind: "stack", row: map[string]interface{}{"latestRevId": 9, "currentStackRevId": 5}, want: "5"},
+		{kind: "stack", row: map[string]interface{}{"stackRevision": map[string]interface{}{"id": 6}}, want: "6"},
+		{kind: "service", row: map[string]interface{}{"latestRevId": 9, "serviceRev": map[string]interface{}{"id": 7}}, want: "7"},
+		{kind: "service", row: map[string]interface{}{"latestRevId": 9}, want: ""},
+	} {
+		if got := currentRevisionID(tc.row, tc.kind); got != tc.want {
+			t.Fatalf("currentRevisionID(%v, %s) = %q, want %q", tc.row, tc.kind, got, tc.want)
+		}
+	}
+}
+
+func TestApplyManifestShowsDiffAndCreatesRevision(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "stack.yml")
+	if err := os.WriteFile(manifestPath, []byte("name: php-stack\nservices:\n  - name: php\n    options: [{version: \"8.4\"}]\n  - name: nginx\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests []string
+	var applied map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method + " " + r.URL.Path {
+		case "POST /v1/stacks/actions/validate-manifest":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"valid": true})
+		case "GET /v1/stacks/12":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 12, "name": "php-stack", "revId": 130})
+		case "GET /v1/stack-revisions/130":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 130, "manifest": `{"name":"php-stack","services":[{"name":"nginx"},{"name":"php","options":[{"version":"8.3"}]}]}`})
+		case "POST /v1/stacks/12/actions/update-from-manifest":
+			if err := json.NewDecoder(r.Body).Decode(&applied); err != nil {
+				t.Errorf("Decode() error = %v", err)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 12, "name": "php-stack", "title": "PHP Stack"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newStackCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"apply-manifest", "12", manifestPath, "--version", "1.1", "--dry-run"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "removed  services[php].options[8.3]") || !strings.Contains(out.String(), "added    services[php].options[8.4]") {
+		t.Fatalf("output should show the diff:\n%s", out.String())
+	}
+	if len(requests) != 3 {
+		t.Fatalf("--dry-run requests = %v", requests)
+	}
+
+	requests = nil
+	out.Reset()
+	cmd = newStackCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"apply-manifest", "12", "-f", manifestPath, "--version", "1.1", "--draft", "-y"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(requests, ", "); got != "POST /v1/stacks/actions/validate-manifest, GET /v1/stacks/12, GET /v1/stack-revisions/130, POST /v1/stacks/12/actions/update-from-manifest" {
+		t.Fatalf("requests = %s", got)
+	}
+	if applied["version"] != "1.1" || applied["draft"] != true || !strings.HasPrefix(fmt.Sprint(applied["manifestYaml"]), "name: php-stack\n") {
+		t.Fatalf("body = %#v", applied)
+	}
+	if !strings.Contains(out.String(), "PHP Stack") {
+		t.Fatalf("output should include the updated stack:\n%s", out.String())
+	}
+}
+
+func TestApplyManifestPublishCreatesDraftAndPublishesIt(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "stack.yml")
+	if err := os.WriteFile(manifestPath, []byte("name: php-stack\nservices:\n  - name: php\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests []string
+	var applied map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method + " " + r.URL.Path {
+		case "POST /v1/stacks/actions/validate-manifest":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"valid": true})
+		case "GET /v1/stacks/12":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 12, "name": "php-stack", "revId": 130})
+		case "GET /v1/stack-revisions/130":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 130, "manifest": `{"name":"php-stack","services":[{"name":"nginx"}]}`})
+		case "POST /v1/stacks/12/actions/update-from-manifest":
+			if err := json.NewDecoder(r.Body).Decode(&applied); err != nil {
+				t.Errorf("Decode() error = %v", err)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"taskId": "draft-task"})
+		case "GET /v1/tasks/draft-task":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "draft-task", "status": "completed"})
+		case "POST /v1/stacks/12/actions/publish-draft":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"taskId": "publish-task"})
+		case "GET /v1/tasks/publish-task":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "publish-task", "status": "completed"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	cmd := newStackCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetArgs([]string{"apply-manifest", "12", "-f", manifestPath, "--version", "1.1", "--publish", "-y", "--wait"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	want := "POST /v1/stacks/actions/validate-manifest, GET /v1/stacks/12, GET /v1/stack-revisions/130, POST /v1/stacks/12/actions/update-from-manifest, " +
+		"GET /v1/tasks/draft-task, POST /v1/stacks/12/actions/publish-draft, GET /v1/tasks/publish-task"
+	if got := strings.Join(requests, ", "); got != want {
+		t.Fatalf("requests = %s\nwant %s", got, want)
+	}
+	if applied["draft"] != true {
+		t.Fatalf("body = %#v", applied)
+	}
+
+	cmd = newStackCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"apply-manifest", "12", "-f", manifestPath, "--draft", "--publish"})
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "use either --draft or --publish") {
+		t.Fatalf("Execute() error = %v, want draft and publish conflict", err)
+	}
+}
+
+func TestApplyServiceManifestDoesNotSendDraft(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "service.yml")
+	if err := os.WriteFile(manifestPath, []byte("name: redis\ntype: datastore\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var applied map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /v1/services/actions/validate-manifest":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"valid": true})
+		case "GET /v1/services/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "redis", "revId": 70})
+		case "GET /v1/service-revisions/70":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 70, "manifest": `{"name":"redis","type":"cache"}`})
+		case "POST /v1/services/7/actions/update-from-manifest":
+			if err := json.NewDecoder(r.Body).Decode(&applied); err != nil {
+				t.Errorf("Decode() error = %v", err)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "redis"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	cmd := newServiceCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetArgs([]string{"apply-manifest", "7", "-f", manifestPath, "--version", "2", "-y"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := applied["draft"]; ok || applied["version"] != "2" {
+		t.Fatalf("body = %#v", applied)
+	}
+}
+
+func TestManifestLintFailsWithFileLineDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.yml")
+	bad := filepath.Join(dir, "bad.yml")
+	if err := os.WriteFile(good, []byte("name: php\nservices:\n  - name: php\n    options: [{version: \"8.3\"}]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bad, []byte("name: php\nservices:\n  - name: php\n    replicas: -1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut bytes.Buffer
+	cmd := newManifestCommand()
+	cmd.SetOut(&out)
+	cmd.SetErr(&errOut)
+	cmd.SetArgs([]string{"lint", good})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "" || errOut.String() != "1 manifest OK\n" {
+		t.Fatalf("out = %q, err = %q", out.String(), errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	cmd = newManifestCommand()
+	cmd.SetOut(&out)
+	cmd.SetErr(&errOut)
+	cmd.SetArgs([]string{"lint", good, bad, "--include", "nginx.conf=" + filepath.Join(dir, "missing.conf")})
+	err := cmd.Execute()
+	if err == nil || err.Error() != "2 errors, 0 warnings" {
+		t.Fatalf("err = %v", err)
+	}
+	want := filepath.Join(dir, "missing.conf") + ": error: --include nginx.conf does not exist (include)\n" +
+		bad + ":4:15: error: services[0].replicas must be at least 0 (schema)\n"
+	if out.String() != want || strings.Contains(errOut.String(), "Usage:") {
+		t.Fatalf("out =\n%s\nerr =\n%s", out.String(), errOut.String())
+	}
+
+	out.Reset()
+	cmd = newManifestCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"schema", "stack"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &schema); err != nil || schema["title"] != "Wodby stack manifest" {
+		t.Fatalf("schema = %v, %v", schema["title"], err)
+	}
+}
+
+func TestManifestTemplatingRendersBeforeSending(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"stack.yml":    "name: shop-{{ .Values.region }}\nservices:\n  - name: php\n    replicas: {{ .Values.replicas }}\n",
+		"regions.yaml": "region: eu\nreplicas: 2\n",
+	})
+
+	var out bytes.Buffer
+	cmd := newManifestCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"render", filepath.Join(dir, "stack.yml"), "--values", filepath.Join(dir, "regions.yaml"), "--set", "replicas=3"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	want := "name: shop-eu\nservices:\n  - name: php\n    replicas: 3\n"
+	if out.String() != want {
+		t.Fatalf("rendered =\n%s", out.String())
+	}
+
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Decode() error = %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99, "name": "shop-eu"})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	cmd = newStackCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetArgs([]string{"create-from-manifest", filepath.Join(dir, "stack.yml"), "--values", filepath.Join(dir, "regions.yaml"), "--set", "replicas=3"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if body["manifestYaml"] != want {
+		t.Fatalf("manifestYaml = %q", body["manifestYaml"])
+	}
+}
+
+func TestStackRevisionDiffComparesServices(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/v1/stacks/12":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 12, "revId": 131, "draftRevId": 132})
+		case "/v1/stack-revisions":
+			if r.URL.Query().Get("stackId") != "12" {
+				t.Errorf("stackId = %q", r.URL.Query().Get("stackId"))
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"id": 130, "number": 3}, {"id": 131, "number": 4}}})
+		case "/v1/stack-revisions/130/services":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+				{"id": 1, "name": "php", "replicas": 1, "serviceRev": map[string]interface{}{"number": 7}, "settings": []map[string]interface{}{{"name": "upload_max", "value": "32M"}}},
+				{"id": 2, "name": "redis", "replicas": 1},
+			}})
+		case "/v1/stack-revisions/131/services", "/v1/stack-revisions/132/services":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+				{"id": 11, "name": "php", "replicas": 2, "serviceRev": map[string]interface{}{"number": 8}, "settings": []map[string]interface{}{{"name": "upload_max", "value": "32M"}}},
+			}})
+		case "/v1/stack-services/1/options":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"version": "8.3", "default": true}}})
+		case "/v1/stack-services/11/options":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"version": "8.3"}, {"version": "8.4", "default": true}}})
+		case "/v1/stack-services/1/env-vars":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"name": "APP_ENV", "value": "dev"}, {"name": "SECRET", "value": "a", "secret": true}}})
+		case "/v1/stack-services/11/env-vars":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"name": "APP_ENV", "value": "prod"}, {"name": "SECRET", "value": "a", "secret": true}}})
+		case "/v1/stack-services/11/cron-schedules":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"name": "cron", "crontab": "*/5 * * * *", "command": "drush cron"}}})
+		default:
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newStackCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"revision", "diff", "12", "--from", "3"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"changed services[php].defaultVersion 8.3 8.4",
+		"changed services[php].env.APP_ENV dev prod",
+		"changed services[php].replicas 1 2",
+		"changed services[php].serviceRev #7 #8",
+		"changed services[php].versions 8.3 8.3, 8.4",
+		"added services[php].cronSchedules.cron",
+		"removed services[redis]",
+	} {
+		if !strings.Contains(strings.Join(strings.Fields(out.String()), " "), want) {
+			t.Fatalf("output should contain %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "SECRET") || strings.Contains(out.String(), "upload_max") {
+		t.Fatalf("output should not list unchanged values:\n%s", out.String())
+	}
+
+	mu.Lock()
+	requests = nil
+	mu.Unlock()
+	out.Reset()
+	cmd = newStackCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"publish-draft", "12", "--preview"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out.String()) != "The draft matches the current stack revision." {
+		t.Fatalf("preview output =\n%s", out.String())
+	}
+	for _, request := range requests {
+		if strings.HasPrefix(request, "POST ") {
+			t.Fatalf("--preview should not publish: %v", requests)
+		}
+	}
+}
+
 func TestValidateManifestReturnsErrorForInvalidManifest(t *testing.T) {
 	tempDir := t.TempDir()
 	manifestPath := filepath.Join(tempDir, "service.yml")
@@ -3183,58 +3649,211 @@ func TestHelmChartReferenceRejectsAmbiguousSource(t *testing.T) {
 	}
 }
 
-func TestHelmScaffoldServiceWritesManifest(t *testing.T) {
-	tempDir := t.TempDir()
-	valuesPath := filepath.Join(tempDir, "values.json")
-	outPath := filepath.Join(tempDir, "service.yml")
-	if err := os.WriteFile(valuesPath, []byte(`{"architecture":"standalone","replicaCount":1}`), 0o644); err != nil {
-		t.Fatal(err)
+func TestHelmChartRejectsVersionForLocalChart(t *testing.T) {
+	cmd := newHelmCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	chartDir := t.TempDir()
+	writeTestFiles(t, chartDir, testHelmChartFiles)
+	cmd.SetArgs([]string{"inspect", chartDir, "--version", "1.2.0"})
+	err := cmd.Execute()
+	if err == nil {
+		t.Fatal("Execute() error = nil, want version conflict error")
+	}
+	if !strings.Contains(err.Error(), "do not combine --version with a local chart") {
+		t.Fatalf("Execute() error = %q, want version conflict error", err)
 	}
+}
 
-	var gotMethod string
-	var gotPath string
-	var body map[string]interface{}
+func TestHelmInspectRendersLocalChartWithoutAPI(t *testing.T) {
+	dir := writeTestHelmChart(t)
+	valuesPath := filepath.Join(t.TempDir(), "values.yaml")
+	if err := os.WriteFile(valuesPath, []byte("image:\n  tag: \"3.5\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gotMethod = r.Method
-		gotPath = r.URL.Path
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			t.Fatalf("Decode() error = %v", err)
-		}
-		_ = json.NewEncoder(w).Encode(map[string]interface{}{
-			"manifestYaml": "name: redis\n",
-			"manifest":     map[string]interface{}{"name": "redis"},
-			"analysis": map[string]interface{}{
-				"warnings": []string{"chart uses persistent storage"},
-			},
-			"warnings": []string{"review generated service", "chart uses persistent storage"},
-		})
+		t.Errorf("local chart should not be sent to the API: %s %s", r.Method, r.URL.Path)
+		encodeEmptyItems(w)
 	}))
 	defer server.Close()
 	configureTestAPI(t, server.URL+"/v1")
 
 	var out bytes.Buffer
-	var errOut bytes.Buffer
 	cmd := newHelmCommand()
 	cmd.SetOut(&out)
-	cmd.SetErr(&errOut)
-	cmd.SetArgs([]string{
-		"scaffold-service",
-		"oci://registry-1.docker.io/bitnamicharts/redis",
-		"--values", valuesPath,
-		"--service-name", "redis",
-		"--service-title", "Redis",
-		"--service-type", "database",
-		"--icon", "redis",
-		"--out", outPath,
-	})
+	cmd.SetArgs([]string{"inspect", dir, "--release", "shop", "--values-yaml", valuesPath})
 	if err := cmd.Execute(); err != nil {
 		t.Fatal(err)
 	}
+	for _, expected := range []string{
+		"shop\n  Version: 1.2.0 / app 3.4\n  Chart: " + dir + "\n  Release: shop\n  Namespace: default\n  Rendered resources: 5\n",
+		"deployment shop\n    containers: shop (registry.example.com/shop:3.5; ports http:8080/tcp; 1 env vars)",
+		"statefulset shop-redis-standalone",
+		"volumes: data (1Gi; ReadWriteOnce)",
+		"Services: 2",
+		"shop-redis-headless (headless; ports redis:6379/tcp)",
+		"Hooks: 1\n  - Pod shop-test-connection (v1)",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("output should include %q:\n%s", expected, out.String())
+		}
+	}
 
-	if gotMethod != http.MethodPost {
-		t.Fatalf("method = %q, want POST", gotMethod)
+	cmd = newHelmCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"scaffold-service", dir})
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "helm inspect") {
+		t.Fatalf("scaffold-service with a local chart error = %v", err)
 	}
-	if gotPath != "/v1/services/actions/scaffold-from-helm-chart" {
+}
+
+func TestHelmDiffShowsValueResourceAndOverrideChanges(t *testing.T) {
+	from := writeTestHelmChart(t)
+	to := writeTestHelmChart(t)
+	for name, replacements := range map[string][]string{
+		"values.yaml":               {"persistence:", "storage:", "port: 80", "port: 8080"},
+		"templates/deployment.yaml": {".Values.persistence", ".Values.storage", "containerPort: 8080", "containerPort: 9000"},
+		"templates/pvc.yaml":        {".Values.persistence", ".Values.storage"},
+	} {
+		content := readTestFile(t, filepath.Join(to, name))
+		content = strings.NewReplacer(replacements...).Replace(content)
+		if err := os.WriteFile(filepath.Join(to, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	valuesPath := filepath.Join(t.TempDir(), "app-values.yaml")
+	if err := os.WriteFile(valuesPath, []byte("persistence:\n  enabled: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/app-services/5/helm-values" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+			{"name": "image.tag", "value": "3.5"},
+			{"name": "persistence.size", "value": "20Gi"},
+			{"name": "extraEnv.DEBUG", "value": "1"},
+		}})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newHelmCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"diff", "--from", from, "--to", to, "--release", "shop", "--values", valuesPath, "--service", "5"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	output := strings.Join(strings.Fields(out.String()), " ")
+	for _, expected := range []string{
+		`Default values: change path from to removed persistence {"enabled":false,"size":"8Gi"} changed service.port 80 8080 added storage {`,
+		"Resources: change path from to changed services[shop].ports http:80/tcp http:8080/tcp",
+		"removed volumeClaims[shop] {",
+		"changed workloads[deployment shop].containers[shop].ports http:8080/tcp http:9000/tcp",
+		"changed workloads[deployment shop].volumes shop",
+		"Overrides that no longer apply: source path value reason values persistence.enabled true removed from chart defaults app-service 5 persistence.size 20Gi removed from chart defaults",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("output should include %q:\n%s", expected, out.String())
+		}
+	}
+	for _, unexpected := range []string{"image.tag", "extraEnv.DEBUG"} {
+		if strings.Contains(output, unexpected) {
+			t.Fatalf("output should not include %q:\n%s", unexpected, out.String())
+		}
+	}
+}
+
+func TestHelmDiffInspectsChartVersionsWithAPI(t *testing.T) {
+	var versions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Decode() error = %v", err)
+		}
+		if body["chart"] != "redis" || body["source"] != "https://charts.bitnami.com/bitnami" {
+			t.Errorf("body = %#v", body)
+		}
+		version := fmt.Sprint(body["version"])
+		versions = append(versions, version)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"defaultValuesYaml": map[string]string{"21.0.0": "auth:\n  password: \"\"\n", "22.0.0": "auth:\n  existingSecret: \"\"\n"}[version],
+			"workloads":         []map[string]interface{}{{"kind": "StatefulSet", "name": "redis-master"}},
+		})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newHelmCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"diff", "--from", "https://charts.bitnami.com/bitnami/redis@21.0.0", "--to", "https://charts.bitnami.com/bitnami/redis@22.0.0"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(versions, ","); got != "21.0.0,22.0.0" {
+		t.Fatalf("versions = %s", got)
+	}
+	output := strings.Join(strings.Fields(out.String()), " ")
+	if !strings.Contains(output, "added auth.existingSecret") || !strings.Contains(output, "removed auth.password") || !strings.Contains(output, "Resources: none") {
+		t.Fatalf("output =\n%s", out.String())
+	}
+}
+
+func TestHelmScaffoldServiceWritesManifest(t *testing.T) {
+	tempDir := t.TempDir()
+	valuesPath := filepath.Join(tempDir, "values.json")
+	outPath := filepath.Join(tempDir, "service.yml")
+	if err := os.WriteFile(valuesPath, []byte(`{"architecture":"standalone","replicaCount":1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotMethod string
+	var gotPath string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"manifestYaml": "name: redis\n",
+			"manifest":     map[string]interface{}{"name": "redis"},
+			"analysis": map[string]interface{}{
+				"warnings": []string{"chart uses persistent storage"},
+			},
+			"warnings": []string{"review generated service", "chart uses persistent storage"},
+		})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	var errOut bytes.Buffer
+	cmd := newHelmCommand()
+	cmd.SetOut(&out)
+	cmd.SetErr(&errOut)
+	cmd.SetArgs([]string{
+		"scaffold-service",
+		"oci://registry-1.docker.io/bitnamicharts/redis",
+		"--values", valuesPath,
+		"--service-name", "redis",
+		"--service-title", "Redis",
+		"--service-type", "database",
+		"--icon", "redis",
+		"--out", outPath,
+	})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotMethod != http.MethodPost {
+		t.Fatalf("method = %q, want POST", gotMethod)
+	}
+	if gotPath != "/v1/services/actions/scaffold-from-helm-chart" {
 		t.Fatalf("path = %q, want /v1/services/actions/scaffold-from-helm-chart", gotPath)
 	}
 	chart, ok := body["chart"].(map[string]interface{})
@@ -8245,6 +8864,1908 @@ func TestTaskLogsWithoutStepsPrintsNoLogs(t *testing.T) {
 	}
 }
 
+func newInstanceBundleTestServer(t *testing.T, envVars []map[string]interface{}, requests *[]string, bodies map[string]map[string]interface{}) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodGet:
+			*requests = append(*requests, r.Method+" "+r.URL.Path)
+			body := map[string]interface{}{}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			bodies[r.Method+" "+r.URL.Path] = body
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99})
+		case r.URL.Path == "/v1/app-instances/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "dev", "title": "Dev"})
+		case r.URL.Path == "/v1/app-services":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 11, "name": "php", "title": "PHP"}})
+		case r.URL.Path == "/v1/app-services/11/env-vars":
+			_ = json.NewEncoder(w).Encode(envVars)
+		default:
+			encodeEmptyList(w)
+		}
+	}))
+}
+
+func TestInstanceExportMasksSecretsByDefault(t *testing.T) {
+	server := newInstanceBundleTestServer(t, []map[string]interface{}{
+		{"id": 1, "name": "APP_ENV", "value": "dev", "runtime": true},
+		{"id": 2, "name": "DB_PASSWORD", "value": "hunter2", "secret": true},
+	}, &[]string{}, map[string]map[string]interface{}{})
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"export", "7"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := decodeInstanceBundle(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Secrets != bundleSecretsMasked || len(bundle.Services) != 1 || bundle.Services[0].Name != "php" {
+		t.Fatalf("bundle = %+v, want one masked php service", bundle)
+	}
+	if strings.Contains(out.String(), "hunter2") {
+		t.Fatalf("export leaked secret value:\n%s", out.String())
+	}
+	envVars := bundle.Services[0].EnvVars
+	if len(envVars) != 2 || envVars[0]["name"] != "APP_ENV" || envVars[0]["value"] != "dev" {
+		t.Fatalf("env vars = %#v, want APP_ENV first with value", envVars)
+	}
+	if _, ok := envVars[1]["value"]; ok {
+		t.Fatalf("secret env var kept value: %#v", envVars[1])
+	}
+}
+
+func TestInstanceExportSectionsLimitsBundle(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/v1/app-instances/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "dev"})
+		case "/v1/app-services":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 11, "name": "php"}})
+		case "/v1/app-routes":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 5, "host": "dev.example.com", "path": "/", "appServiceId": 11}})
+		case "/v1/app-services/11/env-vars":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 1, "name": "APP_ENV", "value": "dev"}})
+		default:
+			encodeEmptyList(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"export", "7", "--sections", "envVars,routes"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := decodeInstanceBundle(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := bundle.Services[0]
+	if len(service.EnvVars) != 1 || len(service.Routes) != 1 || service.Ports != nil {
+		t.Fatalf("service = %+v, want only env vars and routes", service)
+	}
+	for _, path := range requests {
+		if strings.HasPrefix(path, "/v1/app-services/11/") && path != "/v1/app-services/11/env-vars" {
+			t.Fatalf("export read unselected section %s", path)
+		}
+	}
+
+	cmd = newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs([]string{"export", "7", "--sections", "envVars,secrets"})
+	if err := cmd.Execute(); err == nil || err.Error() != `unknown instance bundle section "secrets"` {
+		t.Fatalf("export error = %v, want unknown section", err)
+	}
+}
+
+func TestInstanceBundleEncryptedSecretsRoundTrip(t *testing.T) {
+	t.Setenv(defaultBundlePassphraseEnv, "correct horse")
+	bundle := &instanceBundle{
+		Kind:     instanceBundleKind,
+		Version:  instanceBundleVersion,
+		Secrets:  bundleSecretsEncrypted,
+		Services: []*instanceBundleService{{Name: "php", EnvVars: []map[string]interface{}{{"name": "DB_PASSWORD", "value": "hunter2", "secret": true}}}},
+	}
+	if err := protectInstanceBundleSecrets(bundle, ""); err != nil {
+		t.Fatal(err)
+	}
+	content, err := encodeInstanceBundle(bundle, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(content, "hunter2") {
+		t.Fatalf("encrypted bundle leaked secret value:\n%s", content)
+	}
+
+	decoded, err := decodeInstanceBundle([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(defaultBundlePassphraseEnv, "wrong")
+	if err := decryptInstanceBundle(decoded, ""); err == nil {
+		t.Fatal("decrypt with wrong passphrase succeeded")
+	}
+	t.Setenv(defaultBundlePassphraseEnv, "correct horse")
+	if err := decryptInstanceBundle(decoded, ""); err != nil {
+		t.Fatal(err)
+	}
+	if value := decoded.Services[0].EnvVars[0]["value"]; value != "hunter2" {
+		t.Fatalf("decrypted value = %#v, want hunter2", value)
+	}
+}
+
+func TestInstanceImportConfigAppliesOnlyChangedItems(t *testing.T) {
+	var requests []string
+	bodies := map[string]map[string]interface{}{}
+	server := newInstanceBundleTestServer(t, []map[string]interface{}{
+		{"id": 1, "name": "APP_ENV", "value": "prod", "runtime": true},
+		{"id": 2, "name": "UNCHANGED", "value": "same"},
+	}, &requests, bodies)
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	bundlePath := filepath.Join(t.TempDir(), "bundle.yaml")
+	bundle := `kind: AppInstanceBundle
+version: 1
+secrets: masked
+instance:
+  name: dev
+services:
+  - name: php
+    envVars:
+      - name: APP_ENV
+        value: dev
+        runtime: true
+      - name: UNCHANGED
+        value: same
+      - name: NEW_VAR
+        value: "1"
+      - name: DB_PASSWORD
+        secret: true
+  - name: redis
+`
+	if err := os.WriteFile(bundlePath, []byte(bundle), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"import-config", "7", "--file", bundlePath, "--yes"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"PUT /v1/app-service-env-vars/1", "POST /v1/app-services/11/env-vars"}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("requests = %#v, want %#v", requests, want)
+	}
+	if value := bodies["PUT /v1/app-service-env-vars/1"]["value"]; value != "dev" {
+		t.Fatalf("update body value = %#v, want dev", value)
+	}
+	if name := bodies["POST /v1/app-services/11/env-vars"]["name"]; name != "NEW_VAR" {
+		t.Fatalf("create body name = %#v, want NEW_VAR", name)
+	}
+	output := out.String()
+	for _, want := range []string{"DB_PASSWORD", "secret value is not in the bundle", "redis", "no service with this name"} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("output missing %q:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "UNCHANGED") {
+		t.Fatalf("output lists unchanged item:\n%s", output)
+	}
+}
+
+func TestUnifiedDiffGroupsChangesIntoHunks(t *testing.T) {
+	from := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	to := []string{"a", "B", "c", "d", "e", "f", "g", "h", "i", "j", "k"}
+
+	diff := unifiedDiff("old", "new", from, to, 1)
+	want := "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n@@ -10 +10,2 @@\n j\n+k\n"
+	if diff != want {
+		t.Fatalf("diff =\n%s\nwant\n%s", diff, want)
+	}
+	if diff := unifiedDiff("old", "new", from, from, 3); diff != "" {
+		t.Fatalf("diff of equal input = %q, want empty", diff)
+	}
+}
+
+func TestInstanceDiffComparesServicesAndHashesSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/app-instances/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "staging"})
+		case "/v1/app-instances/8":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 8, "name": "prod"})
+		case "/v1/app-services":
+			if r.URL.Query().Get("appInstanceId") == "7" {
+				_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 11, "name": "php", "version": "8.3", "replicas": 1}})
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 21, "name": "php", "version": "8.2", "replicas": 1}})
+		case "/v1/app-services/11/env-vars":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 1, "name": "DB_PASSWORD", "value": "staging-secret", "secret": true}})
+		case "/v1/app-services/21/env-vars":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 2, "name": "DB_PASSWORD", "value": "prod-secret", "secret": true}})
+		case "/v1/app-services/11/configs", "/v1/app-services/21/configs":
+			t.Fatalf("diff fetched unused section %s", r.URL.Path)
+		default:
+			encodeEmptyList(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"diff", "7", "8"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := out.String()
+	for _, want := range []string{
+		"--- instance 7 (staging)",
+		"+++ instance 8 (prod)",
+		"-services[php].version: 8.3",
+		"+services[php].version: 8.2",
+		" services[php].replicas: 1",
+		"-services[php].envVars[DB_PASSWORD].value: secret sha256:",
+	} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("diff missing %q:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "staging-secret") || strings.Contains(output, "prod-secret") {
+		t.Fatalf("diff leaked secret values:\n%s", output)
+	}
+
+	out.Reset()
+	cmd = newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"diff", "7", "8", "-o", "json"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Changes []instanceDiffChange `json:"changes"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 2 || result.Changes[1].Path != "services[php].version" || result.Changes[1].From != "8.3" || result.Changes[1].To != "8.2" {
+		t.Fatalf("changes = %#v, want secret and version changes", result.Changes)
+	}
+}
+
+func TestParseDotenvHandlesQuotesCommentsAndExport(t *testing.T) {
+	vars, err := parseDotenv(`# comment
+export APP_ENV=dev # trailing
+EMPTY=
+SINGLE='a "literal" $value'
+DOUBLE="line1\nline2 \"quoted\""
+MULTI="first
+second"
+APP_ENV=prod
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	names := make([]string, 0, len(vars))
+	for _, variable := range vars {
+		got[variable.name] = variable.value
+		names = append(names, variable.name)
+	}
+	if strings.Join(names, ",") != "APP_ENV,EMPTY,SINGLE,DOUBLE,MULTI" {
+		t.Fatalf("names = %v", names)
+	}
+	want := map[string]string{
+		"APP_ENV": "prod",
+		"EMPTY":   "",
+		"SINGLE":  `a "literal" $value`,
+		"DOUBLE":  "line1\nline2 \"quoted\"",
+		"MULTI":   "first\nsecond",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Fatalf("%s = %q, want %q", name, got[name], value)
+		}
+	}
+
+	if _, err := parseDotenv("not a variable\n"); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("parse error = %v, want line 1 error", err)
+	}
+}
+
+func TestAppServiceEnvVarImportSendsOnlyNeededChanges(t *testing.T) {
+	var requests []string
+	bodies := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/app-services/11/env-vars" {
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"id": 1, "name": "APP_ENV", "value": "prod", "runtime": true},
+				{"id": 2, "name": "SAME", "value": "x"},
+				{"id": 3, "name": "OLD", "value": "y"},
+				{"id": 4, "name": "SCOPED", "value": "z", "workload": "php"},
+			})
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies[r.Method+" "+r.URL.Path] = body
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	envPath := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envPath, []byte("APP_ENV=dev\nSAME=x\nDB_PASSWORD=hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"env-var", "import", "11", "--file", envPath, "--secret-keys", "DB_PASSWORD", "--prune", "--yes"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"PUT /v1/app-service-env-vars/1", "POST /v1/app-services/11/env-vars", "DELETE /v1/app-service-env-vars/3"}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("requests = %#v, want %#v", requests, want)
+	}
+	if body := bodies["PUT /v1/app-service-env-vars/1"]; body["value"] != "dev" || body["secret"] != false {
+		t.Fatalf("update body = %#v", body)
+	}
+	if body := bodies["POST /v1/app-services/11/env-vars"]; body["name"] != "DB_PASSWORD" || body["secret"] != true {
+		t.Fatalf("create body = %#v", body)
+	}
+}
+
+func TestAppServiceEnvVarImportKeepsExistingSecrets(t *testing.T) {
+	var requests []string
+	bodies := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/app-services/11/env-vars" {
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"id": 1, "name": "API_TOKEN", "value": "old", "secret": true},
+				{"id": 2, "name": "DB_PASSWORD", "secret": true},
+				{"id": 3, "name": "SMTP_PASSWORD", "value": "mail"},
+			})
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies[r.Method+" "+r.URL.Path] = body
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	envPath := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envPath, []byte("API_TOKEN=new\nDB_PASSWORD=hunter2\nSMTP_PASSWORD=mail\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"env-var", "import", "11", "--file", envPath, "--secret-keys", "SMTP_PASSWORD", "--yes"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"PUT /v1/app-service-env-vars/1", "PUT /v1/app-service-env-vars/3"}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("requests = %#v, want %#v", requests, want)
+	}
+	if body := bodies["PUT /v1/app-service-env-vars/1"]; body["value"] != "new" || body["secret"] != true {
+		t.Fatalf("unlisted secret update body = %#v", body)
+	}
+	if body := bodies["PUT /v1/app-service-env-vars/3"]; body["value"] != "mail" || body["secret"] != true {
+		t.Fatalf("listed secret update body = %#v", body)
+	}
+}
+
+func TestAppServiceEnvVarExportRedactsSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"id": 1, "name": "GREETING", "value": "hello world"},
+			{"id": 2, "name": "DB_PASSWORD", "value": "hunter2", "secret": true},
+			{"id": 3, "name": "SCOPED", "value": "z", "workload": "php"},
+		})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"env-var", "export", "11"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	want := "# DB_PASSWORD=<redacted secret>\nGREETING=\"hello world\"\n"
+	if out.String() != want {
+		t.Fatalf("export =\n%s\nwant\n%s", out.String(), want)
+	}
+
+	vars, err := parseDotenv(out.String())
+	if err != nil || len(vars) != 1 || vars[0].value != "hello world" {
+		t.Fatalf("re-parsed export = %#v, %v", vars, err)
+	}
+}
+
+func TestAppServiceEnvVarExportImportPruneKeepsRedactedSecrets(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/app-services/11/env-vars" {
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"id": 1, "name": "GREETING", "value": "hello world"},
+				{"id": 2, "name": "DB_PASSWORD", "secret": true},
+				{"id": 3, "name": "OLD", "value": "y"},
+			})
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var exported bytes.Buffer
+	cmd := newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+	cmd.SetOut(&exported)
+	cmd.SetArgs([]string{"env-var", "export", "11"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Replace(exported.String(), "OLD=y\n", "", 1)
+	envPath := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"env-var", "import", "11", "--file", envPath, "--prune", "--yes"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"DELETE /v1/app-service-env-vars/3"}; strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("requests = %#v, want %#v", requests, want)
+	}
+}
+
+func TestInstanceCloneCreatesInstanceAndCopiesConfiguration(t *testing.T) {
+	var requests []string
+	bodies := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			var body interface{}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			bodies[r.Method+" "+r.URL.Path] = body
+			switch r.URL.Path {
+			case "/v1/app-instances":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 8, "taskId": "task-1"})
+			case "/v1/app-deployments":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 31})
+			default:
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 99})
+			}
+			return
+		}
+		instanceID := r.URL.Query().Get("appInstanceId")
+		switch r.URL.Path {
+		case "/v1/app-instances/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "staging", "appId": 3, "clusterId": 5, "stackRevId": 9, "orgId": 1, "domain": "staging.example.com"})
+		case "/v1/app-instances/8":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 8, "name": "qa"})
+		case "/v1/tasks/task-1":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "task-1", "status": "completed"})
+		case "/v1/app-services":
+			if instanceID == "7" {
+				_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 11, "name": "php"}})
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 21, "name": "php"}, {"id": 22, "name": "redis"}})
+		case "/v1/app-deployments":
+			if instanceID != "7" {
+				t.Fatalf("deployment history read for app instance %q", instanceID)
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"id": 40, "status": "failed", "createdAt": "2026-10-18T10:00:00Z"},
+				{"id": 30, "status": "completed", "createdAt": "2026-10-17T10:00:00Z", "builds": []map[string]interface{}{{"appServiceBuilds": []map[string]interface{}{{"id": 61, "appServiceId": 11, "image": "registry/php:61"}}}}, "appServiceDeployments": []map[string]interface{}{{"appServiceId": 11, "appServiceBuildId": 61}}},
+			})
+		case "/v1/app-services/11/env-vars":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 1, "name": "APP_ENV", "value": "staging"}})
+		case "/v1/app-services/11/volumes":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 5, "name": "files", "size": 20}, {"id": 6, "name": "cache", "size": 1}})
+		case "/v1/app-services/21/volumes":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 7, "name": "files", "size": 10}, {"id": 8, "name": "cache", "size": 1}})
+		case "/v1/app-routes":
+			if instanceID == "7" {
+				_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+					{"id": 1, "appServiceId": 11, "host": "api.staging.example.com", "path": "/", "port": 80},
+					{"id": 2, "appServiceId": 11, "host": "www.customer.com", "path": "/", "port": 80},
+				})
+				return
+			}
+			encodeEmptyList(w)
+		default:
+			encodeEmptyList(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out, errOut bytes.Buffer
+	cmd := newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetErr(&errOut)
+	cmd.SetArgs([]string{"clone", "7", "--name", "qa", "--env", "4", "--domain", "qa.example.com", "--deploy"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Warning: volume sizes are not copied; these volumes of app instance 8 differ from the source: php/files (20 -> 10)\n"; errOut.String() != want {
+		t.Fatalf("stderr = %q, want %q", errOut.String(), want)
+	}
+
+	want := []string{"POST /v1/app-instances", "POST /v1/app-services/21/env-vars", "POST /v1/app-routes", "POST /v1/app-deployments"}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("requests = %#v, want %#v", requests, want)
+	}
+	create := bodies["POST /v1/app-instances"].(map[string]interface{})
+	for key, value := range map[string]interface{}{"appId": 3.0, "envId": 4.0, "clusterId": 5.0, "stackRevId": 9.0, "instanceName": "qa", "domain": "qa.example.com", "deferInitialDeployment": true} {
+		if create[key] != value {
+			t.Fatalf("create body %s = %#v, want %#v", key, create[key], value)
+		}
+	}
+	route := bodies["POST /v1/app-routes"].(map[string]interface{})
+	if route["host"] != "api.qa.example.com" || route["appServiceId"] != 21.0 {
+		t.Fatalf("route body = %#v, want rewritten host for service 21", route)
+	}
+	deployment := bodies["POST /v1/app-deployments"].(map[string]interface{})
+	if got := fmt.Sprint(deployment["services"]); got != "[map[appServiceBuildId:61 appServiceId:21] map[appServiceId:22]]" {
+		t.Fatalf("deployment services = %s", got)
+	}
+	if !strings.Contains(out.String(), "Created app instance 8 (qa)") || !strings.Contains(out.String(), "Started deployment 31") {
+		t.Fatalf("output =\n%s", out.String())
+	}
+}
+
+func TestInstanceCloneWarnsWhenDomainHasNoRoutes(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 8})
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/app-instances/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "staging", "appId": 3, "clusterId": 5, "domain": "staging.example.com"})
+		case "/v1/app-instances/8":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 8, "name": "qa"})
+		case "/v1/app-services":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 11, "name": "php"}})
+		case "/v1/app-routes":
+			if r.URL.Query().Get("appInstanceId") == "7" {
+				_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 2, "appServiceId": 11, "host": "www.customer.com", "path": "/", "port": 80}})
+				return
+			}
+			encodeEmptyList(w)
+		default:
+			encodeEmptyList(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out, errOut bytes.Buffer
+	cmd := newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetErr(&errOut)
+	cmd.SetArgs([]string{"clone", "7", "--name", "qa", "--env", "4", "--domain", "qa.example.com"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Warning: app instance 7 has no routes under its domain; --domain only sets the new instance domain\n"; errOut.String() != want {
+		t.Fatalf("stderr = %q, want %q", errOut.String(), want)
+	}
+	if strings.Join(requests, "\n") != "POST /v1/app-instances" {
+		t.Fatalf("requests = %#v, want only the instance create", requests)
+	}
+}
+
+func TestBackupDownloadResumesAndVerifiesChecksum(t *testing.T) {
+	var archive bytes.Buffer
+	writer := gzip.NewWriter(&archive)
+	_, _ = writer.Write([]byte("CREATE TABLE demo;\n"))
+	_ = writer.Close()
+	content := archive.Bytes()
+	sum := sha256.Sum256(content)
+
+	var ranges []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/backups/5/download":
+			if r.URL.Query().Get("component") != "db" {
+				t.Fatalf("component = %q, want db", r.URL.Query().Get("component"))
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"url":      server.URL + "/objects/db.sql.gz?signature=abc",
+				"size":     len(content),
+				"checksum": "sha256:" + hex.EncodeToString(sum[:]),
+			})
+		case "/objects/db.sql.gz":
+			ranges = append(ranges, r.Header.Get("Range"))
+			http.ServeContent(w, r, "db.sql.gz", time.Time{}, bytes.NewReader(content))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "db.sql.gz.part"), content[:10], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut bytes.Buffer
+	cmd := newBackupCommand()
+	cmd.SetOut(&out)
+	cmd.SetErr(&errOut)
+	cmd.SetArgs([]string{"download", "5", "--component", "db", "--out", dir, "--decompress"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranges) != 1 || ranges[0] != "bytes=10-" {
+		t.Fatalf("ranges = %#v, want resume from byte 10", ranges)
+	}
+	decompressed, err := os.ReadFile(filepath.Join(dir, "db.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != "CREATE TABLE demo;\n" {
+		t.Fatalf("decompressed = %q", decompressed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db.sql.gz.part")); !os.IsNotExist(err) {
+		t.Fatalf("part file still exists: %v", err)
+	}
+	if !strings.Contains(out.String(), "sha256 verified") || !strings.Contains(errOut.String(), "100%") {
+		t.Fatalf("stdout = %q, stderr = %q", out.String(), errOut.String())
+	}
+}
+
+func TestBackupDownloadRejectsChecksumMismatch(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/backups/5/download" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"url": server.URL + "/objects/files.tar.gz", "md5": strings.Repeat("0", 32)})
+			return
+		}
+		_, _ = w.Write([]byte("archive"))
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	dir := t.TempDir()
+	cmd := newBackupCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"download", "5", "--out", dir})
+	err := cmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "md5 checksum mismatch") {
+		t.Fatalf("error = %v, want md5 checksum mismatch", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("download left files behind: %v", entries)
+	}
+}
+
+func TestImportCreateUploadsFileInPartsAndResumes(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	content := []byte("0123456789")
+	dumpPath := filepath.Join(t.TempDir(), "dump.sql.gz")
+	if err := os.WriteFile(dumpPath, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	failPart2 := true
+	received := map[string]string{}
+	var uploadBody, completeBody, importBody map[string]interface{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := func(etags ...string) []map[string]interface{} {
+			rows := make([]map[string]interface{}, 0, 3)
+			for i := 1; i <= 3; i++ {
+				row := map[string]interface{}{"partNumber": i, "url": fmt.Sprintf("%s/objects/part-%d", server.URL, i)}
+				if i <= len(etags) && etags[i-1] != "" {
+					row["etag"] = etags[i-1]
+				}
+				rows = append(rows, row)
+			}
+			return rows
+		}
+		switch {
+		case r.URL.Path == "/v1/app-services":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 12, "name": "mariadb"}})
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/import-uploads":
+			_ = json.NewDecoder(r.Body).Decode(&uploadBody)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "up-1", "partSize": 4, "parts": parts()})
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/import-uploads/up-1":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "up-1", "status": "uploading", "partSize": 4, "parts": parts("etag-1")})
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/objects/"):
+			if r.URL.Path == "/objects/part-2" && failPart2 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			received[r.URL.Path] = string(data)
+			w.Header().Set("ETag", `"etag-`+strings.TrimPrefix(r.URL.Path, "/objects/part-")+`"`)
+		case r.URL.Path == "/v1/import-uploads/up-1/complete":
+			_ = json.NewDecoder(r.Body).Decode(&completeBody)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/v1/imports":
+			_ = json.NewDecoder(r.Body).Decode(&importBody)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 40})
+		default:
+			t.Fatalf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	run := func() error {
+		cmd := newImportCommand()
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs([]string{"create", "--instance", "7", "--service", "mariadb", "--upload", dumpPath, "--retries", "0"})
+		return cmd.Execute()
+	}
+	if err := run(); err == nil || !strings.Contains(err.Error(), "upload part 2") {
+		t.Fatalf("first run error = %v, want part 2 failure", err)
+	}
+	if uploadBody["kind"] != "db" || uploadBody["size"] != 10.0 || uploadBody["appServiceId"] != 12.0 {
+		t.Fatalf("upload body = %#v", uploadBody)
+	}
+
+	failPart2 = false
+	delete(received, "/objects/part-1")
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := received["/objects/part-1"]; ok {
+		t.Fatal("resumed upload sent part 1 again")
+	}
+	if received["/objects/part-2"] != "4567" || received["/objects/part-3"] != "89" {
+		t.Fatalf("received parts = %#v", received)
+	}
+	if completed := completeBody["parts"].([]interface{}); len(completed) != 3 || completed[1].(map[string]interface{})["etag"] != "etag-2" {
+		t.Fatalf("complete body = %#v", completeBody)
+	}
+	importInput := importBody["import"].(map[string]interface{})
+	if importInput["source"] != "upload" || importInput["uploadId"] != "up-1" || importBody["appServiceId"] != 12.0 {
+		t.Fatalf("import body = %#v", importBody)
+	}
+}
+
+func TestImportUploadStateIsOnlyResumedForTheSameTarget(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	configureTestAPI(t, "https://api.example.com/v1")
+
+	saved := newImportUploadState("sha256:abc", 10, "db", "12")
+	saved.UploadID = "up-1"
+	saveImportUploadState(importUploadStatePath(saved), saved)
+	if state := loadImportUploadState(importUploadStatePath(saved), newImportUploadState("sha256:abc", 10, "db", "12")); state.UploadID != "up-1" {
+		t.Fatalf("same target state = %#v, want up-1", state)
+	}
+
+	for name, target := range map[string]func() importUploadState{
+		"service": func() importUploadState { return newImportUploadState("sha256:abc", 10, "db", "13") },
+		"kind":    func() importUploadState { return newImportUploadState("sha256:abc", 10, "files", "12") },
+		"api": func() importUploadState {
+			viper.Set("api_base_url", "https://api.other.example.com/v1")
+			defer viper.Set("api_base_url", "https://api.example.com/v1")
+			return newImportUploadState("sha256:abc", 10, "db", "12")
+		},
+		"credentials": func() importUploadState {
+			viper.Set("api_key", "other-key")
+			defer viper.Set("api_key", "secret")
+			return newImportUploadState("sha256:abc", 10, "db", "12")
+		},
+	} {
+		target := target()
+		if state := loadImportUploadState(importUploadStatePath(target), target); state.UploadID != "" {
+			t.Fatalf("%s: state = %#v, want a new upload", name, state)
+		}
+		if state := loadImportUploadState(importUploadStatePath(saved), target); state.UploadID != "" {
+			t.Fatalf("%s: state from the saved path = %#v, want a new upload", name, state)
+		}
+	}
+}
+
+func TestPlanBackupRetentionKeepsLastDailyAndWeekly(t *testing.T) {
+	backup := func(id string, createdAt string, status string) map[string]interface{} {
+		return map[string]interface{}{"id": id, "appServiceId": 7, "createdAt": createdAt, "status": status}
+	}
+	rows := []map[string]interface{}{
+		backup("1", "2026-10-01T11:00:00Z", "completed"),
+		backup("2", "2026-10-08T11:00:00Z", "completed"),
+		backup("3", "2026-10-16T11:00:00Z", "completed"),
+		backup("4", "2026-10-17T11:00:00Z", "completed"),
+		backup("5", "2026-10-18T11:00:00Z", "completed"),
+		backup("6", "2026-10-18T12:00:00Z", "completed"),
+		backup("7", "2026-10-19T11:00:00Z", "failed"),
+		backup("8", "yesterday", "completed"),
+	}
+	items := planBackupRetention(rows, backupRetention{KeepLast: 1, KeepDaily: 2, KeepWeekly: 2})
+
+	kept := map[string]bool{}
+	for _, item := range items {
+		kept[scalarString(item.row["id"])] = item.keep
+	}
+	want := map[string]bool{"1": false, "2": true, "3": false, "4": true, "5": false, "6": true, "7": true, "8": true}
+	if fmt.Sprint(kept) != fmt.Sprint(want) {
+		t.Fatalf("kept = %#v, want %#v", kept, want)
+	}
+	if items[0].reasons[0] != "not finished" {
+		t.Fatalf("failed backup reasons = %#v", items[0].reasons)
+	}
+	if last := items[len(items)-1]; scalarString(last.row["id"]) != "8" || fmt.Sprint(last.reasons) != "[unknown creation time]" {
+		t.Fatalf("backup without a creation time = %v %#v", last.row["id"], last.reasons)
+	}
+}
+
+func TestBackupPruneDeletesBackupsOutsidePolicy(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		var deleted []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodDelete:
+				deleted = append(deleted, r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			case r.URL.Path == "/v1/backups":
+				if r.URL.Query().Get("appInstanceId") != "42" {
+					t.Fatalf("appInstanceId = %q, want 42", r.URL.Query().Get("appInstanceId"))
+				}
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+					{"id": 1, "name": "old", "appServiceId": 7, "createdAt": "2026-10-10T03:00:00Z", "status": "completed"},
+					{"id": 2, "name": "new", "appServiceId": 7, "createdAt": "2026-10-18T03:00:00Z", "status": "completed"},
+					{"id": 3, "name": "other", "appServiceId": 8, "createdAt": "2026-10-01T03:00:00Z", "status": "completed"},
+				}})
+			default:
+				encodeEmptyItems(w)
+			}
+		}))
+		configureTestAPI(t, server.URL+"/v1")
+
+		policyPath := filepath.Join(t.TempDir(), ".wodby", "backup-policy.yaml")
+		policy := newBackupCommand()
+		policy.SetOut(io.Discard)
+		policy.SetArgs([]string{"policy", "set", "--policy-file", policyPath, "--instance", "42", "--keep-last", "1"})
+		if err := policy.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		cmd := newBackupCommand()
+		cmd.SetOut(&out)
+		args := []string{"prune", "--policy-file", policyPath, "--yes"}
+		if dryRun {
+			args = append(args, "--dry-run")
+		}
+		cmd.SetArgs(args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+
+		want := []string{"/v1/backups/1"}
+		if dryRun {
+			want = nil
+		}
+		if fmt.Sprint(deleted) != fmt.Sprint(want) {
+			t.Fatalf("dryRun=%v deleted = %#v, want %#v", dryRun, deleted, want)
+		}
+		if !strings.Contains(out.String(), "keep last 1, daily 0, weekly 0") || !strings.Contains(out.String(), "delete") {
+			t.Fatalf("output = %q", out.String())
+		}
+	}
+}
+
+func TestBackupPruneRejectsKeepFlagsWithoutInstance(t *testing.T) {
+	cmd := newBackupCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"prune", "--keep-last", "3", "--policy-file", filepath.Join(t.TempDir(), "policy.yaml")})
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "--keep-last requires --instance") {
+		t.Fatalf("prune error = %v, want --keep-last requires --instance", err)
+	}
+}
+
+func TestBackupPolicySetAndRemove(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "policy.yaml")
+	run := func(args ...string) error {
+		cmd := newBackupCommand()
+		cmd.SetOut(io.Discard)
+		cmd.SetArgs(append([]string{"policy"}, append(args, "--policy-file", policyPath)...))
+		return cmd.Execute()
+	}
+	for _, args := range [][]string{
+		{"set", "--instance", "9", "--keep-daily", "7"},
+		{"set", "--instance", "3", "--keep-weekly", "4"},
+		{"set", "--instance", "9", "--keep-daily", "14", "--keep-last", "2"},
+	} {
+		if err := run(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policies, err := readBackupPolicyFile(policyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []backupRetention{{Instance: "3", KeepWeekly: 4}, {Instance: "9", KeepLast: 2, KeepDaily: 14}}
+	if fmt.Sprint(policies.Policies) != fmt.Sprint(want) {
+		t.Fatalf("policies = %#v, want %#v", policies.Policies, want)
+	}
+	if err := run("remove", "--instance", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("remove", "--instance", "3"); err == nil {
+		t.Fatal("removing a missing policy succeeded")
+	}
+	if err := run("set", "--instance", "5"); err == nil {
+		t.Fatal("setting an empty policy succeeded")
+	}
+}
+
+func TestBackupVerifyRestoresAndWritesJUnitReport(t *testing.T) {
+	var importBody map[string]interface{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/backups/5":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 5, "status": "completed", "appServiceId": 7})
+		case "/v1/app-services/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "name": "mariadb"})
+		case "/v1/app-services":
+			if r.URL.Query().Get("appInstanceId") != "99" {
+				t.Fatalf("appInstanceId = %q, want 99", r.URL.Query().Get("appInstanceId"))
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"id": 70, "name": "mariadb"}}})
+		case "/v1/imports":
+			_ = json.NewDecoder(r.Body).Decode(&importBody)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 11, "taskId": 500})
+		case "/v1/tasks/500":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 500, "status": "completed"})
+		case "/v1/app-services/70/actions/row-count":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"taskId": 501})
+		case "/v1/tasks/501":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 501, "status": "completed", "jobs": []map[string]interface{}{
+				{"steps": []map[string]interface{}{{"id": "s1", "name": "Run"}}},
+			}})
+		case "/v1/task-steps/s1/logs":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"message": "users: 42"}}})
+		case "/health":
+			_, _ = w.Write([]byte("status ok"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	dir := t.TempDir()
+	checksPath := filepath.Join(dir, "checks.yaml")
+	checks := "checks:\n" +
+		"  - name: users restored\n    service: mariadb\n    action: row-count\n    expect: 'users: (\\d+)'\n    min: 1\n" +
+		"  - name: too few users\n    service: mariadb\n    action: row-count\n    expect: 'users: (\\d+)'\n    min: 100\n" +
+		"  - name: health\n    url: " + server.URL + "/health\n    contains: ok\n"
+	if err := os.WriteFile(checksPath, []byte(checks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reportPath := filepath.Join(dir, "report.xml")
+
+	cmd := newBackupCommand()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"verify", "5", "--into", "99", "--checks", checksPath, "--report", "junit", "--out", reportPath, "--yes"})
+	err := cmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 checks did not pass") {
+		t.Fatalf("error = %v, want one failed check", err)
+	}
+
+	if got := fmt.Sprint(importBody); got != "map[appServiceId:70 import:map[backupId:5 source:backup]]" {
+		t.Fatalf("import body = %s", got)
+	}
+	report, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`tests="4" failures="1" skipped="0"`, `<testcase name="users restored"`, `<failure message="value 42 is below the minimum 100">`, `<testcase name="health" classname="wodby.backup.verify.http"`} {
+		if !strings.Contains(string(report), want) {
+			t.Fatalf("report missing %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestDeploymentRollbackDeploysImagesOfEarlierDeployment(t *testing.T) {
+	deployment := func(id int, services ...[3]interface{}) map[string]interface{} {
+		serviceBuilds := make([]map[string]interface{}, 0, len(services))
+		serviceDeployments := make([]map[string]interface{}, 0, len(services))
+		for _, service := range services {
+			serviceBuilds = append(serviceBuilds, map[string]interface{}{"id": service[1], "appServiceId": service[0], "image": service[2]})
+			serviceDeployments = append(serviceDeployments, map[string]interface{}{"appServiceId": service[0], "appServiceBuildId": service[1]})
+		}
+		return map[string]interface{}{"id": id, "status": "completed", "builds": []map[string]interface{}{{"appServiceBuilds": serviceBuilds}}, "appServiceDeployments": serviceDeployments}
+	}
+	details := map[string]map[string]interface{}{
+		"30": deployment(30, [3]interface{}{7, 301, "php:3"}, [3]interface{}{8, 302, "nginx:2"}),
+		"10": deployment(10, [3]interface{}{7, 101, "php:1"}),
+		"5":  deployment(5, [3]interface{}{7, 51, "php:0"}, [3]interface{}{8, 52, "nginx:1"}),
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--steps", "1"}, want: "[map[appServiceBuildId:52 appServiceId:8] map[appServiceBuildId:101 appServiceId:7]]"},
+		{args: []string{"--to", "5", "--services", "php"}, want: "[map[appServiceBuildId:51 appServiceId:7]]"},
+	} {
+		var posted map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPost && r.URL.Path == "/v1/app-deployments":
+				_ = json.NewDecoder(r.Body).Decode(&posted)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 40, "status": "pending"})
+			case r.URL.Path == "/v1/app-deployments":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+					{"id": 10, "status": "completed", "createdAt": "2026-10-10T10:00:00Z"},
+					{"id": 30, "status": "completed", "createdAt": "2026-10-18T10:00:00Z"},
+					{"id": 20, "status": "failed", "createdAt": "2026-10-15T10:00:00Z"},
+					{"id": 5, "status": "completed", "createdAt": "2026-10-01T10:00:00Z"},
+				}})
+			case strings.HasPrefix(r.URL.Path, "/v1/app-deployments/"):
+				_ = json.NewEncoder(w).Encode(details[strings.TrimPrefix(r.URL.Path, "/v1/app-deployments/")])
+			case r.URL.Path == "/v1/app-services":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"id": 7, "name": "php"}, {"id": 8, "name": "nginx"}}})
+			default:
+				encodeEmptyItems(w)
+			}
+		}))
+		configureTestAPI(t, server.URL+"/v1")
+
+		var out bytes.Buffer
+		cmd := newDeploymentCommand()
+		cmd.SetOut(&out)
+		cmd.SetArgs(append([]string{"rollback", "--instance", "42", "--yes"}, tc.args...))
+		err := cmd.Execute()
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(posted["services"]); got != tc.want {
+			t.Fatalf("%v: deployed %s, want %s", tc.args, got, tc.want)
+		}
+		if !strings.Contains(out.String(), "php:3") || !strings.Contains(out.String(), "rollback") {
+			t.Fatalf("%v: output = %q", tc.args, out.String())
+		}
+	}
+}
+
+func TestBuildPromoteDeploysBuildImagesToAnotherInstance(t *testing.T) {
+	for _, tc := range []struct {
+		targetRev string
+		args      []string
+		want      string
+		wantErr   string
+	}{
+		{targetRev: "3", want: "[map[appServiceBuildId:901 appServiceId:21] map[appServiceBuildId:902 appServiceId:22]]"},
+		{targetRev: "3", args: []string{"--services", "php"}, want: "[map[appServiceBuildId:901 appServiceId:21]]"},
+		{targetRev: "4", wantErr: "runs stack revision 4 but the build was made for stack revision 3"},
+	} {
+		var posted map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/app-builds/90":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 90, "status": "completed", "appInstanceId": 1, "appServiceBuilds": []map[string]interface{}{
+					{"id": 901, "appServiceId": 11, "image": "registry/php@sha256:aa"},
+					{"id": 902, "appServiceId": 12, "image": "registry/nginx@sha256:bb"},
+				}})
+			case "/v1/app-instances/1":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "appId": 5, "stackRevId": 3})
+			case "/v1/app-instances/2":
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 2, "appId": 5, "stackRevId": tc.targetRev})
+			case "/v1/app-services":
+				offset := 10
+				if r.URL.Query().Get("appInstanceId") == "2" {
+					offset = 20
+				}
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"id": offset + 1, "name": "php"}, {"id": offset + 2, "name": "nginx"}}})
+			case "/v1/app-deployments":
+				_ = json.NewDecoder(r.Body).Decode(&posted)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 40, "status": "pending"})
+			default:
+				encodeEmptyItems(w)
+			}
+		}))
+		configureTestAPI(t, server.URL+"/v1")
+
+		var out bytes.Buffer
+		cmd := newBuildCommand()
+		cmd.SetOut(&out)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs(append([]string{"promote", "90", "--to", "2", "--yes"}, tc.args...))
+		err := cmd.Execute()
+		server.Close()
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tc.wantErr)
+			}
+			if posted != nil {
+				t.Fatalf("deployed despite incompatible instances: %v", posted)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(posted["services"]); got != tc.want {
+			t.Fatalf("%v: deployed %s, want %s", tc.args, got, tc.want)
+		}
+		if !strings.Contains(out.String(), "registry/php@sha256:aa") {
+			t.Fatalf("output = %q", out.String())
+		}
+	}
+}
+
+func TestCronScheduleCreateRejectsInvalidCrontabBeforeRequest(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 80})
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	for _, args := range [][]string{
+		{"cron-schedule", "create", "21", "--title", "Nightly", "--crontab", "0 25 * * *", "--command", "bin/cron"},
+		{"cron-schedule", "update", "81", "--data", `{"crontab":"0 0 * * * *"}`},
+	} {
+		cmd := newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs(args)
+		err := cmd.Execute()
+		if err == nil || !strings.Contains(err.Error(), "invalid crontab") {
+			t.Fatalf("%v: error = %v, want invalid crontab", args, err)
+		}
+	}
+	if requests != 0 {
+		t.Fatalf("sent %d requests for invalid crontabs", requests)
+	}
+
+	cmd := newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+	cmd.SetOut(io.Discard)
+	cmd.SetArgs([]string{"cron-schedule", "update", "81", "--crontab", "0 25 * * *", "--skip-crontab-check"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Fatalf("requests = %d, want 1 with --skip-crontab-check", requests)
+	}
+}
+
+func TestCronScheduleCalendarFlagsOverlappingHeavyJobs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/app-services":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{{"id": 7, "name": "php"}, {"id": 8, "name": "mariadb"}}})
+		case "/v1/app-services/7/cron-schedules":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"id": 1, "name": "drupal-cron", "crontab": "*/5 * * * *"},
+				{"id": 2, "name": "reindex", "crontab": "0 */6 * * *"},
+				{"id": 3, "name": "off", "crontab": "0 * * * *", "disabled": true},
+			})
+		case "/v1/app-services/8/cron-schedules":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 4, "name": "backup", "crontab": "10 0,6,12,18 * * *"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newAppServiceCommand("aps", nil, "Manage app services", instanceFilterFlag)
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"cron-schedule", "list", "--calendar", "--instance", "42", "-o", "json"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	var calendar struct {
+		Schedules []struct {
+			Name  string   `json:"name"`
+			Heavy bool     `json:"heavy"`
+			Runs  []string `json:"runs"`
+		} `json:"schedules"`
+		Overlaps []struct {
+			Jobs []string `json:"jobs"`
+		} `json:"overlaps"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &calendar); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	got := make([]string, 0)
+	for _, schedule := range calendar.Schedules {
+		got = append(got, fmt.Sprintf("%s:%v:%d", schedule.Name, schedule.Heavy, len(schedule.Runs)))
+	}
+	if fmt.Sprint(got) != "[backup:true:4 drupal-cron:false:288 reindex:true:4]" {
+		t.Fatalf("schedules = %v", got)
+	}
+	if len(calendar.Overlaps) != 4 || fmt.Sprint(calendar.Overlaps[0].Jobs) != "[php/reindex mariadb/backup]" {
+		t.Fatalf("overlaps = %+v", calendar.Overlaps)
+	}
+}
+
+func TestCertReportExitsWithNagiosStatus(t *testing.T) {
+	now := time.Now().UTC()
+	certs := []map[string]interface{}{
+		{"id": 1, "host": "ok.example.com", "status": "issued", "expiresAt": now.Add(60 * 24 * time.Hour).Format(time.RFC3339), "appInstanceId": 5},
+		{"id": 2, "host": "soon.example.com", "status": "issued", "expiresAt": now.Add(10 * 24 * time.Hour).Format(time.RFC3339), "appInstanceId": 5},
+		{"id": 3, "host": "failing.example.com", "status": "failed", "expiresAt": now.Add(3 * 24 * time.Hour).Format(time.RFC3339), "appInstanceId": 6},
+		{"id": 4, "host": "pending.example.com", "status": "pending", "appInstanceId": 6},
+	}
+	for _, tc := range []struct {
+		certs    []map[string]interface{}
+		wantCode int
+		wantLine string
+	}{
+		{certs: certs[:1], wantCode: 0, wantLine: "CERT OK - 1 ok"},
+		{certs: certs[:2], wantCode: 1, wantLine: "CERT WARNING - 1 warning, 1 ok"},
+		{certs: certs[:3], wantCode: 2, wantLine: "CERT CRITICAL - 1 critical, 1 warning, 1 ok"},
+		{certs: []map[string]interface{}{certs[0], certs[3]}, wantCode: 3, wantLine: "CERT UNKNOWN - 1 unknown, 1 ok"},
+		{certs: certs, wantCode: 2, wantLine: "CERT CRITICAL - 1 critical, 1 warning, 1 unknown, 1 ok"},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/certs" {
+				encodeEmptyItems(w)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": tc.certs})
+		}))
+		configureTestAPI(t, server.URL+"/v1")
+
+		promPath := filepath.Join(t.TempDir(), "wodby_certs.prom")
+		var out bytes.Buffer
+		cmd := newAppCertCommand("cert", nil, "Manage app certificates", instanceFilterFlag)
+		cmd.SetOut(&out)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs([]string{"report", "--prometheus", promPath})
+		err := cmd.Execute()
+		server.Close()
+
+		code := 0
+		if err != nil {
+			var exitErr interface{ ExitCode() int }
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("error = %v, want an exit code", err)
+			}
+			code = exitErr.ExitCode()
+		}
+		if code != tc.wantCode || !strings.HasPrefix(out.String(), tc.wantLine+"\n") {
+			t.Fatalf("code = %d, output = %q; want %d and %q", code, out.String(), tc.wantCode, tc.wantLine)
+		}
+		metrics, err := os.ReadFile(promPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("wodby_cert_report_status %d\n", tc.wantCode); !strings.Contains(string(metrics), want) {
+			t.Fatalf("metrics missing %q:\n%s", want, metrics)
+		}
+		if tc.wantCode == 2 && !strings.Contains(string(metrics), `wodby_cert_status{id="3",host="failing.example.com",instance_id="6"} 2`) {
+			t.Fatalf("metrics = %s", metrics)
+		}
+		if tc.wantCode == 3 && !strings.Contains(string(metrics), `wodby_cert_status{id="4",host="pending.example.com",instance_id="6"} 3`) {
+			t.Fatalf("metrics = %s", metrics)
+		}
+		if strings.Contains(string(metrics), "report=") {
+			t.Fatalf("status must not be a label, or every status change starts a new series:\n%s", metrics)
+		}
+	}
+}
+
+func TestRouteCheckComparesResponsesWithRouteConfiguration(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer secure.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host == "plain.example.com":
+			http.Redirect(w, r, "https://example.com"+r.URL.Path, http.StatusMovedPermanently)
+		case r.URL.Path == "/old":
+			http.Redirect(w, r, "http://other.example.com/new", http.StatusFound)
+		default:
+			fmt.Fprint(w, "ok")
+		}
+	}))
+	defer plain.Close()
+
+	prober := newRouteProber(5 * time.Second)
+	prober.resolve = func(ctx context.Context, host string) ([]string, error) {
+		if host == "missing.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+	prober.roots = x509.NewCertPool()
+	prober.roots.AddCert(secure.Certificate())
+	transport := prober.client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		target := plain.Listener.Addr().String()
+		if strings.HasSuffix(addr, ":443") {
+			target = secure.Listener.Addr().String()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, target)
+	}
+
+	expiresAt := secure.Certificate().NotAfter.Format(time.RFC3339)
+	routes := []map[string]interface{}{
+		{"id": 1, "host": "example.com", "path": "/", "action": "SERVE", "certId": 7, "certExpiresAt": expiresAt},
+		{"id": 2, "host": "example.com", "path": "/old", "action": "REDIRECT", "certId": 7, "redirectScheme": "https", "redirectHost": "example.com", "redirectPath": "/new", "redirectStatusCode": 301},
+		{"id": 3, "host": "plain.example.com", "path": "/", "action": "REDIRECT", "redirectScheme": "https", "redirectHost": "example.com", "redirectStatusCode": 301},
+		{"id": 4, "host": "example.org", "path": "/", "action": "SERVE", "certId": 8, "certExpiresAt": "2020-01-01T00:00:00Z"},
+		{"id": 5, "host": "missing.example.com", "path": "/", "action": "SERVE"},
+		{"id": 6, "host": "example.com", "path": "/", "disabled": true},
+	}
+	now := time.Now()
+	results := make([]routeCheckResult, 0, len(routes))
+	for _, route := range routes {
+		results = append(results, prober.check(context.Background(), route, now))
+	}
+
+	if got := results[0]; got.row["result"] != "ok" || got.row["response"] != "200" || !strings.HasPrefix(fmt.Sprint(got.row["cert"]), "expires ") {
+		t.Fatalf("route 1 = %v", got.row)
+	}
+	if got := fmt.Sprint(results[1].issues); got != "[redirect status 302, want 301 redirect scheme http, want https redirect host other.example.com, want example.com]" {
+		t.Fatalf("route 2 issues = %s", got)
+	}
+	if got := results[1].row; got["response"] != "302 -> 200" || !strings.HasPrefix(fmt.Sprint(got["cert"]), "expires ") {
+		t.Fatalf("route 2 = %v", got)
+	}
+	if got := results[2]; got.row["result"] != "ok" || got.row["response"] != "301 -> 200" || got.row["location"] != "https://example.com/" {
+		t.Fatalf("route 3 = %v", got.row)
+	}
+	if got := results[3].issues; len(got) != 2 || !strings.HasPrefix(got[0], "certificate: ") || !strings.Contains(got[1], "API reports 2020-01-01T00:00:00Z") {
+		t.Fatalf("route 4 issues = %q", got)
+	}
+	if got := fmt.Sprint(results[4].issues); got != "[resolve missing.example.com: no such host]" {
+		t.Fatalf("route 5 issues = %s", got)
+	}
+	if got := results[5]; got.row["result"] != "skipped" || len(got.issues) != 0 {
+		t.Fatalf("route 6 = %v", got.row)
+	}
+}
+
+func TestRouteCheckWithoutInstanceChecksEveryOrgRoute(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/app-instances":
+			if r.URL.Query().Get("orgId") != "3" {
+				t.Fatalf("orgId = %q, want 3", r.URL.Query().Get("orgId"))
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 5, "name": "dev"}, {"id": 6, "name": "prod"}})
+		case "/v1/app-routes":
+			id := r.URL.Query().Get("appInstanceId")
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": id + "1", "host": id + ".example.com", "path": "/", "disabled": true}})
+		default:
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newAppRouteCommand("route", nil, "Manage app routes", instanceFilterFlag)
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"check", "--org", "3"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(strings.Fields(out.String()), " ")
+	for _, want := range []string{"dev 5.example.com", "prod 6.example.com", "skipped route is disabled"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("output = %s, want %q", got, want)
+		}
+	}
+}
+
+func TestAppInstanceDNSCheckComparesRecordsWithClusterIngress(t *testing.T) {
+	resolver := startDNSStub(t, dnsStubZone{
+		answers: map[string][]dnsStubAnswer{
+			"example.com/A":     {{name: "example.com", rtype: dnsTypeA, ttl: 300, value: "203.0.113.10"}},
+			"www.example.com/A": {{name: "www.example.com", rtype: dnsTypeCNAME, ttl: 3600, value: "app-21.cluster.example.net"}},
+			"old.example.com/A": {{name: "old.example.com", rtype: dnsTypeA, ttl: 86400, value: "198.51.100.7"}},
+			"mix.example.com/A": {
+				{name: "mix.example.com", rtype: dnsTypeA, ttl: 600, value: "203.0.113.10"},
+				{name: "mix.example.com", rtype: dnsTypeA, ttl: 600, value: "198.51.100.7"},
+			},
+		},
+		rcodes: map[string]int{"gone.example.com": dnsRcodeNameError},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/app-instances/21":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 21, "clusterId": 3})
+		case "/v1/clusters/3":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 3, "ips": []string{"203.0.113.10"}, "domain": "cluster.example.net"})
+		case "/v1/app-routes":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+				{"id": 1, "host": "example.com", "path": "/"},
+				{"id": 2, "host": "www.example.com", "path": "/"},
+				{"id": 3, "host": "old.example.com", "path": "/"},
+				{"id": 4, "host": "mix.example.com", "path": "/"},
+				{"id": 5, "host": "gone.example.com", "path": "/"},
+				{"id": 6, "host": "example.com", "path": "/docs"},
+				{"id": 7, "host": "disabled.example.com", "path": "/", "disabled": true},
+			}})
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newAppInstanceCommand("instance", "Manage app instances")
+	cmd.SetOut(&out)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"dns-check", "21", "--resolver", resolver, "-o", "json"})
+	err := cmd.Execute()
+	if err == nil || err.Error() != "3 of 5 domains do not point to Wodby 2 yet" {
+		t.Fatalf("err = %v", err)
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatalf("output = %s: %v", out.String(), err)
+	}
+	got := make([]string, 0, len(rows))
+	for _, row := range rows {
+		got = append(got, fmt.Sprint(row["domain"], " ", row["status"], " ", row["ttl"]))
+	}
+	if want := "[example.com wodby 5m gone.example.com missing <nil> mix.example.com partial 10m old.example.com elsewhere 1d www.example.com wodby 1h]"; fmt.Sprint(got) != want {
+		t.Fatalf("rows = %v\nwant %s", got, want)
+	}
+	if got := rows[2]["message"]; got != "1 address outside the cluster: 198.51.100.7" {
+		t.Fatalf("mix message = %v", got)
+	}
+}
+
+func TestInventoryFlattensOrgResourcesAndCachesResponses(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		items := func(rows ...map[string]interface{}) {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": rows})
+		}
+		switch r.URL.Path {
+		case "/v1/clusters":
+			items(map[string]interface{}{"id": 3, "title": "Production"})
+		case "/v1/apps":
+			items(map[string]interface{}{"id": 4, "title": "Shop"})
+		case "/v1/envs":
+			items(map[string]interface{}{"id": 5, "title": "prod"})
+		case "/v1/app-instances":
+			if r.URL.Query().Get("orgId") != "1" || r.URL.Query().Get("clusterApp") != "false" {
+				t.Errorf("instance query = %s", r.URL.RawQuery)
+			}
+			items(map[string]interface{}{"id": 21, "title": "Shop Live", "appId": 4, "envId": 5, "clusterId": 3, "stackRevId": 9, "outdated": false})
+		case "/v1/databases":
+			items(map[string]interface{}{"id": 7, "title": "shop-db", "kind": "mariadb", "version": "11.4", "envId": 5, "eol": false})
+		case "/v1/stack-revisions/9":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 9, "number": 12, "version": "1.4.0"})
+		case "/v1/app-services":
+			items(
+				map[string]interface{}{"id": 31, "name": "php", "type": "php", "version": "8.3", "replicas": 2, "outdated": true},
+				map[string]interface{}{"id": 32, "name": "nginx", "type": "nginx", "version": "1.27", "replicas": 1, "containers": []map[string]interface{}{{"requestCPU": "100m", "limitMem": "256Mi"}}},
+			)
+		case "/v1/app-services/31/containers":
+			items(map[string]interface{}{"requestCPU": "250m", "limitCPU": "1", "requestMem": "512Mi", "limitMem": "1Gi"})
+		case "/v1/app-routes":
+			items(map[string]interface{}{"id": 1, "host": "www.shop.example"}, map[string]interface{}{"id": 2, "host": "shop.example"})
+		case "/v1/app-deployments":
+			items(
+				map[string]interface{}{"id": 1, "status": "succeeded", "endedAt": "2026-10-01T10:00:00Z"},
+				map[string]interface{}{"id": 2, "status": "failed", "endedAt": "2026-10-02T10:00:00Z"},
+			)
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		cmd := newInventoryCommand()
+		cmd.SetOut(&out)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs(append([]string{"--org", "1"}, args...))
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	want := strings.Join([]string{
+		"kind,app,instance,env,cluster,stack,stackRevision,stackVersion,service,type,version,replicas,cpu,memory,domains,lastDeployedAt,outdated,eol",
+		"database,,,prod,,,,,shop-db,mariadb,11.4,,,,,,false,false",
+		`service,Shop,Shop Live,prod,Production,,12,1.4.0,nginx,nginx,1.27,1,100m/-,-/256Mi,"shop.example, www.shop.example",2026-10-01T10:00:00Z,false,`,
+		`service,Shop,Shop Live,prod,Production,,12,1.4.0,php,php,8.3,2,250m/1,512Mi/1Gi,"shop.example, www.shop.example",2026-10-01T10:00:00Z,true,`,
+	}, "\n") + "\n"
+	if got := run("-o", "csv"); got != want {
+		t.Fatalf("csv =\n%s\nwant\n%s", got, want)
+	}
+	if got := requests["/v1/app-services/31/containers"]; got != 1 {
+		t.Fatalf("container requests = %d", got)
+	}
+
+	yamlOutput := run("-o", "yaml")
+	if !strings.Contains(yamlOutput, "  cluster: Production\n") || !strings.Contains(yamlOutput, "outdated: true\n") {
+		t.Fatalf("yaml = %s", yamlOutput)
+	}
+	if got := requests["/v1/app-instances"]; got != 1 {
+		t.Fatalf("cached run requested instances %d times", got)
+	}
+	run("-o", "json", "--refresh")
+	if got := requests["/v1/app-instances"]; got != 2 {
+		t.Fatalf("refresh requested instances %d times", got)
+	}
+}
+
+func TestReportOutdatedBuildsPrioritizedUpgradeBacklog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items := func(rows ...map[string]interface{}) {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": rows})
+		}
+		switch r.URL.Path {
+		case "/v1/app-instances":
+			if r.URL.Query().Get("orgId") != "1" || r.URL.Query().Get("clusterApp") != "false" {
+				t.Errorf("query = %s", r.URL.RawQuery)
+			}
+			items(
+				map[string]interface{}{"id": 21, "title": "Shop Live", "outdated": true, "stack": map[string]interface{}{"id": 2, "title": "Drupal"}},
+				map[string]interface{}{"id": 22, "title": "Blog Live", "outdated": false, "stack": map[string]interface{}{"id": 3, "title": "WordPress"}},
+				map[string]interface{}{"id": 23, "title": "Docs", "outdated": false, "stack": map[string]interface{}{"id": 4, "title": "Static"}},
+			)
+		case "/v1/app-services":
+			switch r.URL.Query().Get("appInstanceId") {
+			case "21":
+				items(
+					map[string]interface{}{"id": 1, "name": "php", "version": "8.1", "eol": true},
+					map[string]interface{}{"id": 2, "name": "nginx", "version": "1.25", "outdated": false},
+					map[string]interface{}{"id": 3, "name": "redis", "version": "7", "outdated": false},
+				)
+			case "22":
+				items(
+					map[string]interface{}{"id": 4, "name": "php", "version": "8.1", "outdated": true, "eol": true},
+					map[string]interface{}{"id": 5, "name": "mariadb", "version": "10.6", "outdated": true},
+				)
+			default:
+				items(map[string]interface{}{"id": 6, "name": "nginx", "version": "1.27", "outdated": false})
+			}
+		case "/v1/app-instance-stack-upgrade-changelogs/21":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"previousStackVersion": "1.2.0",
+				"stackVersion":         "1.3.0",
+				"serviceChanges": []map[string]interface{}{
+					{"name": "php", "previousVersion": "8.1", "version": "8.3", "entries": []string{"PHP 8.3 released"}},
+					{"name": "nginx", "previousVersion": "1.25", "version": "1.27", "entries": []map[string]interface{}{{"message": "nginx 1.27"}}},
+				},
+			})
+		case "/v1/stack-service-update-changelogs/3":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"name": "mariadb", "previousVersion": "10.6", "version": "11.4", "entries": []map[string]interface{}{{"title": "MariaDB 11.4 LTS"}}},
+				{"name": "php", "previousVersion": "8.1", "version": "8.3", "entries": []string{"PHP 8.3"}},
+			})
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	var out bytes.Buffer
+	cmd := newReportCommand()
+	cmd.SetOut(&out)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"outdated", "--org", "1"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	_, body, _ := strings.Cut(out.String(), "\n\nGenerated ")
+	_, body, _ = strings.Cut(body, "\n")
+	want := `
+## 1. php 8.1 -> 8.3 (P1, EOL)
+
+2 App instances:
+
+- Blog Live (ID 22)
+- Shop Live (ID 21)
+
+Changelog:
+
+- PHP 8.3 released
+- PHP 8.3
+
+## 2. mariadb 10.6 -> 11.4 (P2)
+
+1 App instance:
+
+- Blog Live (ID 22)
+
+Changelog:
+
+- MariaDB 11.4 LTS
+
+## 3. nginx 1.25 -> 1.27 (P3)
+
+1 App instance:
+
+- Shop Live (ID 21)
+
+Changelog:
+
+- nginx 1.27
+
+## 4. Stack Drupal 1.2.0 -> 1.3.0 (P3)
+
+1 App instance:
+
+- Shop Live (ID 21)
+`
+	if body != want {
+		t.Fatalf("markdown =\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), ": 4 upgrades across 2 app instances.\n") {
+		t.Fatalf("summary = %s", out.String())
+	}
+}
+
+func TestInstanceUpgradeStackUpgradesSelectedInstancesInBulk(t *testing.T) {
+	var mu sync.Mutex
+	var upgraded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items := func(rows ...map[string]interface{}) {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": rows})
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/envs":
+			items(map[string]interface{}{"id": 5, "title": "QA"}, map[string]interface{}{"id": 6, "title": "Production"})
+		case "GET /v1/app-instances":
+			if r.URL.Query().Get("orgId") != "1" || r.URL.Query().Get("clusterApp") != "false" {
+				t.Errorf("query = %s", r.URL.RawQuery)
+			}
+			items(
+				map[string]interface{}{"id": 21, "name": "dev-shop", "title": "Dev Shop", "envId": 5},
+				map[string]interface{}{"id": 22, "name": "dev-blog", "title": "Dev Blog", "envId": 5},
+				map[string]interface{}{"id": 23, "name": "dev-docs", "title": "Dev Docs", "envId": 5},
+				map[string]interface{}{"id": 24, "name": "dev-api", "title": "Dev API", "envId": 6},
+				map[string]interface{}{"id": 25, "name": "live-shop", "title": "Live Shop", "envId": 5},
+			)
+		case "GET /v1/app-instance-stack-upgrade-changelogs/21", "GET /v1/app-instance-stack-upgrade-changelogs/22":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"previousStackVersion": "1.2.0", "previousStackRevNumber": 3,
+				"stackVersion": "1.3.0", "stackRevNumber": 4,
+				"serviceChanges": []map[string]interface{}{{"name": "php", "previousVersion": "8.1", "version": "8.3", "entries": []interface{}{"PHP 8.3 released", map[string]interface{}{"title": "JIT enabled"}}}},
+			})
+		case "GET /v1/app-instance-stack-upgrade-changelogs/23":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"previousStackRevNumber": 4, "stackRevNumber": 4})
+		case "POST /v1/app-instances/21/actions/upgrade-stack", "POST /v1/app-instances/22/actions/upgrade-stack":
+			mu.Lock()
+			upgraded = append(upgraded, r.URL.Path)
+			mu.Unlock()
+			if strings.Contains(r.URL.Path, "/22/") {
+				http.Error(w, `{"message":"stack revision is not available"}`, http.StatusUnprocessableEntity)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "taskId": 41})
+		case "GET /v1/tasks/41":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 41, "status": "done"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		upgraded int
+		want     []string
+	}{
+		{
+			name:     "all",
+			args:     []string{"--concurrency", "2", "--wait"},
+			upgraded: 2,
+			want:     []string{"22  Dev Blog  1.2.0 (rev 3)  1.3.0 (rev 4)  failed", "21  Dev Shop  1.2.0 (rev 3)  1.3.0 (rev 4)  succeeded  41"},
+		},
+		{
+			name:     "stop on failure",
+			args:     []string{"--concurrency", "1", "--stop-on-failure"},
+			upgraded: 1,
+			want:     []string{"21  Dev Shop  1.2.0 (rev 3)  1.3.0 (rev 4)  skipped"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upgraded = nil
+			var out, progress bytes.Buffer
+			cmd := newAppInstanceCommand("instance", "Manage app instances")
+			cmd.SetOut(&out)
+			cmd.SetErr(&progress)
+			cmd.SetArgs(append([]string{"upgrade-stack", "--org", "1", "--name-glob", "dev-*", "--env", "qa", "-y"}, tc.args...))
+			err := cmd.Execute()
+			if err == nil || err.Error() != "1 of 2 app instances failed to upgrade" {
+				t.Fatalf("err = %v", err)
+			}
+			if len(upgraded) != tc.upgraded {
+				t.Fatalf("upgraded = %v", upgraded)
+			}
+			for _, want := range append([]string{
+				"php 8.1 -> 8.3 (2 instances)\n    - PHP 8.3 released\n    - JIT enabled\n",
+				"Skipping 1 instance already up to date",
+			}, tc.want...) {
+				if !strings.Contains(out.String(), want) {
+					t.Fatalf("output missing %q:\n%s", want, out.String())
+				}
+			}
+			if !strings.Contains(progress.String(), "| Dev Blog: failed (") || strings.Contains(out.String(), "Usage:") {
+				t.Fatalf("progress:\n%s\noutput:\n%s", progress.String(), out.String())
+			}
+		})
+	}
+}
+
+func TestAppInstanceUpgradeStackRejectsBulkOnlyFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"21", "--yes"}, want: "--yes only applies to bulk upgrades with --all, --app, --env or --name-glob"},
+		{args: []string{"21", "--concurrency", "2"}, want: "--concurrency only applies to bulk upgrades with --all, --app, --env or --name-glob"},
+		{args: []string{"21", "--stop-on-failure"}, want: "--stop-on-failure only applies to bulk upgrades with --all, --app, --env or --name-glob"},
+		{args: []string{"--all", "-o", "json"}, want: "--yes is required with -o json because the preview is not printed"},
+	} {
+		cmd := newAppInstanceCommand("instance", "Manage app instances")
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs(append([]string{"upgrade-stack"}, tc.args...))
+		if err := cmd.Execute(); err == nil || err.Error() != tc.want {
+			t.Fatalf("%v: err = %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestCapacitySumsResourcesPerInstanceAndCluster(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items := func(rows ...map[string]interface{}) {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": rows})
+		}
+		switch r.URL.Path {
+		case "/v1/app-instances":
+			items(
+				map[string]interface{}{"id": 21, "title": "Shop", "clusterId": 3},
+				map[string]interface{}{"id": 22, "title": "Blog", "clusterId": 3},
+				map[string]interface{}{"id": 23, "title": "Other", "clusterId": 4},
+			)
+		case "/v1/app-services":
+			switch r.URL.Query().Get("appInstanceId") {
+			case "21":
+				items(
+					map[string]interface{}{"id": 1, "name": "php", "replicas": 2, "containers": []map[string]interface{}{{"requestCPU": 250, "limitCPU": 500, "requestMem": 256, "limitMem": 512}}},
+					map[string]interface{}{"id": 2, "name": "mariadb", "replicas": 1, "volumes": []map[string]interface{}{{"name": "data", "size": 20}}},
+					map[string]interface{}{"id": 3, "name": "redis", "disabled": true},
+				)
+			case "22":
+				items(map[string]interface{}{"id": 4, "name": "nginx", "containers": []map[string]interface{}{{"requestCPU": 100, "limitCPU": 200, "requestMem": 128, "limitMem": 256}}})
+			default:
+				t.Errorf("unexpected services query %s", r.URL.RawQuery)
+				encodeEmptyItems(w)
+			}
+		case "/v1/app-services/1/volumes":
+			items(map[string]interface{}{"name": "files", "size": 10}, map[string]interface{}{"name": "shared", "size": 5, "fromVolumeId": 9})
+		case "/v1/app-services/2/containers":
+			items(map[string]interface{}{"requestCPU": 500, "requestMem": 1024})
+		case "/v1/app-services/4/volumes":
+			encodeEmptyItems(w)
+		case "/v1/clusters/3":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 3, "title": "Main", "nodes": []map[string]interface{}{
+				{"allocatableCPU": 2000, "allocatableMem": 4096},
+				{"allocatableCPU": 2000, "allocatableMem": 4096},
+			}})
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			encodeEmptyItems(w)
+		}
+	}))
+	defer server.Close()
+	configureTestAPI(t, server.URL+"/v1")
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		cmd := newCapacityCommand()
+		cmd.SetOut(&out)
+		cmd.SetArgs(append([]string{"--org", "1", "--cluster", "3"}, args...))
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	var report map[string][]map[string]interface{}
+	if err := json.Unmarshal([]byte(run("-o", "json")), &report); err != nil {
+		t.Fatal(err)
+	}
+	cluster := report["clusters"][0]
+	if got := fmt.Sprintln(len(report["clusters"]), cluster["cluster"], cluster["instances"], cluster["services"], cluster["cpu"], cluster["memory"], cluster["storage"], cluster["cpuCapacity"], cluster["cpuFree"], cluster["memoryCapacity"], cluster["memoryFree"]); got != "1 Main 2 3 1.1/1.2 1.6Gi/1.3Gi 30Gi 4 2.9 (73%) 8Gi 6.4Gi (80%)\n" {
+		t.Fatalf("cluster = %q", got)
+	}
+	biggest := report["biggestInstances"]
+	if got := fmt.Sprintln(len(biggest), biggest[0]["instance"], biggest[0]["cpu"], biggest[0]["memory"], biggest[0]["storage"], biggest[1]["instance"]); got != "2 Shop 1/1 1.5Gi/1Gi 30Gi Blog\n" {
+		t.Fatalf("biggest = %q", got)
+	}
+	unlimited := report["servicesWithoutLimits"]
+	if got := fmt.Sprintln(len(unlimited), unlimited[0]["instance"], unlimited[0]["service"], unlimited[0]["missingLimits"]); got != "1 Shop mariadb cpu, memory\n" {
+		t.Fatalf("unlimited = %q", got)
+	}
+
+	table := run("--top", "1")
+	for _, want := range []string{"Clusters:\n", "\n\nBiggest app instances:\n", "\n\nServices without limits:\n", "cpu free", "2.9 (73%)", "cpu, memory"} {
+		if !strings.Contains(table, want) {
+			t.Fatalf("output missing %q:\n%s", want, table)
+		}
+	}
+	if strings.Contains(table, "Blog  Main") {
+		t.Fatalf("--top 1 listed more than one instance:\n%s", table)
+	}
+}
+
 func executeInstanceListQuery(t *testing.T, args ...string) url.Values {
 	t.Helper()
 
@@ -0,0 +1,235 @@
+package ops
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cronSchedule is a parsed five-field crontab expression as run by
+// Kubernetes CronJobs: minute, hour, day of month, month and day of week.
+// Day of month and day of week are combined with OR when both are
+// restricted, like Vixie cron.
+type cronSchedule struct {
+	expression string
+	minute     uint64
+	hour       uint64
+	dom        uint64
+	month      uint64
+	dow        uint64
+	domStar    bool
+	dowStar    bool
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronMinuteField = cronField{name: "minute", min: 0, max: 59}
+	cronHourField   = cronField{name: "hour", min: 0, max: 23}
+	cronDomField    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonthField  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDowField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSearchYears bounds the search for the next run; eight years always
+// include a leap day, so an expression with no run in that span never runs.
+const cronSearchYears = 8
+
+func parseCronExpression(expression string) (*cronSchedule, error) {
+	trimmed := strings.TrimSpace(expression)
+	if trimmed == "" {
+		return nil, errors.New("crontab expression is empty")
+	}
+	if strings.HasPrefix(trimmed, "@") {
+		macro, ok := cronMacros[strings.ToLower(trimmed)]
+		if !ok {
+			return nil, errors.Errorf("unsupported crontab macro %q", trimmed)
+		}
+		trimmed = macro
+	}
+	fields := strings.Fields(trimmed)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "TZ=") || strings.HasPrefix(fields[0], "CRON_TZ=")) {
+		return nil, errors.Errorf("crontab expression %q sets a time zone; Kubernetes does not accept TZ in the schedule", expression)
+	}
+	switch {
+	case len(fields) == 6:
+		return nil, errors.Errorf("crontab expression %q has 6 fields; seconds are not supported, use minute hour day-of-month month day-of-week", expression)
+	case len(fields) != 5:
+		return nil, errors.Errorf("crontab expression %q has %d fields, want 5: minute hour day-of-month month day-of-week", expression, len(fields))
+	}
+
+	schedule := &cronSchedule{expression: expression}
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], cronMinuteField); err != nil {
+		return nil, err
+	}
+	if schedule.hour, err = parseCronField(fields[1], cronHourField); err != nil {
+		return nil, err
+	}
+	if schedule.dom, err = parseCronField(fields[2], cronDomField); err != nil {
+		return nil, err
+	}
+	if schedule.month, err = parseCronField(fields[3], cronMonthField); err != nil {
+		return nil, err
+	}
+	if schedule.dow, err = parseCronField(fields[4], cronDowField); err != nil {
+		return nil, err
+	}
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domStar = strings.HasPrefix(fields[2], "*") || fields[2] == "?"
+	schedule.dowStar = strings.HasPrefix(fields[4], "*") || fields[4] == "?"
+	return schedule, nil
+}
+
+func parseCronField(value string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		if part == "" {
+			return 0, errors.Errorf("%s field %q has an empty list item", field.name, value)
+		}
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepPart)
+			if err != nil || parsed < 1 {
+				return 0, errors.Errorf("%s field %q has an invalid step %q", field.name, value, stepPart)
+			}
+			step = parsed
+		}
+
+		var low, high int
+		switch {
+		case rangePart == "*" || (rangePart == "?" && (field.name == cronDomField.name || field.name == cronDowField.name)):
+			low, high = field.min, field.max
+			if field.name == cronDowField.name {
+				high = 6
+			}
+		case strings.Contains(rangePart, "-"):
+			from, to, _ := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = parseCronValue(from, value, field); err != nil {
+				return 0, err
+			}
+			if high, err = parseCronValue(to, value, field); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, errors.Errorf("%s field %q has a descending range %s", field.name, value, rangePart)
+			}
+		default:
+			var err error
+			if low, err = parseCronValue(rangePart, value, field); err != nil {
+				return 0, err
+			}
+			high = low
+			if hasStep {
+				high = field.max
+			}
+		}
+		for i := low; i <= high; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, fieldValue string, field cronField) (int, error) {
+	if number, ok := field.names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("%s field %q has an invalid value %q", field.name, fieldValue, value)
+	}
+	if number < field.min || number > field.max {
+		return 0, errors.Errorf("%s field %q has value %d out of range %d-%d", field.name, fieldValue, number, field.min, field.max)
+	}
+	return number, nil
+}
+
+// validateCrontab parses an expression and checks that it runs at all, so
+// "0 0 30 2 *" is rejected like a syntax error.
+func validateCrontab(expression string) error {
+	schedule, err := parseCronExpression(expression)
+	if err != nil {
+		return err
+	}
+	if schedule.next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return errors.Errorf("crontab expression %q never runs", expression)
+	}
+	return nil
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first run strictly after t in t's location, or the zero
+// time when the schedule has no run within cronSearchYears.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// runs returns up to count runs after from, stopping at until when it is set.
+func (s *cronSchedule) runs(from time.Time, until time.Time, count int) []time.Time {
+	runs := make([]time.Time, 0)
+	for t := from; count <= 0 || len(runs) < count; {
+		t = s.next(t)
+		if t.IsZero() || (!until.IsZero() && !t.Before(until)) {
+			break
+		}
+		runs = append(runs, t)
+	}
+	return runs
+}
@@ -0,0 +1,361 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+const skipCrontabCheckFlag = "skip-crontab-check"
+
+// cronHeavyMaxWeekRuns is the most runs a job may have in a week to count as
+// heavy without a --heavy pattern: one run an hour. Jobs that run more often
+// are usually quick checks or queue workers.
+const cronHeavyMaxWeekRuns = 7 * 24
+
+var cronScheduleNextColumns = []string{"run", "in"}
+
+// calendarSchedule is one cron schedule placed on the calendar timeline.
+type calendarSchedule struct {
+	service string
+	name    string
+	crontab string
+	heavy   bool
+	runs    []time.Time
+}
+
+// withCrontabValidation parses the crontab of a create or update request,
+// from --crontab or the JSON body, before anything is sent to the API.
+func withCrontabValidation(cmd *cobra.Command) *cobra.Command {
+	cmd.Flags().Bool(skipCrontabCheckFlag, false, "Send the crontab expression without local validation")
+	cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if skip, _ := cmd.Flags().GetBool(skipCrontabCheckFlag); skip {
+			return nil
+		}
+		data, _ := cmd.Flags().GetString("data")
+		file, _ := cmd.Flags().GetString("file")
+		body, hasBody, err := readBody(bodyOptions{data: data, file: file})
+		if err != nil {
+			return err
+		}
+		crontab, present := "", false
+		if hasBody {
+			if values, ok := body.(map[string]interface{}); ok {
+				_, present = values["crontab"]
+				crontab = scalarString(values["crontab"])
+			}
+		} else if cmd.Flags().Changed("crontab") {
+			crontab, _ = cmd.Flags().GetString("crontab")
+			present = true
+		}
+		if !present {
+			return nil
+		}
+		if err := validateCrontab(crontab); err != nil {
+			return errors.Wrapf(err, "invalid crontab; pass --%s to send it anyway", skipCrontabCheckFlag)
+		}
+		return nil
+	}
+	return cmd
+}
+
+func newAppServiceCronScheduleNextCommand(out outputOptions) *cobra.Command {
+	var count int
+	var tz string
+	cmd := &cobra.Command{
+		Use:   "next ID",
+		Short: "Preview the next run times of an app service cron schedule",
+		Long: "Preview the next run times of an app service cron schedule.\n\n" +
+			"Kubernetes evaluates schedules in the time zone of the cluster control plane, which is usually UTC; --tz evaluates and shows the runs in another zone.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if count < 1 {
+				return errors.New("--count must be at least 1")
+			}
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				return errors.Wrap(err, "invalid --tz")
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			var result interface{}
+			if err := client.Get(cmd.Context(), escapedPath("/app-service-cron-schedules/%s", args[0]), nil, &result); err != nil {
+				return err
+			}
+			crontab := firstScalarPath(cloneFirstRow(normalizeItem(result)), "crontab")
+			schedule, err := parseCronExpression(crontab)
+			if err != nil {
+				return err
+			}
+			now := time.Now().In(loc)
+			runs := schedule.runs(now, time.Time{}, count)
+			if outputFormat(cmd, out) == outputJSON {
+				values := make([]string, 0, len(runs))
+				for _, run := range runs {
+					values = append(values, run.Format(time.RFC3339))
+				}
+				return printJSON(cmd, map[string]interface{}{"id": args[0], "crontab": crontab, "timeZone": loc.String(), "runs": values})
+			}
+			rows := make([]map[string]interface{}, 0, len(runs))
+			for _, run := range runs {
+				rows = append(rows, map[string]interface{}{
+					"run": run.Format("Mon 2006-01-02 15:04 MST"),
+					"in":  formatDisplayDuration(run.Sub(now)),
+				})
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s (%s)\n\n", crontab, loc)
+			return printResult(cmd, out, rows, cronScheduleNextColumns)
+		},
+	}
+	cmd.Flags().IntVar(&count, "count", 10, "Number of runs to show")
+	cmd.Flags().StringVar(&tz, "tz", "UTC", "IANA time zone to evaluate the schedule in")
+	return cmd
+}
+
+func newAppServiceCronScheduleListCommand(out outputOptions) *cobra.Command {
+	var calendar bool
+	var instanceID, tz string
+	var heavy []string
+	var hours int
+	var window time.Duration
+	cmd := &cobra.Command{
+		Use:   "list [SERVICE_ID]",
+		Short: "List app service cron schedules",
+		Long: "List app service cron schedules.\n\n" +
+			"--calendar shows the runs of the next --hours on an hourly timeline, for one service or, with --instance, for every service of an app instance. " +
+			"Runs of heavy jobs that start within --window of each other are reported as overlaps. " +
+			"Jobs are heavy when they run at most once an hour, or when their name matches a --heavy pattern.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !calendar {
+				if len(args) != 1 {
+					return errors.New("SERVICE_ID is required")
+				}
+				client, err := newRESTClient()
+				if err != nil {
+					return err
+				}
+				var result interface{}
+				if err := client.Get(cmd.Context(), escapedPath("/app-services/%s/cron-schedules", args[0]), nil, &result); err != nil {
+					return err
+				}
+				return printClientResult(cmd, client, out, result, appServiceCronScheduleColumns)
+			}
+			if (len(args) == 1) == (instanceID != "") {
+				return errors.New("pass either SERVICE_ID or --instance")
+			}
+			if hours < 1 {
+				return errors.New("--hours must be at least 1")
+			}
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				return errors.Wrap(err, "invalid --tz")
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			from := time.Now().In(loc).Truncate(time.Hour)
+			until := from.Add(time.Duration(hours) * time.Hour)
+			schedules, err := collectCalendarSchedules(cmd.Context(), client, args, instanceID, heavy, from, until)
+			if err != nil {
+				return err
+			}
+			overlaps := calendarOverlaps(schedules, window)
+			if outputFormat(cmd, out) == outputJSON {
+				return printJSON(cmd, calendarJSON(schedules, overlaps, from, until))
+			}
+			printCronCalendar(cmd, schedules, overlaps, from, hours)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&calendar, "calendar", false, "Show runs on a timeline")
+	cmd.Flags().StringVarP(&instanceID, "instance", "i", "", "App instance ID; shows the schedules of all its services with --calendar")
+	cmd.Flags().IntVar(&hours, "hours", 24, "Hours shown by --calendar")
+	cmd.Flags().StringVar(&tz, "tz", "UTC", "IANA time zone to evaluate the schedules in")
+	cmd.Flags().StringSliceVar(&heavy, "heavy", nil, "Cron schedule name patterns to treat as heavy, such as backup-*")
+	cmd.Flags().DurationVar(&window, "window", 15*time.Minute, "Heavy runs that start within this window overlap")
+	return cmd
+}
+
+func collectCalendarSchedules(ctx context.Context, client *rest.Client, args []string, instanceID string, heavy []string, from time.Time, until time.Time) ([]calendarSchedule, error) {
+	var services []map[string]interface{}
+	if instanceID != "" {
+		var err error
+		if services, err = fetchRows(ctx, client, "/app-services", url.Values{"appInstanceId": []string{instanceID}}); err != nil {
+			return nil, err
+		}
+	} else {
+		services = []map[string]interface{}{{"id": args[0], "name": args[0]}}
+	}
+
+	schedules := make([]calendarSchedule, 0)
+	for _, service := range services {
+		serviceID := firstScalarPath(service, "id")
+		rows, err := fetchRows(ctx, client, escapedPath("/app-services/%s/cron-schedules", serviceID), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if formatYesNo(row["disabled"]) == "yes" {
+				continue
+			}
+			item := calendarSchedule{
+				service: firstScalarPath(service, "name"),
+				name:    firstScalarPath(row, "name", "title", "id"),
+				crontab: firstScalarPath(row, "crontab"),
+			}
+			schedule, err := parseCronExpression(item.crontab)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cron schedule %s of service %s", item.name, item.service)
+			}
+			item.runs = schedule.runs(from.Add(-time.Minute), until, 0)
+			item.heavy = matchesAnyPattern(item.name, heavy)
+			if len(heavy) == 0 {
+				weekRuns := schedule.runs(from.Add(-time.Minute), from.Add(7*24*time.Hour), cronHeavyMaxWeekRuns+1)
+				item.heavy = len(weekRuns) <= cronHeavyMaxWeekRuns
+			}
+			schedules = append(schedules, item)
+		}
+	}
+	sort.SliceStable(schedules, func(i, j int) bool {
+		if schedules[i].service != schedules[j].service {
+			return schedules[i].service < schedules[j].service
+		}
+		return schedules[i].name < schedules[j].name
+	})
+	return schedules, nil
+}
+
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type calendarOverlap struct {
+	at   time.Time
+	jobs []string
+}
+
+// calendarOverlaps groups runs of heavy schedules that start within window
+// of the first run in the group.
+func calendarOverlaps(schedules []calendarSchedule, window time.Duration) []calendarOverlap {
+	type heavyRun struct {
+		at  time.Time
+		job string
+	}
+	runs := make([]heavyRun, 0)
+	for _, schedule := range schedules {
+		if !schedule.heavy {
+			continue
+		}
+		for _, run := range schedule.runs {
+			runs = append(runs, heavyRun{at: run, job: schedule.service + "/" + schedule.name})
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].at.Before(runs[j].at) })
+
+	overlaps := make([]calendarOverlap, 0)
+	for i := 0; i < len(runs); {
+		group := calendarOverlap{at: runs[i].at, jobs: []string{runs[i].job}}
+		seen := map[string]bool{runs[i].job: true}
+		j := i + 1
+		for ; j < len(runs) && runs[j].at.Sub(runs[i].at) <= window; j++ {
+			if !seen[runs[j].job] {
+				seen[runs[j].job] = true
+				group.jobs = append(group.jobs, runs[j].job)
+			}
+		}
+		if len(group.jobs) > 1 {
+			overlaps = append(overlaps, group)
+		}
+		i = j
+	}
+	return overlaps
+}
+
+func printCronCalendar(cmd *cobra.Command, schedules []calendarSchedule, overlaps []calendarOverlap, from time.Time, hours int) {
+	fmt.Fprintf(cmd.OutOrStdout(), "Cron runs from %s, one column per hour; digits count runs, + means more than 9, * marks heavy jobs\n\n", from.Format("2006-01-02 15:04 MST"))
+	var header strings.Builder
+	for hour := 0; hour < hours; hour += 3 {
+		fmt.Fprintf(&header, "%-3s", from.Add(time.Duration(hour)*time.Hour).Format("15"))
+	}
+	writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "job\tcrontab\truns\t%s\n", strings.TrimRight(header.String()[:min(header.Len(), hours)], " "))
+	for _, schedule := range schedules {
+		counts := make([]int, hours)
+		for _, run := range schedule.runs {
+			if hour := int(run.Sub(from) / time.Hour); hour >= 0 && hour < hours {
+				counts[hour]++
+			}
+		}
+		var strip strings.Builder
+		for _, count := range counts {
+			switch {
+			case count == 0:
+				strip.WriteByte('.')
+			case count > 9:
+				strip.WriteByte('+')
+			default:
+				strip.WriteByte(byte('0' + count))
+			}
+		}
+		job := schedule.service + "/" + schedule.name
+		if schedule.heavy {
+			job += " *"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\n", job, schedule.crontab, len(schedule.runs), strip.String())
+	}
+	_ = writer.Flush()
+
+	if len(overlaps) == 0 {
+		fmt.Fprintln(cmd.OutOrStdout(), "\nNo overlapping heavy jobs")
+		return
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), "\nOverlapping heavy jobs:")
+	for _, overlap := range overlaps {
+		fmt.Fprintf(cmd.OutOrStdout(), "  %s  %s\n", overlap.at.Format("Mon 15:04"), strings.Join(overlap.jobs, ", "))
+	}
+}
+
+func calendarJSON(schedules []calendarSchedule, overlaps []calendarOverlap, from time.Time, until time.Time) map[string]interface{} {
+	items := make([]map[string]interface{}, 0, len(schedules))
+	for _, schedule := range schedules {
+		runs := make([]string, 0, len(schedule.runs))
+		for _, run := range schedule.runs {
+			runs = append(runs, run.Format(time.RFC3339))
+		}
+		items = append(items, map[string]interface{}{
+			"service": schedule.service,
+			"name":    schedule.name,
+			"crontab": schedule.crontab,
+			"heavy":   schedule.heavy,
+			"runs":    runs,
+		})
+	}
+	overlapItems := make([]map[string]interface{}, 0, len(overlaps))
+	for _, overlap := range overlaps {
+		overlapItems = append(overlapItems, map[string]interface{}{"at": overlap.at.Format(time.RFC3339), "jobs": overlap.jobs})
+	}
+	return map[string]interface{}{
+		"from":      from.Format(time.RFC3339),
+		"to":        until.Format(time.RFC3339),
+		"schedules": items,
+		"overlaps":  overlapItems,
+	}
+}
@@ -0,0 +1,61 @@
+package ops
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronExpressionNextRuns(t *testing.T) {
+	from := time.Date(2026, 10, 19, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expression string
+		want       []string
+	}{
+		{"*/15 * * * *", []string{"2026-10-19T10:15:00Z", "2026-10-19T10:30:00Z", "2026-10-19T10:45:00Z"}},
+		{"30 2 * * mon-fri", []string{"2026-10-20T02:30:00Z", "2026-10-21T02:30:00Z", "2026-10-22T02:30:00Z"}},
+		{"0 0 1,15 * *", []string{"2026-11-01T00:00:00Z", "2026-11-15T00:00:00Z", "2026-12-01T00:00:00Z"}},
+		{"0 12 13 * 5", []string{"2026-10-23T12:00:00Z", "2026-10-30T12:00:00Z", "2026-11-06T12:00:00Z"}},
+		{"0 0 * * 7", []string{"2026-10-25T00:00:00Z", "2026-11-01T00:00:00Z", "2026-11-08T00:00:00Z"}},
+		{"0 0 29 FEB *", []string{"2028-02-29T00:00:00Z", "2032-02-29T00:00:00Z", "2036-02-29T00:00:00Z"}},
+		{"@weekly", []string{"2026-10-25T00:00:00Z", "2026-11-01T00:00:00Z", "2026-11-08T00:00:00Z"}},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCronExpression(tt.expression)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expression, err)
+		}
+		runs := schedule.runs(from, time.Time{}, len(tt.want))
+		got := make([]string, 0, len(runs))
+		for _, run := range runs {
+			got = append(got, run.Format(time.RFC3339))
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Fatalf("%q runs = %v, want %v", tt.expression, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCrontabRejectsMistypedFields(t *testing.T) {
+	tests := map[string]string{
+		"":                 "empty",
+		"0 * * *":          "has 4 fields",
+		"0 0 * * * *":      "seconds are not supported",
+		"60 * * * *":       "minute field \"60\" has value 60 out of range 0-59",
+		"0 24 * * *":       "hour field",
+		"0 0 * 13 *":       "month field",
+		"0 0 * * 8":        "day of week field",
+		"0 0 * jan-x *":    "invalid value \"x\"",
+		"5-1 * * * *":      "descending range",
+		"*/0 * * * *":      "invalid step",
+		"0 0 30 2 *":       "never runs",
+		"@reboot":          "unsupported crontab macro",
+		"TZ=UTC 0 * * * *": "sets a time zone",
+	}
+	for expression, want := range tests {
+		err := validateCrontab(expression)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("validateCrontab(%q) = %v, want error containing %q", expression, err, want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+// deploymentRollbackHistory is how many recent deployments rollback looks
+// through for --steps and for the images currently running.
+const deploymentRollbackHistory = 50
+
+var deploymentRollbackColumns = []string{"service", "current", "target", "change"}
+
+// deploymentHistory holds the successful deployments of an instance, newest
+// first, and fetches a deployment's details only when its list row does not
+// include the deployed images.
+type deploymentHistory struct {
+	client      *rest.Client
+	deployments []map[string]interface{}
+	images      map[int][]deploymentServiceImage
+}
+
+func newDeploymentRollbackCommand(out outputOptions) *cobra.Command {
+	wait := waitOptions{}
+	var instanceID, to string
+	var steps int
+	var services []string
+	var yes bool
+	cmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Deploy the images of an earlier deployment",
+		Long: "Deploy the images of an earlier deployment of an app instance.\n\n" +
+			"--steps counts successful deployments back from the latest one; failed deployments are skipped. " +
+			"A service that an earlier deployment did not include is rolled back to the image it ran at that point. " +
+			"The image changes are printed before confirmation, and only services whose image changes are deployed.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(instanceID, "--instance"); err != nil {
+				return err
+			}
+			if to != "" && cmd.Flags().Changed("steps") {
+				return errors.New("use either --to or --steps, not both")
+			}
+			if steps < 1 {
+				return errors.New("--steps must be at least 1")
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			history, err := loadDeploymentHistory(cmd.Context(), client, instanceID)
+			if err != nil {
+				return err
+			}
+			targetIndex := steps
+			if to != "" {
+				targetIndex = history.index(to)
+				if targetIndex < 0 {
+					return errors.Errorf("deployment %s is not one of the last %d successful deployments of app instance %s", to, deploymentRollbackHistory, instanceID)
+				}
+			}
+			if targetIndex >= len(history.deployments) {
+				return errors.Errorf("app instance %s has %s; cannot go back %d", instanceID, pluralizeCount(len(history.deployments), "successful deployment", "successful deployments"), targetIndex)
+			}
+			targetID := firstScalarPath(history.deployments[targetIndex], "id")
+
+			instanceServices, err := fetchRows(cmd.Context(), client, "/app-services", url.Values{"appInstanceId": []string{instanceID}})
+			if err != nil {
+				return err
+			}
+			selected, err := selectRollbackServices(instanceServices, services)
+			if err != nil {
+				return err
+			}
+			current, err := history.effectiveImages(cmd.Context(), 0, selected)
+			if err != nil {
+				return err
+			}
+			target, err := history.effectiveImages(cmd.Context(), targetIndex, selected)
+			if err != nil {
+				return err
+			}
+
+			rows, changes := deploymentRollbackPlan(selected, current, target)
+			jsonOutput := outputFormat(cmd, out) == outputJSON
+			if !jsonOutput {
+				fmt.Fprintf(cmd.OutOrStdout(), "Rolling back app instance %s to deployment %s\n\n", instanceID, targetID)
+				if err := printResult(cmd, out, rows, deploymentRollbackColumns); err != nil {
+					return err
+				}
+			}
+			if len(changes) == 0 {
+				if jsonOutput {
+					return printJSON(cmd, map[string]interface{}{"target": targetID, "services": rows})
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "\nServices already run the images of deployment %s\n", targetID)
+				return nil
+			}
+			if !jsonOutput {
+				fmt.Fprintln(cmd.OutOrStdout())
+			}
+			if err := confirm(cmd, yes, fmt.Sprintf("Deploy %s of deployment %s to app instance %s?", pluralizeCount(len(changes), "image", "images"), targetID, instanceID)); err != nil {
+				return err
+			}
+
+			result, handled, err := createServiceBuildDeployment(cmd, client, out, wait, changes)
+			if handled || err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(cmd, map[string]interface{}{"target": targetID, "services": rows, "deployment": result})
+			}
+			return printClientResult(cmd, client, out, result, deploymentColumns)
+		},
+	}
+	addWaitFlags(cmd, &wait)
+	cmd.Flags().StringVarP(&instanceID, "instance", "i", "", "App instance ID")
+	cmd.Flags().StringVar(&to, "to", "", "Deployment ID to roll back to")
+	cmd.Flags().IntVar(&steps, "steps", 1, "Number of successful deployments to go back")
+	cmd.Flags().StringSliceVar(&services, "services", nil, "App service names or IDs to roll back; defaults to all")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Confirm without prompting")
+	return cmd
+}
+
+func loadDeploymentHistory(ctx context.Context, client *rest.Client, instanceID string) (*deploymentHistory, error) {
+	rows, err := fetchRows(ctx, client, "/app-deployments", url.Values{
+		"appInstanceId": []string{instanceID},
+		"pageSize":      []string{strconv.Itoa(deploymentRollbackHistory)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	history := &deploymentHistory{client: client, images: map[int][]deploymentServiceImage{}}
+	for _, row := range rows {
+		if successfulStatuses[strings.ToLower(formatValue(row["status"]))] {
+			history.deployments = append(history.deployments, row)
+		}
+	}
+	if len(history.deployments) == 0 {
+		return nil, errors.Errorf("app instance %s has no successful deployments", instanceID)
+	}
+	sort.SliceStable(history.deployments, func(i, j int) bool {
+		left, _ := parseDisplayTime(firstNonNilPath(history.deployments[i], "createdAt", "startedAt"))
+		right, _ := parseDisplayTime(firstNonNilPath(history.deployments[j], "createdAt", "startedAt"))
+		return left.After(right)
+	})
+	return history, nil
+}
+
+func (h *deploymentHistory) index(id string) int {
+	for i, deployment := range h.deployments {
+		if firstScalarPath(deployment, "id") == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *deploymentHistory) deploymentImages(ctx context.Context, index int) ([]deploymentServiceImage, error) {
+	if images, ok := h.images[index]; ok {
+		return images, nil
+	}
+	images := deploymentServiceImages(h.deployments[index])
+	if images == nil {
+		var detail interface{}
+		id := firstScalarPath(h.deployments[index], "id")
+		if err := h.client.Get(ctx, "/app-deployments/"+url.PathEscape(id), nil, &detail); err != nil {
+			return nil, err
+		}
+		images = deploymentServiceImages(cloneFirstRow(normalizeItem(detail)))
+	}
+	h.images[index] = images
+	return images, nil
+}
+
+// effectiveImages returns, for each selected service ID, the image it ran
+// right after the deployment at index: the image from the newest deployment
+// at or before it that included the service.
+func (h *deploymentHistory) effectiveImages(ctx context.Context, index int, services map[string]string) (map[string]deploymentServiceImage, error) {
+	result := map[string]deploymentServiceImage{}
+	for i := index; i < len(h.deployments) && len(result) < len(services); i++ {
+		images, err := h.deploymentImages(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			if _, ok := services[image.serviceID]; !ok {
+				continue
+			}
+			if _, ok := result[image.serviceID]; !ok {
+				result[image.serviceID] = image
+			}
+		}
+	}
+	return result, nil
+}
+
+// selectRollbackServices maps the app service IDs of the instance to their
+// names, limited to the --services filter when it is set.
+func selectRollbackServices(rows []map[string]interface{}, filter []string) (map[string]string, error) {
+	wanted := stringSet(filter)
+	matched := map[string]bool{}
+	selected := map[string]string{}
+	for _, row := range rows {
+		id := firstScalarPath(row, "id")
+		name := firstScalarPath(row, "name")
+		if len(wanted) != 0 && !wanted[id] && !wanted[name] {
+			continue
+		}
+		selected[id] = name
+		matched[id] = true
+		matched[name] = true
+	}
+	missing := make([]string, 0)
+	for name := range wanted {
+		if !matched[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, errors.Errorf("app instance has no service %s", strings.Join(missing, ", "))
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("app instance has no services")
+	}
+	return selected, nil
+}
+
+func deploymentRollbackPlan(services map[string]string, current map[string]deploymentServiceImage, target map[string]deploymentServiceImage) ([]map[string]interface{}, []map[string]interface{}) {
+	ids := make([]string, 0, len(services))
+	for id := range services {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return services[ids[i]] < services[ids[j]] })
+
+	rows := make([]map[string]interface{}, 0, len(ids))
+	changes := make([]map[string]interface{}, 0)
+	for _, id := range ids {
+		from, to := current[id], target[id]
+		change := "unchanged"
+		switch {
+		case to.image == "":
+			change = "not deployed"
+		case from.image == to.image && from.buildID == to.buildID:
+		case to.buildID == "":
+			change = "skipped: no service build id"
+		default:
+			change = "rollback"
+			changes = append(changes, map[string]interface{}{"appServiceId": optionalInt(id), "appServiceBuildId": optionalInt(to.buildID)})
+		}
+		rows = append(rows, map[string]interface{}{
+			"service": services[id],
+			"current": from.image,
+			"target":  to.image,
+			"change":  change,
+		})
+	}
+	return rows, changes
+}
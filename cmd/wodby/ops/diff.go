@@ -0,0 +1,181 @@
+package ops
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultDiffContext = 3
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff renders the line difference between from and to in the unified
+// format used by diff -u. It returns an empty string when both are equal.
+func unifiedDiff(fromName, toName string, from, to []string, context int) string {
+	ops := diffLines(from, to)
+	changed := false
+	for _, op := range ops {
+		if op.kind != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(ops); {
+		first := nextDiffChange(ops, start)
+		if first < 0 {
+			break
+		}
+		hunkStart := max(first-context, start)
+		hunkEnd := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				hunkEnd = i + 1
+				continue
+			}
+			if i-hunkEnd >= 2*context {
+				break
+			}
+		}
+		hunkEnd = min(hunkEnd+context, len(ops))
+
+		fromLine, toLine := diffLinePosition(ops, hunkStart)
+		fromCount, toCount := 0, 0
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != '+' {
+				fromCount++
+			}
+			if op.kind != '-' {
+				toCount++
+			}
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", diffRange(fromLine, fromCount), diffRange(toLine, toCount))
+		for _, op := range ops[hunkStart:hunkEnd] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.line)
+			b.WriteByte('\n')
+		}
+		start = hunkEnd
+	}
+	return b.String()
+}
+
+func nextDiffChange(ops []diffOp, start int) int {
+	for i := start; i < len(ops); i++ {
+		if ops[i].kind != ' ' {
+			return i
+		}
+	}
+	return -1
+}
+
+func diffLinePosition(ops []diffOp, index int) (int, int) {
+	fromLine, toLine := 1, 1
+	for _, op := range ops[:index] {
+		if op.kind != '+' {
+			fromLine++
+		}
+		if op.kind != '-' {
+			toLine++
+		}
+	}
+	return fromLine, toLine
+}
+
+func diffRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// diffLines computes a shortest edit script with Myers' algorithm and returns
+// it as kept (' '), removed ('-') and added ('+') lines.
+func diffLines(from, to []string) []diffOp {
+	n, m := len(from), len(to)
+	maxSteps := n + m
+	offset := maxSteps + 1
+	v := make([]int, 2*maxSteps+3)
+	trace := make([][]int, 0)
+
+	for d := 0; d <= maxSteps; d++ {
+		snapshot := make([]int, len(v))
+		copy(snapshot, v)
+		trace = append(trace, snapshot)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && from[x] == to[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(from, to, trace, offset, d)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(from, to []string, trace [][]int, offset, steps int) []diffOp {
+	ops := make([]diffOp, 0, len(from)+len(to))
+	x, y := len(from), len(to)
+	for d := steps; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{kind: ' ', line: from[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{kind: '+', line: to[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{kind: '-', line: from[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, diffOp{kind: ' ', line: from[x]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func splitDiffLines(content string) []string {
+	content = strings.TrimSuffix(content, "\n")
+	if content == "" {
+		return nil
+	}
+	return strings.Split(content, "\n")
+}
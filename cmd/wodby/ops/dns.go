@@ -0,0 +1,318 @@
+package ops
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A minimal DNS client for "wodby instance dns-check". The net package
+// resolver does not expose TTLs or query a chosen server for CNAME chains,
+// so queries are built and parsed here (RFC 1035).
+
+const (
+	dnsTypeA     uint16 = 1
+	dnsTypeCNAME uint16 = 5
+	dnsTypeAAAA  uint16 = 28
+	dnsClassIN   uint16 = 1
+
+	dnsRcodeNameError = 3
+)
+
+const dnsDefaultTimeout = 5 * time.Second
+
+var dnsRcodeNames = map[int]string{1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED"}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	value string
+}
+
+type dnsResponse struct {
+	rcode     int
+	truncated bool
+	answers   []dnsRecord
+}
+
+// dnsServerAddress adds the default port to a resolver address, or reads the
+// first nameserver of /etc/resolv.conf when server is empty.
+func dnsServerAddress(server string) (string, error) {
+	if server == "" {
+		file, err := os.Open("/etc/resolv.conf")
+		if err != nil {
+			return "", errors.Wrap(err, "no resolver configured; use --resolver")
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				server = fields[1]
+				break
+			}
+		}
+		if server == "" {
+			return "", errors.New("/etc/resolv.conf has no nameserver; use --resolver")
+		}
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, nil
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53"), nil
+}
+
+// queryDNS sends a recursive query over UDP and retries over TCP when the
+// answer is truncated.
+func queryDNS(ctx context.Context, server string, name string, qtype uint16) (*dnsResponse, error) {
+	id := uint16(rand.Uint32())
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsDefaultTimeout)
+		defer cancel()
+	}
+	response, err := exchangeDNS(ctx, "udp", server, query, id)
+	if err == nil && response.truncated {
+		response, err = exchangeDNS(ctx, "tcp", server, query, id)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "query %s", name)
+	}
+	return response, nil
+}
+
+func exchangeDNS(ctx context.Context, network string, server string, query []byte, id uint16) (*dnsResponse, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, server)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		framed := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		message := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, message); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return parseDNSResponse(message, id)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		// Ignore stray datagrams that answer a different query.
+		if n >= 2 && binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		return parseDNSResponse(buf[:n], id)
+	}
+}
+
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	message := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(message[0:], id)
+	binary.BigEndian.PutUint16(message[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(message[4:], 1)
+	message, err := appendDNSName(message, name)
+	if err != nil {
+		return nil, err
+	}
+	message = binary.BigEndian.AppendUint16(message, qtype)
+	return binary.BigEndian.AppendUint16(message, dnsClassIN), nil
+}
+
+func appendDNSName(message []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, errors.Errorf("invalid domain name %q", name)
+			}
+			message = append(message, byte(len(label)))
+			message = append(message, label...)
+		}
+	}
+	return append(message, 0), nil
+}
+
+func parseDNSResponse(message []byte, id uint16) (*dnsResponse, error) {
+	if len(message) < 12 {
+		return nil, errors.New("DNS response is too short")
+	}
+	if binary.BigEndian.Uint16(message) != id {
+		return nil, errors.New("DNS response does not match the query")
+	}
+	flags := binary.BigEndian.Uint16(message[2:])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("DNS message is not a response")
+	}
+	response := &dnsResponse{rcode: int(flags & 0x000f), truncated: flags&0x0200 != 0}
+	questions := int(binary.BigEndian.Uint16(message[4:]))
+	answers := int(binary.BigEndian.Uint16(message[6:]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(message, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4
+	}
+	for i := 0; i < answers; i++ {
+		name, next, err := readDNSName(message, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(message) {
+			return nil, errors.New("DNS answer is truncated")
+		}
+		record := dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(message[next:]),
+			ttl:   binary.BigEndian.Uint32(message[next+4:]),
+		}
+		length := int(binary.BigEndian.Uint16(message[next+8:]))
+		start := next + 10
+		if start+length > len(message) {
+			return nil, errors.New("DNS answer is truncated")
+		}
+		data := message[start : start+length]
+		switch record.rtype {
+		case dnsTypeA, dnsTypeAAAA:
+			if len(data) != net.IPv4len && len(data) != net.IPv6len {
+				return nil, errors.Errorf("DNS answer for %s has an invalid address", name)
+			}
+			record.value = net.IP(data).String()
+		case dnsTypeCNAME:
+			if record.value, _, err = readDNSName(message, start); err != nil {
+				return nil, err
+			}
+		}
+		if record.value != "" && binary.BigEndian.Uint16(message[next+2:]) == dnsClassIN {
+			response.answers = append(response.answers, record)
+		}
+		offset = start + length
+	}
+	return response, nil
+}
+
+// readDNSName reads a possibly compressed name at offset and returns it with
+// the offset after the name as it is stored at offset.
+func readDNSName(message []byte, offset int) (string, int, error) {
+	labels := make([]string, 0)
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(message) {
+			return "", 0, errors.New("DNS name is truncated")
+		}
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(message) {
+				return "", 0, errors.New("DNS name is truncated")
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errors.New("DNS name has a compression loop")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(message[offset:]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, errors.New("DNS name has an unsupported label type")
+		default:
+			if offset+1+length > len(message) {
+				return "", 0, errors.New("DNS name is truncated")
+			}
+			labels = append(labels, string(message[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// dnsLookup is what a resolver answers for the A and AAAA records of a
+// domain, with the CNAME chain it followed and the lowest TTL seen.
+type dnsLookup struct {
+	cnames    []string
+	addresses []string
+	ttl       uint32
+	nxdomain  bool
+}
+
+func lookupDNSDomain(ctx context.Context, server string, domain string) (*dnsLookup, error) {
+	lookup := &dnsLookup{}
+	seen := map[string]bool{}
+	hasTTL := false
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		response, err := queryDNS(ctx, server, domain, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if response.rcode == dnsRcodeNameError {
+			lookup.nxdomain = true
+			continue
+		}
+		if response.rcode != 0 {
+			name := dnsRcodeNames[response.rcode]
+			if name == "" {
+				name = "rcode " + strconv.Itoa(response.rcode)
+			}
+			return nil, errors.Errorf("resolver %s answered %s for %s", server, name, domain)
+		}
+		for _, answer := range response.answers {
+			if answer.rtype != qtype && answer.rtype != dnsTypeCNAME {
+				continue
+			}
+			if !hasTTL || answer.ttl < lookup.ttl {
+				lookup.ttl, hasTTL = answer.ttl, true
+			}
+			value := strings.ToLower(strings.TrimSuffix(answer.value, "."))
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			if answer.rtype == dnsTypeCNAME {
+				lookup.cnames = append(lookup.cnames, value)
+			} else {
+				lookup.addresses = append(lookup.addresses, value)
+			}
+		}
+	}
+	return lookup, nil
+}
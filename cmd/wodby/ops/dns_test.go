@@ -0,0 +1,131 @@
+package ops
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// dnsStubAnswer is one answer record of the stub resolver. Addresses are
+// parsed IPs and CNAME values are names.
+type dnsStubAnswer struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	value string
+}
+
+type dnsStubZone struct {
+	answers map[string][]dnsStubAnswer
+	rcodes  map[string]int
+}
+
+// startDNSStub serves zone over UDP on localhost and returns its address.
+// Answers are keyed by "name/TYPE", for example "example.com/A".
+func startDNSStub(t *testing.T, zone dnsStubZone) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			name, end, err := readDNSName(buf[:n], 12)
+			if err != nil {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(buf[end:])
+			key := fmt.Sprintf("%s/%s", name, map[uint16]string{dnsTypeA: "A", dnsTypeAAAA: "AAAA"}[qtype])
+			answers := zone.answers[key]
+
+			response := append([]byte{}, buf[:end+4]...)
+			binary.BigEndian.PutUint16(response[2:], 0x8180|uint16(zone.rcodes[name]))
+			binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+			for i, answer := range answers {
+				if i == 0 && answer.name == name {
+					// Point to the question name to exercise compression.
+					response = append(response, 0xc0, 12)
+				} else {
+					response, _ = appendDNSName(response, answer.name)
+				}
+				response = binary.BigEndian.AppendUint16(response, answer.rtype)
+				response = binary.BigEndian.AppendUint16(response, dnsClassIN)
+				response = binary.BigEndian.AppendUint32(response, answer.ttl)
+				var data []byte
+				switch answer.rtype {
+				case dnsTypeA:
+					data = net.ParseIP(answer.value).To4()
+				case dnsTypeAAAA:
+					data = net.ParseIP(answer.value).To16()
+				default:
+					data, _ = appendDNSName(nil, answer.value)
+				}
+				response = binary.BigEndian.AppendUint16(response, uint16(len(data)))
+				response = append(response, data...)
+			}
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestLookupDNSDomainFollowsCNAMEsAndKeepsLowestTTL(t *testing.T) {
+	server := startDNSStub(t, dnsStubZone{
+		answers: map[string][]dnsStubAnswer{
+			"www.example.com/A": {
+				{name: "www.example.com", rtype: dnsTypeCNAME, ttl: 3600, value: "lb.cluster.example.net"},
+				{name: "lb.cluster.example.net", rtype: dnsTypeA, ttl: 60, value: "203.0.113.10"},
+			},
+			"www.example.com/AAAA": {
+				{name: "www.example.com", rtype: dnsTypeCNAME, ttl: 3600, value: "lb.cluster.example.net"},
+				{name: "lb.cluster.example.net", rtype: dnsTypeAAAA, ttl: 120, value: "2001:db8::10"},
+			},
+		},
+		rcodes: map[string]int{"gone.example.com": dnsRcodeNameError, "broken.example.com": 2},
+	})
+
+	lookup, err := lookupDNSDomain(context.Background(), server, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(lookup.cnames, lookup.addresses, lookup.ttl, lookup.nxdomain); got != "[lb.cluster.example.net] [203.0.113.10 2001:db8::10] 60 false" {
+		t.Fatalf("lookup = %s", got)
+	}
+
+	lookup, err = lookupDNSDomain(context.Background(), server, "gone.example.com")
+	if err != nil || !lookup.nxdomain || len(lookup.addresses) != 0 {
+		t.Fatalf("lookup = %+v, %v", lookup, err)
+	}
+
+	if _, err := lookupDNSDomain(context.Background(), server, "broken.example.com"); err == nil || err.Error() != "resolver "+server+" answered SERVFAIL for broken.example.com" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestReadDNSNameRejectsCompressionLoops(t *testing.T) {
+	message := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xc0, 12}
+	if _, _, err := readDNSName(message, 12); err == nil || err.Error() != "DNS name has a compression loop" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestDNSServerAddressAddsDefaultPort(t *testing.T) {
+	for input, want := range map[string]string{
+		"1.1.1.1":        "1.1.1.1:53",
+		"127.0.0.1:5353": "127.0.0.1:5353",
+		"2001:db8::1":    "[2001:db8::1]:53",
+		"[2001:db8::1]":  "[2001:db8::1]:53",
+	} {
+		if got, err := dnsServerAddress(input); err != nil || got != want {
+			t.Fatalf("dnsServerAddress(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package ops
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+const (
+	envVarFormatDotenv = "dotenv"
+	envVarFormatJSON   = "json"
+
+	// dotenvRedactedSecret is the value export writes in the comment that
+	// stands in for a redacted secret.
+	dotenvRedactedSecret = "<redacted secret>"
+)
+
+var (
+	envVarImportColumns = []string{"name", "action", "detail"}
+	dotenvNamePattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+	dotenvPlainValue    = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+	dotenvRedactedLine  = regexp.MustCompile(`^#\s*([A-Za-z_][A-Za-z0-9_.-]*)=` + regexp.QuoteMeta(dotenvRedactedSecret) + `$`)
+)
+
+type dotenvVar struct {
+	name  string
+	value string
+}
+
+type envVarScope struct {
+	workload  string
+	container string
+}
+
+func newAppServiceEnvVarImportCommand(out outputOptions) *cobra.Command {
+	var file string
+	var secretKeys []string
+	var scope envVarScope
+	var prune, dryRun, yes bool
+	cmd := &cobra.Command{
+		Use:   "import SERVICE_ID",
+		Short: "Import app service environment variables from a dotenv file",
+		Long: "Import app service environment variables from a dotenv file.\n\n" +
+			"The file is compared with the service's current variables and only the needed creates, updates and deletes are sent. " +
+			"Variables listed in --secret-keys are stored as secrets and existing secrets stay secret. " +
+			"Masked secret values cannot be compared, so they are only sent when another setting of the variable changes. " +
+			"--runtime and --build set exposure on every imported variable; without them new variables use the API defaults and existing ones keep their settings. " +
+			"--prune deletes variables in the same workload and container scope that are missing from the file; " +
+			"secrets that env-var export wrote as redacted comments are kept.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(file, "--file"); err != nil {
+				return err
+			}
+			content, err := readTextFileOrStdin(cmd, file)
+			if err != nil {
+				return errors.Wrap(err, "read env file")
+			}
+			vars, err := parseDotenv(content)
+			if err != nil {
+				return errors.Wrap(err, file)
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			current, err := fetchRows(cmd.Context(), client, escapedPath("/app-services/%s/env-vars", args[0]), nil)
+			if err != nil {
+				return err
+			}
+
+			flags := map[string]interface{}{}
+			for _, name := range []string{"runtime", "build"} {
+				if cmd.Flags().Changed(name) {
+					value, _ := cmd.Flags().GetBool(name)
+					flags[name] = value
+				}
+			}
+			changes := planEnvVarImport(args[0], vars, redactedDotenvNames(content), current, stringSet(secretKeys), flags, scope, prune)
+			if err := printEnvVarImportChanges(cmd, out, changes); err != nil {
+				return err
+			}
+			pending := pendingInstanceBundleChanges(changes)
+			if dryRun || len(pending) == 0 {
+				return nil
+			}
+			if prune && hasDeleteChange(pending) {
+				if err := confirm(cmd, yes, fmt.Sprintf("Apply %s to app service %s, including deletes?", pluralizeCount(len(pending), "change", "changes"), args[0])); err != nil {
+					return err
+				}
+			}
+			return applyInstanceBundleChanges(cmd.Context(), client, pending)
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Path to dotenv file; use - for stdin")
+	cmd.Flags().StringSliceVar(&secretKeys, "secret-keys", nil, "Variable names to store as secrets; comma-separated")
+	cmd.Flags().Bool("runtime", false, "Expose imported variables at runtime")
+	cmd.Flags().Bool("build", false, "Expose imported variables during builds")
+	addEnvVarScopeFlags(cmd, &scope)
+	cmd.Flags().BoolVar(&prune, "prune", false, "Delete variables missing from the file")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the changes without applying them")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Confirm deletes without prompting")
+	return cmd
+}
+
+func newAppServiceEnvVarExportCommand() *cobra.Command {
+	var format, outPath string
+	var scope envVarScope
+	var includeSecrets bool
+	cmd := &cobra.Command{
+		Use:   "export SERVICE_ID",
+		Short: "Export app service environment variables",
+		Long: "Export app service environment variables as a dotenv file or JSON.\n\n" +
+			"Secret values are redacted unless --include-secrets is set; in dotenv output redacted variables are written as comments so the file can be imported back without clearing them.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != envVarFormatDotenv && format != envVarFormatJSON {
+				return errors.Errorf("unsupported --format %q; use dotenv or json", format)
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			rows, err := fetchEnvVarsInScope(cmd.Context(), client, args[0], scope)
+			if err != nil {
+				return err
+			}
+			var content string
+			if format == envVarFormatJSON {
+				content, err = formatEnvVarsJSON(rows, includeSecrets)
+				if err != nil {
+					return err
+				}
+			} else {
+				content = formatDotenv(rows, includeSecrets)
+			}
+			if outPath != "" {
+				if err := writeTextOutput(outPath, content); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s to %s\n", pluralizeCount(len(rows), "environment variable", "environment variables"), outPath)
+				return nil
+			}
+			fmt.Fprint(cmd.OutOrStdout(), content)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", envVarFormatDotenv, "Export format: dotenv or json")
+	cmd.Flags().StringVar(&outPath, "out", "", "Write the export to path instead of stdout")
+	cmd.Flags().BoolVar(&includeSecrets, "include-secrets", false, "Include secret values instead of redacting them")
+	addEnvVarScopeFlags(cmd, &scope)
+	return cmd
+}
+
+func addEnvVarScopeFlags(cmd *cobra.Command, scope *envVarScope) {
+	cmd.Flags().StringVar(&scope.workload, "workload", "", "Only use variables of this workload; default is service-wide variables")
+	cmd.Flags().StringVar(&scope.container, "container", "", "Only use variables of this container")
+}
+
+func (s envVarScope) matches(row map[string]interface{}) bool {
+	return scalarString(row["workload"]) == s.workload && scalarString(row["container"]) == s.container
+}
+
+func fetchEnvVarsInScope(ctx context.Context, client *rest.Client, serviceID string, scope envVarScope) ([]map[string]interface{}, error) {
+	rows, err := fetchRows(ctx, client, escapedPath("/app-services/%s/env-vars", serviceID), nil)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		if scope.matches(row) {
+			matched = append(matched, row)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return scalarString(matched[i]["name"]) < scalarString(matched[j]["name"])
+	})
+	return matched, nil
+}
+
+// planEnvVarImport compares the file with the current variables. Secrets in
+// redacted are only in the file as export's comments, so prune keeps them.
+func planEnvVarImport(serviceID string, vars []dotenvVar, redacted map[string]bool, current []map[string]interface{}, secretKeys map[string]bool, flags map[string]interface{}, scope envVarScope, prune bool) []instanceBundleChange {
+	currentByName := map[string]map[string]interface{}{}
+	for _, row := range current {
+		if scope.matches(row) {
+			currentByName[scalarString(row["name"])] = row
+		}
+	}
+
+	changes := make([]instanceBundleChange, 0)
+	seen := map[string]bool{}
+	for _, variable := range vars {
+		seen[variable.name] = true
+		change := instanceBundleChange{service: serviceID, section: "env var", item: variable.name}
+		row, exists := currentByName[variable.name]
+		if !exists {
+			change.action = "create"
+			change.method = "POST"
+			change.path = escapedPath("/app-services/%s/env-vars", serviceID)
+			change.body = map[string]interface{}{"name": variable.name, "value": variable.value, "secret": secretKeys[variable.name]}
+			if scope.workload != "" {
+				change.body["workload"] = scope.workload
+			}
+			if scope.container != "" {
+				change.body["container"] = scope.container
+			}
+			for name, value := range flags {
+				change.body[name] = value
+			}
+			changes = append(changes, change)
+			continue
+		}
+
+		currentSecret := formatYesNo(row["secret"]) == "yes"
+		secret := currentSecret || secretKeys[variable.name]
+		changed := make([]string, 0)
+		// The API masks secret values, so they cannot be compared and are
+		// only resent along with another change.
+		if currentValue := scalarString(row["value"]); !(currentSecret && currentValue == "") && currentValue != variable.value {
+			changed = append(changed, "value")
+		}
+		if secret != currentSecret {
+			changed = append(changed, "secret")
+		}
+		body := map[string]interface{}{"value": variable.value, "secret": secret}
+		for _, name := range []string{"runtime", "build"} {
+			if value, ok := flags[name]; ok && formatYesNo(row[name]) != formatYesNo(value) {
+				body[name] = value
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		change.action = "update"
+		change.detail = strings.Join(changed, ", ")
+		change.method = "PUT"
+		change.path = escapedPath("/app-service-env-vars/%s", scalarString(row["id"]))
+		change.body = body
+		changes = append(changes, change)
+	}
+
+	if prune {
+		names := make([]string, 0, len(currentByName))
+		for name := range currentByName {
+			if !seen[name] && !(redacted[name] && formatYesNo(currentByName[name]["secret"]) == "yes") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			changes = append(changes, instanceBundleChange{
+				service: serviceID,
+				section: "env var",
+				item:    name,
+				action:  "delete",
+				detail:  "missing from file",
+				method:  "DELETE",
+				path:    escapedPath("/app-service-env-vars/%s", scalarString(currentByName[name]["id"])),
+			})
+		}
+	}
+	return changes
+}
+
+func hasDeleteChange(changes []instanceBundleChange) bool {
+	for _, change := range changes {
+		if change.method == "DELETE" {
+			return true
+		}
+	}
+	return false
+}
+
+func printEnvVarImportChanges(cmd *cobra.Command, out outputOptions, changes []instanceBundleChange) error {
+	rows := make([]map[string]interface{}, 0, len(changes))
+	for _, change := range changes {
+		rows = append(rows, map[string]interface{}{"name": change.item, "action": change.action, "detail": change.detail})
+	}
+	if len(rows) == 0 && outputFormat(cmd, out) != outputJSON {
+		fmt.Fprintln(cmd.OutOrStdout(), "environment variables already match the file")
+		return nil
+	}
+	return printResult(cmd, out, rows, envVarImportColumns)
+}
+
+// parseDotenv reads KEY=VALUE lines with optional export prefixes, comments,
+// single-quoted literals and double-quoted values with escapes that may span
+// several lines.
+func parseDotenv(content string) ([]dotenvVar, error) {
+	vars := make([]dotenvVar, 0)
+	index := map[string]int{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		start := lineNumber
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		name, raw, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !dotenvNamePattern.MatchString(name) {
+			return nil, errors.Errorf("line %d: expected KEY=VALUE", start)
+		}
+		raw = strings.TrimSpace(raw)
+
+		var value string
+		switch {
+		case strings.HasPrefix(raw, `"`):
+			for !dotenvQuoteClosed(raw[1:]) {
+				if !scanner.Scan() {
+					return nil, errors.Errorf("line %d: unterminated double quote", start)
+				}
+				lineNumber++
+				raw += "\n" + scanner.Text()
+			}
+			closing := dotenvClosingQuote(raw[1:]) + 1
+			if rest := strings.TrimSpace(raw[closing+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, errors.Errorf("line %d: unexpected text after closing quote", start)
+			}
+			value = unescapeDotenv(raw[1:closing])
+		case strings.HasPrefix(raw, "'"):
+			closing := strings.Index(raw[1:], "'")
+			if closing < 0 {
+				return nil, errors.Errorf("line %d: unterminated single quote", start)
+			}
+			value = raw[1 : closing+1]
+		default:
+			if i := strings.Index(raw, " #"); i >= 0 {
+				raw = raw[:i]
+			}
+			value = strings.TrimSpace(raw)
+		}
+
+		if i, ok := index[name]; ok {
+			vars[i] = dotenvVar{name: name, value: value}
+			continue
+		}
+		index[name] = len(vars)
+		vars = append(vars, dotenvVar{name: name, value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return vars, nil
+}
+
+// redactedDotenvNames returns the variables that export wrote as redacted
+// secret comments.
+func redactedDotenvNames(content string) map[string]bool {
+	names := map[string]bool{}
+	for _, line := range strings.Split(content, "\n") {
+		if match := dotenvRedactedLine.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			names[match[1]] = true
+		}
+	}
+	return names
+}
+
+func dotenvQuoteClosed(value string) bool {
+	return dotenvClosingQuote(value) >= 0
+}
+
+func dotenvClosingQuote(value string) int {
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeDotenv(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+func formatDotenv(rows []map[string]interface{}, includeSecrets bool) string {
+	var b strings.Builder
+	for _, row := range rows {
+		name := scalarString(row["name"])
+		if formatYesNo(row["secret"]) == "yes" && !includeSecrets {
+			fmt.Fprintf(&b, "# %s=%s\n", name, dotenvRedactedSecret)
+			continue
+		}
+		fmt.Fprintf(&b, "%s=%s\n", name, quoteDotenv(scalarString(row["value"])))
+	}
+	return b.String()
+}
+
+func quoteDotenv(value string) string {
+	if dotenvPlainValue.MatchString(value) {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+func formatEnvVarsJSON(rows []map[string]interface{}, includeSecrets bool) (string, error) {
+	items := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		item := map[string]interface{}{
+			"name":    scalarString(row["name"]),
+			"secret":  formatYesNo(row["secret"]) == "yes",
+			"runtime": formatYesNo(row["runtime"]) == "yes",
+			"build":   formatYesNo(row["build"]) == "yes",
+		}
+		if item["secret"] == true && !includeSecrets {
+			item["redacted"] = true
+		} else {
+			item["value"] = scalarString(row["value"])
+		}
+		for _, field := range []string{"workload", "container"} {
+			if value := scalarString(row[field]); value != "" {
+				item[field] = value
+			}
+		}
+		items = append(items, item)
+	}
+	content, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(content) + "\n", nil
+}
@@ -55,6 +55,7 @@ func newHelmCommand() *cobra.Command {
 		newHelmInspectCommand(out),
 		newHelmScaffoldServiceCommand(out),
 		newHelmScaffoldStackCommand(out),
+		newHelmDiffCommand(out),
 	)
 	return cmd
 }
@@ -64,12 +65,27 @@ func newHelmInspectCommand(out outputOptions) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "inspect [CHART]",
 		Short: "Inspect Helm chart",
+		Long:  "Inspect Helm chart. A chart directory or .tgz archive on disk is rendered locally with its default values and never sent to the API.",
 		Args:  cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			body, err := helmChartRequestBody(cmd, args, opts)
 			if err != nil {
 				return err
 			}
+			if chart := scalarString(body["chart"]); isLocalHelmChart(chart) {
+				values, err := readHelmValues(body)
+				if err != nil {
+					return err
+				}
+				analysis, err := inspectLocalHelmChart(chart, values, opts.release, opts.namespace)
+				if err != nil {
+					return err
+				}
+				if outputFormat(cmd, out) == outputJSON {
+					return printJSON(cmd, analysis)
+				}
+				return printHelmChartInspection(cmd, analysis)
+			}
 			client, err := newRESTClient()
 			if err != nil {
 				return err
@@ -99,6 +115,9 @@ func newHelmScaffoldServiceCommand(out outputOptions) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if isLocalHelmChart(scalarString(chart["chart"])) {
+				return errors.New("scaffolding renders the chart in the API; push the chart to a repository, or use helm inspect to review a local chart offline")
+			}
 			body := map[string]interface{}{"chart": chart}
 			addOptionalString(body, "serviceName", opts.serviceName)
 			addOptionalString(body, "serviceTitle", opts.serviceTitle)
@@ -148,6 +167,9 @@ func newHelmScaffoldStackCommand(out outputOptions) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if isLocalHelmChart(scalarString(chart["chart"])) {
+				return errors.New("scaffolding renders the chart in the API; push the chart to a repository, or use helm inspect to review a local chart offline")
+			}
 			body := map[string]interface{}{"chart": chart}
 			addOptionalString(body, "serviceName", opts.serviceName)
 			addOptionalString(body, "serviceTitle", opts.serviceTitle)
@@ -204,7 +226,7 @@ func addHelmChartFlags(cmd *cobra.Command, opts *helmChartOptions) {
 	cmd.Flags().StringVar(&opts.chart, "chart", "", "Helm chart reference")
 	cmd.Flags().StringVar(&opts.source, "source", "", "Helm repository or OCI source URL")
 	cmd.Flags().StringVar(&opts.sourceName, "source-name", "", "Chart source name to use in generated manifests")
-	cmd.Flags().StringVar(&opts.version, "version", "", "Helm chart version")
+	cmd.Flags().StringVar(&opts.version, "version", "", "Helm chart version; not used with a local chart")
 	cmd.Flags().StringVar(&opts.release, "release", "", "Helm release name used for rendering")
 	cmd.Flags().StringVar(&opts.namespace, "namespace", "", "Kubernetes namespace used for rendering")
 	cmd.Flags().StringVar(&opts.values, "values", "", "Path to Helm values JSON object")
@@ -235,6 +257,12 @@ func helmChartRequestBody(cmd *cobra.Command, args []string, opts helmChartOptio
 	if err != nil {
 		return nil, err
 	}
+	if source != "" && isLocalHelmChart(chart) {
+		return nil, errors.New("do not combine --source with a local chart")
+	}
+	if opts.version != "" && isLocalHelmChart(chart) {
+		return nil, errors.New("do not combine --version with a local chart; the version comes from its Chart.yaml")
+	}
 	if opts.values != "" && opts.valuesYAML != "" {
 		return nil, errors.New("use either --values or --values-yaml, not both")
 	}
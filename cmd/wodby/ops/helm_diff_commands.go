@@ -0,0 +1,429 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+)
+
+var helmStaleOverrideColumns = []string{"source", "path", "value", "reason"}
+
+type helmDiffOptions struct {
+	from          string
+	to            string
+	source        string
+	release       string
+	namespace     string
+	values        string
+	appServices   []string
+	stackServices []string
+}
+
+// helmDiffSide is one chart version: its inspection and default values.
+type helmDiffSide struct {
+	ref      string
+	analysis map[string]interface{}
+	defaults map[string]interface{}
+}
+
+// helmOverride is a value set over the chart defaults, from --values or a
+// service Helm value.
+type helmOverride struct {
+	source string
+	path   string
+	value  string
+}
+
+func newHelmDiffCommand(out outputOptions) *cobra.Command {
+	opts := helmDiffOptions{}
+	cmd := &cobra.Command{
+		Use:   "diff --from CHART@VERSION --to CHART@VERSION",
+		Short: "Compare two Helm chart versions",
+		Long: "Compare two Helm chart versions: changed default values, added or removed workloads, containers, ports and volume claims, " +
+			"and the overrides from --values, --service and --stack-service Helm values whose path the new version no longer has. " +
+			"Chart directories and .tgz archives on disk are rendered locally; other charts are inspected by the API.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var values map[string]interface{}
+			if opts.values != "" {
+				content, err := readTextFileOrStdin(cmd, opts.values)
+				if err != nil {
+					return errors.Wrap(err, "read values")
+				}
+				if err := yaml.Unmarshal([]byte(content), &values); err != nil {
+					return errors.Wrap(err, "decode values")
+				}
+			}
+			from, err := loadHelmDiffSide(cmd, opts.from, values, opts)
+			if err != nil {
+				return err
+			}
+			to, err := loadHelmDiffSide(cmd, opts.to, values, opts)
+			if err != nil {
+				return err
+			}
+			overrides, err := collectHelmOverrides(cmd.Context(), values, opts)
+			if err != nil {
+				return err
+			}
+
+			valueChanges := diffManifests(from.defaults, to.defaults)
+			resourceChanges := diffManifests(helmInspectionShape(from.analysis), helmInspectionShape(to.analysis))
+			stale := staleHelmOverrides(overrides, from.defaults, to.defaults)
+			warnings := make([]string, 0)
+			for _, side := range []helmDiffSide{from, to} {
+				for _, warning := range helmStringList(side.analysis["warnings"]) {
+					warnings = append(warnings, side.ref+": "+warning)
+				}
+			}
+
+			if outputFormat(cmd, out) == outputJSON {
+				return printJSON(cmd, map[string]interface{}{
+					"from":           from.analysis,
+					"to":             to.analysis,
+					"values":         valueChanges,
+					"resources":      resourceChanges,
+					"staleOverrides": stale,
+					"warnings":       warnings,
+				})
+			}
+			sections := []struct {
+				title   string
+				rows    []map[string]interface{}
+				columns []string
+			}{
+				{"Default values", manifestChangeRows(valueChanges), manifestChangeColumns},
+				{"Resources", manifestChangeRows(resourceChanges), manifestChangeColumns},
+				{"Overrides that no longer apply", stale, helmStaleOverrideColumns},
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s -> %s\n", from.ref, to.ref)
+			for _, section := range sections {
+				fmt.Fprintln(cmd.OutOrStdout())
+				fmt.Fprintln(cmd.OutOrStdout(), section.title+":")
+				if len(section.rows) == 0 {
+					fmt.Fprintln(cmd.OutOrStdout(), "  none")
+					continue
+				}
+				if err := printResult(cmd, out, section.rows, section.columns); err != nil {
+					return err
+				}
+			}
+			printHelmStringList(cmd.OutOrStdout(), "Warnings", warnings)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.from, "from", "", "Current chart as CHART@VERSION, or a chart directory or .tgz archive")
+	cmd.Flags().StringVar(&opts.to, "to", "", "New chart as CHART@VERSION, or a chart directory or .tgz archive")
+	cmd.Flags().StringVar(&opts.source, "source", "", "Helm repository or OCI source URL")
+	cmd.Flags().StringVar(&opts.release, "release", "", "Helm release name used for rendering")
+	cmd.Flags().StringVar(&opts.namespace, "namespace", "", "Kubernetes namespace used for rendering")
+	cmd.Flags().StringVar(&opts.values, "values", "", "Path to Helm values YAML or JSON applied to both versions; use - for stdin")
+	cmd.Flags().StringSliceVar(&opts.appServices, "service", nil, "App service ID whose Helm values are checked against the new version")
+	cmd.Flags().StringSliceVar(&opts.stackServices, "stack-service", nil, "Stack service ID whose Helm values are checked against the new version")
+	_ = cmd.MarkFlagRequired("from")
+	_ = cmd.MarkFlagRequired("to")
+	return cmd
+}
+
+// splitHelmChartVersion splits CHART@VERSION. Chart references without a
+// version, or whose text after the last @ is part of a path, are returned
+// unchanged.
+func splitHelmChartVersion(ref string) (string, string) {
+	index := strings.LastIndex(ref, "@")
+	if index <= 0 || strings.ContainsAny(ref[index+1:], "/:") {
+		return ref, ""
+	}
+	return ref[:index], ref[index+1:]
+}
+
+func loadHelmDiffSide(cmd *cobra.Command, ref string, values map[string]interface{}, opts helmDiffOptions) (helmDiffSide, error) {
+	side := helmDiffSide{ref: ref}
+	if isLocalHelmChart(ref) {
+		analysis, err := inspectLocalHelmChart(ref, values, opts.release, opts.namespace)
+		if err != nil {
+			return side, err
+		}
+		side.analysis = analysis
+	} else {
+		chartRef, version := splitHelmChartVersion(ref)
+		if version == "" {
+			return side, errors.Errorf("%s: use CHART@VERSION, or a chart directory or .tgz archive", ref)
+		}
+		chart, source, err := resolveHelmChartReference([]string{chartRef}, helmChartOptions{source: opts.source})
+		if err != nil {
+			return side, err
+		}
+		body := map[string]interface{}{"chart": chart, "version": version}
+		addOptionalString(body, "source", source)
+		addOptionalString(body, "release", opts.release)
+		addOptionalString(body, "namespace", opts.namespace)
+		if values != nil {
+			body["values"] = values
+		}
+		client, err := newRESTClient()
+		if err != nil {
+			return side, err
+		}
+		var result interface{}
+		if err := client.Post(cmd.Context(), "/helm-charts/actions/inspect", nil, body, &result); err != nil {
+			return side, err
+		}
+		rows := responseRows(result)
+		if len(rows) == 0 {
+			return side, errors.New("response missing Helm chart analysis")
+		}
+		side.analysis = rows[0]
+	}
+
+	var err error
+	side.defaults, err = helmAnalysisDefaults(side.analysis)
+	if err != nil {
+		return side, errors.Wrapf(err, "%s default values", ref)
+	}
+	if side.defaults == nil {
+		side.defaults = map[string]interface{}{}
+		side.analysis["warnings"] = append(helmStringList(side.analysis["warnings"]), "the inspection did not include the chart default values")
+	}
+	return side, nil
+}
+
+// helmAnalysisDefaults reads the chart default values of an inspection,
+// given as an object or as YAML.
+func helmAnalysisDefaults(analysis map[string]interface{}) (map[string]interface{}, error) {
+	if values, ok := firstNonNilPath(analysis, "defaultValues", "chart.values", "values").(map[string]interface{}); ok {
+		return values, nil
+	}
+	content := firstScalarPath(analysis, "defaultValuesYaml", "chart.valuesYaml", "valuesYaml")
+	if content == "" {
+		return nil, nil
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(content), &values); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return values, nil
+}
+
+// helmInspectionShape keeps the parts of a chart inspection that an upgrade
+// can break, with named lists so that diffManifests pairs them by name.
+func helmInspectionShape(analysis map[string]interface{}) map[string]interface{} {
+	workloads := make([]interface{}, 0)
+	for _, workload := range asRows(firstNonNilPath(analysis, "workloads")) {
+		workloads = append(workloads, map[string]interface{}{
+			"name":           helmLower(firstScalarPath(workload, "kind")) + " " + firstScalarPath(workload, "name"),
+			"containers":     helmContainerShapes(asRows(firstNonNilPath(workload, "containers"))),
+			"initContainers": helmContainerShapes(asRows(firstNonNilPath(workload, "initContainers"))),
+			"volumes":        strings.Join(helmVolumeClaimLabels(asRows(firstNonNilPath(workload, "volumes"))), ", "),
+		})
+	}
+	services := make([]interface{}, 0)
+	for _, service := range asRows(firstNonNilPath(analysis, "services")) {
+		services = append(services, map[string]interface{}{
+			"name":     firstScalarPath(service, "name"),
+			"headless": helmBool(firstNonNilPath(service, "headless")),
+			"ports":    strings.Join(helmPortLabels(asRows(firstNonNilPath(service, "ports"))), ", "),
+		})
+	}
+	volumeClaims := make([]interface{}, 0)
+	for _, volume := range asRows(firstNonNilPath(analysis, "volumeClaims")) {
+		volumeClaims = append(volumeClaims, map[string]interface{}{
+			"name":             firstScalarPath(volume, "name"),
+			"size":             firstScalarPath(volume, "size"),
+			"storageClassName": firstScalarPath(volume, "storageClassName"),
+			"accessModes":      strings.Join(helmStringList(firstNonNilPath(volume, "accessModes")), ","),
+		})
+	}
+	return map[string]interface{}{
+		"workloads":    workloads,
+		"services":     services,
+		"volumeClaims": volumeClaims,
+	}
+}
+
+func helmContainerShapes(containers []map[string]interface{}) []interface{} {
+	shapes := make([]interface{}, 0, len(containers))
+	for _, container := range containers {
+		shapes = append(shapes, map[string]interface{}{
+			"name":  firstScalarPath(container, "name"),
+			"image": firstScalarPath(container, "image"),
+			"ports": strings.Join(helmPortLabels(asRows(firstNonNilPath(container, "ports"))), ", "),
+		})
+	}
+	return shapes
+}
+
+func collectHelmOverrides(ctx context.Context, values map[string]interface{}, opts helmDiffOptions) ([]helmOverride, error) {
+	overrides := make([]helmOverride, 0)
+	for _, path := range flattenHelmValues("", values) {
+		overrides = append(overrides, helmOverride{source: "values", path: path.path, value: path.value})
+	}
+	if len(opts.appServices) == 0 && len(opts.stackServices) == 0 {
+		return overrides, nil
+	}
+	client, err := newRESTClient()
+	if err != nil {
+		return nil, err
+	}
+	services := []struct {
+		kind string
+		ids  []string
+	}{
+		{"app-service", opts.appServices},
+		{"stack-service", opts.stackServices},
+	}
+	for _, service := range services {
+		for _, id := range service.ids {
+			rows, err := fetchRows(ctx, client, "/"+service.kind+"s/"+url.PathEscape(id)+"/helm-values", nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range rows {
+				value := firstScalarPath(row, "value")
+				if truthyPath(row, "secret") {
+					value = "(secret)"
+				}
+				overrides = append(overrides, helmOverride{source: service.kind + " " + id, path: firstScalarPath(row, "name"), value: value})
+			}
+		}
+	}
+	return overrides, nil
+}
+
+type helmValuePath struct {
+	path  string
+	value string
+}
+
+// flattenHelmValues lists the leaf values of a values file by their dotted
+// path, the form service Helm values use. Lists are leaves.
+func flattenHelmValues(prefix string, values map[string]interface{}) []helmValuePath {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	paths := make([]helmValuePath, 0, len(keys))
+	for _, key := range keys {
+		path := strings.ReplaceAll(key, ".", `\.`)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		if nested, ok := values[key].(map[string]interface{}); ok && len(nested) != 0 {
+			paths = append(paths, flattenHelmValues(path, nested)...)
+			continue
+		}
+		paths = append(paths, helmValuePath{path: path, value: formatManifestValue(values[key])})
+	}
+	return paths
+}
+
+// staleHelmOverrides returns the overrides whose path the old chart defaults
+// have and the new ones lack or turn into a different kind of value. Paths
+// neither version defines, such as extra environment variables, are kept
+// out because charts commonly accept them.
+func staleHelmOverrides(overrides []helmOverride, from map[string]interface{}, to map[string]interface{}) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0)
+	for _, override := range overrides {
+		parts := splitHelmValuePath(override.path)
+		fromValue, inFrom := lookupHelmValue(from, parts)
+		if !inFrom {
+			continue
+		}
+		toValue, inTo := lookupHelmValue(to, parts)
+		reason := ""
+		switch {
+		case !inTo:
+			reason = "removed from chart defaults"
+		case fromValue != nil && toValue != nil && helmValueKind(fromValue) != helmValueKind(toValue):
+			reason = fmt.Sprintf("changed from %s to %s", helmValueKind(fromValue), helmValueKind(toValue))
+		default:
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"source": override.source,
+			"path":   override.path,
+			"value":  override.value,
+			"reason": reason,
+		})
+	}
+	return rows
+}
+
+// splitHelmValuePath splits a path like "image.tag" or "ingress.hosts[0].host"
+// as helm --set does; "\." escapes a dot inside a key.
+func splitHelmValuePath(path string) []string {
+	parts := make([]string, 0)
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path) && path[i+1] == '.':
+			current.WriteByte('.')
+			i++
+		case path[i] == '.':
+			parts = append(parts, current.String())
+			current.Reset()
+		case path[i] == '[':
+			if end := strings.IndexByte(path[i:], ']'); end > 0 {
+				parts = append(parts, current.String(), path[i:i+end+1])
+				current.Reset()
+				i += end
+				if i+1 < len(path) && path[i+1] == '.' {
+					i++
+				}
+				continue
+			}
+			current.WriteByte(path[i])
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	parts = append(parts, current.String())
+	compact := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			compact = append(compact, part)
+		}
+	}
+	return compact
+}
+
+func lookupHelmValue(values map[string]interface{}, parts []string) (interface{}, bool) {
+	var current interface{} = values
+	for _, part := range parts {
+		if strings.HasPrefix(part, "[") {
+			items, ok := current.([]interface{})
+			index, err := strconv.Atoi(strings.Trim(part, "[]"))
+			if !ok || err != nil || index < 0 || index >= len(items) {
+				return nil, false
+			}
+			current = items[index]
+			continue
+		}
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func helmValueKind(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "a map"
+	case []interface{}:
+		return "a list"
+	default:
+		return "a value"
+	}
+}
@@ -0,0 +1,495 @@
+package ops
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	defaultHelmRelease   = "release-name"
+	defaultHelmNamespace = "default"
+	defaultKubeVersion   = "v1.31.0"
+)
+
+// helmLocalChart is a chart read from a directory or a .tgz archive with its
+// subcharts from charts/.
+type helmLocalChart struct {
+	name      string
+	metadata  map[string]interface{}
+	values    map[string]interface{}
+	templates map[string]string
+	crds      map[string]string
+	files     map[string][]byte
+	subcharts []*helmLocalChart
+}
+
+// helmRenderedFile is the output of one chart template.
+type helmRenderedFile struct {
+	name    string
+	content string
+}
+
+// isLocalHelmChart reports whether ref names a chart directory or a .tgz
+// archive on disk. Local charts are rendered by the CLI and never sent to the
+// API.
+func isLocalHelmChart(ref string) bool {
+	info, err := os.Stat(ref)
+	if err != nil {
+		return false
+	}
+	if info.IsDir() {
+		_, err := os.Stat(filepath.Join(ref, "Chart.yaml"))
+		return err == nil
+	}
+	return strings.HasSuffix(ref, ".tgz") || strings.HasSuffix(ref, ".tar.gz")
+}
+
+func loadLocalHelmChart(ref string) (*helmLocalChart, error) {
+	info, err := os.Stat(ref)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !info.IsDir() {
+		content, err := os.ReadFile(ref)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return loadHelmChartArchive(content)
+	}
+
+	files := map[string][]byte{}
+	err = filepath.WalkDir(ref, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if file != ref && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(ref, file)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = content
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return loadHelmChartFiles(files)
+}
+
+// loadHelmChartArchive reads a packaged chart, whose files are all below a
+// directory named after the chart.
+func loadHelmChartArchive(content []byte) (*helmLocalChart, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.Wrap(err, "read chart archive")
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read chart archive")
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(filepath.ToSlash(header.Name), "/"))
+		_, rel, ok := strings.Cut(name, "/")
+		if !ok || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if files[rel], err = io.ReadAll(reader); err != nil {
+			return nil, errors.Wrap(err, "read chart archive")
+		}
+	}
+	return loadHelmChartFiles(files)
+}
+
+func loadHelmChartFiles(files map[string][]byte) (*helmLocalChart, error) {
+	chartYAML, ok := files["Chart.yaml"]
+	if !ok {
+		return nil, errors.New("chart has no Chart.yaml")
+	}
+	chart := &helmLocalChart{
+		metadata:  map[string]interface{}{},
+		values:    map[string]interface{}{},
+		templates: map[string]string{},
+		crds:      map[string]string{},
+		files:     map[string][]byte{},
+	}
+	if err := yaml.Unmarshal(chartYAML, &chart.metadata); err != nil {
+		return nil, errors.Wrap(err, "decode Chart.yaml")
+	}
+	chart.name = scalarString(chart.metadata["name"])
+	if chart.name == "" {
+		return nil, errors.New("Chart.yaml has no name")
+	}
+	if values, ok := files["values.yaml"]; ok {
+		if err := yaml.Unmarshal(values, &chart.values); err != nil {
+			return nil, errors.Wrapf(err, "decode %s values.yaml", chart.name)
+		}
+		if chart.values == nil {
+			chart.values = map[string]interface{}{}
+		}
+	}
+
+	subchartFiles := map[string]map[string][]byte{}
+	for name, content := range files {
+		switch {
+		case strings.HasPrefix(name, "templates/"):
+			chart.templates[name] = string(content)
+		case strings.HasPrefix(name, "crds/"):
+			chart.crds[name] = string(content)
+		case strings.HasPrefix(name, "charts/"):
+			rel := strings.TrimPrefix(name, "charts/")
+			if dir, file, ok := strings.Cut(rel, "/"); ok {
+				if subchartFiles[dir] == nil {
+					subchartFiles[dir] = map[string][]byte{}
+				}
+				subchartFiles[dir][file] = content
+			} else if strings.HasSuffix(rel, ".tgz") {
+				subchart, err := loadHelmChartArchive(content)
+				if err != nil {
+					return nil, errors.Wrapf(err, "load subchart %s", rel)
+				}
+				chart.subcharts = append(chart.subcharts, subchart)
+			}
+		default:
+			chart.files[name] = content
+		}
+	}
+	dirs := make([]string, 0, len(subchartFiles))
+	for dir := range subchartFiles {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if _, ok := subchartFiles[dir]["Chart.yaml"]; !ok {
+			continue
+		}
+		subchart, err := loadHelmChartFiles(subchartFiles[dir])
+		if err != nil {
+			return nil, errors.Wrapf(err, "load subchart %s", dir)
+		}
+		chart.subcharts = append(chart.subcharts, subchart)
+	}
+	sort.Slice(chart.subcharts, func(i, j int) bool {
+		return chart.subcharts[i].name < chart.subcharts[j].name
+	})
+	return chart, nil
+}
+
+// helmRenderer renders the templates of a chart and its enabled subcharts
+// the way helm template does, with the Sprig and Helm functions in
+// helmTemplateFuncs. Template errors are collected as warnings so that one
+// broken template does not hide the rest of the chart.
+type helmRenderer struct {
+	release   string
+	namespace string
+	root      *template.Template
+	warnings  []string
+}
+
+type helmRenderScope struct {
+	prefix string
+	chart  *helmLocalChart
+	values map[string]interface{}
+}
+
+func renderLocalHelmChart(chart *helmLocalChart, values map[string]interface{}, release string, namespace string) ([]helmRenderedFile, []string) {
+	renderer := &helmRenderer{release: release, namespace: namespace}
+	renderer.root = template.New(chart.name).Option("missingkey=zero")
+	renderer.root.Funcs(helmTemplateFuncs(renderer))
+
+	merged := helmCopyValues(chart.values)
+	mergeManifestValues(merged, values)
+	scopes := renderer.scopes(chart.name, chart, merged, nil)
+
+	names := make([]string, 0)
+	for _, scope := range scopes {
+		templates := make([]string, 0, len(scope.chart.templates))
+		for name := range scope.chart.templates {
+			templates = append(templates, name)
+		}
+		sort.Strings(templates)
+		for _, name := range templates {
+			fullName := scope.prefix + "/" + name
+			if _, err := renderer.root.New(fullName).Parse(scope.chart.templates[name]); err != nil {
+				renderer.warnings = append(renderer.warnings, strings.TrimPrefix(err.Error(), "template: "))
+				continue
+			}
+			if strings.HasPrefix(path.Base(name), "_") || strings.HasSuffix(name, "NOTES.txt") {
+				continue
+			}
+			names = append(names, fullName)
+		}
+	}
+	sort.Strings(names)
+
+	files := make([]helmRenderedFile, 0, len(names))
+	for _, scope := range scopes {
+		crds := make([]string, 0, len(scope.chart.crds))
+		for name := range scope.chart.crds {
+			crds = append(crds, name)
+		}
+		sort.Strings(crds)
+		for _, name := range crds {
+			files = append(files, helmRenderedFile{name: scope.prefix + "/" + name, content: scope.chart.crds[name]})
+		}
+	}
+	for _, name := range names {
+		scope := helmScopeForTemplate(scopes, name)
+		var buffer bytes.Buffer
+		if err := renderer.root.ExecuteTemplate(&buffer, name, renderer.data(scope, name)); err != nil {
+			renderer.warnings = append(renderer.warnings, strings.TrimPrefix(err.Error(), "template: "))
+			continue
+		}
+		files = append(files, helmRenderedFile{name: name, content: strings.ReplaceAll(buffer.String(), "<no value>", "")})
+	}
+	return files, renderer.warnings
+}
+
+// scopes lists the chart and its subcharts that are enabled by their
+// dependency condition, each with the values it sees: its own defaults,
+// overridden by the parent values under its name, and the global values.
+func (r *helmRenderer) scopes(prefix string, chart *helmLocalChart, values map[string]interface{}, global map[string]interface{}) []helmRenderScope {
+	if global == nil {
+		global, _ = values["global"].(map[string]interface{})
+		if global == nil {
+			global = map[string]interface{}{}
+		}
+	}
+	values["global"] = global
+	scopes := []helmRenderScope{{prefix: prefix, chart: chart, values: values}}
+
+	vendored := map[string]bool{}
+	for _, subchart := range chart.subcharts {
+		vendored[subchart.name] = true
+	}
+	for _, dependency := range asRows(chart.metadata["dependencies"]) {
+		name := scalarString(dependency["name"])
+		if !vendored[name] && helmConditionEnabled(values, scalarString(dependency["condition"])) {
+			r.warnings = append(r.warnings, fmt.Sprintf("%s: dependency %s is not in charts/; run helm dependency build to include it", prefix, name))
+		}
+	}
+	for _, subchart := range chart.subcharts {
+		name := subchart.name
+		condition := ""
+		for _, dependency := range asRows(chart.metadata["dependencies"]) {
+			if scalarString(dependency["name"]) == subchart.name {
+				if alias := scalarString(dependency["alias"]); alias != "" {
+					name = alias
+				}
+				condition = scalarString(dependency["condition"])
+				break
+			}
+		}
+		if !helmConditionEnabled(values, condition) {
+			continue
+		}
+		subvalues := helmCopyValues(subchart.values)
+		if parent, ok := values[name].(map[string]interface{}); ok {
+			mergeManifestValues(subvalues, helmCopyValues(parent))
+		}
+		if subglobal, ok := subvalues["global"].(map[string]interface{}); ok {
+			merged := helmCopyValues(subglobal)
+			mergeManifestValues(merged, global)
+			global = merged
+		}
+		values[name] = subvalues
+		scopes = append(scopes, r.scopes(prefix+"/charts/"+name, subchart, subvalues, global)...)
+	}
+	return scopes
+}
+
+func (r *helmRenderer) data(scope helmRenderScope, name string) map[string]interface{} {
+	chart := map[string]interface{}{}
+	for key, value := range scope.chart.metadata {
+		switch key {
+		case "apiVersion":
+			chart["APIVersion"] = value
+		default:
+			chart[strings.ToUpper(key[:1])+key[1:]] = value
+		}
+	}
+	return map[string]interface{}{
+		"Values": scope.values,
+		"Chart":  chart,
+		"Release": map[string]interface{}{
+			"Name":      r.release,
+			"Namespace": r.namespace,
+			"Service":   "Helm",
+			"Revision":  1,
+			"IsInstall": true,
+			"IsUpgrade": false,
+		},
+		"Capabilities": map[string]interface{}{
+			"KubeVersion": map[string]interface{}{
+				"Version":    defaultKubeVersion,
+				"GitVersion": defaultKubeVersion,
+				"Major":      "1",
+				"Minor":      strings.Split(defaultKubeVersion, ".")[1],
+			},
+			"APIVersions": helmAPIVersions{},
+		},
+		"Template": map[string]interface{}{
+			"Name":     name,
+			"BasePath": scope.prefix + "/templates",
+		},
+		"Files": helmFiles(scope.chart.files),
+	}
+}
+
+func helmScopeForTemplate(scopes []helmRenderScope, name string) helmRenderScope {
+	match := scopes[0]
+	for _, scope := range scopes {
+		if strings.HasPrefix(name, scope.prefix+"/templates/") && len(scope.prefix) > len(match.prefix) {
+			match = scope
+		}
+	}
+	return match
+}
+
+// helmConditionEnabled evaluates a dependency condition: the first of its
+// comma separated value paths that is set decides.
+func helmConditionEnabled(values map[string]interface{}, condition string) bool {
+	for _, path := range strings.Split(condition, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		var value interface{} = values
+		for _, part := range strings.Split(path, ".") {
+			current, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = current[part]
+		}
+		if enabled, ok := value.(bool); ok {
+			return enabled
+		}
+	}
+	return true
+}
+
+func helmCopyValues(values map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = helmCopyValues(nested)
+		}
+		copied[key] = value
+	}
+	return copied
+}
+
+// helmAPIVersions answers .Capabilities.APIVersions.Has for the API groups
+// of a current Kubernetes release.
+type helmAPIVersions struct{}
+
+var helmKnownAPIVersions = map[string]bool{
+	"v1":                              true,
+	"apps/v1":                         true,
+	"batch/v1":                        true,
+	"autoscaling/v1":                  true,
+	"autoscaling/v2":                  true,
+	"policy/v1":                       true,
+	"networking.k8s.io/v1":            true,
+	"rbac.authorization.k8s.io/v1":    true,
+	"storage.k8s.io/v1":               true,
+	"scheduling.k8s.io/v1":            true,
+	"coordination.k8s.io/v1":          true,
+	"apiextensions.k8s.io/v1":         true,
+	"admissionregistration.k8s.io/v1": true,
+	"certificates.k8s.io/v1":          true,
+	"discovery.k8s.io/v1":             true,
+	"node.k8s.io/v1":                  true,
+}
+
+func (helmAPIVersions) Has(version string) bool {
+	if helmKnownAPIVersions[version] {
+		return true
+	}
+	group, _, ok := strings.Cut(version, "/")
+	return ok && helmKnownAPIVersions[group]
+}
+
+// helmFiles is .Files: the chart files outside templates/, crds/ and charts/.
+type helmFiles map[string][]byte
+
+func (f helmFiles) Get(name string) string {
+	return string(f[name])
+}
+
+func (f helmFiles) GetBytes(name string) []byte {
+	return f[name]
+}
+
+func (f helmFiles) Lines(name string) []string {
+	content := strings.TrimRight(string(f[name]), "\n")
+	if content == "" {
+		return []string{}
+	}
+	return strings.Split(content, "\n")
+}
+
+func (f helmFiles) Glob(pattern string) helmFiles {
+	matched := helmFiles{}
+	for name, content := range f {
+		if ok, _ := path.Match(pattern, name); ok {
+			matched[name] = content
+		}
+	}
+	return matched
+}
+
+func (f helmFiles) AsConfig() string {
+	return helmFilesYAML(f, func(content []byte) string { return string(content) })
+}
+
+func (f helmFiles) AsSecrets() string {
+	return helmFilesYAML(f, helmBase64)
+}
+
+func helmFilesYAML(files helmFiles, encode func([]byte) string) string {
+	values := map[string]interface{}{}
+	for name, content := range files {
+		values[path.Base(name)] = encode(content)
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return helmToYAML(values)
+}
@@ -0,0 +1,269 @@
+package ops
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.yaml.in/yaml/v3"
+)
+
+var (
+	helmWorkloadKinds = map[string]bool{
+		"Deployment":  true,
+		"StatefulSet": true,
+		"DaemonSet":   true,
+		"ReplicaSet":  true,
+		"Job":         true,
+		"CronJob":     true,
+		"Pod":         true,
+	}
+	helmClusterKinds = map[string]bool{
+		"Namespace":                      true,
+		"ClusterRole":                    true,
+		"ClusterRoleBinding":             true,
+		"PersistentVolume":               true,
+		"StorageClass":                   true,
+		"PriorityClass":                  true,
+		"IngressClass":                   true,
+		"RuntimeClass":                   true,
+		"APIService":                     true,
+		"ValidatingWebhookConfiguration": true,
+		"MutatingWebhookConfiguration":   true,
+	}
+	helmSupportedKinds = map[string]bool{
+		"Service":                 true,
+		"PersistentVolumeClaim":   true,
+		"ConfigMap":               true,
+		"Secret":                  true,
+		"ServiceAccount":          true,
+		"Role":                    true,
+		"RoleBinding":             true,
+		"Ingress":                 true,
+		"NetworkPolicy":           true,
+		"PodDisruptionBudget":     true,
+		"HorizontalPodAutoscaler": true,
+	}
+)
+
+// inspectLocalHelmChart renders a chart on disk and describes it in the
+// shape of the /helm-charts/actions/inspect response.
+func inspectLocalHelmChart(ref string, values map[string]interface{}, release string, namespace string) (map[string]interface{}, error) {
+	chart, err := loadLocalHelmChart(ref)
+	if err != nil {
+		return nil, err
+	}
+	if release == "" {
+		release = defaultHelmRelease
+	}
+	if namespace == "" {
+		namespace = defaultHelmNamespace
+	}
+	files, warnings := renderLocalHelmChart(chart, values, release, namespace)
+
+	resources := make([]map[string]interface{}, 0)
+	for _, file := range files {
+		decoder := yaml.NewDecoder(strings.NewReader(file.content))
+		for {
+			var resource map[string]interface{}
+			err := decoder.Decode(&resource)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				warnings = append(warnings, errors.Wrapf(err, "decode %s", file.name).Error())
+				break
+			}
+			if resource != nil && scalarString(resource["kind"]) != "" {
+				resources = append(resources, resource)
+			}
+		}
+	}
+
+	analysis := helmResourceAnalysis(resources)
+	analysis["chart"] = map[string]interface{}{
+		"name":       chart.name,
+		"version":    scalarString(chart.metadata["version"]),
+		"appVersion": scalarString(chart.metadata["appVersion"]),
+		"chart":      ref,
+	}
+	analysis["defaultValues"] = chart.values
+	analysis["release"] = release
+	analysis["namespace"] = namespace
+	analysis["warnings"] = append(warnings, helmStringList(analysis["warnings"])...)
+	return analysis, nil
+}
+
+func helmResourceAnalysis(resources []map[string]interface{}) map[string]interface{} {
+	workloads := make([]map[string]interface{}, 0)
+	services := make([]map[string]interface{}, 0)
+	volumeClaims := make([]map[string]interface{}, 0)
+	crds := make([]map[string]interface{}, 0)
+	clusterResources := make([]map[string]interface{}, 0)
+	hooks := make([]map[string]interface{}, 0)
+	unsupported := map[string]bool{}
+
+	for _, resource := range resources {
+		kind := scalarString(resource["kind"])
+		summary := map[string]interface{}{
+			"kind":       kind,
+			"name":       firstScalarPath(resource, "metadata.name"),
+			"apiVersion": scalarString(resource["apiVersion"]),
+		}
+		switch {
+		case helmHookAnnotation(resource) != "":
+			hooks = append(hooks, summary)
+		case kind == "CustomResourceDefinition":
+			crds = append(crds, summary)
+		case helmClusterKinds[kind]:
+			clusterResources = append(clusterResources, summary)
+		case helmWorkloadKinds[kind]:
+			workloads = append(workloads, helmWorkload(resource))
+		case kind == "Service":
+			services = append(services, helmService(resource))
+		case kind == "PersistentVolumeClaim":
+			volumeClaims = append(volumeClaims, helmVolumeClaim(firstScalarPath(resource, "metadata.name"), helmMap(resource["spec"])))
+		case !helmSupportedKinds[kind]:
+			unsupported[kind] = true
+		}
+	}
+
+	unsupportedKinds := make([]string, 0, len(unsupported))
+	for kind := range unsupported {
+		unsupportedKinds = append(unsupportedKinds, kind)
+	}
+	sort.Strings(unsupportedKinds)
+	warnings := make([]string, 0)
+	if len(workloads) == 0 {
+		warnings = append(warnings, "chart renders no workloads")
+	}
+	return map[string]interface{}{
+		"resourceCount":    len(resources),
+		"workloads":        workloads,
+		"services":         services,
+		"volumeClaims":     volumeClaims,
+		"crds":             crds,
+		"clusterResources": clusterResources,
+		"hooks":            hooks,
+		"unsupportedKinds": unsupportedKinds,
+		"warnings":         warnings,
+	}
+}
+
+// helmHookAnnotation reads the helm.sh/hook annotation, whose key contains a
+// dot and so cannot be reached with a value path.
+func helmHookAnnotation(resource map[string]interface{}) string {
+	annotations := helmMap(helmMap(resource["metadata"])["annotations"])
+	return scalarString(annotations["helm.sh/hook"])
+}
+
+func helmWorkload(resource map[string]interface{}) map[string]interface{} {
+	kind := scalarString(resource["kind"])
+	spec := helmMap(resource["spec"])
+	podSpec := helmMap(helmMap(spec["template"])["spec"])
+	switch kind {
+	case "Pod":
+		podSpec = spec
+	case "CronJob":
+		podSpec = helmMap(helmMap(helmMap(helmMap(spec["jobTemplate"])["spec"])["template"])["spec"])
+	}
+
+	volumes := make([]map[string]interface{}, 0)
+	for _, template := range asRows(spec["volumeClaimTemplates"]) {
+		volumes = append(volumes, helmVolumeClaim(firstScalarPath(template, "metadata.name"), helmMap(template["spec"])))
+	}
+	for _, volume := range asRows(podSpec["volumes"]) {
+		if claim := firstScalarPath(volume, "persistentVolumeClaim.claimName"); claim != "" {
+			volumes = append(volumes, map[string]interface{}{"name": claim})
+		}
+	}
+	return map[string]interface{}{
+		"kind":           kind,
+		"name":           firstScalarPath(resource, "metadata.name"),
+		"containers":     helmContainers(podSpec["containers"]),
+		"initContainers": helmContainers(podSpec["initContainers"]),
+		"volumes":        volumes,
+	}
+}
+
+func helmContainers(value interface{}) []map[string]interface{} {
+	containers := make([]map[string]interface{}, 0)
+	for _, container := range asRows(value) {
+		ports := make([]map[string]interface{}, 0)
+		for _, port := range asRows(container["ports"]) {
+			ports = append(ports, map[string]interface{}{
+				"name":     scalarString(port["name"]),
+				"number":   scalarString(port["containerPort"]),
+				"protocol": helmLower(helmStringOr(port["protocol"], "TCP")),
+			})
+		}
+		env := make([]string, 0)
+		for _, item := range asRows(container["env"]) {
+			env = append(env, scalarString(item["name"]))
+		}
+		containers = append(containers, map[string]interface{}{
+			"name":  scalarString(container["name"]),
+			"image": scalarString(container["image"]),
+			"ports": ports,
+			"env":   env,
+		})
+	}
+	return containers
+}
+
+func helmService(resource map[string]interface{}) map[string]interface{} {
+	spec := helmMap(resource["spec"])
+	ports := make([]map[string]interface{}, 0)
+	for _, port := range asRows(spec["ports"]) {
+		ports = append(ports, map[string]interface{}{
+			"name":       scalarString(port["name"]),
+			"number":     scalarString(port["port"]),
+			"targetPort": scalarString(port["targetPort"]),
+			"protocol":   helmLower(helmStringOr(port["protocol"], "TCP")),
+		})
+	}
+	return map[string]interface{}{
+		"name":     firstScalarPath(resource, "metadata.name"),
+		"headless": scalarString(spec["clusterIP"]) == "None",
+		"ports":    ports,
+	}
+}
+
+func helmVolumeClaim(name string, spec map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":             name,
+		"size":             firstScalarPath(spec, "resources.requests.storage"),
+		"storageClassName": scalarString(spec["storageClassName"]),
+		"accessModes":      helmStringList(spec["accessModes"]),
+	}
+}
+
+func helmMap(value interface{}) map[string]interface{} {
+	if values, ok := value.(map[string]interface{}); ok {
+		return values
+	}
+	return map[string]interface{}{}
+}
+
+func helmStringOr(value interface{}, fallback string) string {
+	if scalar := scalarString(value); scalar != "" {
+		return scalar
+	}
+	return fallback
+}
+
+// readHelmValues reads --values or --values-yaml for local rendering.
+func readHelmValues(body map[string]interface{}) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if provided, ok := body["values"].(map[string]interface{}); ok {
+		values = provided
+	}
+	if valuesYAML, ok := body["valuesYaml"].(string); ok {
+		if err := yaml.NewDecoder(bytes.NewReader([]byte(valuesYAML))).Decode(&values); err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "decode values yaml")
+		}
+	}
+	return values, nil
+}
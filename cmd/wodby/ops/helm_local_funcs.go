@@ -0,0 +1,158 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/pkg/errors"
+	"go.yaml.in/yaml/v3"
+)
+
+// helmOfflineCertificate stands in for the certificates genCA and the other
+// cert functions return; templates read its Cert and Key.
+type helmOfflineCertificate struct {
+	Cert string
+	Key  string
+}
+
+// helmTemplateFuncs returns the Sprig functions with the Helm additions, the
+// way Helm builds its function map. Functions that need a cluster, DNS or
+// randomness, like lookup, getHostByName, randAlphaNum and genCA, return
+// empty or fixed values so that rendering stays offline and repeatable.
+func helmTemplateFuncs(r *helmRenderer) template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	delete(funcs, "env")
+	delete(funcs, "expandenv")
+
+	helm := template.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			var buffer bytes.Buffer
+			if err := r.root.ExecuteTemplate(&buffer, name, data); err != nil {
+				return "", err
+			}
+			return buffer.String(), nil
+		},
+		"tpl": func(text string, data interface{}) (string, error) {
+			clone, err := r.root.Clone()
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+			tmpl, err := clone.New("tpl").Parse(text)
+			if err != nil {
+				return "", err
+			}
+			var buffer bytes.Buffer
+			if err := tmpl.Execute(&buffer, data); err != nil {
+				return "", err
+			}
+			return strings.ReplaceAll(buffer.String(), "<no value>", ""), nil
+		},
+		"required": func(message string, value interface{}) (interface{}, error) {
+			if value == nil || value == "" {
+				return nil, errors.New(message)
+			}
+			return value, nil
+		},
+		"lookup": func(...interface{}) map[string]interface{} {
+			return map[string]interface{}{}
+		},
+		"getHostByName": func(string) string {
+			return ""
+		},
+
+		"toYaml":        helmToYAML,
+		"mustToYaml":    helmToYAML,
+		"fromYaml":      helmFromYAML,
+		"fromYamlArray": helmFromYAMLArray,
+		"toJson":        helmToJSON,
+		"fromJson": func(content string) map[string]interface{} {
+			values := map[string]interface{}{}
+			_ = json.Unmarshal([]byte(content), &values)
+			return values
+		},
+
+		"randAlphaNum": helmPlaceholder,
+		"randAlpha":    helmPlaceholder,
+		"randNumeric":  helmPlaceholder,
+		"randAscii":    helmPlaceholder,
+		"randInt":      func(min int, max int) int { return min },
+		"randBytes":    func(count int) string { return helmBase64(make([]byte, max(count, 0))) },
+		"shuffle":      func(value string) string { return value },
+		"uuidv4": func() string {
+			return "00000000-0000-4000-8000-000000000000"
+		},
+		"now": func() time.Time {
+			return time.Unix(0, 0).UTC()
+		},
+
+		"genPrivateKey":            func(string) string { return "" },
+		"genCA":                    helmOfflineCertificateFunc,
+		"genCAWithKey":             helmOfflineCertificateFunc,
+		"genSelfSignedCert":        helmOfflineCertificateFunc,
+		"genSelfSignedCertWithKey": helmOfflineCertificateFunc,
+		"genSignedCert":            helmOfflineCertificateFunc,
+		"genSignedCertWithKey":     helmOfflineCertificateFunc,
+		"htpasswd":                 func(username string, _ ...interface{}) string { return username + ":" },
+		"bcrypt":                   func(string) string { return "" },
+		"encryptAES":               func(string, string) (string, error) { return "", nil },
+	}
+	for name, fn := range helm {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+func helmToYAML(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return ""
+	}
+	_ = encoder.Close()
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+func helmFromYAML(content string) map[string]interface{} {
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(content), &values); err != nil {
+		return map[string]interface{}{"Error": err.Error()}
+	}
+	return values
+}
+
+func helmFromYAMLArray(content string) []interface{} {
+	values := []interface{}{}
+	if err := yaml.Unmarshal([]byte(content), &values); err != nil {
+		return []interface{}{err.Error()}
+	}
+	return values
+}
+
+func helmToJSON(value interface{}) string {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+func helmBase64(content []byte) string {
+	return base64.StdEncoding.EncodeToString(content)
+}
+
+func helmOfflineCertificateFunc(...interface{}) helmOfflineCertificate {
+	return helmOfflineCertificate{}
+}
+
+func helmPlaceholder(length int) string {
+	return strings.Repeat("x", max(length, 0))
+}
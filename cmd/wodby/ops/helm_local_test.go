@@ -0,0 +1,320 @@
+package ops
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+var testHelmChartFiles = map[string]string{
+	"Chart.yaml": `apiVersion: v2
+name: shop
+version: 1.2.0
+appVersion: "3.4"
+dependencies:
+  - name: redis
+    version: 1.0.0
+    condition: redis.enabled
+  - name: metrics
+    version: 1.0.0
+    condition: metrics.enabled
+`,
+	"values.yaml": `replicaCount: 1
+image:
+  repository: registry.example.com/shop
+  tag: ""
+service:
+  type: ClusterIP
+  port: 80
+persistence:
+  enabled: false
+  size: 8Gi
+env:
+  APP_ENV: prod
+redis:
+  enabled: true
+metrics:
+  enabled: false
+`,
+	"templates/_helpers.tpl": `{{- define "shop.name" -}}
+{{- default .Chart.Name .Values.nameOverride | trunc 63 | trimSuffix "-" }}
+{{- end }}
+
+{{- define "shop.fullname" -}}
+{{- if contains .Chart.Name .Release.Name }}
+{{- .Release.Name | trunc 63 | trimSuffix "-" }}
+{{- else }}
+{{- printf "%s-%s" .Release.Name .Chart.Name | trunc 63 | trimSuffix "-" }}
+{{- end }}
+{{- end }}
+
+{{- define "shop.labels" -}}
+helm.sh/chart: {{ printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" }}
+app.kubernetes.io/name: {{ include "shop.name" . }}
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end }}
+`,
+	"templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ include "shop.fullname" . }}
+  labels:
+    {{- include "shop.labels" . | nindent 4 }}
+spec:
+  replicas: {{ .Values.replicaCount }}
+  template:
+    spec:
+      containers:
+        - name: {{ .Chart.Name }}
+          image: "{{ .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}"
+          ports:
+            - name: http
+              containerPort: 8080
+          env:
+            {{- range $name, $value := .Values.env }}
+            - name: {{ $name }}
+              value: {{ $value | quote }}
+            {{- end }}
+          {{- if .Values.persistence.enabled }}
+          volumeMounts:
+            - name: data
+              mountPath: /data
+          {{- end }}
+      {{- if .Values.persistence.enabled }}
+      volumes:
+        - name: data
+          persistentVolumeClaim:
+            claimName: {{ include "shop.fullname" . }}
+      {{- end }}
+`,
+	"templates/service.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: {{ include "shop.fullname" . }}
+spec:
+  type: {{ .Values.service.type }}
+  ports:
+    - port: {{ .Values.service.port }}
+      targetPort: http
+      name: http
+`,
+	"templates/pvc.yaml": `{{- if .Values.persistence.enabled }}
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: {{ include "shop.fullname" . }}
+spec:
+  accessModes: [ReadWriteOnce]
+  resources:
+    requests:
+      storage: {{ .Values.persistence.size | quote }}
+{{- end }}
+`,
+	"templates/tests/test-connection.yaml": `apiVersion: v1
+kind: Pod
+metadata:
+  name: "{{ include "shop.fullname" . }}-test-connection"
+  annotations:
+    "helm.sh/hook": test
+spec:
+  containers:
+    - name: wget
+      image: busybox
+`,
+	"templates/NOTES.txt": `Visit {{ .Values.missing.value }}`,
+	"charts/redis/Chart.yaml": `apiVersion: v2
+name: redis
+version: 1.0.0
+`,
+	"charts/redis/values.yaml": `architecture: standalone
+storage: 1Gi
+`,
+	"charts/redis/templates/statefulset.yaml": `apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: {{ .Release.Name }}-redis-{{ .Values.architecture }}
+spec:
+  template:
+    spec:
+      containers:
+        - name: redis
+          image: redis:7
+          ports:
+            - name: redis
+              containerPort: 6379
+  volumeClaimTemplates:
+    - metadata:
+        name: data
+      spec:
+        accessModes: [ReadWriteOnce]
+        resources:
+          requests:
+            storage: {{ .Values.storage }}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Release.Name }}-redis-headless
+spec:
+  clusterIP: None
+  ports:
+    - name: redis
+      port: 6379
+`,
+}
+
+func writeTestHelmChart(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "shop")
+	for name, content := range testHelmChartFiles {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func helmAnalysisSummary(analysis map[string]interface{}) string {
+	lines := []string{}
+	for _, workload := range asRows(analysis["workloads"]) {
+		for _, container := range asRows(workload["containers"]) {
+			lines = append(lines, fmt.Sprintf("workload %s %s %s %s %s %v", workload["kind"], workload["name"], container["name"], container["image"], strings.Join(helmPortLabels(asRows(container["ports"])), ","), container["env"]))
+		}
+		for _, label := range helmVolumeClaimLabels(asRows(workload["volumes"])) {
+			lines = append(lines, fmt.Sprintf("volume %s %s", workload["name"], label))
+		}
+	}
+	for _, service := range asRows(analysis["services"]) {
+		lines = append(lines, fmt.Sprintf("service %s headless=%v %s", service["name"], service["headless"], strings.Join(helmPortLabels(asRows(service["ports"])), ",")))
+	}
+	for _, label := range helmVolumeClaimLabels(asRows(analysis["volumeClaims"])) {
+		lines = append(lines, "claim "+label)
+	}
+	for _, hook := range asRows(analysis["hooks"]) {
+		lines = append(lines, fmt.Sprintf("hook %s %s", hook["kind"], hook["name"]))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestInspectLocalHelmChartRendersDefaultValues(t *testing.T) {
+	dir := writeTestHelmChart(t)
+
+	analysis, err := inspectLocalHelmChart(dir, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `hook Pod release-name-shop-test-connection
+service release-name-redis-headless headless=true redis:6379/tcp
+service release-name-shop headless=false http:80/tcp
+volume release-name-redis-standalone data (1Gi; ReadWriteOnce)
+workload Deployment release-name-shop shop registry.example.com/shop:3.4 http:8080/tcp [APP_ENV]
+workload StatefulSet release-name-redis-standalone redis redis:7 redis:6379/tcp []`
+	if got := helmAnalysisSummary(analysis); got != want {
+		t.Fatalf("analysis =\n%s\nwant\n%s", got, want)
+	}
+	if analysis["resourceCount"] != 5 || analysis["release"] != "release-name" || analysis["namespace"] != "default" {
+		t.Fatalf("analysis = %#v", analysis)
+	}
+	if got := fmt.Sprint(analysis["warnings"]); got != "[]" {
+		t.Fatalf("warnings = %s", got)
+	}
+}
+
+func TestInspectLocalHelmChartAppliesValuesToArchive(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	for name, content := range testHelmChartFiles {
+		if err := tw.WriteHeader(&tar.Header{Name: "shop/" + name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "shop-1.2.0.tgz")
+	if err := os.WriteFile(path, archive.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]interface{}{
+		"image":       map[string]interface{}{"tag": "3.5"},
+		"persistence": map[string]interface{}{"enabled": true},
+		"redis":       map[string]interface{}{"enabled": false},
+		"metrics":     map[string]interface{}{"enabled": true},
+	}
+	analysis, err := inspectLocalHelmChart(path, values, "shop", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `claim shop (8Gi; ReadWriteOnce)
+hook Pod shop-test-connection
+service shop headless=false http:80/tcp
+volume shop shop
+workload Deployment shop shop registry.example.com/shop:3.5 http:8080/tcp [APP_ENV]`
+	if got := helmAnalysisSummary(analysis); got != want {
+		t.Fatalf("analysis =\n%s\nwant\n%s", got, want)
+	}
+	if got := fmt.Sprint(analysis["warnings"]); got != "[shop: dependency metrics is not in charts/; run helm dependency build to include it]" {
+		t.Fatalf("warnings = %s", got)
+	}
+}
+
+func TestHelmTemplateFuncsRenderOffline(t *testing.T) {
+	tmpl, err := template.New("secret.yaml").Funcs(helmTemplateFuncs(&helmRenderer{})).Parse(`host: "{{ getHostByName "localhost" }}"
+port: {{ randInt 1000 2000 }}
+{{- $ca := genCA "shop-ca" 365 }}
+ca: "{{ $ca.Cert }}"
+password: {{ randAlphaNum 4 }}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, nil); err != nil {
+			t.Fatal(err)
+		}
+		if want := "host: \"\"\nport: 1000\nca: \"\"\npassword: xxxx\n"; rendered.String() != want {
+			t.Fatalf("rendered =\n%s\nwant\n%s", rendered.String(), want)
+		}
+	}
+}
+
+func TestHelmSemverCompare(t *testing.T) {
+	for constraint, want := range map[string]bool{
+		">=1.19-0":           true,
+		">= 1.19.0, <1.31":   false,
+		"<1.19 || >=1.30":    true,
+		"~1.31.0":            true,
+		"^2.0":               false,
+		">=1.21-0 <1.32.0-0": true,
+	} {
+		semverCompare := helmTemplateFuncs(&helmRenderer{})["semverCompare"].(func(string, string) (bool, error))
+		got, err := semverCompare(constraint, defaultKubeVersion)
+		if err != nil {
+			t.Fatalf("semverCompare(%q) error = %v", constraint, err)
+		}
+		if got != want {
+			t.Fatalf("semverCompare(%q) = %v, want %v", constraint, got, want)
+		}
+	}
+}
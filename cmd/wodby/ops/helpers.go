@@ -1287,6 +1287,16 @@ func formatOutdatedColumn(row map[string]interface{}) string {
 	return "no"
 }
 
+// formatEOLColumn reports whether a service or database version reached its
+// end of life, or "" when the API does not say.
+func formatEOLColumn(row map[string]interface{}) string {
+	value := firstNonNilPath(row, "eol", "isEol", "endOfLife", "serviceRev.eol", "serviceRevision.eol", "deprecated", "serviceRev.deprecated", "serviceRevision.deprecated")
+	if value == nil {
+		return ""
+	}
+	return formatYesNo(value)
+}
+
 func formatYesNo(value interface{}) string {
 	switch v := value.(type) {
 	case bool:
@@ -2076,48 +2086,77 @@ func imageCollectionPaths() []string {
 }
 
 func deploymentImageLabels(row map[string]interface{}) []string {
+	images := deploymentServiceImages(row)
+	if images == nil {
+		return nil
+	}
+	labels := make([]string, 0, len(images))
+	for _, image := range images {
+		if image.service != "" && image.service != image.image {
+			labels = append(labels, image.service+"="+image.image)
+			continue
+		}
+		labels = append(labels, image.image)
+	}
+	return labels
+}
+
+// deploymentServiceImage is the image a deployment rolled out to one app
+// service, with the service build it came from.
+type deploymentServiceImage struct {
+	serviceID string
+	service   string
+	buildID   string
+	image     string
+}
+
+func deploymentServiceImages(row map[string]interface{}) []deploymentServiceImage {
 	buildImagesByID := map[string]string{}
-	buildImagesByServiceID := map[string]string{}
+	buildsByServiceID := map[string]deploymentServiceImage{}
 	for _, build := range asRows(firstNonNilPath(row, "builds", "appBuilds", "build", "appBuild")) {
 		for _, serviceBuild := range asRows(firstNonNilPath(build, "appServiceBuilds", "serviceBuilds", "services")) {
 			image := imageReference(serviceBuild)
 			if image == "" {
 				continue
 			}
-			if id := firstScalarPath(serviceBuild, "id", "appServiceBuildId", "serviceBuildId"); id != "" {
+			id := firstScalarPath(serviceBuild, "id", "appServiceBuildId", "serviceBuildId")
+			if id != "" {
 				buildImagesByID[id] = image
 			}
 			if serviceID := firstRelationID(serviceBuild, relationColumns["service"]); serviceID != "" {
-				buildImagesByServiceID[serviceID] = image
+				buildsByServiceID[serviceID] = deploymentServiceImage{buildID: id, image: image}
 			}
 		}
 	}
 
-	if len(buildImagesByID) == 0 && len(buildImagesByServiceID) == 0 {
+	if len(buildImagesByID) == 0 && len(buildsByServiceID) == 0 {
 		return nil
 	}
 
 	serviceDeployments := firstNonNilPath(row, "appServiceDeployments", "serviceDeployments", "deploymentServices", "appDeploymentServices", "services")
-	labels := make([]string, 0)
+	images := make([]deploymentServiceImage, 0)
 	for _, deployment := range asRows(serviceDeployments) {
-		image := ""
-		if buildID := firstScalarPath(deployment, "appServiceBuildId", "appServiceBuild.id", "serviceBuildId", "serviceBuild.id"); buildID != "" {
-			image = buildImagesByID[buildID]
-		}
-		if image == "" {
-			serviceID := firstRelationID(deployment, relationColumns["service"])
-			image = buildImagesByServiceID[serviceID]
-		}
-		if image == "" {
-			continue
+		item := deploymentServiceImage{
+			serviceID: firstRelationID(deployment, relationColumns["service"]),
+			service:   serviceLabel(deployment),
+			buildID:   firstScalarPath(deployment, "appServiceBuildId", "appServiceBuild.id", "serviceBuildId", "serviceBuild.id"),
+		}
+		if item.buildID != "" {
+			item.image = buildImagesByID[item.buildID]
+		}
+		if item.image == "" {
+			build := buildsByServiceID[item.serviceID]
+			item.image = build.image
+			if item.buildID == "" {
+				item.buildID = build.buildID
+			}
 		}
-		if service := serviceLabel(deployment); service != "" && service != image {
-			labels = append(labels, service+"="+image)
+		if item.image == "" {
 			continue
 		}
-		labels = append(labels, image)
+		images = append(images, item)
 	}
-	return labels
+	return images
 }
 
 func imageLabels(value interface{}) []string {
@@ -0,0 +1,331 @@
+package ops
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+const importSourceUpload = "upload"
+
+// importUploadState is kept in the user cache directory between runs so an
+// interrupted multipart upload of the same file continues where it stopped.
+// The upload session belongs to a service, kind and account, so they are part
+// of the state and a session is only resumed for the same ones.
+type importUploadState struct {
+	UploadID    string         `json:"uploadId"`
+	API         string         `json:"api"`
+	Credentials string         `json:"credentials"`
+	ServiceID   string         `json:"serviceId"`
+	Kind        string         `json:"kind"`
+	Checksum    string         `json:"checksum"`
+	Size        int64          `json:"size"`
+	Parts       map[int]string `json:"parts"`
+}
+
+// newImportUploadState returns an empty state for uploading a file to a
+// service with the current API endpoint and credentials. Only a hash of the
+// credentials is kept.
+func newImportUploadState(checksum string, size int64, kind string, serviceID string) importUploadState {
+	credentials := sha256.Sum256([]byte(viper.GetString("api_key") + "\n" + viper.GetString("access_token")))
+	return importUploadState{
+		API:         apiBaseURL(),
+		Credentials: hex.EncodeToString(credentials[:]),
+		ServiceID:   serviceID,
+		Kind:        kind,
+		Checksum:    checksum,
+		Size:        size,
+		Parts:       map[int]string{},
+	}
+}
+
+// sameTarget reports whether two states are for the same file, service, kind
+// and account.
+func (s importUploadState) sameTarget(other importUploadState) bool {
+	return s.API == other.API && s.Credentials == other.Credentials && s.ServiceID == other.ServiceID &&
+		s.Kind == other.Kind && s.Checksum == other.Checksum && s.Size == other.Size
+}
+
+type importUploadSession struct {
+	id       string
+	url      string
+	partSize int64
+	parts    []importUploadPart
+}
+
+type importUploadPart struct {
+	number int
+	url    string
+	etag   string
+}
+
+// importUploadKind infers whether a local file is a database dump or a files
+// archive from its name.
+func importUploadKind(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, suffix := range []string{".sql", ".sql.gz", ".sql.zst", ".sql.bz2", ".dump", ".dump.gz"} {
+		if strings.HasSuffix(name, suffix) {
+			return "db"
+		}
+	}
+	return "files"
+}
+
+func uploadImportFile(ctx context.Context, cmd *cobra.Command, client *rest.Client, path string, kind string, serviceID string, retries int) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", errors.Errorf("%s is not a regular file", path)
+	}
+	sum, err := fileChecksum(path, "sha256")
+	if err != nil {
+		return "", err
+	}
+	checksum := "sha256:" + sum
+
+	target := newImportUploadState(checksum, info.Size(), kind, serviceID)
+	statePath := importUploadStatePath(target)
+	state := loadImportUploadState(statePath, target)
+	session, err := resumeImportUpload(ctx, client, state.UploadID)
+	if err != nil {
+		return "", err
+	}
+	if session == nil {
+		body := map[string]interface{}{
+			"fileName":     filepath.Base(path),
+			"size":         info.Size(),
+			"checksum":     checksum,
+			"kind":         kind,
+			"appServiceId": optionalInt(serviceID),
+		}
+		var result interface{}
+		if err := client.Post(ctx, "/import-uploads", nil, bodyFromMap(body), &result); err != nil {
+			return "", errors.Wrap(err, "start upload")
+		}
+		session, err = parseImportUploadSession(result)
+		if err != nil {
+			return "", err
+		}
+		state = target
+		state.UploadID = session.id
+	}
+	for _, part := range session.parts {
+		if part.etag != "" {
+			state.Parts[part.number] = part.etag
+		}
+	}
+	saveImportUploadState(statePath, state)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer file.Close()
+
+	progress := newTransferProgress(cmd.ErrOrStderr(), "upload "+filepath.Base(path), info.Size(), 0)
+	complete := map[string]interface{}{}
+	if session.url != "" {
+		if _, err := putUploadPart(ctx, session.url, io.NewSectionReader(file, 0, info.Size()), info.Size(), progress, retries); err != nil {
+			return "", err
+		}
+	} else {
+		parts := make([]map[string]interface{}, 0, len(session.parts))
+		for _, part := range session.parts {
+			offset := int64(part.number-1) * session.partSize
+			size := min(session.partSize, info.Size()-offset)
+			if size <= 0 {
+				continue
+			}
+			etag := state.Parts[part.number]
+			if etag != "" {
+				progress.done += size
+			} else {
+				etag, err = putUploadPart(ctx, part.url, io.NewSectionReader(file, offset, size), size, progress, retries)
+				if err != nil {
+					return "", errors.Wrapf(err, "upload part %d; run the command again to resume", part.number)
+				}
+				state.Parts[part.number] = etag
+				saveImportUploadState(statePath, state)
+			}
+			parts = append(parts, map[string]interface{}{"partNumber": part.number, "etag": etag})
+		}
+		complete["parts"] = parts
+	}
+	progress.Finish()
+
+	if err := client.Post(ctx, escapedPath("/import-uploads/%s/complete", session.id), nil, complete, nil); err != nil {
+		return "", errors.Wrap(err, "complete upload")
+	}
+	_ = os.Remove(statePath)
+	return session.id, nil
+}
+
+func resumeImportUpload(ctx context.Context, client *rest.Client, uploadID string) (*importUploadSession, error) {
+	if uploadID == "" {
+		return nil, nil
+	}
+	var result interface{}
+	if err := client.Get(ctx, escapedPath("/import-uploads/%s", uploadID), nil, &result); err != nil {
+		var apiErr *rest.APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusGone) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	row := cloneFirstRow(normalizeItem(result))
+	if status := strings.ToLower(firstScalarPath(row, "status")); status == "expired" || status == "aborted" || status == "completed" {
+		return nil, nil
+	}
+	return parseImportUploadSession(result)
+}
+
+func parseImportUploadSession(value interface{}) (*importUploadSession, error) {
+	row := cloneFirstRow(normalizeItem(value))
+	if row == nil {
+		return nil, errors.New("upload response did not include an item")
+	}
+	session := &importUploadSession{
+		id:  firstScalarPath(row, "id", "uploadId"),
+		url: firstScalarPath(row, "url", "uploadUrl"),
+	}
+	if session.id == "" {
+		return nil, errors.New("upload response did not include an id")
+	}
+	if size := firstScalarPath(row, "partSize"); size != "" {
+		parsed, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || parsed <= 0 {
+			return nil, errors.Errorf("invalid upload part size %q", size)
+		}
+		session.partSize = parsed
+	}
+	for _, part := range asRows(row["parts"]) {
+		number, err := strconv.Atoi(firstScalarPath(part, "partNumber", "number"))
+		if err != nil || number < 1 {
+			return nil, errors.New("upload response included a part without a number")
+		}
+		session.parts = append(session.parts, importUploadPart{
+			number: number,
+			url:    firstScalarPath(part, "url", "uploadUrl"),
+			etag:   firstScalarPath(part, "etag", "eTag"),
+		})
+	}
+	sort.Slice(session.parts, func(i, j int) bool { return session.parts[i].number < session.parts[j].number })
+	if session.url == "" && (len(session.parts) == 0 || session.partSize == 0) {
+		return nil, errors.New("upload response included neither a url nor parts")
+	}
+	return session, nil
+}
+
+// putUploadPart sends one signed PUT, retrying the whole part on failure, and
+// returns the ETag reported by the object store.
+func putUploadPart(ctx context.Context, signedURL string, body *io.SectionReader, size int64, progress *transferProgress, retries int) (string, error) {
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(transferRetryDelay):
+			}
+		}
+		start := progress.done
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return "", errors.WithStack(err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, signedURL, io.TeeReader(body, progress))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		req.ContentLength = size
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+				return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+			}
+			err = errors.Errorf("upload returned status %d", resp.StatusCode)
+		}
+		lastErr = err
+		progress.done = start
+	}
+	return "", errors.Wrap(lastErr, "upload")
+}
+
+func importUploadStatePath(target importUploadState) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{target.API, target.Credentials, target.ServiceID, target.Kind, target.Checksum}, "\n")))
+	return filepath.Join(dir, "wodby", "uploads", hex.EncodeToString(sum[:])+".json")
+}
+
+// loadImportUploadState returns the saved state when it is for the same
+// target, and target itself otherwise.
+func loadImportUploadState(path string, target importUploadState) importUploadState {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return target
+	}
+	state := importUploadState{}
+	if err := json.Unmarshal(content, &state); err != nil || !state.sameTarget(target) {
+		return target
+	}
+	if state.Parts == nil {
+		state.Parts = map[int]string{}
+	}
+	return state
+}
+
+// saveImportUploadState is best effort; losing it only means a later run
+// starts the upload again.
+func saveImportUploadState(path string, state importUploadState) {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return
+	}
+	_ = os.WriteFile(path, content, 0o600)
+}
+
+func resolveImportServiceID(ctx context.Context, client *rest.Client, service string, instanceID string) (string, error) {
+	if service == "" {
+		return "", nil
+	}
+	if _, err := strconv.Atoi(service); err == nil {
+		return service, nil
+	}
+	if instanceID == "" {
+		return "", errors.New("--instance is required to resolve --service by name")
+	}
+	rows, err := fetchRows(ctx, client, "/app-services", url.Values{"appInstanceId": []string{instanceID}})
+	if err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		if firstScalarPath(row, "name") == service {
+			return firstScalarPath(row, "id"), nil
+		}
+	}
+	return "", errors.Errorf("app instance %s has no service named %q", instanceID, service)
+}
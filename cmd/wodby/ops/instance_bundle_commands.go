@@ -0,0 +1,978 @@
+package ops
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	instanceBundleKind    = "AppInstanceBundle"
+	instanceBundleVersion = 1
+
+	bundleSecretsMasked    = "masked"
+	bundleSecretsHashed    = "hashed"
+	bundleSecretsEncrypted = "encrypted"
+	bundleSecretsPlain     = "plain"
+
+	defaultBundlePassphraseEnv = "WODBY_BUNDLE_PASSPHRASE"
+	bundleKDFIterations        = 600000
+)
+
+var instanceBundleChangeColumns = []string{"service", "section", "item", "action", "detail"}
+
+// instanceBundle is the portable configuration record of one app instance.
+// Items are kept as plain maps so the document follows the API field names.
+type instanceBundle struct {
+	Kind       string                    `json:"kind" yaml:"kind"`
+	Version    int                       `json:"version" yaml:"version"`
+	ExportedAt string                    `json:"exportedAt,omitempty" yaml:"exportedAt,omitempty"`
+	Secrets    string                    `json:"secrets" yaml:"secrets"`
+	Encryption *instanceBundleEncryption `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+	Instance   map[string]interface{}    `json:"instance" yaml:"instance"`
+	Services   []*instanceBundleService  `json:"services" yaml:"services"`
+}
+
+type instanceBundleEncryption struct {
+	Algorithm  string `json:"algorithm" yaml:"algorithm"`
+	KDF        string `json:"kdf" yaml:"kdf"`
+	Iterations int    `json:"iterations" yaml:"iterations"`
+	Salt       string `json:"salt" yaml:"salt"`
+}
+
+type instanceBundleService struct {
+	ID            string                   `json:"id,omitempty" yaml:"id,omitempty"`
+	Name          string                   `json:"name" yaml:"name"`
+	Title         string                   `json:"title,omitempty" yaml:"title,omitempty"`
+	Type          string                   `json:"type,omitempty" yaml:"type,omitempty"`
+	Version       string                   `json:"version,omitempty" yaml:"version,omitempty"`
+	Replicas      interface{}              `json:"replicas,omitempty" yaml:"replicas,omitempty"`
+	Disabled      bool                     `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	EnvVars       []map[string]interface{} `json:"envVars,omitempty" yaml:"envVars,omitempty"`
+	HelmValues    []map[string]interface{} `json:"helmValues,omitempty" yaml:"helmValues,omitempty"`
+	Tokens        []map[string]interface{} `json:"tokens,omitempty" yaml:"tokens,omitempty"`
+	Annotations   []map[string]interface{} `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Settings      []map[string]interface{} `json:"settings,omitempty" yaml:"settings,omitempty"`
+	Configs       []map[string]interface{} `json:"configs,omitempty" yaml:"configs,omitempty"`
+	Links         []map[string]interface{} `json:"links,omitempty" yaml:"links,omitempty"`
+	Volumes       []map[string]interface{} `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	CronSchedules []map[string]interface{} `json:"cronSchedules,omitempty" yaml:"cronSchedules,omitempty"`
+	Resources     []map[string]interface{} `json:"resources,omitempty" yaml:"resources,omitempty"`
+	Routes        []map[string]interface{} `json:"routes,omitempty" yaml:"routes,omitempty"`
+	Ports         []map[string]interface{} `json:"ports,omitempty" yaml:"ports,omitempty"`
+}
+
+// instanceBundleSection describes how one kind of app service child resource
+// is read into a bundle and written back by import-config.
+type instanceBundleSection struct {
+	key      string
+	label    string
+	listPath string
+	fields   []string
+	identity []string
+	secret   bool
+
+	createPath   string
+	createFields []string
+	updatePath   string
+	updateFields []string
+	deletePath   string
+	setPath      string
+	setByName    bool
+	setFields    []string
+
+	fromRow func(row map[string]interface{}) map[string]interface{}
+	items   func(service *instanceBundleService) *[]map[string]interface{}
+}
+
+var instanceBundleSections = []instanceBundleSection{
+	{
+		key:          "envVars",
+		items:        func(s *instanceBundleService) *[]map[string]interface{} { return &s.EnvVars },
+		label:        "env var",
+		listPath:     "/app-services/%s/env-vars",
+		fields:       []string{"name", "value", "secret", "runtime", "build", "envType", "workload", "container", "source"},
+		identity:     []string{"workload", "container", "name"},
+		secret:       true,
+		createPath:   "/app-services/%s/env-vars",
+		createFields: []string{"workload", "container", "name", "value", "secret", "runtime", "build"},
+		updatePath:   "/app-service-env-vars/%s",
+		updateFields: []string{"value", "secret", "runtime", "build"},
+	},
+	{
+		key:          "helmValues",
+		items:        func(s *instanceBundleService) *[]map[string]interface{} { return &s.HelmValues },
+		label:        "helm value",
+		listPath:     "/app-services/%s/helm-values",
+		fields:       []string{"name", "value", "secret", "source"},
+		identity:     []string{"name"},
+		secret:       true,
+		createPath:   "/app-services/%s/helm-values",
+		createFields: []string{"name", "value", "secret"},
+		updatePath:   "/app-service-helm-values/%s",
+		updateFields: []string{"value", "secret"},
+	},
+	{
+		key:          "tokens",
+		items:        func(s *instanceBundleService) *[]map[string]interface{} { return &s.Tokens },
+		label:        "token",
+		listPath:     "/app-services/%s/tokens",
+		fields:       []string{"name", "value", "secret", "envType"},
+		identity:     []string{"name"},
+		secret:       true,
+		createPath:   "/app-services/%s/tokens",
+		createFields: []string{"name", "value", "secret"},
+		updatePath:   "/app-service-tokens/%s",
+		updateFields: []string{"value", "secret"},
+	},
+	{
+		key:          "annotations",
+		items:        func(s *instanceBundleService) *[]map[string]interface{} { return &s.Annotations },
+		label:        "annotation",
+		listPath:     "/app-services/%s/annotations",
+		fields:       []string{"name", "value", "envType", "source"},
+		identity:     []string{"name"},
+		createPath:   "/app-services/%s/annotations",
+		createFields: []string{"name", "value"},
+		deletePath:   "/app-service-annotations/%s",
+	},
+	{
+		key:       "settings",
+		items:     func(s *instanceBundleService) *[]map[string]interface{} { return &s.Settings },
+		label:     "setting",
+		listPath:  "/app-services/%s/settings",
+		fields:    []string{"name", "value", "var", "runtime", "build"},
+		identity:  []string{"name"},
+		setPath:   "/app-services/%s/settings/%s",
+		setByName: true,
+		setFields: []string{"value"},
+	},
+	{
+		key:       "configs",
+		items:     func(s *instanceBundleService) *[]map[string]interface{} { return &s.Configs },
+		label:     "config",
+		listPath:  "/app-services/%s/configs",
+		fields:    []string{"name", "title", "disabled", "config"},
+		identity:  []string{"name"},
+		setPath:   "/app-services/%s/configs/%s",
+		setByName: true,
+		setFields: []string{"config", "disabled"},
+	},
+	{
+		key:       "links",
+		items:     func(s *instanceBundleService) *[]map[string]interface{} { return &s.Links },
+		label:     "link",
+		listPath:  "/app-services/%s/links",
+		fields:    []string{"name", "linkedService"},
+		identity:  []string{"name"},
+		setPath:   "/app-services/%s/links/%s",
+		setByName: true,
+		setFields: []string{"linkedService"},
+		fromRow:   linkBundleItem,
+	},
+	{
+		key:          "volumes",
+		items:        func(s *instanceBundleService) *[]map[string]interface{} { return &s.Volumes },
+		label:        "volume",
+		listPath:     "/app-services/%s/volumes",
+		fields:       []string{"name", "path", "size", "shared", "readOnly", "configuredStorageClassName"},
+		identity:     []string{"name"},
+		createPath:   "/app-services/%s/volumes",
+		createFields: []string{"name", "size"},
+	},
+	{
+		key:          "cronSchedules",
+		items:        func(s *instanceBundleService) *[]map[string]interface{} { return &s.CronSchedules },
+		label:        "cron schedule",
+		listPath:     "/app-services/%s/cron-schedules",
+		fields:       []string{"name", "title", "crontab", "command", "workload", "envType", "disabled"},
+		identity:     []string{"name"},
+		createPath:   "/app-services/%s/cron-schedules",
+		createFields: []string{"name", "title", "crontab", "command", "workload"},
+		updatePath:   "/app-service-cron-schedules/%s",
+		updateFields: []string{"title", "crontab", "command", "workload", "disabled"},
+	},
+	{
+		key:       "resources",
+		items:     func(s *instanceBundleService) *[]map[string]interface{} { return &s.Resources },
+		label:     "resources",
+		listPath:  "/app-services/%s/containers",
+		fields:    []string{"workload", "container", "requestCPU", "requestMem", "limitCPU", "limitMem"},
+		identity:  []string{"workload", "container"},
+		setPath:   "/app-services/%s/resources",
+		setFields: []string{"workload", "container", "requestCPU", "requestMem", "limitCPU", "limitMem"},
+		fromRow:   containerBundleItem,
+	},
+	{
+		key:          "routes",
+		items:        func(s *instanceBundleService) *[]map[string]interface{} { return &s.Routes },
+		label:        "route",
+		fields:       []string{"host", "path", "pathType", "action", "port", "main", "primary", "private", "disabled", "redirectScheme", "redirectHost", "redirectPath", "redirectStatusCode"},
+		identity:     []string{"host", "path"},
+		createPath:   "/app-routes",
+		createFields: []string{"host", "port", "path", "pathType", "action", "main", "primary", "redirectScheme", "redirectHost", "redirectPath", "redirectStatusCode"},
+		updatePath:   "/app-routes/%s",
+		updateFields: []string{"pathType", "action", "main", "primary", "disabled", "redirectScheme", "redirectHost", "redirectPath", "redirectStatusCode"},
+	},
+	{
+		key:      "ports",
+		items:    func(s *instanceBundleService) *[]map[string]interface{} { return &s.Ports },
+		label:    "port",
+		fields:   []string{"name", "number", "publicPort", "protocol", "private"},
+		identity: []string{"name"},
+	},
+}
+
+type instanceBundleOptions struct {
+	services      []string
+	sections      []string
+	secrets       string
+	passphraseEnv string
+}
+
+type instanceBundleChange struct {
+	service string
+	section string
+	item    string
+	action  string
+	detail  string
+	method  string
+	path    string
+	body    map[string]interface{}
+}
+
+func newAppInstanceExportCommand(out outputOptions) *cobra.Command {
+	opts := instanceBundleOptions{}
+	var outPath string
+	cmd := &cobra.Command{
+		Use:     "export ID",
+		Aliases: []string{"export-config"},
+		Short:   "Export app instance configuration as a portable bundle",
+		Long: "Export app instance configuration as a portable bundle.\n\n" +
+			"The bundle records every app service's env vars, Helm values, tokens, annotations, settings, configs, links, volumes, cron schedules, resources, routes and ports. " +
+			"Secret values are masked by default; use --secrets encrypted with the passphrase in $" + defaultBundlePassphraseEnv + " to keep them restorable. " +
+			"Apply the bundle with \"wodby instance import-config\".",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			bundle, err := collectInstanceBundle(cmd.Context(), client, args[0], opts)
+			if err != nil {
+				return err
+			}
+			content, err := encodeInstanceBundle(bundle, outputFormat(cmd, out) == outputJSON)
+			if err != nil {
+				return err
+			}
+			if outPath != "" {
+				if err := writeTextOutput(outPath, content); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Wrote app instance bundle with %s to %s\n", pluralizeCount(len(bundle.Services), "service", "services"), outPath)
+				return nil
+			}
+			fmt.Fprint(cmd.OutOrStdout(), content)
+			return nil
+		},
+	}
+	addInstanceBundleFlags(cmd, &opts)
+	cmd.Flags().StringVar(&outPath, "out", "", "Write the bundle to path instead of stdout")
+	return cmd
+}
+
+func newAppInstanceImportConfigCommand(out outputOptions) *cobra.Command {
+	var file, passphraseEnv string
+	var services []string
+	var dryRun, yes, routes bool
+	cmd := &cobra.Command{
+		Use:   "import-config ID",
+		Short: "Apply an app instance configuration bundle",
+		Long: "Apply an app instance configuration bundle produced by \"wodby instance export\".\n\n" +
+			"Services are matched by name and only the creates and updates needed to match the bundle are sent. " +
+			"Masked or hashed secrets are skipped. Routes are only applied with --routes because their hosts usually differ between instances.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(file, "--file"); err != nil {
+				return err
+			}
+			content, err := readTextFileOrStdin(cmd, file)
+			if err != nil {
+				return errors.Wrap(err, "read bundle")
+			}
+			bundle, err := decodeInstanceBundle([]byte(content))
+			if err != nil {
+				return err
+			}
+			if err := decryptInstanceBundle(bundle, passphraseEnv); err != nil {
+				return err
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			changes, err := planInstanceBundleImport(cmd.Context(), client, args[0], bundle, services, routes)
+			if err != nil {
+				return err
+			}
+			if err := printInstanceBundleChanges(cmd, out, changes); err != nil {
+				return err
+			}
+			pending := pendingInstanceBundleChanges(changes)
+			if dryRun || len(pending) == 0 {
+				return nil
+			}
+			if err := confirm(cmd, yes, fmt.Sprintf("Apply %s to app instance %s?", pluralizeCount(len(pending), "change", "changes"), args[0])); err != nil {
+				return err
+			}
+			return applyInstanceBundleChanges(cmd.Context(), client, pending)
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Path to bundle YAML or JSON; use - for stdin")
+	cmd.Flags().StringSliceVar(&services, "services", nil, "Only apply these app service names; comma-separated")
+	cmd.Flags().StringVar(&passphraseEnv, "passphrase-env", defaultBundlePassphraseEnv, "Environment variable holding the passphrase for encrypted secrets")
+	cmd.Flags().BoolVar(&routes, "routes", false, "Also create and update routes")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the changes without applying them")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Confirm without prompting")
+	return cmd
+}
+
+func addInstanceBundleFlags(cmd *cobra.Command, opts *instanceBundleOptions) {
+	cmd.Flags().StringSliceVar(&opts.services, "services", nil, "Only include these app service names; comma-separated")
+	cmd.Flags().StringSliceVar(&opts.sections, "sections", nil, "Only include these sections, such as envVars,settings,routes; comma-separated")
+	cmd.Flags().StringVar(&opts.secrets, "secrets", bundleSecretsMasked, "Secret values: masked, hashed, encrypted, or plain")
+	cmd.Flags().StringVar(&opts.passphraseEnv, "passphrase-env", defaultBundlePassphraseEnv, "Environment variable holding the passphrase for --secrets encrypted")
+}
+
+func collectInstanceBundle(ctx context.Context, client *rest.Client, instanceID string, opts instanceBundleOptions) (*instanceBundle, error) {
+	secrets := opts.secrets
+	if secrets == "" {
+		secrets = bundleSecretsMasked
+	}
+	switch secrets {
+	case bundleSecretsMasked, bundleSecretsHashed, bundleSecretsEncrypted, bundleSecretsPlain:
+	default:
+		return nil, errors.Errorf("unsupported --secrets %q; use masked, hashed, encrypted, or plain", secrets)
+	}
+
+	var instance interface{}
+	if err := client.Get(ctx, "/app-instances/"+url.PathEscape(instanceID), nil, &instance); err != nil {
+		return nil, err
+	}
+	row := cloneFirstRow(normalizeItem(instance))
+	if row == nil {
+		return nil, errors.New("app instance response did not include an item")
+	}
+
+	query := url.Values{"appInstanceId": []string{instanceID}}
+	serviceRows, err := fetchRows(ctx, client, "/app-services", query)
+	if err != nil {
+		return nil, err
+	}
+	routeRows, err := fetchRows(ctx, client, "/app-routes", query)
+	if err != nil {
+		return nil, err
+	}
+	portRows, err := fetchRows(ctx, client, "/app-ports", query)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceNames := map[string]string{}
+	for _, service := range serviceRows {
+		serviceNames[firstScalarPath(service, "id")] = firstScalarPath(service, "name")
+	}
+
+	bundle := &instanceBundle{
+		Kind:       instanceBundleKind,
+		Version:    instanceBundleVersion,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Secrets:    secrets,
+		Instance:   instanceBundleInstance(row),
+		Services:   make([]*instanceBundleService, 0, len(serviceRows)),
+	}
+	selected := stringSet(opts.services)
+	sections := stringSet(opts.sections)
+	for _, key := range opts.sections {
+		if _, err := instanceBundleSectionByKey(key); err != nil {
+			return nil, err
+		}
+	}
+	childRows := map[string][]map[string]interface{}{"routes": routeRows, "ports": portRows}
+	for _, serviceRow := range serviceRows {
+		service := &instanceBundleService{
+			ID:       firstScalarPath(serviceRow, "id"),
+			Name:     firstScalarPath(serviceRow, "name"),
+			Title:    firstScalarPath(serviceRow, "title"),
+			Type:     firstScalarPath(serviceRow, "type"),
+			Version:  firstScalarPath(serviceRow, "version"),
+			Replicas: bundleScalar(serviceRow["replicas"]),
+			Disabled: formatYesNo(serviceRow["disabled"]) == "yes",
+		}
+		if len(selected) != 0 && !selected[service.Name] {
+			continue
+		}
+		for _, section := range instanceBundleSections {
+			if len(sections) != 0 && !sections[section.key] {
+				continue
+			}
+			if section.listPath == "" {
+				*section.items(service) = bundleItems(section, rowsForService(childRows[section.key], service.ID), serviceNames)
+				continue
+			}
+			rows, err := fetchRows(ctx, client, escapedPath(section.listPath, service.ID), nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read %s %ss", service.Name, section.label)
+			}
+			*section.items(service) = bundleItems(section, rows, serviceNames)
+		}
+		bundle.Services = append(bundle.Services, service)
+	}
+	if missing := missingNames(opts.services, bundle.Services); len(missing) != 0 {
+		return nil, errors.Errorf("app instance has no services named %s", strings.Join(missing, ", "))
+	}
+
+	if err := protectInstanceBundleSecrets(bundle, opts.passphraseEnv); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+func instanceBundleInstance(row map[string]interface{}) map[string]interface{} {
+	instance := map[string]interface{}{}
+	for key, value := range map[string]string{
+		"id":            firstScalarPath(row, "id"),
+		"name":          firstScalarPath(row, "name"),
+		"title":         firstScalarPath(row, "title"),
+		"domain":        firstScalarPath(row, "domain", "mainDomain"),
+		"app":           firstTitlePath(row, "appName", "app.name", "appTitle", "app.title"),
+		"env":           firstTitlePath(row, "envName", "env.name", "envTitle", "env.title"),
+		"cluster":       firstTitlePath(row, "clusterName", "cluster.name", "clusterTitle", "cluster.title"),
+		"stack":         firstTitlePath(row, relationColumns["stack"].titlePaths...),
+		"stackRevision": firstScalarPath(row, "stackRevNumber", "stackRev.number", "stackRevision.number", "app.stackRev.number"),
+		"stackVersion":  firstScalarPath(row, "stackVersion", "stackRev.version", "stackRevision.version", "app.stackRev.version"),
+	} {
+		if value != "" {
+			instance[key] = value
+		}
+	}
+	return instance
+}
+
+func instanceBundleSectionByKey(key string) (instanceBundleSection, error) {
+	for _, section := range instanceBundleSections {
+		if section.key == key {
+			return section, nil
+		}
+	}
+	return instanceBundleSection{}, errors.Errorf("unknown instance bundle section %q", key)
+}
+
+func bundleItems(section instanceBundleSection, rows []map[string]interface{}, serviceNames map[string]string) []map[string]interface{} {
+	items := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		source := row
+		if section.fromRow != nil {
+			source = section.fromRow(row)
+		}
+		if section.key == "links" {
+			if linked := firstScalarPath(row, "linkedAppServiceId", "linkedAppService.id", "linkedServiceId"); linked != "" && serviceNames[linked] != "" {
+				source["linkedService"] = serviceNames[linked]
+			}
+		}
+		item := map[string]interface{}{}
+		if id := firstScalarPath(row, "id"); id != "" {
+			item["id"] = id
+		}
+		for _, field := range section.fields {
+			if value := bundleScalar(source[field]); value != nil && value != "" {
+				item[field] = value
+			}
+		}
+		items = append(items, item)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return bundleItemKey(section, items[i]) < bundleItemKey(section, items[j])
+	})
+	return items
+}
+
+func linkBundleItem(row map[string]interface{}) map[string]interface{} {
+	item := cloneRow(row)
+	if title := firstTitlePath(row, "linkedAppService.name", "linkedService.name", "linkedServiceName"); title != "" {
+		item["linkedService"] = title
+	}
+	return item
+}
+
+func containerBundleItem(row map[string]interface{}) map[string]interface{} {
+	item := cloneRow(row)
+	item["container"] = firstScalarPath(row, "container", "name")
+	return item
+}
+
+func rowsForService(rows []map[string]interface{}, serviceID string) []map[string]interface{} {
+	matched := make([]map[string]interface{}, 0)
+	for _, row := range rows {
+		if firstRelationID(row, relationColumns["service"]) == serviceID {
+			matched = append(matched, row)
+		}
+	}
+	return matched
+}
+
+// bundleScalar converts API numbers to plain Go numbers so YAML output keeps
+// them unquoted and import sends them back with the same JSON type.
+func bundleScalar(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if number, err := v.Int64(); err == nil {
+			return number
+		}
+		if number, err := v.Float64(); err == nil {
+			return number
+		}
+		return v.String()
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[key] = bundleScalar(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			converted = append(converted, bundleScalar(item))
+		}
+		return converted
+	default:
+		return v
+	}
+}
+
+func bundleItemKey(section instanceBundleSection, item map[string]interface{}) string {
+	parts := make([]string, 0, len(section.identity))
+	for _, field := range section.identity {
+		if value := scalarString(item[field]); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func bundleItemIsSecret(section instanceBundleSection, item map[string]interface{}) bool {
+	return section.secret && formatYesNo(item["secret"]) == "yes"
+}
+
+func stringSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				set[part] = true
+			}
+		}
+	}
+	return set
+}
+
+func missingNames(names []string, services []*instanceBundleService) []string {
+	found := map[string]bool{}
+	for _, service := range services {
+		found[service.Name] = true
+	}
+	missing := make([]string, 0)
+	for name := range stringSet(names) {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func protectInstanceBundleSecrets(bundle *instanceBundle, passphraseEnv string) error {
+	var gcm cipher.AEAD
+	if bundle.Secrets == bundleSecretsEncrypted {
+		passphrase, err := bundlePassphrase(passphraseEnv)
+		if err != nil {
+			return err
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return errors.WithStack(err)
+		}
+		bundle.Encryption = &instanceBundleEncryption{
+			Algorithm:  "aes-256-gcm",
+			KDF:        "pbkdf2-sha256",
+			Iterations: bundleKDFIterations,
+			Salt:       base64.StdEncoding.EncodeToString(salt),
+		}
+		gcm, err = bundleCipher(passphrase, bundle.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, service := range bundle.Services {
+		for _, section := range instanceBundleSections {
+			for _, item := range *section.items(service) {
+				if !bundleItemIsSecret(section, item) {
+					continue
+				}
+				value := scalarString(item["value"])
+				switch bundle.Secrets {
+				case bundleSecretsMasked:
+					delete(item, "value")
+				case bundleSecretsHashed:
+					if value != "" {
+						item["value"] = secretValueHash(value)
+					}
+				case bundleSecretsEncrypted:
+					delete(item, "value")
+					if value == "" {
+						continue
+					}
+					nonce := make([]byte, gcm.NonceSize())
+					if _, err := rand.Read(nonce); err != nil {
+						return errors.WithStack(err)
+					}
+					item["encryptedValue"] = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), nil))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func decryptInstanceBundle(bundle *instanceBundle, passphraseEnv string) error {
+	if bundle.Secrets != bundleSecretsEncrypted {
+		return nil
+	}
+	if bundle.Encryption == nil {
+		return errors.New("encrypted bundle is missing encryption parameters")
+	}
+	passphrase, err := bundlePassphrase(passphraseEnv)
+	if err != nil {
+		return err
+	}
+	gcm, err := bundleCipher(passphrase, bundle.Encryption)
+	if err != nil {
+		return err
+	}
+	for _, service := range bundle.Services {
+		for _, section := range instanceBundleSections {
+			for _, item := range *section.items(service) {
+				encrypted := scalarString(item["encryptedValue"])
+				if encrypted == "" {
+					continue
+				}
+				content, err := base64.StdEncoding.DecodeString(encrypted)
+				if err != nil || len(content) < gcm.NonceSize() {
+					return errors.Errorf("invalid encrypted value for %s %s %q", service.Name, section.label, bundleItemKey(section, item))
+				}
+				plain, err := gcm.Open(nil, content[:gcm.NonceSize()], content[gcm.NonceSize():], nil)
+				if err != nil {
+					return errors.New("decrypt bundle secrets: wrong passphrase or corrupted bundle")
+				}
+				delete(item, "encryptedValue")
+				item["value"] = string(plain)
+			}
+		}
+	}
+	bundle.Secrets = bundleSecretsPlain
+	return nil
+}
+
+func bundlePassphrase(envName string) (string, error) {
+	if envName == "" {
+		envName = defaultBundlePassphraseEnv
+	}
+	passphrase := os.Getenv(envName)
+	if passphrase == "" {
+		return "", errors.Errorf("$%s must hold the bundle passphrase", envName)
+	}
+	return passphrase, nil
+}
+
+func bundleCipher(passphrase string, params *instanceBundleEncryption) (cipher.AEAD, error) {
+	if params.Algorithm != "aes-256-gcm" || params.KDF != "pbkdf2-sha256" {
+		return nil, errors.Errorf("unsupported bundle encryption %s/%s", params.Algorithm, params.KDF)
+	}
+	salt, err := base64.StdEncoding.DecodeString(params.Salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid bundle encryption salt")
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, params.Iterations, 32)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return gcm, nil
+}
+
+func secretValueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func encodeInstanceBundle(bundle *instanceBundle, asJSON bool) (string, error) {
+	if asJSON {
+		content, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return string(content) + "\n", nil
+	}
+	content, err := yaml.Marshal(bundle)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(content), nil
+}
+
+func decodeInstanceBundle(content []byte) (*instanceBundle, error) {
+	bundle := &instanceBundle{}
+	if err := yaml.Unmarshal(content, bundle); err != nil {
+		return nil, errors.Wrap(err, "decode bundle")
+	}
+	if bundle.Kind != instanceBundleKind {
+		return nil, errors.Errorf("bundle kind is %q, want %s", bundle.Kind, instanceBundleKind)
+	}
+	if bundle.Version != instanceBundleVersion {
+		return nil, errors.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+	return bundle, nil
+}
+
+func planInstanceBundleImport(ctx context.Context, client *rest.Client, instanceID string, bundle *instanceBundle, services []string, includeRoutes bool) ([]instanceBundleChange, error) {
+	target, err := collectInstanceBundle(ctx, client, instanceID, instanceBundleOptions{secrets: bundleSecretsPlain})
+	if err != nil {
+		return nil, err
+	}
+	targetServices := map[string]*instanceBundleService{}
+	serviceIDs := map[string]string{}
+	for _, service := range target.Services {
+		targetServices[service.Name] = service
+		serviceIDs[service.Name] = service.ID
+	}
+
+	selected := stringSet(services)
+	changes := make([]instanceBundleChange, 0)
+	for _, desired := range bundle.Services {
+		if len(selected) != 0 && !selected[desired.Name] {
+			continue
+		}
+		current, ok := targetServices[desired.Name]
+		if !ok {
+			changes = append(changes, instanceBundleChange{service: desired.Name, action: "skip", detail: "app instance has no service with this name"})
+			continue
+		}
+		for _, section := range instanceBundleSections {
+			if section.key == "routes" && !includeRoutes {
+				continue
+			}
+			changes = append(changes, planInstanceBundleSection(section, current, *section.items(desired), *section.items(current), serviceIDs)...)
+		}
+	}
+	return changes, nil
+}
+
+func planInstanceBundleSection(section instanceBundleSection, service *instanceBundleService, desiredItems []map[string]interface{}, currentItems []map[string]interface{}, serviceIDs map[string]string) []instanceBundleChange {
+	currentByKey := map[string]map[string]interface{}{}
+	for _, item := range currentItems {
+		currentByKey[bundleItemKey(section, item)] = item
+	}
+
+	changes := make([]instanceBundleChange, 0)
+	for _, desired := range desiredItems {
+		key := bundleItemKey(section, desired)
+		change := instanceBundleChange{service: service.Name, section: section.label, item: key}
+		if bundleItemIsSecret(section, desired) && !bundleHasPlainSecret(desired) {
+			change.action = "skip"
+			change.detail = "secret value is not in the bundle"
+			changes = append(changes, change)
+			continue
+		}
+		desired = bundleItemForTarget(section, desired, serviceIDs)
+		current, exists := currentByKey[key]
+		if exists {
+			fields := section.updateFields
+			if section.setPath != "" {
+				fields = section.setFields
+			}
+			changed := changedBundleFields(fields, desired, current)
+			if section.key == "links" {
+				changed = changedBundleFields([]string{"linkedService"}, desired, current)
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			change.detail = strings.Join(changed, ", ")
+		}
+
+		switch {
+		case section.setPath != "":
+			change.action = "set"
+			change.method = "PUT"
+			if section.setByName {
+				change.path = escapedPath(section.setPath, service.ID, scalarString(desired["name"]))
+			} else {
+				change.path = escapedPath(section.setPath, service.ID)
+			}
+			change.body = bundleRequestBody(section.setFields, desired)
+			if section.key == "links" {
+				change.body = map[string]interface{}{"linkedAppServiceId": desired["linkedAppServiceId"]}
+			}
+		case !exists && section.createPath != "":
+			change.action = "create"
+			change.method = "POST"
+			change.path = section.createPath
+			if strings.Contains(section.createPath, "%s") {
+				change.path = escapedPath(section.createPath, service.ID)
+			}
+			change.body = bundleRequestBody(section.createFields, desired)
+			if section.key == "routes" {
+				change.body["appServiceId"] = optionalInt(service.ID)
+			}
+		case exists && section.updatePath != "":
+			change.action = "update"
+			change.method = "PUT"
+			change.path = escapedPath(section.updatePath, scalarString(current["id"]))
+			change.body = bundleRequestBody(section.updateFields, desired)
+		case exists && section.deletePath != "" && section.createPath != "":
+			change.action = "replace"
+			change.method = "DELETE"
+			change.path = escapedPath(section.deletePath, scalarString(current["id"]))
+			changes = append(changes, change)
+			change = instanceBundleChange{service: service.Name, section: section.label, item: key, action: "replace", detail: change.detail}
+			change.method = "POST"
+			change.path = escapedPath(section.createPath, service.ID)
+			change.body = bundleRequestBody(section.createFields, desired)
+		default:
+			change.action = "skip"
+			if exists {
+				change.detail = "cannot be updated through the API: " + change.detail
+			} else {
+				change.detail = "cannot be created through the API"
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func bundleHasPlainSecret(item map[string]interface{}) bool {
+	value := scalarString(item["value"])
+	return value != "" && !strings.HasPrefix(value, "sha256:")
+}
+
+func bundleItemForTarget(section instanceBundleSection, item map[string]interface{}, serviceIDs map[string]string) map[string]interface{} {
+	if section.key != "links" {
+		return item
+	}
+	converted := cloneRow(item)
+	if id := serviceIDs[scalarString(item["linkedService"])]; id != "" {
+		converted["linkedAppServiceId"] = optionalInt(id)
+	}
+	return converted
+}
+
+func changedBundleFields(fields []string, desired map[string]interface{}, current map[string]interface{}) []string {
+	changed := make([]string, 0)
+	for _, field := range fields {
+		if _, ok := desired[field]; !ok {
+			continue
+		}
+		if formatValue(desired[field]) != formatValue(current[field]) {
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+func bundleRequestBody(fields []string, item map[string]interface{}) map[string]interface{} {
+	body := map[string]interface{}{}
+	for _, field := range fields {
+		if value, ok := item[field]; ok && value != nil {
+			body[field] = value
+		}
+	}
+	return body
+}
+
+func pendingInstanceBundleChanges(changes []instanceBundleChange) []instanceBundleChange {
+	pending := make([]instanceBundleChange, 0, len(changes))
+	for _, change := range changes {
+		if change.method != "" {
+			pending = append(pending, change)
+		}
+	}
+	return pending
+}
+
+func applyInstanceBundleChanges(ctx context.Context, client *rest.Client, changes []instanceBundleChange) error {
+	for _, change := range changes {
+		var body interface{}
+		if change.body != nil {
+			body = change.body
+		}
+		if err := client.Do(ctx, change.method, change.path, nil, body, nil); err != nil {
+			return errors.Wrapf(err, "%s %s %s %q", change.action, change.service, change.section, change.item)
+		}
+	}
+	return nil
+}
+
+func printInstanceBundleChanges(cmd *cobra.Command, out outputOptions, changes []instanceBundleChange) error {
+	rows := instanceBundleChangeRows(changes)
+	if len(rows) == 0 && outputFormat(cmd, out) != outputJSON {
+		fmt.Fprintln(cmd.OutOrStdout(), "app instance already matches the bundle")
+		return nil
+	}
+	return printResult(cmd, out, rows, instanceBundleChangeColumns)
+}
+
+// instanceBundleChangeRows lists planned changes for display; the delete half
+// of a replace is folded into its create.
+func instanceBundleChangeRows(changes []instanceBundleChange) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, len(changes))
+	for _, change := range changes {
+		if change.method == "DELETE" && change.action == "replace" {
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"service": change.service,
+			"section": change.section,
+			"item":    change.item,
+			"action":  change.action,
+			"detail":  change.detail,
+		})
+	}
+	return rows
+}
@@ -0,0 +1,289 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+// instanceCloneSections lists the bundle sections copied by instance clone.
+var instanceCloneSections = []string{"envVars", "helmValues", "settings", "configs", "cronSchedules", "resources", "volumes", "routes"}
+
+func newAppInstanceCloneCommand(out outputOptions) *cobra.Command {
+	wait := waitOptions{}
+	var orgID, name, title, env, cluster, domain string
+	var deploy bool
+	cmd := &cobra.Command{
+		Use:   "clone SOURCE_ID",
+		Short: "Create a new app instance with the configuration of an existing one",
+		Long: "Create a new app instance of the same app and stack revision as SOURCE_ID, then copy its per-service env vars, Helm values, settings, configs, cron schedules and resources and add the optional volumes it has.\n\n" +
+			"The API cannot resize volumes, so volume sizes are not copied; a warning lists the volumes whose size differs from the source. " +
+			"Routes under the source domain are rewritten to --domain; routes on other domains are not copied. " +
+			"The new instance is created without its initial deployment; use --deploy to deploy all its services with the builds of the source's latest successful deployment once the configuration is copied. " +
+			"Secret values are copied only when the API returns them.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := requireFlag(name, "--name"); err != nil {
+				return err
+			}
+			if err := requireFlag(env, "--env"); err != nil {
+				return err
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+
+			source, err := collectInstanceBundle(cmd.Context(), client, args[0], instanceBundleOptions{
+				sections: instanceCloneSections,
+				secrets:  bundleSecretsPlain,
+			})
+			if err != nil {
+				return err
+			}
+			var sourceInstance interface{}
+			if err := client.Get(cmd.Context(), "/app-instances/"+url.PathEscape(args[0]), nil, &sourceInstance); err != nil {
+				return err
+			}
+			sourceRow := cloneFirstRow(normalizeItem(sourceInstance))
+
+			includeRoutes := false
+			if domain != "" {
+				if sourceDomain := scalarString(source.Instance["domain"]); sourceDomain == "" || rewriteInstanceBundleRoutes(source, sourceDomain, domain) == 0 {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Warning: app instance %s has no routes under its domain; --domain only sets the new instance domain\n", args[0])
+				} else {
+					includeRoutes = true
+				}
+			}
+
+			requestBody, err := instanceCloneRequestBody(cmd.Context(), client, sourceRow, orgID, name, title, env, cluster, domain)
+			if err != nil {
+				return err
+			}
+			var created interface{}
+			if err := client.Post(cmd.Context(), "/app-instances", nil, requestBody, &created); err != nil {
+				return errors.Wrap(err, "create app instance")
+			}
+			instanceID := firstCreatedResourceID(created)
+			if instanceID == "" {
+				return errors.New("create app instance response did not include an id")
+			}
+			taskID := firstTaskID(created)
+			if taskID == "" {
+				if taskID, err = fetchReferencedTaskID(cmd.Context(), client, "appInstanceId", instanceID); err != nil {
+					return err
+				}
+			}
+			if taskID != "" {
+				if _, err := waitForTask(cmd.Context(), client, taskID, wait.timeout); err != nil {
+					return errors.Wrapf(err, "create app instance %s", instanceID)
+				}
+			}
+			if outputFormat(cmd, out) != outputJSON {
+				fmt.Fprintf(cmd.OutOrStdout(), "Created app instance %s (%s)\n", instanceID, name)
+			}
+
+			changes, err := planInstanceBundleImport(cmd.Context(), client, instanceID, source, nil, includeRoutes)
+			if err != nil {
+				return err
+			}
+			if err := applyInstanceBundleChanges(cmd.Context(), client, pendingInstanceBundleChanges(changes)); err != nil {
+				return errors.Wrapf(err, "copy configuration to app instance %s", instanceID)
+			}
+			target, err := collectInstanceBundle(cmd.Context(), client, instanceID, instanceBundleOptions{sections: []string{"volumes"}})
+			if err != nil {
+				return err
+			}
+			if differences := instanceCloneVolumeSizeDifferences(source, target); len(differences) != 0 {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Warning: volume sizes are not copied; these volumes of app instance %s differ from the source: %s\n", instanceID, strings.Join(differences, ", "))
+			}
+
+			result := map[string]interface{}{"id": instanceID, "name": name, "source": args[0]}
+			if deploy {
+				deployment, err := deployAllInstanceServices(cmd.Context(), client, source, args[0], instanceID)
+				if err != nil {
+					return err
+				}
+				result["deploymentId"] = firstID(deployment)
+				if wait.wait && firstID(deployment) != "" {
+					if _, err := waitForDeployment(cmd.Context(), client, firstID(deployment), wait.timeout); err != nil {
+						return err
+					}
+				}
+			}
+
+			if outputFormat(cmd, out) == outputJSON {
+				result["changes"] = instanceBundleChangeRows(changes)
+				return printJSON(cmd, result)
+			}
+			if err := printInstanceBundleChanges(cmd, out, changes); err != nil {
+				return err
+			}
+			if id := scalarString(result["deploymentId"]); id != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "Started deployment %s\n", id)
+			}
+			return nil
+		},
+	}
+	addWaitFlags(cmd, &wait)
+	cmd.Flags().StringVar(&orgID, "org", "", "Organization ID for resolving names; defaults to the source organization")
+	cmd.Flags().StringVar(&name, "name", "", "New app instance machine name")
+	cmd.Flags().StringVar(&title, "title", "", "New app instance title")
+	cmd.Flags().StringVar(&env, "env", "", "Environment ID or name")
+	cmd.Flags().StringVar(&cluster, "cluster", "", "Cluster ID or name; defaults to the source cluster")
+	cmd.Flags().StringVar(&domain, "domain", "", "New app instance domain; source routes are rewritten to it")
+	cmd.Flags().BoolVar(&deploy, "deploy", false, "Deploy all services after copying the configuration")
+	return cmd
+}
+
+func instanceCloneRequestBody(ctx context.Context, client *rest.Client, source map[string]interface{}, orgID, name, title, env, cluster, domain string) (map[string]interface{}, error) {
+	if orgID == "" {
+		orgID = firstScalarPath(source, "orgId", "org.id", "app.orgId")
+	}
+	appID := firstRelationID(source, relationColumns["app"])
+	if appID == "" {
+		return nil, errors.New("source app instance does not reference an app")
+	}
+	stackRevID := firstScalarPath(source, "stackRevId", "stackRev.id", "stackRevisionId", "stackRevision.id", "app.stackRevId", "app.stackRev.id")
+	envID, err := resolveEnvID(ctx, client, env, orgID)
+	if err != nil {
+		return nil, err
+	}
+	clusterID := firstRelationID(source, relationColumns["cluster"])
+	if cluster != "" {
+		if clusterID, err = resolveClusterID(ctx, client, cluster, orgID); err != nil {
+			return nil, err
+		}
+	}
+	if clusterID == "" {
+		return nil, errors.New("source app instance does not reference a cluster; use --cluster")
+	}
+
+	values := map[string]interface{}{"instanceName": name, "deferInitialDeployment": true}
+	for _, field := range []struct {
+		key   string
+		value string
+		flag  string
+	}{
+		{"appId", appID, "source app"},
+		{"envId", envID, "--env"},
+		{"clusterId", clusterID, "--cluster"},
+		{"stackRevId", stackRevID, "source stack revision"},
+		{"ciIntegrationId", firstScalarPath(source, "ciIntegrationId", "ciIntegration.id"), "source CI integration"},
+		{"registryIntegrationId", firstScalarPath(source, "registryIntegrationId", "registryIntegration.id"), "source registry integration"},
+	} {
+		if err := addOptionalInt(values, field.key, field.value, field.flag); err != nil {
+			return nil, err
+		}
+	}
+	addOptionalString(values, "instanceTitle", title)
+	addOptionalString(values, "domain", domain)
+	return values, nil
+}
+
+// instanceCloneVolumeSizeDifferences lists the volumes of the new instance
+// whose size differs from the same volume of the source as
+// SERVICE/VOLUME (SOURCE_SIZE -> NEW_SIZE).
+func instanceCloneVolumeSizeDifferences(source *instanceBundle, target *instanceBundle) []string {
+	sizes := map[string]string{}
+	for _, service := range source.Services {
+		for _, volume := range service.Volumes {
+			sizes[service.Name+"/"+scalarString(volume["name"])] = scalarString(volume["size"])
+		}
+	}
+	differences := make([]string, 0)
+	for _, service := range target.Services {
+		for _, volume := range service.Volumes {
+			key := service.Name + "/" + scalarString(volume["name"])
+			if size, ok := sizes[key]; ok && size != scalarString(volume["size"]) {
+				differences = append(differences, fmt.Sprintf("%s (%s -> %s)", key, size, scalarString(volume["size"])))
+			}
+		}
+	}
+	return differences
+}
+
+// rewriteInstanceBundleRoutes moves routes from the source domain and its
+// subdomains to the target domain, drops routes on unrelated hosts and
+// returns how many routes were kept.
+func rewriteInstanceBundleRoutes(bundle *instanceBundle, sourceDomain, targetDomain string) int {
+	kept := 0
+	sourceDomain = strings.ToLower(strings.TrimSuffix(sourceDomain, "."))
+	for _, service := range bundle.Services {
+		routes := make([]map[string]interface{}, 0, len(service.Routes))
+		for _, route := range service.Routes {
+			host := strings.ToLower(scalarString(route["host"]))
+			switch {
+			case host == sourceDomain:
+				route["host"] = targetDomain
+			case strings.HasSuffix(host, "."+sourceDomain):
+				route["host"] = strings.TrimSuffix(host, sourceDomain) + targetDomain
+			default:
+				continue
+			}
+			if redirectHost := strings.ToLower(scalarString(route["redirectHost"])); redirectHost == sourceDomain || strings.HasSuffix(redirectHost, "."+sourceDomain) {
+				route["redirectHost"] = strings.TrimSuffix(redirectHost, sourceDomain) + targetDomain
+			}
+			routes = append(routes, route)
+		}
+		service.Routes = routes
+		kept += len(routes)
+	}
+	return kept
+}
+
+// deployAllInstanceServices deploys every enabled service of the new
+// instance with the build its namesake ran after the source's latest
+// successful deployment, like build promote does.
+func deployAllInstanceServices(ctx context.Context, client *rest.Client, source *instanceBundle, sourceID string, instanceID string) (interface{}, error) {
+	history, err := loadDeploymentHistory(ctx, client, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	sourceServices := map[string]string{}
+	for _, service := range source.Services {
+		sourceServices[service.ID] = service.Name
+	}
+	images, err := history.effectiveImages(ctx, 0, sourceServices)
+	if err != nil {
+		return nil, err
+	}
+	buildIDs := map[string]string{}
+	for serviceID, image := range images {
+		buildIDs[sourceServices[serviceID]] = image.buildID
+	}
+
+	services, err := fetchRows(ctx, client, "/app-services", url.Values{"appInstanceId": []string{instanceID}})
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([]map[string]interface{}, 0, len(services))
+	for _, service := range services {
+		if formatYesNo(service["disabled"]) == "yes" {
+			continue
+		}
+		id, err := strconv.Atoi(firstScalarPath(service, "id"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid app service id")
+		}
+		input := map[string]interface{}{"appServiceId": id}
+		if buildID := buildIDs[firstScalarPath(service, "name")]; buildID != "" {
+			input["appServiceBuildId"] = optionalInt(buildID)
+		}
+		inputs = append(inputs, input)
+	}
+	if len(inputs) == 0 {
+		return nil, errors.Errorf("app instance %s has no services to deploy", instanceID)
+	}
+	var result interface{}
+	if err := client.Post(ctx, "/app-deployments", nil, map[string]interface{}{"services": inputs}, &result); err != nil {
+		return nil, errors.Wrap(err, "create deployment")
+	}
+	return result, nil
+}
@@ -0,0 +1,238 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+// instanceDiffSections lists the bundle sections compared by instance diff.
+var instanceDiffSections = []string{"resources", "envVars", "settings", "routes", "cronSchedules"}
+
+type instanceDiffChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+type instanceDiffSide struct {
+	label  string
+	bundle *instanceBundle
+}
+
+func newAppInstanceDiffCommand(out outputOptions) *cobra.Command {
+	var services []string
+	var contextLines int
+	var exitCode bool
+	cmd := &cobra.Command{
+		Use:   "diff A B",
+		Short: "Compare the configuration of two app instances",
+		Long: "Compare the configuration of two app instances, such as staging and production.\n\n" +
+			"The diff covers the stack revision and, for every app service, its version, replicas, resources, env vars, settings, routes and cron schedules. " +
+			"Secret values are compared by SHA-256 hash and never printed. " +
+			"Either side may be a bundle file from \"wodby instance export --secrets hashed\" to compare with an earlier point in time.\n\n" +
+			"Prints a unified diff by default, or the list of changes with -o json.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			from, err := loadInstanceDiffSide(cmd.Context(), client, args[0], services)
+			if err != nil {
+				return err
+			}
+			to, err := loadInstanceDiffSide(cmd.Context(), client, args[1], services)
+			if err != nil {
+				return err
+			}
+
+			fromValues, err := instanceDiffValues(from.bundle, services)
+			if err != nil {
+				return err
+			}
+			toValues, err := instanceDiffValues(to.bundle, services)
+			if err != nil {
+				return err
+			}
+			changes := instanceDiffChanges(fromValues, toValues)
+			if outputFormat(cmd, out) == outputJSON {
+				if err := printJSON(cmd, map[string]interface{}{"from": from.label, "to": to.label, "changes": changes}); err != nil {
+					return err
+				}
+			} else if diff := unifiedDiff(from.label, to.label, instanceDiffLines(fromValues), instanceDiffLines(toValues), contextLines); diff != "" {
+				fmt.Fprint(cmd.OutOrStdout(), diff)
+			} else {
+				fmt.Fprintln(cmd.OutOrStdout(), "no differences")
+			}
+			if exitCode && len(changes) != 0 {
+				return errors.Errorf("%s differ", pluralizeCount(len(changes), "value", "values"))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&services, "services", nil, "Only compare these app service names; comma-separated")
+	cmd.Flags().IntVarP(&contextLines, "context", "U", defaultDiffContext, "Number of unchanged lines around each change")
+	cmd.Flags().BoolVar(&exitCode, "exit-code", false, "Fail when the instances differ")
+	return cmd
+}
+
+func loadInstanceDiffSide(ctx context.Context, client *rest.Client, arg string, services []string) (instanceDiffSide, error) {
+	if info, err := os.Stat(arg); err == nil && info.Mode().IsRegular() {
+		content, err := os.ReadFile(arg)
+		if err != nil {
+			return instanceDiffSide{}, errors.WithStack(err)
+		}
+		bundle, err := decodeInstanceBundle(content)
+		if err != nil {
+			return instanceDiffSide{}, errors.Wrap(err, arg)
+		}
+		if bundle.Secrets == bundleSecretsPlain {
+			hashInstanceBundleSecrets(bundle)
+		}
+		label := arg
+		if bundle.ExportedAt != "" {
+			label += " (" + bundle.ExportedAt + ")"
+		}
+		return instanceDiffSide{label: label, bundle: bundle}, nil
+	}
+
+	bundle, err := collectInstanceBundle(ctx, client, arg, instanceBundleOptions{
+		services: services,
+		sections: instanceDiffSections,
+		secrets:  bundleSecretsHashed,
+	})
+	if err != nil {
+		return instanceDiffSide{}, err
+	}
+	label := "instance " + arg
+	if name := scalarString(bundle.Instance["name"]); name != "" {
+		label += " (" + name + ")"
+	}
+	return instanceDiffSide{label: label, bundle: bundle}, nil
+}
+
+func hashInstanceBundleSecrets(bundle *instanceBundle) {
+	for _, service := range bundle.Services {
+		for _, section := range instanceBundleSections {
+			for _, item := range *section.items(service) {
+				if value := scalarString(item["value"]); bundleItemIsSecret(section, item) && bundleHasPlainSecret(item) {
+					item["value"] = secretValueHash(value)
+				}
+			}
+		}
+	}
+	bundle.Secrets = bundleSecretsHashed
+}
+
+// instanceDiffValues flattens the compared parts of a bundle into ordered
+// path/value pairs such as services[php].envVars[APP_ENV].value.
+func instanceDiffValues(bundle *instanceBundle, services []string) ([][2]string, error) {
+	values := make([][2]string, 0)
+	add := func(path string, value interface{}) {
+		if text := formatValue(value); text != "" {
+			values = append(values, [2]string{path, text})
+		}
+	}
+	for _, key := range []string{"stack", "stackRevision", "stackVersion"} {
+		add("instance."+key, bundle.Instance[key])
+	}
+
+	selected := stringSet(services)
+	sorted := make([]*instanceBundleService, 0, len(bundle.Services))
+	for _, service := range bundle.Services {
+		if len(selected) == 0 || selected[service.Name] {
+			sorted = append(sorted, service)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	for _, service := range sorted {
+		prefix := "services[" + service.Name + "]"
+		add(prefix+".version", service.Version)
+		add(prefix+".replicas", service.Replicas)
+		if service.Disabled {
+			add(prefix+".disabled", true)
+		}
+		for _, key := range instanceDiffSections {
+			section, err := instanceBundleSectionByKey(key)
+			if err != nil {
+				return nil, err
+			}
+			identity := stringSet(section.identity)
+			for _, item := range *section.items(service) {
+				itemPrefix := prefix + "." + key + "[" + bundleItemKey(section, item) + "]"
+				fields := make([]string, 0, len(section.fields))
+				for _, field := range section.fields {
+					if !identity[field] {
+						fields = append(fields, field)
+					}
+				}
+				for _, field := range fields {
+					value := item[field]
+					if field == "value" && bundleItemIsSecret(section, item) {
+						value = instanceDiffSecretValue(item)
+					}
+					add(itemPrefix+"."+field, value)
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func instanceDiffSecretValue(item map[string]interface{}) string {
+	value := scalarString(item["value"])
+	switch {
+	case strings.HasPrefix(value, "sha256:"):
+		return "secret " + value[:min(len(value), len("sha256:")+12)]
+	case value == "":
+		return "secret (masked)"
+	default:
+		return "secret " + secretValueHash(value)[:len("sha256:")+12]
+	}
+}
+
+func instanceDiffLines(values [][2]string) []string {
+	lines := make([]string, 0, len(values))
+	for _, value := range values {
+		lines = append(lines, value[0]+": "+value[1])
+	}
+	return lines
+}
+
+func instanceDiffChanges(from, to [][2]string) []instanceDiffChange {
+	fromValues := map[string]string{}
+	for _, value := range from {
+		fromValues[value[0]] = value[1]
+	}
+	toValues := map[string]string{}
+	for _, value := range to {
+		toValues[value[0]] = value[1]
+	}
+
+	changes := make([]instanceDiffChange, 0)
+	for _, value := range from {
+		next, ok := toValues[value[0]]
+		switch {
+		case !ok:
+			changes = append(changes, instanceDiffChange{Path: value[0], Change: "removed", From: value[1]})
+		case next != value[1]:
+			changes = append(changes, instanceDiffChange{Path: value[0], Change: "changed", From: value[1], To: next})
+		}
+	}
+	for _, value := range to {
+		if _, ok := fromValues[value[0]]; !ok {
+			changes = append(changes, instanceDiffChange{Path: value[0], Change: "added", To: value[1]})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
@@ -0,0 +1,204 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	dnsCheckWodby     = "wodby"
+	dnsCheckPartial   = "partial"
+	dnsCheckElsewhere = "elsewhere"
+	dnsCheckMissing   = "missing"
+	dnsCheckError     = "error"
+)
+
+var instanceDNSCheckColumns = []string{"domain", "status", "cname", "addresses", "ttl", "message"}
+
+// dnsCheckTarget is what a domain must resolve to for traffic to reach the
+// cluster: one of its ingress IPs, or a CNAME to one of its hostnames.
+type dnsCheckTarget struct {
+	ips   map[string]bool
+	hosts []string
+}
+
+func newAppInstanceDNSCheckCommand(out outputOptions) *cobra.Command {
+	var resolver string
+	var expectIPs, expectHosts []string
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:   "dns-check ID",
+		Short: "Check whether route domains point to the app instance cluster",
+		Long: "Resolve the A, AAAA and CNAME records of every route domain of an app instance and compare them with the ingress IPs of its cluster.\n\n" +
+			"A domain points to Wodby 2 when all its addresses are ingress IPs of the cluster, or when it is a CNAME to an expected hostname. " +
+			"TTLs show how long resolvers may keep serving old records after a change. " +
+			"Use it after changing DNS and before \"wodby migrate wodby1 ... --verify\". The command fails while any domain points elsewhere.",
+		Example: `  wodby instance dns-check 21
+  wodby instance dns-check 21 --resolver 1.1.1.1
+  wodby instance dns-check 21 --expect-host lb.example.net`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			server, err := dnsServerAddress(resolver)
+			if err != nil {
+				return err
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			var instance interface{}
+			if err := client.Get(cmd.Context(), "/app-instances/"+url.PathEscape(args[0]), nil, &instance); err != nil {
+				return err
+			}
+			instanceRow := cloneFirstRow(normalizeItem(instance))
+			if instanceRow == nil {
+				return errors.New("app instance response did not include an item")
+			}
+
+			target := dnsCheckTarget{ips: map[string]bool{}}
+			if clusterID := firstRelationID(instanceRow, relationColumns["cluster"]); clusterID != "" {
+				var cluster interface{}
+				if err := client.Get(cmd.Context(), "/clusters/"+url.PathEscape(clusterID), nil, &cluster); err != nil {
+					return err
+				}
+				clusterRow := cloneFirstRow(normalizeItem(cluster))
+				for _, ip := range strings.Split(formatIPsColumn(clusterRow), ",") {
+					target.addIP(ip)
+				}
+				for _, host := range []string{firstScalarPath(clusterRow, "ingressHostname", "loadBalancerHostname", "hostname"), firstScalarPath(clusterRow, "domain")} {
+					target.addHost(host)
+				}
+			}
+			for _, ip := range expectIPs {
+				target.addIP(ip)
+			}
+			for _, host := range expectHosts {
+				target.addHost(host)
+			}
+			if len(target.ips) == 0 && len(target.hosts) == 0 {
+				return errors.Errorf("the cluster of app instance %s has no ingress IPs; use --expect-ip or --expect-host", args[0])
+			}
+
+			routes, err := fetchRows(cmd.Context(), client, "/app-routes", url.Values{"appInstanceId": []string{args[0]}})
+			if err != nil {
+				return err
+			}
+			domains := routeDomains(routes)
+			if len(domains) == 0 {
+				return errors.Errorf("app instance %s has no route domains", args[0])
+			}
+
+			rows := make([]map[string]interface{}, 0, len(domains))
+			pending := 0
+			for _, domain := range domains {
+				ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+				lookup, err := lookupDNSDomain(ctx, server, domain)
+				cancel()
+				row := classifyDNSDomain(domain, lookup, err, target)
+				if row["status"] != dnsCheckWodby {
+					pending++
+				}
+				rows = append(rows, row)
+			}
+			if err := printResult(cmd, out, rows, instanceDNSCheckColumns); err != nil {
+				return err
+			}
+			if pending != 0 {
+				cmd.SilenceUsage = true
+				return errors.Errorf("%d of %s do not point to Wodby 2 yet", pending, pluralizeCount(len(domains), "domain", "domains"))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&resolver, "resolver", "", "DNS resolver as HOST or HOST:PORT; defaults to the first nameserver in /etc/resolv.conf")
+	cmd.Flags().StringSliceVar(&expectIPs, "expect-ip", nil, "Additional IP address that counts as pointing to Wodby 2")
+	cmd.Flags().StringSliceVar(&expectHosts, "expect-host", nil, "Hostname that a CNAME may point to, including its subdomains")
+	cmd.Flags().DurationVar(&timeout, "timeout", dnsDefaultTimeout, "Timeout of the lookups of each domain")
+	return cmd
+}
+
+func (t *dnsCheckTarget) addIP(value string) {
+	if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+		t.ips[ip.String()] = true
+	}
+}
+
+func (t *dnsCheckTarget) addHost(value string) {
+	if host := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(value), ".")); host != "" {
+		t.hosts = append(t.hosts, host)
+	}
+}
+
+func (t *dnsCheckTarget) matchesHost(name string) bool {
+	for _, host := range t.hosts {
+		if name == host || strings.HasSuffix(name, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeDomains returns the distinct hosts of the enabled routes, sorted.
+func routeDomains(routes []map[string]interface{}) []string {
+	seen := map[string]bool{}
+	domains := make([]string, 0)
+	for _, route := range routes {
+		host := strings.ToLower(firstScalarPath(route, "host", "hostname", "domain"))
+		if host == "" || seen[host] || truthyPath(route, "disabled") {
+			continue
+		}
+		seen[host] = true
+		domains = append(domains, host)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func classifyDNSDomain(domain string, lookup *dnsLookup, err error, target dnsCheckTarget) map[string]interface{} {
+	row := map[string]interface{}{"domain": domain}
+	if err != nil {
+		row["status"] = dnsCheckError
+		row["message"] = err.Error()
+		return row
+	}
+	row["cname"] = strings.Join(lookup.cnames, " -> ")
+	row["addresses"] = strings.Join(lookup.addresses, ", ")
+	if len(lookup.cnames) != 0 || len(lookup.addresses) != 0 {
+		row["ttl"] = formatDisplayDuration(time.Duration(lookup.ttl) * time.Second)
+	}
+
+	for _, cname := range lookup.cnames {
+		if target.matchesHost(cname) {
+			row["status"] = dnsCheckWodby
+			row["message"] = "CNAME to " + cname
+			return row
+		}
+	}
+	other := make([]string, 0)
+	for _, address := range lookup.addresses {
+		if !target.ips[address] {
+			other = append(other, address)
+		}
+	}
+	switch {
+	case len(lookup.addresses) == 0 && lookup.nxdomain:
+		row["status"], row["message"] = dnsCheckMissing, "domain does not exist"
+	case len(lookup.addresses) == 0:
+		row["status"], row["message"] = dnsCheckMissing, "no A or AAAA records"
+	case len(other) == 0:
+		row["status"], row["message"] = dnsCheckWodby, "all addresses are cluster ingress IPs"
+	case len(other) < len(lookup.addresses):
+		row["status"], row["message"] = dnsCheckPartial, fmt.Sprintf("%s outside the cluster: %s", pluralizeCount(len(other), "address", "addresses"), strings.Join(other, ", "))
+	default:
+		row["status"], row["message"] = dnsCheckElsewhere, "no address is a cluster ingress IP"
+	}
+	return row
+}
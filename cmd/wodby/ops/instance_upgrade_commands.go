@@ -0,0 +1,421 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+const (
+	bulkUpgradePending   = "pending"
+	bulkUpgradeRunning   = "running"
+	bulkUpgradeStarted   = "started"
+	bulkUpgradeSucceeded = "succeeded"
+	bulkUpgradeFailed    = "failed"
+	bulkUpgradeSkipped   = "skipped"
+)
+
+var (
+	bulkUpgradePreviewColumns = []string{"id", "instance", "app", "env", "from", "to", "serviceChanges"}
+	bulkUpgradeResultColumns  = []string{"id", "instance", "from", "to", "status", "upgradeTask", "duration", "error"}
+)
+
+type bulkUpgradeOptions struct {
+	orgID         string
+	all           bool
+	app           string
+	env           string
+	nameGlob      string
+	concurrency   int
+	stopOnFailure bool
+	yes           bool
+}
+
+func (o bulkUpgradeOptions) selected() bool {
+	return o.all || o.app != "" || o.env != "" || o.nameGlob != ""
+}
+
+// bulkUpgradeTarget is an app instance selected for a bulk stack upgrade,
+// with its pending changelog and, once run, its result.
+type bulkUpgradeTarget struct {
+	id        string
+	title     string
+	app       string
+	env       string
+	changelog map[string]interface{}
+
+	status   string
+	taskID   string
+	duration time.Duration
+	err      error
+}
+
+func addBulkUpgradeFlags(cmd *cobra.Command, opts *bulkUpgradeOptions) {
+	cmd.Flags().StringVar(&opts.orgID, "org", "", "Organization ID; inferred when current credentials expose one org")
+	cmd.Flags().BoolVar(&opts.all, "all", false, "Upgrade every app instance of the organization")
+	cmd.Flags().StringVar(&opts.app, "app", "", "Upgrade the app instances of this app ID or name")
+	cmd.Flags().StringVar(&opts.env, "env", "", "Upgrade the app instances in this env ID or name")
+	cmd.Flags().StringVar(&opts.nameGlob, "name-glob", "", "Upgrade the app instances whose name or title matches this glob, for example 'dev-*'")
+	cmd.Flags().IntVar(&opts.concurrency, "concurrency", 4, "Number of app instances to upgrade at the same time")
+	cmd.Flags().BoolVar(&opts.stopOnFailure, "stop-on-failure", false, "Do not start more upgrades after one fails")
+	cmd.Flags().BoolVarP(&opts.yes, "yes", "y", false, "Confirm without prompting")
+}
+
+// runBulkStackUpgrade previews the selected instances, asks once and then
+// upgrades them with at most opts.concurrency upgrades in flight.
+func runBulkStackUpgrade(cmd *cobra.Command, out outputOptions, opts bulkUpgradeOptions, wait waitOptions, body interface{}) error {
+	if opts.concurrency < 1 {
+		return errors.New("--concurrency must be at least 1")
+	}
+	jsonOutput := outputFormat(cmd, out) == outputJSON
+	if jsonOutput && !opts.yes {
+		return errors.New("--yes is required with -o json because the preview is not printed")
+	}
+	if opts.nameGlob != "" {
+		if _, err := path.Match(opts.nameGlob, ""); err != nil {
+			return errors.Wrap(err, "invalid --name-glob")
+		}
+	}
+	client, err := newRESTClient()
+	if err != nil {
+		return err
+	}
+	orgID, err := inferOrgID(cmd.Context(), client, opts.orgID)
+	if err != nil {
+		return err
+	}
+	fetcher := newInventoryFetcher(client, opts.concurrency, 0, false)
+	targets, upToDate, err := selectBulkUpgradeTargets(cmd.Context(), fetcher, orgID, opts)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		if jsonOutput {
+			return printJSON(cmd, []interface{}{})
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "No app instance needs a stack upgrade (%s already up to date)\n", pluralizeCount(upToDate, "instance", "instances"))
+		return nil
+	}
+
+	if !jsonOutput {
+		if err := printResult(cmd, out, bulkUpgradePreviewRows(targets), bulkUpgradePreviewColumns); err != nil {
+			return err
+		}
+		if summary := bulkUpgradeServiceSummary(targets); len(summary) != 0 {
+			fmt.Fprintln(cmd.OutOrStdout(), "\nService changes:")
+			for _, line := range summary {
+				fmt.Fprintln(cmd.OutOrStdout(), "  "+line)
+			}
+		}
+		if upToDate != 0 {
+			fmt.Fprintf(cmd.OutOrStdout(), "\nSkipping %s already up to date\n", pluralizeCount(upToDate, "instance", "instances"))
+		}
+		fmt.Fprintln(cmd.OutOrStdout())
+	}
+	if err := confirm(cmd, opts.yes, fmt.Sprintf("Upgrade the stack of %s?", pluralizeCount(len(targets), "app instance", "app instances"))); err != nil {
+		return err
+	}
+
+	runBulkUpgrades(cmd.Context(), client, cmd.ErrOrStderr(), targets, opts, wait, body)
+
+	rows := make([]map[string]interface{}, 0, len(targets))
+	failed := 0
+	for _, target := range targets {
+		if target.status == bulkUpgradeFailed {
+			failed++
+		}
+		rows = append(rows, bulkUpgradeResultRow(target))
+	}
+	if err := printResult(cmd, out, rows, bulkUpgradeResultColumns); err != nil {
+		return err
+	}
+	if failed != 0 {
+		cmd.SilenceUsage = true
+		return errors.Errorf("%d of %s failed to upgrade", failed, pluralizeCount(len(targets), "app instance", "app instances"))
+	}
+	return nil
+}
+
+func selectBulkUpgradeTargets(ctx context.Context, fetcher *inventoryFetcher, orgID string, opts bulkUpgradeOptions) ([]*bulkUpgradeTarget, int, error) {
+	orgQuery := url.Values{"orgId": []string{orgID}}
+	names := map[string]map[string]string{}
+	for _, list := range []struct{ key, path, filter string }{{"app", "/apps", opts.app}, {"env", "/envs", opts.env}} {
+		if list.filter == "" {
+			continue
+		}
+		rows, err := fetcher.rows(ctx, list.path, orgQuery)
+		if err != nil {
+			return nil, 0, err
+		}
+		names[list.key] = map[string]string{}
+		for _, row := range rows {
+			names[list.key][firstScalarPath(row, "id")] = firstScalarPath(row, "title", "name")
+		}
+	}
+	instances, err := fetcher.rows(ctx, "/app-instances", url.Values{"orgId": []string{orgID}, "clusterApp": []string{"false"}})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	targets := make([]*bulkUpgradeTarget, 0)
+	for _, instance := range instances {
+		target := &bulkUpgradeTarget{
+			id:     firstScalarPath(instance, "id"),
+			title:  firstScalarPath(instance, "title", "name"),
+			app:    inventoryRelationName(instance, "app", names),
+			env:    inventoryRelationName(instance, "env", names),
+			status: bulkUpgradePending,
+		}
+		if !bulkUpgradeRelationMatches(instance, "app", opts.app, target.app) || !bulkUpgradeRelationMatches(instance, "env", opts.env, target.env) {
+			continue
+		}
+		if opts.nameGlob != "" && !bulkUpgradeNameMatches(instance, opts.nameGlob) {
+			continue
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, 0, errors.New("no app instances match the selection")
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			changelog, err := fetcher.get(ctx, "/app-instance-stack-upgrade-changelogs/"+url.PathEscape(target.id), nil)
+			if err != nil {
+				errs[i] = errors.Wrapf(err, "app instance %s changelog", target.id)
+				return
+			}
+			target.changelog = cloneFirstRow(normalizeItem(changelog))
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	pending := make([]*bulkUpgradeTarget, 0, len(targets))
+	for _, target := range targets {
+		if bulkUpgradeIsCurrent(target.changelog) {
+			continue
+		}
+		pending = append(pending, target)
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].title < pending[j].title })
+	return pending, len(targets) - len(pending), nil
+}
+
+func bulkUpgradeRelationMatches(instance map[string]interface{}, key string, filter string, name string) bool {
+	if filter == "" {
+		return true
+	}
+	return firstRelationID(instance, relationColumns[key]) == filter || strings.EqualFold(name, filter)
+}
+
+func bulkUpgradeNameMatches(instance map[string]interface{}, glob string) bool {
+	for _, name := range []string{firstScalarPath(instance, "name"), firstScalarPath(instance, "title")} {
+		if matched, _ := path.Match(glob, name); matched && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// bulkUpgradeIsCurrent reports whether a changelog shows nothing to upgrade.
+func bulkUpgradeIsCurrent(changelog map[string]interface{}) bool {
+	if changelog == nil || len(asRows(firstNonNilPath(changelog, "serviceChanges"))) != 0 {
+		return false
+	}
+	from, to := firstScalarPath(changelog, "previousStackRevNumber"), firstScalarPath(changelog, "stackRevNumber")
+	if from != "" || to != "" {
+		return from == to
+	}
+	return firstScalarPath(changelog, "previousStackVersion") == firstScalarPath(changelog, "stackVersion")
+}
+
+func bulkUpgradeVersions(changelog map[string]interface{}) (string, string) {
+	label := func(version, revision string) string {
+		switch {
+		case version != "" && revision != "":
+			return version + " (rev " + revision + ")"
+		case revision != "":
+			return "rev " + revision
+		default:
+			return version
+		}
+	}
+	return label(firstScalarPath(changelog, "previousStackVersion"), firstScalarPath(changelog, "previousStackRevNumber")),
+		label(firstScalarPath(changelog, "stackVersion"), firstScalarPath(changelog, "stackRevNumber"))
+}
+
+func bulkUpgradePreviewRows(targets []*bulkUpgradeTarget) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, len(targets))
+	for _, target := range targets {
+		from, to := bulkUpgradeVersions(target.changelog)
+		changes := make([]string, 0)
+		for _, change := range asRows(firstNonNilPath(target.changelog, "serviceChanges")) {
+			changes = append(changes, firstScalarPath(change, "name"))
+		}
+		rows = append(rows, map[string]interface{}{
+			"id":             target.id,
+			"instance":       target.title,
+			"app":            target.app,
+			"env":            target.env,
+			"from":           from,
+			"to":             to,
+			"serviceChanges": strings.Join(changes, ", "),
+		})
+	}
+	return rows
+}
+
+// bulkUpgradeServiceSummary counts how many instances each service version
+// change affects, for example "php 8.1 -> 8.3 (12 instances)", and follows
+// each change with its deduplicated changelog entries as "  - ENTRY" lines.
+func bulkUpgradeServiceSummary(targets []*bulkUpgradeTarget) []string {
+	counts := map[string]int{}
+	entries := map[string][]string{}
+	for _, target := range targets {
+		for _, change := range asRows(firstNonNilPath(target.changelog, "serviceChanges")) {
+			line := firstScalarPath(change, "name")
+			from, to := firstScalarPath(change, "previousVersion"), firstScalarPath(change, "version")
+			if from != "" || to != "" {
+				line += " " + from + " -> " + to
+			}
+			counts[line]++
+			for _, entry := range changelogEntries(firstNonNilPath(change, "entries")) {
+				if !containsString(entries[line], entry) {
+					entries[line] = append(entries[line], entry)
+				}
+			}
+		}
+	}
+	changes := make([]string, 0, len(counts))
+	for line := range counts {
+		changes = append(changes, line)
+	}
+	sort.Strings(changes)
+	lines := make([]string, 0, len(changes))
+	for _, line := range changes {
+		lines = append(lines, fmt.Sprintf("%s (%s)", line, pluralizeCount(counts[line], "instance", "instances")))
+		for _, entry := range entries[line] {
+			lines = append(lines, "  - "+entry)
+		}
+	}
+	return lines
+}
+
+// runBulkUpgrades upgrades the targets and prints one progress line per
+// state change to progress.
+func runBulkUpgrades(ctx context.Context, client *rest.Client, progress io.Writer, targets []*bulkUpgradeTarget, opts bulkUpgradeOptions, wait waitOptions, body interface{}) {
+	var mu sync.Mutex
+	stopped := false
+	report := func(target *bulkUpgradeTarget, status string, detail string) {
+		mu.Lock()
+		defer mu.Unlock()
+		target.status = status
+		counts := map[string]int{}
+		for _, t := range targets {
+			counts[t.status]++
+		}
+		finished := counts[bulkUpgradeSucceeded] + counts[bulkUpgradeStarted] + counts[bulkUpgradeFailed] + counts[bulkUpgradeSkipped]
+		line := fmt.Sprintf("[%d/%d] %d running, %d failed | %s: %s", finished, len(targets), counts[bulkUpgradeRunning], counts[bulkUpgradeFailed], target.title, status)
+		if detail != "" {
+			line += " (" + detail + ")"
+		}
+		fmt.Fprintln(progress, line)
+	}
+
+	jobs := make(chan *bulkUpgradeTarget)
+	var wg sync.WaitGroup
+	for i := 0; i < min(opts.concurrency, len(targets)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				mu.Lock()
+				skip := stopped
+				mu.Unlock()
+				if skip {
+					report(target, bulkUpgradeSkipped, "stopped after a failure")
+					continue
+				}
+				upgradeBulkTarget(ctx, client, target, wait, body, report)
+				if target.status == bulkUpgradeFailed && opts.stopOnFailure {
+					mu.Lock()
+					stopped = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, target := range targets {
+		jobs <- target
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func upgradeBulkTarget(ctx context.Context, client *rest.Client, target *bulkUpgradeTarget, wait waitOptions, body interface{}, report func(*bulkUpgradeTarget, string, string)) {
+	started := time.Now()
+	report(target, bulkUpgradeRunning, "")
+	fail := func(err error) {
+		target.err = err
+		target.duration = time.Since(started)
+		report(target, bulkUpgradeFailed, err.Error())
+	}
+
+	var result interface{}
+	if err := client.Post(ctx, "/app-instances/"+url.PathEscape(target.id)+"/actions/upgrade-stack", nil, body, &result); err != nil {
+		fail(err)
+		return
+	}
+	target.taskID = firstTaskID(result)
+	if !wait.wait || target.taskID == "" {
+		target.duration = time.Since(started)
+		report(target, bulkUpgradeStarted, "task "+target.taskID)
+		return
+	}
+	if _, err := waitForTask(ctx, client, target.taskID, wait.timeout); err != nil {
+		fail(err)
+		return
+	}
+	target.duration = time.Since(started)
+	report(target, bulkUpgradeSucceeded, formatDisplayDuration(target.duration))
+}
+
+func bulkUpgradeResultRow(target *bulkUpgradeTarget) map[string]interface{} {
+	from, to := bulkUpgradeVersions(target.changelog)
+	row := map[string]interface{}{
+		"id":       target.id,
+		"instance": target.title,
+		"from":     from,
+		"to":       to,
+		"status":   target.status,
+	}
+	if target.taskID != "" {
+		row["upgradeTask"] = target.taskID
+	}
+	if target.duration != 0 {
+		row["duration"] = formatDisplayDuration(target.duration)
+	}
+	if target.err != nil {
+		row["error"] = target.err.Error()
+	}
+	return row
+}
@@ -0,0 +1,506 @@
+package ops
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	outputCSV  = "csv"
+	outputYAML = "yaml"
+)
+
+var inventoryColumns = []string{"kind", "app", "instance", "env", "cluster", "stack", "stackRevision", "stackVersion", "service", "type", "version", "replicas", "cpu", "memory", "domains", "lastDeployedAt", "outdated", "eol"}
+
+// inventoryFetcher runs the GET requests of an inventory with at most
+// cap(slots) in flight, caching responses in memory for the run and on disk
+// for ttl so that repeated runs do not walk the whole org again.
+type inventoryFetcher struct {
+	client  *rest.Client
+	slots   chan struct{}
+	dir     string
+	ttl     time.Duration
+	refresh bool
+
+	mu     sync.Mutex
+	memory map[string]interface{}
+}
+
+type inventoryCacheEntry struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// inventoryInstance is an app instance with everything fetched for it.
+type inventoryInstance struct {
+	row         map[string]interface{}
+	services    []map[string]interface{}
+	containers  map[string][]map[string]interface{}
+	domains     []string
+	deployments []map[string]interface{}
+}
+
+func newInventoryCommand() *cobra.Command {
+	out := outputOptions{}
+	var orgID string
+	var concurrency int
+	var cacheTTL time.Duration
+	var refresh bool
+	cmd := &cobra.Command{
+		Use:   "inventory",
+		Short: "Export an inventory of everything an organization runs",
+		Long: "Walk the clusters, apps, app instances, app services, routes and databases of an organization and print one row per app service and database, " +
+			"with the instance, env, cluster, stack revision and version, service version, replicas, container resources, domains, last deployment and outdated or end-of-life flags.\n\n" +
+			"Requests run concurrently up to --concurrency. Responses are cached under the user cache directory for --cache-ttl; --refresh ignores the cache and --cache-ttl 0 disables it.",
+		Example: `  wodby inventory -o csv > inventory.csv
+  wodby inventory --org 1 -o yaml --refresh`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := outputFormat(cmd, out)
+			switch output {
+			case outputTable, outputVertical, outputJSON, outputCSV, outputYAML:
+			default:
+				return errors.Errorf("unsupported output format %q", output)
+			}
+			if concurrency < 1 {
+				return errors.New("--concurrency must be at least 1")
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			resolvedOrgID, err := inferOrgID(cmd.Context(), client, orgID)
+			if err != nil {
+				return err
+			}
+			fetcher := newInventoryFetcher(client, concurrency, cacheTTL, refresh)
+			rows, err := buildInventory(cmd.Context(), fetcher, resolvedOrgID)
+			if err != nil {
+				return err
+			}
+			return printInventory(cmd, out, output, rows)
+		},
+	}
+	cmd.PersistentFlags().StringVarP(&out.output, "output", "o", outputTable, "Output format: table, vertical, json, csv, or yaml")
+	cmd.Flags().StringVar(&orgID, "org", "", "Organization ID; inferred when current credentials expose one org")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 8, "Maximum number of concurrent API requests")
+	cmd.Flags().DurationVar(&cacheTTL, "cache-ttl", 10*time.Minute, "How long cached API responses are reused; 0 disables the cache")
+	cmd.Flags().BoolVar(&refresh, "refresh", false, "Fetch everything again and update the cache")
+	return cmd
+}
+
+func newInventoryFetcher(client *rest.Client, concurrency int, ttl time.Duration, refresh bool) *inventoryFetcher {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return &inventoryFetcher{
+		client:  client,
+		slots:   make(chan struct{}, concurrency),
+		dir:     filepath.Join(dir, "wodby", "inventory"),
+		ttl:     ttl,
+		refresh: refresh,
+		memory:  map[string]interface{}{},
+	}
+}
+
+// cacheKey includes the API endpoint and credentials so that responses are
+// never shared between accounts.
+func (f *inventoryFetcher) cacheKey(path string, query url.Values) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{apiBaseURL(), viper.GetString("api_key"), viper.GetString("access_token"), path, query.Encode()}, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *inventoryFetcher) get(ctx context.Context, path string, query url.Values) (interface{}, error) {
+	key := f.cacheKey(path, query)
+	f.mu.Lock()
+	cached, ok := f.memory[key]
+	f.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+	if value, ok := f.readCache(key); ok {
+		f.remember(key, value)
+		return value, nil
+	}
+
+	select {
+	case f.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.WithStack(ctx.Err())
+	}
+	var result interface{}
+	err := f.client.Get(ctx, path, query, &result)
+	<-f.slots
+	if err != nil {
+		return nil, err
+	}
+	f.remember(key, result)
+	f.writeCache(key, result)
+	return result, nil
+}
+
+func (f *inventoryFetcher) rows(ctx context.Context, path string, query url.Values) ([]map[string]interface{}, error) {
+	result, err := f.get(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	return responseRows(result), nil
+}
+
+func (f *inventoryFetcher) remember(key string, value interface{}) {
+	f.mu.Lock()
+	f.memory[key] = value
+	f.mu.Unlock()
+}
+
+func (f *inventoryFetcher) readCache(key string) (interface{}, bool) {
+	if f.ttl <= 0 || f.refresh {
+		return nil, false
+	}
+	content, err := os.ReadFile(filepath.Join(f.dir, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+	var entry inventoryCacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil || time.Since(entry.FetchedAt) > f.ttl {
+		return nil, false
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(entry.Body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// writeCache is best effort; a missing cache only makes the next run slower.
+func (f *inventoryFetcher) writeCache(key string, value interface{}) {
+	if f.ttl <= 0 {
+		return
+	}
+	body, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	content, err := json.Marshal(inventoryCacheEntry{FetchedAt: time.Now(), Body: body})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return
+	}
+	_ = os.WriteFile(filepath.Join(f.dir, key+".json"), content, 0o600)
+}
+
+func buildInventory(ctx context.Context, fetcher *inventoryFetcher, orgID string) ([]map[string]interface{}, error) {
+	orgQuery := url.Values{"orgId": []string{orgID}}
+	names := map[string]map[string]string{}
+	for _, list := range []struct{ key, path string }{{"cluster", "/clusters"}, {"app", "/apps"}, {"env", "/envs"}} {
+		rows, err := fetcher.rows(ctx, list.path, orgQuery)
+		if err != nil {
+			return nil, err
+		}
+		names[list.key] = map[string]string{}
+		for _, row := range rows {
+			names[list.key][firstScalarPath(row, "id")] = firstScalarPath(row, "title", "name")
+		}
+	}
+	instances, err := fetcher.rows(ctx, "/app-instances", url.Values{"orgId": []string{orgID}, "clusterApp": []string{"false"}})
+	if err != nil {
+		return nil, err
+	}
+	databases, err := fetcher.rows(ctx, "/databases", orgQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	details := make([]*inventoryInstance, len(instances))
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, instance := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			details[i], errs[i] = fetchInventoryInstance(ctx, fetcher, instance)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	revisions := map[string]map[string]interface{}{}
+	for _, detail := range details {
+		revID := firstScalarPath(detail.row, "stackRevId", "stackRev.id", "stackRevisionId", "stackRevision.id")
+		if revID == "" || revisions[revID] != nil {
+			continue
+		}
+		if revision, err := fetcher.get(ctx, "/stack-revisions/"+url.PathEscape(revID), nil); err == nil {
+			revisions[revID] = cloneFirstRow(normalizeItem(revision))
+		}
+	}
+
+	rows := make([]map[string]interface{}, 0)
+	for _, detail := range details {
+		rows = append(rows, inventoryServiceRows(detail, names, revisions)...)
+	}
+	for _, database := range databases {
+		rows = append(rows, inventoryDatabaseRow(database, names))
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, column := range []string{"kind", "app", "instance", "service"} {
+			left, right := formatValue(rows[i][column]), formatValue(rows[j][column])
+			if left != right {
+				return left < right
+			}
+		}
+		return false
+	})
+	return rows, nil
+}
+
+func fetchInventoryInstance(ctx context.Context, fetcher *inventoryFetcher, instance map[string]interface{}) (*inventoryInstance, error) {
+	id := firstScalarPath(instance, "id")
+	query := url.Values{"appInstanceId": []string{id}}
+	detail := &inventoryInstance{row: instance}
+	var err error
+	if detail.services, err = fetcher.rows(ctx, "/app-services", query); err != nil {
+		return nil, err
+	}
+	routes, err := fetcher.rows(ctx, "/app-routes", query)
+	if err != nil {
+		return nil, err
+	}
+	detail.domains = routeDomains(routes)
+	if detail.deployments, err = fetcher.rows(ctx, "/app-deployments", query); err != nil {
+		return nil, err
+	}
+	if detail.containers, err = fetchServiceChildren(ctx, fetcher, "/app-services", detail.services, "containers"); err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// fetchServiceChildren returns the children under key, such as containers or
+// volumes, of each service by service ID, using the ones embedded in the
+// service when there are any.
+func fetchServiceChildren(ctx context.Context, fetcher *inventoryFetcher, servicesPath string, services []map[string]interface{}, key string) (map[string][]map[string]interface{}, error) {
+	children := map[string][]map[string]interface{}{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(services))
+	for i, service := range services {
+		serviceID := firstScalarPath(service, "id")
+		if rows := asRows(firstNonNilPath(service, key)); len(rows) != 0 {
+			mu.Lock()
+			children[serviceID] = rows
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := fetcher.rows(ctx, servicesPath+"/"+url.PathEscape(serviceID)+"/"+key, nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			mu.Lock()
+			children[serviceID] = rows
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return children, nil
+}
+
+func inventoryServiceRows(detail *inventoryInstance, names map[string]map[string]string, revisions map[string]map[string]interface{}) []map[string]interface{} {
+	instance := detail.row
+	base := map[string]interface{}{
+		"kind":           "service",
+		"app":            inventoryRelationName(instance, "app", names),
+		"instance":       firstScalarPath(instance, "title", "name"),
+		"instanceId":     firstScalarPath(instance, "id"),
+		"env":            inventoryRelationName(instance, "env", names),
+		"cluster":        inventoryRelationName(instance, "cluster", names),
+		"stack":          formatColumnValue(instance, "stack"),
+		"domains":        strings.Join(detail.domains, ", "),
+		"lastDeployedAt": lastDeployedAt(detail.deployments),
+	}
+	revID := firstScalarPath(instance, "stackRevId", "stackRev.id", "stackRevisionId", "stackRevision.id")
+	if revision := revisions[revID]; revision != nil {
+		base["stackRevision"] = firstScalarPath(revision, "number", "revNumber")
+		base["stackVersion"] = firstScalarPath(revision, "version")
+	}
+	if base["stackRevision"] == nil || base["stackRevision"] == "" {
+		base["stackRevision"] = firstScalarPath(instance, "stackRevNumber", "stackRev.number", "stackRevision.number")
+	}
+	setInventoryFlag(base, "outdated", formatOutdatedColumn(instance))
+
+	if len(detail.services) == 0 {
+		return []map[string]interface{}{base}
+	}
+	rows := make([]map[string]interface{}, 0, len(detail.services))
+	for _, service := range detail.services {
+		row := cloneRow(base)
+		cpu, memory := inventoryResources(detail.containers[firstScalarPath(service, "id")])
+		row["service"] = firstScalarPath(service, "name", "title")
+		row["type"] = formatColumnValue(service, "type")
+		row["version"] = formatColumnValue(service, "version")
+		row["replicas"] = formatColumnValue(service, "replicas")
+		row["cpu"] = cpu
+		row["memory"] = memory
+		if row["outdated"] != true {
+			setInventoryFlag(row, "outdated", formatOutdatedColumn(service))
+		}
+		setInventoryFlag(row, "eol", formatEOLColumn(service))
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func inventoryDatabaseRow(database map[string]interface{}, names map[string]map[string]string) map[string]interface{} {
+	row := map[string]interface{}{
+		"kind":    "database",
+		"env":     inventoryRelationName(database, "env", names),
+		"cluster": inventoryRelationName(database, "cluster", names),
+		"service": firstScalarPath(database, "title", "name"),
+		"type":    firstScalarPath(database, "kind", "type"),
+		"version": formatColumnValue(database, "version"),
+	}
+	setInventoryFlag(row, "outdated", formatOutdatedColumn(database))
+	setInventoryFlag(row, "eol", formatEOLColumn(database))
+	return row
+}
+
+func inventoryRelationName(row map[string]interface{}, key string, names map[string]map[string]string) string {
+	if name := names[key][firstRelationID(row, relationColumns[key])]; name != "" {
+		return name
+	}
+	return formatRelationColumn(row, relationColumns[key])
+}
+
+// setInventoryFlag sets key to a boolean from a yes/no column value, and
+// leaves it unset when the API did not say.
+func setInventoryFlag(row map[string]interface{}, key string, value string) {
+	switch value {
+	case "yes":
+		row[key] = true
+	case "no":
+		row[key] = false
+	}
+}
+
+// inventoryResources lists the CPU and memory requests and limits of each
+// container as REQUEST/LIMIT.
+func inventoryResources(containers []map[string]interface{}) (string, string) {
+	cpu := make([]string, 0, len(containers))
+	memory := make([]string, 0, len(containers))
+	for _, container := range containers {
+		if value := inventoryRequestLimit(container, "requestCPU", "limitCPU"); value != "" {
+			cpu = append(cpu, value)
+		}
+		if value := inventoryRequestLimit(container, "requestMem", "limitMem"); value != "" {
+			memory = append(memory, value)
+		}
+	}
+	return strings.Join(cpu, ", "), strings.Join(memory, ", ")
+}
+
+func inventoryRequestLimit(container map[string]interface{}, request string, limit string) string {
+	requestValue, limitValue := firstScalarPath(container, request), firstScalarPath(container, limit)
+	if requestValue == "" && limitValue == "" {
+		return ""
+	}
+	if requestValue == "" {
+		requestValue = "-"
+	}
+	if limitValue == "" {
+		limitValue = "-"
+	}
+	return requestValue + "/" + limitValue
+}
+
+func lastDeployedAt(deployments []map[string]interface{}) string {
+	var latest time.Time
+	for _, deployment := range deployments {
+		if !successfulStatuses[strings.ToLower(formatValue(deployment["status"]))] {
+			continue
+		}
+		if at, ok := parseDisplayTime(firstNonNilPath(deployment, "endedAt", "createdAt", "startedAt")); ok && at.After(latest) {
+			latest = at
+		}
+	}
+	if latest.IsZero() {
+		return ""
+	}
+	return latest.UTC().Format(time.RFC3339)
+}
+
+func printInventory(cmd *cobra.Command, out outputOptions, output string, rows []map[string]interface{}) error {
+	switch output {
+	case outputCSV:
+		writer := csv.NewWriter(cmd.OutOrStdout())
+		if err := writer.Write(inventoryColumns); err != nil {
+			return errors.WithStack(err)
+		}
+		for _, row := range rows {
+			record := make([]string, 0, len(inventoryColumns))
+			for _, column := range inventoryColumns {
+				record = append(record, inventoryCell(row[column]))
+			}
+			if err := writer.Write(record); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		writer.Flush()
+		return errors.WithStack(writer.Error())
+	case outputYAML:
+		content, err := yaml.Marshal(rows)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = cmd.OutOrStdout().Write(content)
+		return errors.WithStack(err)
+	default:
+		return printResult(cmd, out, rows, inventoryColumns)
+	}
+}
+
+func inventoryCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return formatValue(v)
+	}
+}
@@ -1,14 +1,21 @@
 package ops
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+	"go.yaml.in/yaml/v3"
 )
 
 var manifestValidationColumns = []string{"valid", "resource", "error"}
@@ -19,6 +26,7 @@ type manifestFileOptions struct {
 	projectID string
 	version   string
 	includes  []string
+	template  manifestTemplateOptions
 }
 
 func newManifestValidateCommand(kind string, out outputOptions) *cobra.Command {
@@ -88,6 +96,7 @@ func addManifestFileFlags(cmd *cobra.Command, opts *manifestFileOptions) {
 	cmd.Flags().StringVar(&opts.projectID, "project", "", "Project ID")
 	cmd.Flags().StringVar(&opts.version, "version", "", "Revision version label")
 	cmd.Flags().StringArrayVar(&opts.includes, "include", nil, "Referenced file to include; use PATH or MANIFEST_PATH=LOCAL_PATH")
+	addManifestTemplateFlags(cmd, &opts.template)
 }
 
 func manifestRequestBody(cmd *cobra.Command, args []string, opts manifestFileOptions) (map[string]interface{}, error) {
@@ -99,6 +108,11 @@ func manifestRequestBody(cmd *cobra.Command, args []string, opts manifestFileOpt
 	if err != nil {
 		return nil, errors.Wrap(err, "read manifest")
 	}
+	if opts.template.enabled() {
+		if manifestYAML, err = renderManifest(manifestPath, manifestYAML, opts.template); err != nil {
+			return nil, err
+		}
+	}
 	files, err := readIncludedFiles(opts.includes)
 	if err != nil {
 		return nil, err
@@ -265,3 +279,414 @@ func requiredStringField(value interface{}, field string) (string, error) {
 	}
 	return text, nil
 }
+
+// manifestExport is a manifest read back from a stack or service revision,
+// in the shape that create-from-manifest sends: the manifest YAML and the
+// included files keyed by the path the manifest references them with.
+type manifestExport struct {
+	RevisionID   string            `json:"revisionId"`
+	Revision     string            `json:"revision,omitempty"`
+	ManifestYAML string            `json:"manifestYaml"`
+	Files        map[string]string `json:"files,omitempty"`
+}
+
+func newManifestExportCommand(kind string, out outputOptions) *cobra.Command {
+	var rev, outDir string
+	cmd := &cobra.Command{
+		Use:   "export-manifest ID",
+		Short: "Export " + kind + " manifest",
+		Long: "Export the manifest of a " + kind + " revision, the current one unless --rev is set, as YAML.\n\n" +
+			"With --out, the manifest is written to DIR/" + kind + ".yml and every included file to DIR under the path the manifest references it with, " +
+			"so that running create-from-manifest from DIR with one --include per file recreates the " + kind + ", for example in another organization.",
+		Example: fmt.Sprintf(`  wodby %[1]s export-manifest 12 > %[1]s.yml
+  wodby %[1]s export-manifest 12 --rev 3 --out ./%[1]s
+  cd ./%[1]s && wodby %[1]s create-from-manifest %[1]s.yml --include templates/nginx.conf --org 2`, kind),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			revision, err := fetchManifestRevision(cmd.Context(), client, kind, args[0], rev)
+			if err != nil {
+				return err
+			}
+			export, err := newManifestExport(revision)
+			if err != nil {
+				return err
+			}
+			if outputFormat(cmd, out) == outputJSON {
+				if outDir != "" {
+					if _, err := writeManifestExport(outDir, kind, export); err != nil {
+						return err
+					}
+				}
+				return printJSON(cmd, export)
+			}
+			if outDir == "" {
+				fmt.Fprint(cmd.OutOrStdout(), export.ManifestYAML)
+				if len(export.Files) != 0 {
+					fmt.Fprintf(cmd.ErrOrStderr(), "The manifest includes %s; use --out to write them.\n", pluralizeCount(len(export.Files), "file", "files"))
+				}
+				return nil
+			}
+			manifestPath, err := writeManifestExport(outDir, kind, export)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s manifest to %s\n", kind, manifestPath)
+			paths := make([]string, 0, len(export.Files))
+			for path := range export.Files {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			command := []string{"wodby", kind, "create-from-manifest", kind + ".yml"}
+			for _, path := range paths {
+				fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s\n", filepath.Join(outDir, filepath.FromSlash(path)))
+				command = append(command, "--include", path)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Recreate it from %s with:\n  %s\n", outDir, strings.Join(command, " "))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&rev, "rev", "", "Revision number; defaults to the current revision")
+	cmd.Flags().StringVar(&outDir, "out", "", "Directory to write the manifest and its included files to")
+	return cmd
+}
+
+// fetchManifestRevision returns the stack or service revision numbered rev,
+// or the current revision of the stack or service when rev is empty.
+func fetchManifestRevision(ctx context.Context, client *rest.Client, kind string, id string, rev string) (map[string]interface{}, error) {
+	revisionID, err := findRevisionID(ctx, client, kind, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	var revision interface{}
+	if err := client.Get(ctx, "/"+kind+"-revisions/"+url.PathEscape(revisionID), nil, &revision); err != nil {
+		return nil, err
+	}
+	row := cloneFirstRow(normalizeItem(revision))
+	if row == nil {
+		return nil, errors.Errorf("%s revision %s response did not include an item", kind, revisionID)
+	}
+	return row, nil
+}
+
+// findRevisionID returns the ID of the stack or service revision with the
+// number rev, or of the current revision when rev is empty.
+func findRevisionID(ctx context.Context, client *rest.Client, kind string, id string, rev string) (string, error) {
+	if rev == "" {
+		var parent interface{}
+		if err := client.Get(ctx, "/"+kind+"s/"+url.PathEscape(id), nil, &parent); err != nil {
+			return "", err
+		}
+		revisionID := currentRevisionID(cloneFirstRow(normalizeItem(parent)), kind)
+		if revisionID == "" {
+			return "", errors.Errorf("%s %s has no current revision", kind, id)
+		}
+		return revisionID, nil
+	}
+	revisions, err := fetchRows(ctx, client, "/"+kind+"-revisions", url.Values{kind + "Id": []string{id}})
+	if err != nil {
+		return "", err
+	}
+	for _, revision := range revisions {
+		if firstScalarPath(revision, "number", "revNumber") == rev {
+			return firstScalarPath(revision, "id"), nil
+		}
+	}
+	return "", errors.Errorf("%s %s has no revision %s", kind, id, rev)
+}
+
+// currentRevisionID reads the ID of the current, published revision from a
+// stack or service row.
+func currentRevisionID(row map[string]interface{}, kind string) string {
+	title := strings.ToUpper(kind[:1]) + kind[1:]
+	return firstScalarPath(row, "revId", kind+"RevId", "currentRevId", "current"+title+"RevId", "rev.id", kind+"Rev.id", kind+"Revision.id")
+}
+
+// newManifestExport reads the manifest of a revision. Revisions store the
+// manifest as JSON, either as a string or as an object with the original in
+// "raw"; it is converted to YAML keeping the order of the keys.
+func newManifestExport(revision map[string]interface{}) (manifestExport, error) {
+	export := manifestExport{
+		RevisionID: firstScalarPath(revision, "id"),
+		Revision:   firstScalarPath(revision, "number", "revNumber"),
+		Files:      manifestFiles(firstNonNilPath(revision, "files", "manifestFiles")),
+	}
+	if manifestYAML := firstScalarPath(revision, "manifestYaml"); manifestYAML != "" {
+		export.ManifestYAML = manifestYAML
+		return export, nil
+	}
+	raw := firstScalarPath(revision, "manifest.raw")
+	if raw == "" {
+		switch manifest := revision["manifest"].(type) {
+		case string:
+			raw = manifest
+		case map[string]interface{}:
+			content, err := json.Marshal(manifest)
+			if err != nil {
+				return export, errors.WithStack(err)
+			}
+			raw = string(content)
+		}
+	}
+	if strings.TrimSpace(raw) == "" {
+		return export, errors.Errorf("revision %s did not include a manifest", export.RevisionID)
+	}
+	manifestYAML, err := manifestJSONToYAML(raw)
+	if err != nil {
+		return export, errors.Wrapf(err, "revision %s manifest", export.RevisionID)
+	}
+	export.ManifestYAML = manifestYAML
+	return export, nil
+}
+
+// manifestFiles accepts included files as a map of path to content or as a
+// list of objects with a path and content.
+func manifestFiles(value interface{}) map[string]string {
+	files := map[string]string{}
+	if m, ok := value.(map[string]interface{}); ok {
+		for path, content := range m {
+			if text, ok := content.(string); ok {
+				files[path] = text
+			}
+		}
+		return files
+	}
+	for _, row := range asRows(value) {
+		if path := firstScalarPath(row, "path", "name"); path != "" {
+			content, _ := row["content"].(string)
+			files[path] = content
+		}
+	}
+	return files
+}
+
+func manifestJSONToYAML(raw string) (string, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(raw), &node); err != nil {
+		return "", errors.WithStack(err)
+	}
+	clearYAMLStyle(&node)
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return buffer.String(), nil
+}
+
+// clearYAMLStyle turns the flow style and quoting that JSON syntax implies
+// into block YAML; the encoder still quotes strings that need it.
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" && strings.Contains(node.Value, "\n") {
+		node.Style = yaml.LiteralStyle
+	}
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
+
+// writeManifestExport writes the manifest and its files under dir and
+// returns the manifest path. File paths may not leave dir.
+func writeManifestExport(dir string, kind string, export manifestExport) (string, error) {
+	for path := range export.Files {
+		if !filepath.IsLocal(filepath.FromSlash(path)) {
+			return "", errors.Errorf("included file %q is outside the manifest directory", path)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", errors.WithStack(err)
+	}
+	manifestPath := filepath.Join(dir, kind+".yml")
+	if err := writeTextOutput(manifestPath, export.ManifestYAML); err != nil {
+		return "", err
+	}
+	for path, content := range export.Files {
+		target := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return "", errors.WithStack(err)
+		}
+		if err := writeTextOutput(target, content); err != nil {
+			return "", err
+		}
+	}
+	return manifestPath, nil
+}
+
+type manifestApplyOptions struct {
+	file    manifestFileOptions
+	draft   bool
+	publish bool
+	dryRun  bool
+	yes     bool
+	wait    waitOptions
+}
+
+func newManifestApplyCommand(kind string, out outputOptions, columns []string) *cobra.Command {
+	opts := manifestApplyOptions{}
+	long := "Validate a " + kind + " manifest, show how it differs from the current revision and create a new revision from it, labelled with --version.\n\n" +
+		"The diff compares the decoded manifests, so key order and the order of named list items such as services do not matter. " +
+		"Nothing is created when the manifest matches the current revision, or with --dry-run."
+	example := fmt.Sprintf(`  wodby %[1]s apply-manifest 12 -f %[1]s.yml --version 1.4.0 --dry-run
+  wodby %[1]s apply-manifest 12 -f %[1]s.yml --include templates/nginx.conf --version 1.4.0 -y`, kind)
+	if kind == "stack" {
+		long += " --draft keeps the new revision as a draft to review with \"wodby stack publish-draft --preview\" before publishing it. " +
+			"--publish creates the draft, waits for it and publishes it right away; without either flag the API decides whether the revision is published."
+		example += "\n  wodby stack apply-manifest 12 -f stack.yml --version 1.4.0 --draft -y --wait" +
+			"\n  wodby stack apply-manifest 12 -f stack.yml --version 1.4.0 --publish -y --wait"
+	}
+	cmd := &cobra.Command{
+		Use:     "apply-manifest ID [MANIFEST]",
+		Short:   "Create " + kind + " revision from manifest",
+		Long:    long,
+		Example: example,
+		Args:    cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.draft && opts.publish {
+				return errors.New("use either --draft or --publish")
+			}
+			body, err := manifestRequestBody(cmd, args[1:], opts.file)
+			if err != nil {
+				return err
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			jsonOutput := outputFormat(cmd, out) == outputJSON
+
+			var validation interface{}
+			if err := client.Post(cmd.Context(), "/"+kind+"s/actions/validate-manifest", nil, body, &validation); err != nil {
+				return err
+			}
+			if manifestValidationFailed(validation) {
+				if err := printManifestValidationResult(cmd, out, kind, validation); err != nil {
+					return err
+				}
+				cmd.SilenceUsage = true
+				return errors.New(kind + " manifest is invalid")
+			}
+
+			changes, err := diffManifestWithCurrentRevision(cmd.Context(), client, kind, args[0], body)
+			if err != nil {
+				return err
+			}
+			if !jsonOutput {
+				if len(changes) == 0 {
+					fmt.Fprintf(cmd.OutOrStdout(), "The manifest matches the current %s revision.\n", kind)
+				} else if err := printResult(cmd, out, manifestChangeRows(changes), manifestChangeColumns); err != nil {
+					return err
+				}
+			}
+			if len(changes) == 0 || opts.dryRun {
+				if jsonOutput {
+					return printJSON(cmd, map[string]interface{}{"changes": changes})
+				}
+				return nil
+			}
+			if !jsonOutput {
+				fmt.Fprintln(cmd.OutOrStdout())
+			}
+			if err := confirm(cmd, opts.yes, fmt.Sprintf("Create a new %s revision with %s?", kind, pluralizeCount(len(changes), "change", "changes"))); err != nil {
+				return err
+			}
+
+			if kind == "stack" {
+				body["draft"] = opts.draft || opts.publish
+			}
+			var result interface{}
+			if err := client.Post(cmd.Context(), "/"+kind+"s/"+url.PathEscape(args[0])+"/actions/update-from-manifest", nil, body, &result); err != nil {
+				return err
+			}
+			if opts.publish {
+				// The draft must exist before it can be published.
+				if taskID := firstTaskID(result); taskID != "" {
+					if _, err := waitForTask(cmd.Context(), client, taskID, opts.wait.timeout); err != nil {
+						return errors.Wrap(err, "create draft")
+					}
+				}
+				result = nil
+				if err := client.Post(cmd.Context(), "/stacks/"+url.PathEscape(args[0])+"/actions/publish-draft", nil, nil, &result); err != nil {
+					return errors.Wrap(err, "publish draft")
+				}
+			}
+			resultColumns := columns
+			if opts.wait.wait && firstTaskID(result) != "" {
+				if result, err = waitForTask(cmd.Context(), client, firstTaskID(result), opts.wait.timeout); err != nil {
+					return err
+				}
+				resultColumns = taskColumns
+			}
+			if jsonOutput {
+				return printJSON(cmd, map[string]interface{}{"changes": changes, "result": result})
+			}
+			return printClientResult(cmd, client, out, result, resultColumns)
+		},
+	}
+	cmd.Flags().StringVarP(&opts.file.manifest, "manifest", "f", "", "Path to Wodby manifest YAML; use - for stdin")
+	cmd.Flags().StringVar(&opts.file.version, "version", "", "Revision version label")
+	cmd.Flags().StringArrayVar(&opts.file.includes, "include", nil, "Referenced file to include; use PATH or MANIFEST_PATH=LOCAL_PATH")
+	addManifestTemplateFlags(cmd, &opts.file.template)
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Validate and show the diff without creating a revision")
+	cmd.Flags().BoolVarP(&opts.yes, "yes", "y", false, "Confirm without prompting")
+	if kind == "stack" {
+		cmd.Flags().BoolVar(&opts.draft, "draft", false, "Keep the new revision as a draft")
+		cmd.Flags().BoolVar(&opts.publish, "publish", false, "Create the new revision as a draft and publish it right away")
+	}
+	addWaitFlags(cmd, &opts.wait)
+	return cmd
+}
+
+// diffManifestWithCurrentRevision compares the manifest and included files of
+// a request body with the current revision of the stack or service.
+func diffManifestWithCurrentRevision(ctx context.Context, client *rest.Client, kind string, id string, body map[string]interface{}) ([]manifestChange, error) {
+	revision, err := fetchManifestRevision(ctx, client, kind, id, "")
+	if err != nil {
+		return nil, err
+	}
+	current, err := newManifestExport(revision)
+	if err != nil {
+		return nil, err
+	}
+	var from, to interface{}
+	if err := yaml.Unmarshal([]byte(current.ManifestYAML), &from); err != nil {
+		return nil, errors.Wrap(err, "decode current manifest")
+	}
+	manifestYAML, _ := body["manifestYaml"].(string)
+	if err := yaml.Unmarshal([]byte(manifestYAML), &to); err != nil {
+		return nil, errors.Wrap(err, "decode manifest")
+	}
+	changes := diffManifests(from, to)
+
+	files, _ := body["files"].(map[string]string)
+	paths := make([]string, 0, len(files)+len(current.Files))
+	for path := range current.Files {
+		paths = append(paths, path)
+	}
+	for path := range files {
+		if _, ok := current.Files[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		currentContent, inCurrent := current.Files[path]
+		content, inFiles := files[path]
+		switch {
+		case !inCurrent:
+			changes = append(changes, manifestChange{Change: manifestChangeAdded, Path: "files[" + path + "]", To: pluralizeCount(strings.Count(content, "\n"), "line", "lines")})
+		case !inFiles:
+			changes = append(changes, manifestChange{Change: manifestChangeRemoved, Path: "files[" + path + "]", From: pluralizeCount(strings.Count(currentContent, "\n"), "line", "lines")})
+		case content != currentContent:
+			changes = append(changes, manifestChange{Change: manifestChangeChanged, Path: "files[" + path + "]", From: pluralizeCount(strings.Count(currentContent, "\n"), "line", "lines"), To: pluralizeCount(strings.Count(content, "\n"), "line", "lines")})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,157 @@
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	manifestChangeAdded   = "added"
+	manifestChangeRemoved = "removed"
+	manifestChangeChanged = "changed"
+)
+
+var manifestChangeColumns = []string{"change", "path", "from", "to"}
+
+// manifestChange is one difference between two decoded manifests. Path
+// names list items by their name, for example "services[php].options".
+type manifestChange struct {
+	Change string      `json:"change"`
+	Path   string      `json:"path"`
+	From   interface{} `json:"from,omitempty"`
+	To     interface{} `json:"to,omitempty"`
+}
+
+// diffManifests compares two decoded manifests semantically: key order and
+// the order of named list items do not matter.
+func diffManifests(from interface{}, to interface{}) []manifestChange {
+	changes := make([]manifestChange, 0)
+	diffManifestValues("", from, to, &changes)
+	return changes
+}
+
+func diffManifestValues(path string, from interface{}, to interface{}, changes *[]manifestChange) {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		keys := make([]string, 0, len(fromMap)+len(toMap))
+		for key := range fromMap {
+			keys = append(keys, key)
+		}
+		for key := range toMap {
+			if _, ok := fromMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffManifestChild(joinManifestPath(path, key), fromMap, toMap, key, changes)
+		}
+		return
+	}
+
+	fromList, fromIsList := from.([]interface{})
+	toList, toIsList := to.([]interface{})
+	if fromIsList && toIsList {
+		fromNamed, fromOK := namedManifestItems(fromList)
+		toNamed, toOK := namedManifestItems(toList)
+		if fromOK && toOK {
+			names := make([]string, 0, len(fromNamed)+len(toNamed))
+			for name := range fromNamed {
+				names = append(names, name)
+			}
+			for name := range toNamed {
+				if _, ok := fromNamed[name]; !ok {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				diffManifestChild(path+"["+name+"]", fromNamed, toNamed, name, changes)
+			}
+			return
+		}
+	}
+
+	if formatManifestValue(from) != formatManifestValue(to) {
+		*changes = append(*changes, manifestChange{Change: manifestChangeChanged, Path: path, From: from, To: to})
+	}
+}
+
+func diffManifestChild(path string, from map[string]interface{}, to map[string]interface{}, key string, changes *[]manifestChange) {
+	fromValue, inFrom := from[key]
+	toValue, inTo := to[key]
+	switch {
+	case !inFrom:
+		*changes = append(*changes, manifestChange{Change: manifestChangeAdded, Path: path, To: toValue})
+	case !inTo:
+		*changes = append(*changes, manifestChange{Change: manifestChangeRemoved, Path: path, From: fromValue})
+	default:
+		diffManifestValues(path, fromValue, toValue, changes)
+	}
+}
+
+// namedManifestItems indexes a list whose items are all objects with a
+// distinct name, or version for version options.
+func namedManifestItems(items []interface{}) (map[string]interface{}, bool) {
+	if len(items) == 0 {
+		return map[string]interface{}{}, true
+	}
+	for _, key := range []string{"name", "version"} {
+		named := map[string]interface{}{}
+		for _, item := range items {
+			row, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			name := scalarString(row[key])
+			if name == "" || named[name] != nil {
+				break
+			}
+			named[name] = row
+		}
+		if len(named) == len(items) {
+			return named, true
+		}
+	}
+	return nil, false
+}
+
+func joinManifestPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// formatManifestValue prints scalars as they are and objects and lists as
+// compact JSON.
+func formatManifestValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		content, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(content)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func manifestChangeRows(changes []manifestChange) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, len(changes))
+	for _, change := range changes {
+		rows = append(rows, map[string]interface{}{
+			"change": change.Change,
+			"path":   change.Path,
+			"from":   strings.TrimSpace(formatManifestValue(change.From)),
+			"to":     strings.TrimSpace(formatManifestValue(change.To)),
+		})
+	}
+	return rows
+}
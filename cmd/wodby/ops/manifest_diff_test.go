@@ -0,0 +1,60 @@
+package ops
+
+import (
+	"fmt"
+	"testing"
+
+	"go.yaml.in/yaml/v3"
+)
+
+func TestDiffManifestsMatchesNamedItemsRegardlessOfOrder(t *testing.T) {
+	decode := func(content string) interface{} {
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(content), &value); err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	from := decode(`
+name: php-stack
+version: "1.0"
+services:
+  - name: nginx
+    options: [{version: "1.25"}, {version: "1.27", default: true}]
+  - name: php
+    options: [{version: "8.3"}]
+  - name: memcached
+settings:
+  tokens: [a, b]
+`)
+	to := decode(`
+services:
+  - name: php
+    options: [{version: "8.3"}, {version: "8.4", default: true}]
+  - name: nginx
+    options: [{version: "1.27", default: true}, {version: "1.25"}]
+  - name: redis
+    replicas: 1
+settings:
+  tokens: [b, a]
+version: "1.1"
+name: php-stack
+`)
+
+	got := ""
+	for _, change := range diffManifests(from, to) {
+		got += fmt.Sprintf("%s %s %s -> %s\n", change.Change, change.Path, formatManifestValue(change.From), formatManifestValue(change.To))
+	}
+	want := `removed services[memcached] {"name":"memcached"} -> 
+added services[php].options[8.4]  -> {"default":true,"version":"8.4"}
+added services[redis]  -> {"name":"redis","replicas":1}
+changed settings.tokens ["a","b"] -> ["b","a"]
+changed version 1.0 -> 1.1
+`
+	if got != want {
+		t.Fatalf("changes =\n%s\nwant\n%s", got, want)
+	}
+	if changes := diffManifests(from, from); len(changes) != 0 {
+		t.Fatalf("changes = %v, want none", changes)
+	}
+}
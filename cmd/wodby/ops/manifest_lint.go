@@ -0,0 +1,404 @@
+package ops
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/pkg/errors"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	manifestSeverityError   = "error"
+	manifestSeverityWarning = "warning"
+
+	manifestRuleSyntax         = "syntax"
+	manifestRuleSchema         = "schema"
+	manifestRuleInclude        = "include"
+	manifestRuleResourceLimits = "resource-limits"
+	manifestRuleLatestTag      = "latest-tag"
+	manifestRuleDuplicateEnv   = "duplicate-env"
+)
+
+var manifestLintRules = []string{manifestRuleSyntax, manifestRuleSchema, manifestRuleInclude, manifestRuleResourceLimits, manifestRuleLatestTag, manifestRuleDuplicateEnv}
+
+//go:embed schemas/*.schema.json
+var manifestSchemaFiles embed.FS
+
+var yamlErrorLinePattern = regexp.MustCompile(`line (\d+)`)
+
+// manifestSchema is the subset of JSON Schema that the embedded manifest
+// schemas use. String values with format "include" reference a file that
+// create-from-manifest must be given with --include.
+type manifestSchema struct {
+	Ref                  string                     `json:"$ref"`
+	Type                 manifestSchemaTypes        `json:"type"`
+	Required             []string                   `json:"required"`
+	Properties           map[string]*manifestSchema `json:"properties"`
+	AdditionalProperties *bool                      `json:"additionalProperties"`
+	Items                *manifestSchema            `json:"items"`
+	Pattern              string                     `json:"pattern"`
+	Minimum              *float64                   `json:"minimum"`
+	MinItems             *int                       `json:"minItems"`
+	Format               string                     `json:"format"`
+	Defs                 map[string]*manifestSchema `json:"$defs"`
+}
+
+type manifestSchemaTypes []string
+
+func (t *manifestSchemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = manifestSchemaTypes{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.WithStack(err)
+	}
+	*t = list
+	return nil
+}
+
+// manifestDiagnostic is one lint finding. Line and column are 1-based and
+// zero when the finding is not about a position in the file.
+type manifestDiagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+}
+
+func (d manifestDiagnostic) String() string {
+	position := d.File
+	if d.Line != 0 {
+		position += fmt.Sprintf(":%d:%d", d.Line, d.Column)
+	}
+	return fmt.Sprintf("%s: %s: %s (%s)", position, d.Severity, d.Message, d.Rule)
+}
+
+// manifestLinter checks manifest files against the embedded schemas and
+// the style rules that are not disabled.
+type manifestLinter struct {
+	kind     string
+	includes map[string]string
+	disabled map[string]bool
+	patterns map[string]*regexp.Regexp
+
+	file        string
+	root        *manifestSchema
+	diagnostics []manifestDiagnostic
+}
+
+func loadManifestSchema(kind string) (*manifestSchema, error) {
+	content, err := manifestSchemaFiles.ReadFile("schemas/" + kind + ".schema.json")
+	if err != nil {
+		return nil, errors.Errorf("unknown manifest kind %q", kind)
+	}
+	schema := &manifestSchema{}
+	if err := json.Unmarshal(content, schema); err != nil {
+		return nil, errors.Wrapf(err, "decode %s manifest schema", kind)
+	}
+	return schema, nil
+}
+
+// lint checks one file. Kind "auto" treats manifests with a top-level
+// services list as stacks and everything else as services.
+func (l *manifestLinter) lint(file string, content []byte) ([]manifestDiagnostic, error) {
+	l.file = file
+	l.diagnostics = nil
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var document yaml.Node
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			line := 0
+			if match := yamlErrorLinePattern.FindStringSubmatch(err.Error()); match != nil {
+				line, _ = strconv.Atoi(match[1])
+			}
+			l.report(&yaml.Node{Line: line, Column: 1}, manifestSeverityError, manifestRuleSyntax, strings.TrimPrefix(err.Error(), "yaml: "))
+			break
+		}
+		if len(document.Content) == 0 {
+			continue
+		}
+		root := document.Content[0]
+		kind := l.kind
+		if kind == "" || kind == "auto" {
+			kind = "service"
+			if root.Kind == yaml.MappingNode && mappingValue(root, "services") != nil {
+				kind = "stack"
+			}
+		}
+		schema, err := loadManifestSchema(kind)
+		if err != nil {
+			return nil, err
+		}
+		l.root = schema
+		l.validate(root, schema, "")
+		l.checkStyle(root)
+	}
+	sort.SliceStable(l.diagnostics, func(i, j int) bool {
+		if l.diagnostics[i].Line != l.diagnostics[j].Line {
+			return l.diagnostics[i].Line < l.diagnostics[j].Line
+		}
+		return l.diagnostics[i].Column < l.diagnostics[j].Column
+	})
+	return l.diagnostics, nil
+}
+
+// checkIncludeFlags reports --include files that do not exist.
+func (l *manifestLinter) checkIncludeFlags() []manifestDiagnostic {
+	keys := make([]string, 0, len(l.includes))
+	for key := range l.includes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	diagnostics := make([]manifestDiagnostic, 0)
+	for _, key := range keys {
+		if _, err := os.Stat(l.includes[key]); err != nil && !l.disabled[manifestRuleInclude] {
+			diagnostics = append(diagnostics, manifestDiagnostic{File: l.includes[key], Severity: manifestSeverityError, Rule: manifestRuleInclude, Message: "--include " + key + " does not exist"})
+		}
+	}
+	return diagnostics
+}
+
+func (l *manifestLinter) report(node *yaml.Node, severity string, rule string, message string) {
+	if l.disabled[rule] {
+		return
+	}
+	l.diagnostics = append(l.diagnostics, manifestDiagnostic{File: l.file, Line: node.Line, Column: node.Column, Severity: severity, Rule: rule, Message: message})
+}
+
+func (l *manifestLinter) resolve(schema *manifestSchema) *manifestSchema {
+	for schema != nil && schema.Ref != "" {
+		schema = l.root.Defs[strings.TrimPrefix(schema.Ref, "#/$defs/")]
+	}
+	return schema
+}
+
+func (l *manifestLinter) validate(node *yaml.Node, schema *manifestSchema, path string) {
+	schema = l.resolve(schema)
+	if schema == nil {
+		return
+	}
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	label := path
+	if label == "" {
+		label = "manifest"
+	}
+	actual := yamlNodeType(node)
+	if len(schema.Type) != 0 && !yamlTypeAllowed(actual, schema.Type) {
+		l.report(node, manifestSeverityError, manifestRuleSchema, fmt.Sprintf("%s must be %s, not %s", label, strings.Join(schema.Type, " or "), actual))
+		return
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		present := map[string]bool{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			present[key.Value] = true
+			property, ok := schema.Properties[key.Value]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					l.report(key, manifestSeverityError, manifestRuleSchema, fmt.Sprintf("%s has unknown key %q", label, key.Value))
+				}
+				continue
+			}
+			l.validate(value, property, joinManifestPath(path, key.Value))
+		}
+		for _, required := range schema.Required {
+			if !present[required] {
+				l.report(node, manifestSeverityError, manifestRuleSchema, fmt.Sprintf("%s is missing required key %q", label, required))
+			}
+		}
+	case yaml.SequenceNode:
+		if schema.MinItems != nil && len(node.Content) < *schema.MinItems {
+			l.report(node, manifestSeverityError, manifestRuleSchema, fmt.Sprintf("%s must have at least %s", label, pluralizeCount(*schema.MinItems, "item", "items")))
+		}
+		if schema.Items != nil {
+			for i, item := range node.Content {
+				l.validate(item, schema.Items, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case yaml.ScalarNode:
+		if schema.Pattern != "" && actual == "string" && !l.pattern(schema.Pattern).MatchString(node.Value) {
+			l.report(node, manifestSeverityError, manifestRuleSchema, fmt.Sprintf("%s %q does not match %s", label, node.Value, schema.Pattern))
+		}
+		if schema.Minimum != nil {
+			if number, err := strconv.ParseFloat(node.Value, 64); err == nil && number < *schema.Minimum {
+				l.report(node, manifestSeverityError, manifestRuleSchema, fmt.Sprintf("%s must be at least %s", label, strconv.FormatFloat(*schema.Minimum, 'f', -1, 64)))
+			}
+		}
+		if schema.Format == "include" {
+			l.checkInclude(node, label)
+		}
+	}
+}
+
+func (l *manifestLinter) pattern(expression string) *regexp.Regexp {
+	if l.patterns == nil {
+		l.patterns = map[string]*regexp.Regexp{}
+	}
+	if l.patterns[expression] == nil {
+		l.patterns[expression] = regexp.MustCompile(expression)
+	}
+	return l.patterns[expression]
+}
+
+// checkInclude checks that a referenced file is passed with --include, or
+// exists next to the manifest when no --include is given.
+func (l *manifestLinter) checkInclude(node *yaml.Node, label string) {
+	local := filepath.Join(filepath.Dir(l.file), filepath.FromSlash(node.Value))
+	if len(l.includes) != 0 {
+		path, ok := l.includes[filepath.ToSlash(node.Value)]
+		if !ok {
+			l.report(node, manifestSeverityError, manifestRuleInclude, fmt.Sprintf("%s references %s, which is not passed with --include", label, node.Value))
+			return
+		}
+		local = path
+	}
+	if _, err := os.Stat(local); err != nil {
+		l.report(node, manifestSeverityError, manifestRuleInclude, fmt.Sprintf("%s references %s, which does not exist", label, local))
+	}
+}
+
+// checkStyle applies the style rules to every containers and env list in
+// the manifest, wherever it is nested.
+func (l *manifestLinter) checkStyle(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Kind == yaml.SequenceNode {
+				switch key.Value {
+				case "containers":
+					for _, container := range value.Content {
+						l.checkContainer(container)
+					}
+				case "env":
+					l.checkEnv(value)
+				}
+			}
+			l.checkStyle(value)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			l.checkStyle(item)
+		}
+	}
+}
+
+func (l *manifestLinter) checkContainer(container *yaml.Node) {
+	if container.Kind != yaml.MappingNode {
+		return
+	}
+	name := "container"
+	if value := mappingValue(container, "name"); value != nil && value.Value != "" {
+		name = "container " + value.Value
+	}
+	missing := make([]string, 0, 2)
+	resources := mappingValue(container, "resources")
+	for _, limit := range []struct{ key, label string }{{"limitCPU", "CPU"}, {"limitMem", "memory"}} {
+		if resources == nil || resources.Kind != yaml.MappingNode || mappingValue(resources, limit.key) == nil {
+			missing = append(missing, limit.label)
+		}
+	}
+	if len(missing) != 0 {
+		l.report(container, manifestSeverityWarning, manifestRuleResourceLimits, fmt.Sprintf("%s has no %s limit", name, strings.Join(missing, " or ")))
+	}
+
+	image := mappingValue(container, "image")
+	if image == nil || image.Kind != yaml.ScalarNode || image.Value == "" {
+		return
+	}
+	named, err := reference.ParseNormalizedNamed(image.Value)
+	if err != nil {
+		return
+	}
+	if _, digested := named.(reference.Digested); digested {
+		return
+	}
+	if tagged, ok := named.(reference.Tagged); !ok {
+		l.report(image, manifestSeverityWarning, manifestRuleLatestTag, fmt.Sprintf("%s image %s has no tag and uses latest", name, image.Value))
+	} else if tagged.Tag() == "latest" {
+		l.report(image, manifestSeverityWarning, manifestRuleLatestTag, fmt.Sprintf("%s image %s uses the latest tag", name, image.Value))
+	}
+}
+
+func (l *manifestLinter) checkEnv(list *yaml.Node) {
+	seen := map[string]*yaml.Node{}
+	for _, item := range list.Content {
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		name := mappingValue(item, "name")
+		if name == nil || name.Value == "" {
+			continue
+		}
+		if first, ok := seen[name.Value]; ok {
+			l.report(name, manifestSeverityError, manifestRuleDuplicateEnv, fmt.Sprintf("env var %s is already defined on line %d", name.Value, first.Line))
+			continue
+		}
+		seen[name.Value] = name
+	}
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func yamlNodeType(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	}
+	switch node.Tag {
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	case "!!bool":
+		return "boolean"
+	case "!!null":
+		return "null"
+	default:
+		return "string"
+	}
+}
+
+func yamlTypeAllowed(actual string, allowed []string) bool {
+	for _, name := range allowed {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package ops
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestLinterReportsPositions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nginx.conf"), []byte("server {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "service.yml")
+	content := `name: Web
+workloads:
+  - name: web
+    replicas: two
+    containers:
+      - name: nginx
+        image: nginx
+        resources: {limitCPU: 500, limitMem: 256}
+        configs:
+          - {path: /etc/nginx/nginx.conf, file: nginx.conf}
+          - {path: /etc/nginx/extra.conf, file: extra.conf}
+      - name: php
+        image: wodby/php:latest
+        resources: {limitMem: 512, limitGPU: 1}
+        env:
+          - {name: APP_ENV, value: prod}
+          - {name: APP_ENV, value: dev}
+      - name: cron
+        image: wodby/php@sha256:0000000000000000000000000000000000000000000000000000000000000000
+        resources: {limitCPU: 100, limitMem: 64}
+`
+	linter := &manifestLinter{kind: "auto", disabled: map[string]bool{}}
+	diagnostics, err := linter.lint(manifest, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0, len(diagnostics))
+	for _, diagnostic := range diagnostics {
+		lines = append(lines, strings.TrimPrefix(diagnostic.String(), dir+string(filepath.Separator)))
+	}
+	want := `service.yml:1:7: error: name "Web" does not match ^[a-z0-9]([a-z0-9-]*[a-z0-9])?$ (schema)
+service.yml:4:15: error: workloads[0].replicas must be integer, not string (schema)
+service.yml:7:16: warning: container nginx image nginx has no tag and uses latest (latest-tag)
+service.yml:11:49: error: workloads[0].containers[0].configs[1].file references ` + filepath.Join(dir, "extra.conf") + `, which does not exist (include)
+service.yml:12:9: warning: container php has no CPU limit (resource-limits)
+service.yml:13:16: warning: container php image wodby/php:latest uses the latest tag (latest-tag)
+service.yml:14:36: error: workloads[0].containers[1].resources has unknown key "limitGPU" (schema)
+service.yml:17:20: error: env var APP_ENV is already defined on line 16 (duplicate-env)`
+	if got := strings.Join(lines, "\n"); got != want {
+		t.Fatalf("diagnostics =\n%s\nwant\n%s", got, want)
+	}
+
+	linter = &manifestLinter{kind: "auto", includes: map[string]string{"extra.conf": filepath.Join(dir, "nginx.conf")}, disabled: map[string]bool{manifestRuleLatestTag: true, manifestRuleSchema: true, manifestRuleResourceLimits: true, manifestRuleDuplicateEnv: true}}
+	diagnostics, _ = linter.lint(manifest, []byte(content))
+	if len(diagnostics) != 1 || diagnostics[0].Message != "workloads[0].containers[0].configs[0].file references nginx.conf, which is not passed with --include" {
+		t.Fatalf("diagnostics = %v", diagnostics)
+	}
+}
+
+func TestManifestLinterDetectsStacksAndSyntaxErrors(t *testing.T) {
+	linter := &manifestLinter{kind: "auto", disabled: map[string]bool{}}
+	diagnostics, err := linter.lint("stack.yml", []byte("name: php\nservices:\n  - title: PHP\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].String() != `stack.yml:3:5: error: services[0] is missing required key "name" (schema)` {
+		t.Fatalf("diagnostics = %v", diagnostics)
+	}
+
+	diagnostics, err = linter.lint("broken.yml", []byte("name: php\nservices:\n  - name: [php\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Rule != manifestRuleSyntax || diagnostics[0].Line == 0 {
+		t.Fatalf("diagnostics = %v", diagnostics)
+	}
+}
+
+func TestManifestLinterAcceptsStackServiceConfigAndNumericVersions(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "stack.yml")
+	content := `name: php-stack
+version: 1.0
+services:
+  - name: nginx
+    options:
+      - version: 1.27
+    config: templates/nginx.conf
+  - name: php
+    options:
+      - version: 8.3
+    labels:
+      tier: app
+`
+	linter := &manifestLinter{kind: "auto", disabled: map[string]bool{}}
+	diagnostics, err := linter.lint(manifest, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "stack.yml:7:13: error: services[0].config references " + filepath.Join(dir, "templates", "nginx.conf") + ", which does not exist (include)"
+	if len(diagnostics) != 1 || strings.TrimPrefix(diagnostics[0].String(), dir+string(filepath.Separator)) != want {
+		t.Fatalf("diagnostics = %v, want %s", diagnostics, want)
+	}
+}
@@ -0,0 +1,160 @@
+package ops
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func newManifestCommand() *cobra.Command {
+	out := outputOptions{}
+	cmd := &cobra.Command{
+		Use:     "manifest",
+		Aliases: []string{"manifests"},
+		Short:   "Work with stack and service manifests offline",
+	}
+	addOutputFlag(cmd, &out)
+	cmd.AddCommand(
+		newManifestRenderCommand(),
+		newManifestLintCommand(out),
+		newManifestSchemaCommand(),
+	)
+	return cmd
+}
+
+func newManifestLintCommand(out outputOptions) *cobra.Command {
+	var kind string
+	var includes, disable []string
+	cmd := &cobra.Command{
+		Use:   "lint FILE...",
+		Short: "Check manifests without calling the API",
+		Long: "Check stack and service manifests against the JSON Schemas built into the CLI and against style rules, without calling the API.\n\n" +
+			"Rules: " + strings.Join(manifestLintRules, ", ") + ". " +
+			"Files referenced by the manifest must be passed with --include as they would be to create-from-manifest, or exist next to the manifest when no --include is given. " +
+			"Style rules warn about containers without CPU or memory limits and images on the latest tag, and reject duplicate env var names. " +
+			"Every finding is printed as FILE:LINE:COLUMN and makes the command fail; use --disable to skip a rule.",
+		Example: `  wodby manifest lint stack.yml services/*.yml
+  wodby manifest render base/stack.yml --overlay overlays/prod | wodby manifest lint -
+  wodby manifest lint service.yml --include templates/nginx.conf --disable latest-tag`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			linter := &manifestLinter{kind: kind, includes: map[string]string{}, disabled: map[string]bool{}}
+			switch kind {
+			case "auto", "stack", "service":
+			default:
+				return errors.Errorf("unsupported --kind %q", kind)
+			}
+			for _, rule := range disable {
+				if !containsString(manifestLintRules, rule) {
+					return errors.Errorf("unknown rule %q; rules are %s", rule, strings.Join(manifestLintRules, ", "))
+				}
+				linter.disabled[rule] = true
+			}
+			for _, include := range includes {
+				key, path := splitInclude(include)
+				if strings.TrimSpace(key) == "" || strings.TrimSpace(path) == "" {
+					return errors.Errorf("invalid --include %q", include)
+				}
+				linter.includes[key] = path
+			}
+
+			diagnostics := linter.checkIncludeFlags()
+			for _, file := range args {
+				content, err := readTextFileOrStdin(cmd, file)
+				if err != nil {
+					return err
+				}
+				found, err := linter.lint(file, []byte(content))
+				if err != nil {
+					return err
+				}
+				diagnostics = append(diagnostics, found...)
+			}
+
+			if outputFormat(cmd, out) == outputJSON {
+				if err := printJSON(cmd, diagnostics); err != nil {
+					return err
+				}
+			} else {
+				for _, diagnostic := range diagnostics {
+					fmt.Fprintln(cmd.OutOrStdout(), diagnostic.String())
+				}
+			}
+			if len(diagnostics) == 0 {
+				if outputFormat(cmd, out) != outputJSON {
+					fmt.Fprintf(cmd.ErrOrStderr(), "%s OK\n", pluralizeCount(len(args), "manifest", "manifests"))
+				}
+				return nil
+			}
+			errorCount := 0
+			for _, diagnostic := range diagnostics {
+				if diagnostic.Severity == manifestSeverityError {
+					errorCount++
+				}
+			}
+			cmd.SilenceUsage = true
+			return errors.Errorf("%s, %s", pluralizeCount(errorCount, "error", "errors"), pluralizeCount(len(diagnostics)-errorCount, "warning", "warnings"))
+		},
+	}
+	cmd.Flags().StringVar(&kind, "kind", "auto", "Manifest kind: auto, stack, or service; auto treats manifests with services as stacks")
+	cmd.Flags().StringArrayVar(&includes, "include", nil, "Referenced file to include; use PATH or MANIFEST_PATH=LOCAL_PATH")
+	cmd.Flags().StringSliceVar(&disable, "disable", nil, "Rule to skip: "+strings.Join(manifestLintRules, ", "))
+	return cmd
+}
+
+func newManifestRenderCommand() *cobra.Command {
+	opts := manifestTemplateOptions{}
+	var outPath string
+	cmd := &cobra.Command{
+		Use:   "render MANIFEST",
+		Short: "Print a manifest after templating and overlays",
+		Long: "Render a manifest the way validate-manifest, create-from-manifest and apply-manifest do before sending it when --values, --set or --overlay is given.\n\n" +
+			"The manifest and each overlay are Go templates that read values as {{ .Values.KEY }}. A missing value is an error unless it is piped to default, as in {{ .Values.replicas | default 1 }}; required fails with its message, as in {{ required \"region is required\" .Values.region }}. " +
+			"Values come from values.yaml in overlay directories, then --values files, then --set. " +
+			"Overlays merge over the manifest in order: maps merge by key, lists of objects with a name merge by name, and other values replace. " +
+			"A null value removes a key and a list item with \"$patch: delete\" removes the item with the same name.",
+		Example: `  wodby manifest render base/stack.yml --overlay overlays/prod
+  wodby manifest render stack.yml --values regions/eu.yaml --set replicas=3 --out build/stack.yml
+  wodby stack apply-manifest 12 -f base/stack.yml --overlay overlays/prod --version 1.4.0`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifestYAML, err := readTextFileOrStdin(cmd, args[0])
+			if err != nil {
+				return errors.Wrap(err, "read manifest")
+			}
+			rendered, err := renderManifest(args[0], manifestYAML, opts)
+			if err != nil {
+				return err
+			}
+			if outPath != "" {
+				return writeTextOutput(outPath, rendered)
+			}
+			fmt.Fprint(cmd.OutOrStdout(), rendered)
+			return nil
+		},
+	}
+	addManifestTemplateFlags(cmd, &opts)
+	cmd.Flags().StringVar(&outPath, "out", "", "Write the rendered manifest to this file instead of stdout")
+	return cmd
+}
+
+func newManifestSchemaCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:       "schema KIND",
+		Short:     "Print the JSON Schema of stack or service manifests",
+		Long:      "Print the JSON Schema that manifest lint uses, for example to configure editor validation.",
+		Example:   "  wodby manifest schema service > service.schema.json",
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"stack", "service"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			content, err := manifestSchemaFiles.ReadFile("schemas/" + args[0] + ".schema.json")
+			if err != nil {
+				return errors.Errorf("unknown manifest kind %q; use stack or service", args[0])
+			}
+			_, err = cmd.OutOrStdout().Write(content)
+			return errors.WithStack(err)
+		},
+	}
+}
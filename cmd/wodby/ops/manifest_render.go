@@ -0,0 +1,249 @@
+package ops
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+)
+
+// manifestValuesFile is read from an overlay directory before --values.
+const manifestValuesFile = "values.yaml"
+
+// manifestMissingValue is what text/template prints for a missing map key
+// when missingkey is not "error".
+const manifestMissingValue = "<no value>"
+
+// manifestTemplateOptions configure the templating stage that runs before a
+// manifest is validated or sent, and in manifest render. It only runs when
+// one of them is set, so manifests that contain "{{" for other reasons are
+// sent unchanged.
+type manifestTemplateOptions struct {
+	values   []string
+	set      []string
+	overlays []string
+}
+
+func (o manifestTemplateOptions) enabled() bool {
+	return len(o.values) != 0 || len(o.set) != 0 || len(o.overlays) != 0
+}
+
+func addManifestTemplateFlags(cmd *cobra.Command, opts *manifestTemplateOptions) {
+	cmd.Flags().StringArrayVar(&opts.values, "values", nil, "YAML file with values for {{ .Values.* }} in the manifest; later files win")
+	cmd.Flags().StringArrayVar(&opts.set, "set", nil, "Value as KEY=VALUE, for example region=eu or db.size=20; wins over --values")
+	cmd.Flags().StringArrayVar(&opts.overlays, "overlay", nil, "Overlay manifest, or directory with a manifest of the same file name and an optional values.yaml, merged over the manifest in order")
+}
+
+// renderManifest templates the manifest and each overlay with the values and
+// merges the overlays into the manifest: maps merge by key, lists of named
+// objects merge by name, other values replace. A null value removes a key
+// and a list item with "$patch: delete" removes the item with its name.
+func renderManifest(manifestPath string, manifestYAML string, opts manifestTemplateOptions) (string, error) {
+	overlays := make([]string, 0, len(opts.overlays))
+	valueFiles := make([]string, 0, len(opts.overlays)+len(opts.values))
+	for _, overlay := range opts.overlays {
+		info, err := os.Stat(overlay)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if !info.IsDir() {
+			overlays = append(overlays, overlay)
+			continue
+		}
+		if manifestPath == "-" {
+			return "", errors.Errorf("--overlay %s is a directory; use the overlay manifest file when the manifest is read from stdin", overlay)
+		}
+		overlays = append(overlays, filepath.Join(overlay, filepath.Base(manifestPath)))
+		if _, err := os.Stat(filepath.Join(overlay, manifestValuesFile)); err == nil {
+			valueFiles = append(valueFiles, filepath.Join(overlay, manifestValuesFile))
+		}
+	}
+	values, err := loadManifestValues(append(valueFiles, opts.values...), opts.set)
+	if err != nil {
+		return "", err
+	}
+
+	document, err := renderManifestDocument(manifestPath, manifestYAML, values)
+	if err != nil {
+		return "", err
+	}
+	for _, overlay := range overlays {
+		content, err := os.ReadFile(overlay)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		patch, err := renderManifestDocument(overlay, string(content), values)
+		if err != nil {
+			return "", err
+		}
+		if len(document.Content) == 0 {
+			document = patch
+		} else if len(patch.Content) != 0 {
+			document.Content[0] = mergeManifestNodes(document.Content[0], patch.Content[0])
+		}
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return buffer.String(), nil
+}
+
+// renderManifestDocument executes one template. Missing values evaluate to
+// nil so that default and required can handle them; a missing value that
+// reaches the output is an error.
+func renderManifestDocument(name string, content string, values map[string]interface{}) (*yaml.Node, error) {
+	tmpl, err := template.New(filepath.Base(name)).Option("missingkey=default").Funcs(template.FuncMap{
+		"default": func(fallback interface{}, value interface{}) interface{} {
+			if value == nil || value == "" {
+				return fallback
+			}
+			return value
+		},
+		"required": func(message string, value interface{}) (interface{}, error) {
+			if value == nil || value == "" {
+				return nil, errors.New(message)
+			}
+			return value, nil
+		},
+	}).Parse(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", name)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, map[string]interface{}{"Values": values}); err != nil {
+		return nil, errors.Wrapf(err, "render %s", name)
+	}
+	for i, line := range strings.Split(rendered.String(), "\n") {
+		if strings.Contains(line, manifestMissingValue) {
+			return nil, errors.Errorf("render %s: rendered line %d uses a value that is not set; pass it with --values or --set, or pipe it to default", name, i+1)
+		}
+	}
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal(rendered.Bytes(), document); err != nil {
+		return nil, errors.Wrapf(err, "decode rendered %s", name)
+	}
+	return document, nil
+}
+
+func loadManifestValues(files []string, set []string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		fileValues := map[string]interface{}{}
+		if err := yaml.Unmarshal(content, &fileValues); err != nil {
+			return nil, errors.Wrapf(err, "decode %s", file)
+		}
+		mergeManifestValues(values, fileValues)
+	}
+	for _, assignment := range set {
+		key, value, ok := strings.Cut(assignment, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, errors.Errorf("invalid --set %q; use KEY=VALUE", assignment)
+		}
+		parts := strings.Split(strings.TrimSpace(key), ".")
+		target := values
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := target[part].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				target[part] = next
+			}
+			target = next
+		}
+		target[parts[len(parts)-1]] = value
+	}
+	return values, nil
+}
+
+func mergeManifestValues(target map[string]interface{}, source map[string]interface{}) {
+	for key, value := range source {
+		sourceMap, sourceIsMap := value.(map[string]interface{})
+		targetMap, targetIsMap := target[key].(map[string]interface{})
+		if sourceIsMap && targetIsMap {
+			mergeManifestValues(targetMap, sourceMap)
+			continue
+		}
+		target[key] = value
+	}
+}
+
+func mergeManifestNodes(base *yaml.Node, patch *yaml.Node) *yaml.Node {
+	switch {
+	case base.Kind == yaml.MappingNode && patch.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(patch.Content); i += 2 {
+			key, value := patch.Content[i], patch.Content[i+1]
+			index := mappingIndex(base, key.Value)
+			switch {
+			case value.Tag == "!!null" && index >= 0:
+				base.Content = append(base.Content[:index], base.Content[index+2:]...)
+			case value.Tag == "!!null":
+			case index >= 0:
+				base.Content[index+1] = mergeManifestNodes(base.Content[index+1], value)
+			default:
+				base.Content = append(base.Content, key, value)
+			}
+		}
+		return base
+	case base.Kind == yaml.SequenceNode && patch.Kind == yaml.SequenceNode && namedYAMLItems(base) && namedYAMLItems(patch):
+		for _, item := range patch.Content {
+			name := mappingValue(item, "name").Value
+			index := -1
+			for i, existing := range base.Content {
+				if mappingValue(existing, "name").Value == name {
+					index = i
+					break
+				}
+			}
+			deleteItem := false
+			if directive := mappingValue(item, "$patch"); directive != nil {
+				deleteItem = directive.Value == "delete"
+				item.Content = append(item.Content[:mappingIndex(item, "$patch")], item.Content[mappingIndex(item, "$patch")+2:]...)
+			}
+			switch {
+			case deleteItem && index >= 0:
+				base.Content = append(base.Content[:index], base.Content[index+1:]...)
+			case deleteItem:
+			case index >= 0:
+				base.Content[index] = mergeManifestNodes(base.Content[index], item)
+			default:
+				base.Content = append(base.Content, item)
+			}
+		}
+		return base
+	default:
+		return patch
+	}
+}
+
+func mappingIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func namedYAMLItems(node *yaml.Node) bool {
+	for _, item := range node.Content {
+		if name := mappingValue(item, "name"); name == nil || name.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
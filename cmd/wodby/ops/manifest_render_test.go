@@ -0,0 +1,102 @@
+package ops
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRenderManifestAppliesValuesAndOverlays(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"base/stack.yml": `name: shop-{{ .Values.region }}
+title: Shop
+services:
+  - name: php
+    replicas: {{ .Values.replicas | default 1 }}
+    env:
+      - {name: REGION, value: "{{ .Values.region }}"}
+  - name: mailpit
+  - name: redis
+    options: [{version: "7"}]
+`,
+		"overlays/prod/values.yaml": "region: eu\nreplicas: 2\n",
+		"overlays/prod/stack.yml": `title: null
+services:
+  - name: php
+    env:
+      - {name: APP_ENV, value: prod}
+  - name: mailpit
+    $patch: delete
+  - name: memcached
+    replicas: {{ .Values.replicas }}
+  - name: redis
+    options: [{version: "7.4"}]
+`,
+	})
+
+	rendered, err := renderManifest(filepath.Join(dir, "base", "stack.yml"), readTestFile(t, filepath.Join(dir, "base", "stack.yml")), manifestTemplateOptions{
+		overlays: []string{filepath.Join(dir, "overlays", "prod")},
+		set:      []string{"region=us"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `name: shop-us
+services:
+  - name: php
+    replicas: 2
+    env:
+      - {name: REGION, value: "us"}
+      - {name: APP_ENV, value: prod}
+  - name: redis
+    options: [{version: "7.4"}]
+  - name: memcached
+    replicas: 2
+`
+	if rendered != want {
+		t.Fatalf("rendered =\n%s\nwant\n%s", rendered, want)
+	}
+
+	if _, err := renderManifest("stack.yml", "name: {{ .Values.missing }}\n", manifestTemplateOptions{set: []string{"region=eu"}}); err == nil {
+		t.Fatal("expected an error for a missing value")
+	}
+}
+
+func TestRenderManifestDefaultsMissingValues(t *testing.T) {
+	rendered, err := renderManifest("stack.yml", "name: shop-{{ .Values.region | default \"eu\" }}\nservices:\n  - name: php\n    replicas: {{ .Values.replicas | default 1 }}\n", manifestTemplateOptions{set: []string{"tier=web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "name: shop-eu\nservices:\n  - name: php\n    replicas: 1\n"; rendered != want {
+		t.Fatalf("rendered =\n%s\nwant\n%s", rendered, want)
+	}
+
+	_, err = renderManifest("stack.yml", "name: shop\nregion: {{ required \"region is required\" .Values.region }}\n", manifestTemplateOptions{set: []string{"tier=web"}})
+	if err == nil || !strings.Contains(err.Error(), "region is required") {
+		t.Fatalf("err = %v, want region is required", err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
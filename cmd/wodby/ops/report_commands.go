@@ -0,0 +1,373 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const outputMarkdown = "markdown"
+
+// Upgrade priorities: end-of-life versions first, then major version jumps.
+const (
+	upgradePriorityEOL   = "P1"
+	upgradePriorityMajor = "P2"
+	upgradePriorityMinor = "P3"
+)
+
+type outdatedGroup struct {
+	Priority      string             `json:"priority"`
+	Kind          string             `json:"kind"`
+	Name          string             `json:"name"`
+	Version       string             `json:"version"`
+	TargetVersion string             `json:"targetVersion,omitempty"`
+	EOL           bool               `json:"eol"`
+	Instances     []outdatedInstance `json:"instances"`
+	Changelog     []string           `json:"changelog,omitempty"`
+
+	targets map[string]bool
+}
+
+type outdatedInstance struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	App   string `json:"app,omitempty"`
+	Env   string `json:"env,omitempty"`
+}
+
+type outdatedReport struct {
+	GeneratedAt time.Time        `json:"generatedAt"`
+	OrgID       string           `json:"orgId"`
+	Instances   int              `json:"instances"`
+	Groups      []*outdatedGroup `json:"groups"`
+}
+
+// outdatedInstanceState is what the report fetched for one app instance.
+type outdatedInstanceState struct {
+	instance       map[string]interface{}
+	services       []map[string]interface{}
+	stackChangelog map[string]interface{}
+	serviceChanges map[string]map[string]interface{}
+}
+
+func newReportCommand() *cobra.Command {
+	out := outputOptions{}
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Generate organization reports",
+	}
+	cmd.PersistentFlags().StringVarP(&out.output, "output", "o", outputMarkdown, "Output format: markdown or json")
+	cmd.AddCommand(newReportOutdatedCommand(out))
+	return cmd
+}
+
+func newReportOutdatedCommand(out outputOptions) *cobra.Command {
+	var orgID string
+	var concurrency int
+	cmd := &cobra.Command{
+		Use:   "outdated",
+		Short: "Report outdated and end-of-life services as an upgrade backlog",
+		Long: "List the app instances whose stack or service revisions are behind, grouped by service and version, with the changelog entries of the pending updates.\n\n" +
+			"Groups are prioritized: P1 for end-of-life versions, P2 for major version upgrades and P3 for the rest; within a priority, groups affecting more instances come first.",
+		Example: `  wodby report outdated > upgrades.md
+  wodby report outdated --org 1 -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := outputFormat(cmd, out)
+			if output != outputMarkdown && output != outputJSON {
+				return errors.Errorf("unsupported output format %q", output)
+			}
+			if concurrency < 1 {
+				return errors.New("--concurrency must be at least 1")
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			resolvedOrgID, err := inferOrgID(cmd.Context(), client, orgID)
+			if err != nil {
+				return err
+			}
+			fetcher := newInventoryFetcher(client, concurrency, 0, false)
+			states, err := fetchOutdatedStates(cmd.Context(), fetcher, resolvedOrgID)
+			if err != nil {
+				return err
+			}
+			report := &outdatedReport{GeneratedAt: time.Now().UTC(), OrgID: resolvedOrgID, Groups: groupOutdated(states)}
+			affected := map[string]bool{}
+			for _, group := range report.Groups {
+				for _, instance := range group.Instances {
+					affected[instance.ID] = true
+				}
+			}
+			report.Instances = len(affected)
+			if output == outputJSON {
+				return printJSON(cmd, report)
+			}
+			_, err = fmt.Fprint(cmd.OutOrStdout(), renderOutdatedMarkdown(report))
+			return errors.WithStack(err)
+		},
+	}
+	cmd.Flags().StringVar(&orgID, "org", "", "Organization ID; inferred when current credentials expose one org")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 8, "Maximum number of concurrent API requests")
+	return cmd
+}
+
+func fetchOutdatedStates(ctx context.Context, fetcher *inventoryFetcher, orgID string) ([]*outdatedInstanceState, error) {
+	instances, err := fetcher.rows(ctx, "/app-instances", url.Values{"orgId": []string{orgID}, "clusterApp": []string{"false"}})
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*outdatedInstanceState, len(instances))
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, instance := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			states[i], errs[i] = fetchOutdatedState(ctx, fetcher, instance)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+func fetchOutdatedState(ctx context.Context, fetcher *inventoryFetcher, instance map[string]interface{}) (*outdatedInstanceState, error) {
+	id := firstScalarPath(instance, "id")
+	state := &outdatedInstanceState{instance: instance, serviceChanges: map[string]map[string]interface{}{}}
+	var err error
+	if state.services, err = fetcher.rows(ctx, "/app-services", url.Values{"appInstanceId": []string{id}}); err != nil {
+		return nil, err
+	}
+
+	if formatOutdatedColumn(instance) == "yes" {
+		changelog, err := fetcher.get(ctx, "/app-instance-stack-upgrade-changelogs/"+url.PathEscape(id), nil)
+		if err != nil {
+			return nil, err
+		}
+		state.stackChangelog = cloneFirstRow(normalizeItem(changelog))
+		for _, change := range asRows(firstNonNilPath(state.stackChangelog, "serviceChanges")) {
+			state.serviceChanges[firstScalarPath(change, "name")] = change
+		}
+	}
+
+	behind := false
+	for _, service := range state.services {
+		if formatOutdatedColumn(service) == "yes" && state.serviceChanges[firstScalarPath(service, "name")] == nil {
+			behind = true
+		}
+	}
+	if stackID := firstRelationID(instance, relationColumns["stack"]); behind && stackID != "" {
+		// The stack changelog lists service revision updates for every
+		// instance of the stack; it is fetched once per stack.
+		changes, err := fetcher.rows(ctx, "/stack-service-update-changelogs/"+url.PathEscape(stackID), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			if name := firstScalarPath(change, "name"); state.serviceChanges[name] == nil {
+				state.serviceChanges[name] = change
+			}
+		}
+	}
+	return state, nil
+}
+
+func groupOutdated(states []*outdatedInstanceState) []*outdatedGroup {
+	groups := map[string]*outdatedGroup{}
+	add := func(kind, name, version, target string, eol bool, entries []string, instance outdatedInstance) {
+		key := kind + "\x00" + name + "\x00" + version
+		group := groups[key]
+		if group == nil {
+			group = &outdatedGroup{Kind: kind, Name: name, Version: version, targets: map[string]bool{}}
+			groups[key] = group
+		}
+		group.EOL = group.EOL || eol
+		if target != "" {
+			group.targets[target] = true
+		}
+		for _, entry := range entries {
+			if !containsString(group.Changelog, entry) {
+				group.Changelog = append(group.Changelog, entry)
+			}
+		}
+		for _, existing := range group.Instances {
+			if existing.ID == instance.ID {
+				return
+			}
+		}
+		group.Instances = append(group.Instances, instance)
+	}
+
+	for _, state := range states {
+		instance := outdatedInstance{
+			ID:    firstScalarPath(state.instance, "id"),
+			Title: firstScalarPath(state.instance, "title", "name"),
+			App:   formatRelationColumn(state.instance, relationColumns["app"]),
+			Env:   formatRelationColumn(state.instance, relationColumns["env"]),
+		}
+		if state.stackChangelog != nil {
+			stack := formatColumnValue(state.instance, "stack")
+			if stack == "" {
+				stack = "stack " + firstRelationID(state.instance, relationColumns["stack"])
+			}
+			add("stack", stack, firstScalarPath(state.stackChangelog, "previousStackVersion"), firstScalarPath(state.stackChangelog, "stackVersion"), false, nil, instance)
+		}
+		for _, service := range state.services {
+			name := firstScalarPath(service, "name", "title")
+			change := state.serviceChanges[name]
+			outdated := formatOutdatedColumn(service) == "yes"
+			eol := formatEOLColumn(service) == "yes"
+			if !outdated && !eol && change == nil {
+				continue
+			}
+			version := formatColumnValue(service, "version")
+			if version == "" {
+				version = firstScalarPath(change, "previousVersion")
+			}
+			add("service", name, version, firstScalarPath(change, "version"), eol, changelogEntries(firstNonNilPath(change, "entries")), instance)
+		}
+	}
+
+	result := make([]*outdatedGroup, 0, len(groups))
+	for _, group := range groups {
+		targets := make([]string, 0, len(group.targets))
+		for target := range group.targets {
+			if target != group.Version {
+				targets = append(targets, target)
+			}
+		}
+		sort.Strings(targets)
+		group.TargetVersion = strings.Join(targets, ", ")
+		group.Priority = upgradePriority(group, targets)
+		sort.Slice(group.Instances, func(i, j int) bool { return group.Instances[i].Title < group.Instances[j].Title })
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		left, right := result[i], result[j]
+		switch {
+		case left.Priority != right.Priority:
+			return left.Priority < right.Priority
+		case len(left.Instances) != len(right.Instances):
+			return len(left.Instances) > len(right.Instances)
+		case left.Kind != right.Kind:
+			return left.Kind < right.Kind
+		case left.Name != right.Name:
+			return left.Name < right.Name
+		default:
+			return left.Version < right.Version
+		}
+	})
+	return result
+}
+
+func upgradePriority(group *outdatedGroup, targets []string) string {
+	if group.EOL {
+		return upgradePriorityEOL
+	}
+	current := majorVersion(group.Version)
+	for _, target := range targets {
+		if major := majorVersion(target); major != "" && current != "" && major != current {
+			return upgradePriorityMajor
+		}
+	}
+	return upgradePriorityMinor
+}
+
+func majorVersion(version string) string {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
+
+// changelogEntries flattens changelog entries that are either strings or
+// objects with a title or message.
+func changelogEntries(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		if value == nil {
+			return nil
+		}
+		items = []interface{}{value}
+	}
+	entries := make([]string, 0, len(items))
+	for _, item := range items {
+		entry := ""
+		if row, ok := item.(map[string]interface{}); ok {
+			entry = firstScalarPath(row, "title", "message", "description", "text", "summary")
+		} else {
+			entry = scalarString(item)
+		}
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func containsString(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
+
+func renderOutdatedMarkdown(report *outdatedReport) string {
+	var b strings.Builder
+	b.WriteString("# Upgrade backlog\n\n")
+	fmt.Fprintf(&b, "Generated %s for org %s: %s across %s.\n", report.GeneratedAt.Format(time.RFC3339), report.OrgID, pluralizeCount(len(report.Groups), "upgrade", "upgrades"), pluralizeCount(report.Instances, "app instance", "app instances"))
+	if len(report.Groups) == 0 {
+		b.WriteString("\nEverything is up to date.\n")
+		return b.String()
+	}
+	for i, group := range report.Groups {
+		title := group.Name + " " + group.Version
+		if group.Kind == "stack" {
+			title = "Stack " + title
+		}
+		if group.TargetVersion != "" {
+			title += " -> " + group.TargetVersion
+		}
+		labels := []string{group.Priority}
+		if group.EOL {
+			labels = append(labels, "EOL")
+		}
+		fmt.Fprintf(&b, "\n## %d. %s (%s)\n\n", i+1, title, strings.Join(labels, ", "))
+		fmt.Fprintf(&b, "%s:\n\n", pluralizeCount(len(group.Instances), "App instance", "App instances"))
+		for _, instance := range group.Instances {
+			details := make([]string, 0, 2)
+			if instance.App != "" {
+				details = append(details, "app "+instance.App)
+			}
+			if instance.Env != "" {
+				details = append(details, "env "+instance.Env)
+			}
+			line := fmt.Sprintf("- %s (ID %s", instance.Title, instance.ID)
+			if len(details) != 0 {
+				line += ", " + strings.Join(details, ", ")
+			}
+			b.WriteString(line + ")\n")
+		}
+		if len(group.Changelog) != 0 {
+			b.WriteString("\nChangelog:\n\n")
+			for _, entry := range group.Changelog {
+				b.WriteString("- " + strings.ReplaceAll(entry, "\n", " ") + "\n")
+			}
+		}
+	}
+	return b.String()
+}
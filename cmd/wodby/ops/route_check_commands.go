@@ -0,0 +1,379 @@
+package ops
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+// routeCheckMaxRedirects bounds how many redirects are followed after the
+// first response to find where a route ends up.
+const routeCheckMaxRedirects = 10
+
+// routeCheckExpiryTolerance is how far the served certificate expiry may be
+// from the one the API reports before it counts as a mismatch.
+const routeCheckExpiryTolerance = 24 * time.Hour
+
+var routeCheckColumns = []string{"route", "addresses", "response", "location", "cert", "result", "issues"}
+
+var routeCheckOrgColumns = append([]string{"instance"}, routeCheckColumns...)
+
+// routeProber sends the requests of "wodby route check". Certificates are
+// not verified by the transport so that an invalid chain can be reported
+// instead of failing the request; verifyRouteCert checks them against roots.
+type routeProber struct {
+	resolve func(ctx context.Context, host string) ([]string, error)
+	client  *http.Client
+	roots   *x509.CertPool
+}
+
+type routeCheckResult struct {
+	row    map[string]interface{}
+	issues []string
+}
+
+func newAppRouteCheckCommand(out outputOptions, mode instanceFilterMode) *cobra.Command {
+	var instanceID, orgID string
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:   instanceScopedListUse("check", mode),
+		Short: "Probe app routes and compare them with their configuration",
+		Long: "Resolve the host of each app route, request the route path and compare the response with the route configuration.\n\n" +
+			"Redirect routes are requested over HTTP and must answer with the configured redirect status code and a location with the configured scheme, host and path; the redirect is then followed to its final response. " +
+			"Other routes with a certificate are requested over HTTPS. For every route with a certificate the presented chain must be valid for the host and expire when the API says it does. " +
+			"Disabled routes are skipped. The command fails when any route does not match.",
+		Args: instanceScopedListArgs(mode),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if mode == instanceFilterArg {
+				instanceID = args[0]
+			}
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			routes, instances, err := fetchRouteCheckRoutes(cmd.Context(), client, instanceID, orgID)
+			if err != nil {
+				return err
+			}
+			if len(routes) == 0 {
+				if instanceID == "" {
+					return errors.New("organization has no app routes")
+				}
+				return errors.Errorf("app instance %s has no routes", instanceID)
+			}
+
+			prober := newRouteProber(timeout)
+			now := time.Now()
+			rows := make([]map[string]interface{}, 0, len(routes))
+			failed := 0
+			for _, route := range routes {
+				result := prober.check(cmd.Context(), route, now)
+				if len(result.issues) != 0 {
+					failed++
+				}
+				if instances != nil {
+					result.row["instance"] = instances[firstRelationID(route, relationColumns["instance"])]
+				}
+				rows = append(rows, result.row)
+			}
+			columns := routeCheckColumns
+			if instances != nil {
+				columns = routeCheckOrgColumns
+			}
+			if err := printResult(cmd, out, rows, columns); err != nil {
+				return err
+			}
+			if failed != 0 {
+				cmd.SilenceUsage = true
+				return errors.Errorf("%d of %s do not behave as configured", failed, pluralizeCount(len(routes), "route", "routes"))
+			}
+			return nil
+		},
+	}
+	if mode == instanceFilterFlag {
+		cmd.Flags().StringVarP(&instanceID, "instance", "i", "", "App instance ID; defaults to every app instance of the organization")
+		cmd.Flags().StringVar(&orgID, "org", "", "Organization ID when --instance is not set; inferred when current credentials expose one org")
+	}
+	cmd.Flags().DurationVar(&timeout, "timeout", 15*time.Second, "Timeout of each request")
+	return cmd
+}
+
+// fetchRouteCheckRoutes returns the routes of one app instance, or of every
+// app instance of the organization together with the instance names by ID.
+func fetchRouteCheckRoutes(ctx context.Context, client *rest.Client, instanceID string, orgID string) ([]map[string]interface{}, map[string]string, error) {
+	if instanceID != "" {
+		routes, err := fetchRows(ctx, client, "/app-routes", url.Values{"appInstanceId": []string{instanceID}})
+		return routes, nil, err
+	}
+	orgID, err := inferOrgID(ctx, client, orgID)
+	if err != nil {
+		return nil, nil, err
+	}
+	instances, err := fetchRows(ctx, client, "/app-instances", url.Values{"orgId": []string{orgID}})
+	if err != nil {
+		return nil, nil, err
+	}
+	names := map[string]string{}
+	routes := make([]map[string]interface{}, 0)
+	for _, instance := range instances {
+		id := firstScalarPath(instance, "id")
+		names[id] = firstScalarPath(instance, "name", "title")
+		rows, err := fetchRows(ctx, client, "/app-routes", url.Values{"appInstanceId": []string{id}})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, row := range rows {
+			if firstRelationID(row, relationColumns["instance"]) == "" {
+				row["appInstanceId"] = id
+			}
+			routes = append(routes, row)
+		}
+	}
+	return routes, names, nil
+}
+
+func newRouteProber(timeout time.Duration) *routeProber {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &routeProber{
+		resolve: net.DefaultResolver.LookupHost,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (p *routeProber) check(ctx context.Context, route map[string]interface{}, now time.Time) routeCheckResult {
+	host := firstScalarPath(route, "host", "hostname", "domain")
+	path := firstScalarPath(route, "path")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	row := map[string]interface{}{"id": firstScalarPath(route, "id"), "route": host}
+	if path != "/" {
+		row["route"] = host + path
+	}
+	if truthyPath(route, "disabled") {
+		row["result"] = "skipped"
+		row["issues"] = "route is disabled"
+		return routeCheckResult{row: row}
+	}
+	issues := p.probe(ctx, route, host, path, row, now)
+	row["result"] = "ok"
+	if len(issues) != 0 {
+		row["result"] = "mismatch"
+		row["issues"] = strings.Join(issues, "; ")
+	}
+	return routeCheckResult{row: row, issues: issues}
+}
+
+// probe requests the route and fills row with what it saw, returning the
+// differences from the route configuration.
+func (p *routeProber) probe(ctx context.Context, route map[string]interface{}, host string, path string, row map[string]interface{}, now time.Time) []string {
+	if host == "" {
+		return []string{"route has no host"}
+	}
+	addresses, err := p.resolve(ctx, host)
+	if err != nil {
+		return []string{"resolve " + host + ": " + err.Error()}
+	}
+	row["addresses"] = strings.Join(addresses, ", ")
+
+	issues := make([]string, 0)
+	scheme := "http"
+	expectTLS := routeExpectsTLS(route)
+	switch {
+	case expectTLS && routeRedirects(route):
+		// Redirects usually move plain HTTP requests, so the redirect is
+		// checked over HTTP and HTTPS is requested only for the certificate.
+		secure, err := p.get(ctx, "https://"+host+path)
+		if err != nil {
+			issues = append(issues, err.Error())
+			break
+		}
+		secure.Body.Close()
+		if secure.TLS != nil {
+			cert, certIssues := verifyRouteCert(secure.TLS, host, p.roots, route, now)
+			row["cert"] = cert
+			issues = append(issues, certIssues...)
+		}
+	case expectTLS:
+		scheme = "https"
+	}
+	target := scheme + "://" + host + path
+	resp, err := p.get(ctx, target)
+	if err != nil {
+		return append(issues, err.Error())
+	}
+	resp.Body.Close()
+	status := resp.StatusCode
+	response := strconv.Itoa(status)
+
+	if scheme == "https" && resp.TLS != nil {
+		cert, certIssues := verifyRouteCert(resp.TLS, host, p.roots, route, now)
+		row["cert"] = cert
+		issues = append(issues, certIssues...)
+	}
+
+	if routeRedirects(route) {
+		issues = append(issues, checkRouteRedirect(route, resp, host, path)...)
+	}
+	if status >= 300 && status < 400 {
+		location, err := resp.Location()
+		if err != nil {
+			issues = append(issues, fmt.Sprintf("GET %s returned %d without a location", target, status))
+			row["response"] = response
+			return issues
+		}
+		row["location"] = location.String()
+		final, finalURL, hops, err := p.follow(ctx, location)
+		if err != nil {
+			issues = append(issues, err.Error())
+			row["response"] = response
+			return issues
+		}
+		response += " -> " + strconv.Itoa(final)
+		if hops > 1 {
+			response += fmt.Sprintf(" (%d redirects)", hops)
+		}
+		if finalURL != location.String() {
+			row["location"] = location.String() + " -> " + finalURL
+		}
+		status = final
+	}
+	row["response"] = response
+	if status >= 500 {
+		issues = append(issues, fmt.Sprintf("GET %s ends with status %d", target, status))
+	}
+	return issues
+}
+
+func (p *routeProber) get(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s", target)
+	}
+	return resp, nil
+}
+
+// follow requests location and the redirects after it and returns the final
+// status code, the final URL and how many requests were made.
+func (p *routeProber) follow(ctx context.Context, location *url.URL) (int, string, int, error) {
+	for hops := 1; hops <= routeCheckMaxRedirects; hops++ {
+		resp, err := p.get(ctx, location.String())
+		if err != nil {
+			return 0, "", hops, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+			return resp.StatusCode, location.String(), hops, nil
+		}
+		next, err := resp.Location()
+		if err != nil {
+			return resp.StatusCode, location.String(), hops, nil
+		}
+		location = next
+	}
+	return 0, "", routeCheckMaxRedirects, errors.Errorf("more than %d redirects after %s", routeCheckMaxRedirects, location)
+}
+
+func routeExpectsTLS(route map[string]interface{}) bool {
+	if firstRelationID(route, relationColumns["cert"]) != "" || truthyPath(route, "letsencrypt", "tls", "https") {
+		return true
+	}
+	_, ok := parseDisplayTime(certTimeColumnValue(route, "certExpiresAt"))
+	return ok
+}
+
+func routeRedirects(route map[string]interface{}) bool {
+	return strings.EqualFold(firstScalarPath(route, "action"), "redirect") ||
+		firstScalarPath(route, "redirectScheme", "redirectHost", "redirectPath") != ""
+}
+
+// checkRouteRedirect compares the first response of a redirect route with
+// its redirectStatusCode, redirectScheme, redirectHost and redirectPath.
+func checkRouteRedirect(route map[string]interface{}, resp *http.Response, host string, path string) []string {
+	issues := make([]string, 0)
+	if want := firstScalarPath(route, "redirectStatusCode"); want != "" && want != "0" {
+		if strconv.Itoa(resp.StatusCode) != want {
+			issues = append(issues, fmt.Sprintf("redirect status %d, want %s", resp.StatusCode, want))
+		}
+	} else if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		issues = append(issues, fmt.Sprintf("status %d, want a redirect", resp.StatusCode))
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return append(issues, "redirect has no location")
+	}
+	if want := firstScalarPath(route, "redirectScheme"); want != "" && !strings.EqualFold(location.Scheme, want) {
+		issues = append(issues, fmt.Sprintf("redirect scheme %s, want %s", location.Scheme, strings.ToLower(want)))
+	}
+	wantHost := firstScalarPath(route, "redirectHost")
+	if wantHost == "" {
+		wantHost = host
+	}
+	if !strings.EqualFold(location.Hostname(), wantHost) {
+		issues = append(issues, fmt.Sprintf("redirect host %s, want %s", location.Hostname(), wantHost))
+	}
+	if want := firstScalarPath(route, "redirectPath"); want != "" {
+		if !strings.HasPrefix(want, "/") {
+			want = "/" + want
+		}
+		if location.Path != want && !strings.HasPrefix(location.Path, strings.TrimSuffix(want, "/")+"/") {
+			issues = append(issues, fmt.Sprintf("redirect path %s, want %s", location.Path, want))
+		}
+	} else if locationPath := "/" + strings.TrimPrefix(location.Path, "/"); locationPath != path {
+		issues = append(issues, fmt.Sprintf("redirect path %s, want %s", locationPath, path))
+	}
+	return issues
+}
+
+// verifyRouteCert checks the presented chain against roots, or the system
+// roots when roots is nil, and compares its expiry with the API.
+func verifyRouteCert(state *tls.ConnectionState, host string, roots *x509.CertPool, route map[string]interface{}, now time.Time) (string, []string) {
+	if len(state.PeerCertificates) == 0 {
+		return "", []string{"no certificate presented"}
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	issues := make([]string, 0)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates, CurrentTime: now}); err != nil {
+		issues = append(issues, "certificate: "+err.Error())
+	}
+	if apiExpiry, ok := parseDisplayTime(certTimeColumnValue(route, "certExpiresAt")); ok {
+		if diff := leaf.NotAfter.Sub(apiExpiry); diff > routeCheckExpiryTolerance || diff < -routeCheckExpiryTolerance {
+			issues = append(issues, fmt.Sprintf("served certificate expires %s, API reports %s", leaf.NotAfter.UTC().Format(time.RFC3339), apiExpiry.UTC().Format(time.RFC3339)))
+		}
+	}
+	issuer := leaf.Issuer.CommonName
+	if issuer == "" && len(leaf.Issuer.Organization) != 0 {
+		issuer = leaf.Issuer.Organization[0]
+	}
+	label := "expires " + leaf.NotAfter.UTC().Format("2006-01-02")
+	if issuer != "" {
+		label += " (" + issuer + ")"
+	}
+	return label, issues
+}
@@ -0,0 +1,197 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wodby/wodby-cli/pkg/api/rest"
+)
+
+// stackRevisionDiffConcurrency bounds the service child requests made while
+// reading a stack revision.
+const stackRevisionDiffConcurrency = 8
+
+// stackRevisionServiceChildren are the stack service children compared
+// between revisions.
+var stackRevisionServiceChildren = []string{"options", "env-vars", "configs", "volumes", "cron-schedules"}
+
+func newStackRevisionDiffCommand(out outputOptions) *cobra.Command {
+	var from, to int
+	cmd := &cobra.Command{
+		Use:   "diff STACK_ID",
+		Short: "Compare two stack revisions",
+		Long:  "Compare the services of two stack revisions: service revisions, versions, replicas, environment variables, settings, configs, volumes and cron schedules. --to defaults to the current revision.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newRESTClient()
+			if err != nil {
+				return err
+			}
+			fromID, err := findRevisionID(cmd.Context(), client, "stack", args[0], strconv.Itoa(from))
+			if err != nil {
+				return err
+			}
+			toRev := ""
+			if to != 0 {
+				toRev = strconv.Itoa(to)
+			}
+			toID, err := findRevisionID(cmd.Context(), client, "stack", args[0], toRev)
+			if err != nil {
+				return err
+			}
+			changes, err := diffStackRevisions(cmd.Context(), client, fromID, toID)
+			if err != nil {
+				return err
+			}
+			return printStackRevisionChanges(cmd, out, changes, "The stack revisions are the same.")
+		},
+	}
+	cmd.Flags().IntVar(&from, "from", 0, "Revision number to compare from")
+	cmd.Flags().IntVar(&to, "to", 0, "Revision number to compare to; defaults to the current revision")
+	_ = cmd.MarkFlagRequired("from")
+	return cmd
+}
+
+// previewStackDraft prints what publishing the draft revision of a stack
+// would change compared with its current revision.
+func previewStackDraft(cmd *cobra.Command, client *rest.Client, out outputOptions, stackID string) error {
+	var result interface{}
+	if err := client.Get(cmd.Context(), "/stacks/"+url.PathEscape(stackID), nil, &result); err != nil {
+		return err
+	}
+	stack := cloneFirstRow(normalizeItem(result))
+	draftID := firstScalarPath(stack, "draftRevId", "draftStackRevId", "draftRev.id", "draftRevision.id")
+	if draftID == "" {
+		return errors.Errorf("stack %s has no draft revision", stackID)
+	}
+	currentID := currentRevisionID(stack, "stack")
+	if currentID == "" {
+		return errors.Errorf("stack %s has no current revision", stackID)
+	}
+	changes, err := diffStackRevisions(cmd.Context(), client, currentID, draftID)
+	if err != nil {
+		return err
+	}
+	return printStackRevisionChanges(cmd, out, changes, "The draft matches the current stack revision.")
+}
+
+func printStackRevisionChanges(cmd *cobra.Command, out outputOptions, changes []manifestChange, same string) error {
+	if outputFormat(cmd, out) == outputJSON {
+		return printJSON(cmd, map[string]interface{}{"changes": changes})
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(cmd.OutOrStdout(), same)
+		return nil
+	}
+	return printResult(cmd, out, manifestChangeRows(changes), manifestChangeColumns)
+}
+
+func diffStackRevisions(ctx context.Context, client *rest.Client, fromID string, toID string) ([]manifestChange, error) {
+	fetcher := newInventoryFetcher(client, stackRevisionDiffConcurrency, 0, false)
+	from, err := stackRevisionSnapshot(ctx, fetcher, fromID)
+	if err != nil {
+		return nil, err
+	}
+	to, err := stackRevisionSnapshot(ctx, fetcher, toID)
+	if err != nil {
+		return nil, err
+	}
+	return diffManifests(from, to), nil
+}
+
+// stackRevisionSnapshot collects what a stack revision configures for each
+// of its services in the shape diffManifests compares, with services as a
+// list of named items and their children keyed by name.
+func stackRevisionSnapshot(ctx context.Context, fetcher *inventoryFetcher, revisionID string) (map[string]interface{}, error) {
+	services, err := fetcher.rows(ctx, "/stack-revisions/"+url.PathEscape(revisionID)+"/services", nil)
+	if err != nil {
+		return nil, err
+	}
+	children := map[string]map[string][]map[string]interface{}{}
+	for _, key := range stackRevisionServiceChildren {
+		if children[key], err = fetchServiceChildren(ctx, fetcher, "/stack-services", services, key); err != nil {
+			return nil, err
+		}
+	}
+
+	items := make([]interface{}, 0, len(services))
+	for _, service := range services {
+		serviceID := firstScalarPath(service, "id")
+		versions := make([]string, 0)
+		defaultVersion := ""
+		for _, option := range children["options"][serviceID] {
+			if truthyPath(option, "disabled") {
+				continue
+			}
+			versions = append(versions, firstScalarPath(option, "version"))
+			if truthyPath(option, "default") {
+				defaultVersion = firstScalarPath(option, "version")
+			}
+		}
+		sort.Strings(versions)
+
+		env := map[string]interface{}{}
+		for _, item := range children["env-vars"][serviceID] {
+			value := firstScalarPath(item, "value")
+			if truthyPath(item, "secret") {
+				value = instanceDiffSecretValue(item)
+			}
+			env[stackRevisionEnvKey(item)] = value
+		}
+		settings := map[string]interface{}{}
+		for _, item := range asRows(firstNonNilPath(service, "settings")) {
+			settings[firstScalarPath(item, "name")] = firstScalarPath(item, "value")
+		}
+		configs := map[string]interface{}{}
+		for _, item := range children["configs"][serviceID] {
+			configs[firstScalarPath(item, "name")] = map[string]interface{}{
+				"config":   firstScalarPath(item, "config"),
+				"disabled": truthyPath(item, "disabled"),
+			}
+		}
+		volumes := map[string]interface{}{}
+		for _, item := range children["volumes"][serviceID] {
+			volumes[firstScalarPath(item, "name")] = firstScalarPath(item, "size")
+		}
+		cronSchedules := map[string]interface{}{}
+		for _, item := range children["cron-schedules"][serviceID] {
+			cronSchedules[firstScalarPath(item, "name")] = map[string]interface{}{
+				"crontab":  firstScalarPath(item, "crontab"),
+				"command":  firstScalarPath(item, "command"),
+				"disabled": truthyPath(item, "disabled"),
+			}
+		}
+
+		items = append(items, map[string]interface{}{
+			"name":           firstScalarPath(service, "name"),
+			"serviceRev":     formatServiceRevisionColumn(service),
+			"versions":       strings.Join(versions, ", "),
+			"defaultVersion": defaultVersion,
+			"replicas":       firstScalarPath(service, "replicas"),
+			"disabled":       truthyPath(service, "disabled"),
+			"env":            env,
+			"settings":       settings,
+			"configs":        configs,
+			"volumes":        volumes,
+			"cronSchedules":  cronSchedules,
+		})
+	}
+	return map[string]interface{}{"services": items}, nil
+}
+
+// stackRevisionEnvKey names an environment variable by its name and, when
+// set, the environment type, workload and container it is limited to.
+func stackRevisionEnvKey(item map[string]interface{}) string {
+	name := firstScalarPath(item, "name")
+	scope := compactNonEmpty(firstScalarPath(item, "envType"), firstScalarPath(item, "workload"), firstScalarPath(item, "container"))
+	if len(scope) == 0 {
+		return name
+	}
+	return name + " (" + strings.Join(scope, ", ") + ")"
+}
@@ -0,0 +1,208 @@
+package ops
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const transferRetryDelay = 2 * time.Second
+
+// transferProgress reports bytes written through it. Terminals get a bar that
+// is redrawn in place; other writers get a line every 10 percent.
+type transferProgress struct {
+	out         io.Writer
+	label       string
+	total       int64
+	done        int64
+	tty         bool
+	lastPercent int
+	lastDraw    time.Time
+}
+
+func newTransferProgress(out io.Writer, label string, total int64, done int64) *transferProgress {
+	return &transferProgress{out: out, label: label, total: total, done: done, tty: isTerminalWriter(out), lastPercent: -1}
+}
+
+func (p *transferProgress) Write(content []byte) (int, error) {
+	p.done += int64(len(content))
+	p.draw(false)
+	return len(content), nil
+}
+
+func (p *transferProgress) Finish() {
+	p.draw(true)
+	if p.tty {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *transferProgress) draw(final bool) {
+	percent := -1
+	if p.total > 0 {
+		percent = int(p.done * 100 / p.total)
+	}
+	if p.tty {
+		if !final && time.Since(p.lastDraw) < 100*time.Millisecond {
+			return
+		}
+		p.lastDraw = time.Now()
+		if percent < 0 {
+			fmt.Fprintf(p.out, "\r%s %s", p.label, formatByteSize(p.done))
+			return
+		}
+		const width = 30
+		filled := min(width, percent*width/100)
+		fmt.Fprintf(p.out, "\r%s [%s%s] %3d%% %s/%s", p.label, strings.Repeat("=", filled), strings.Repeat(" ", width-filled), percent, formatByteSize(p.done), formatByteSize(p.total))
+		return
+	}
+	if percent < 0 {
+		if final {
+			fmt.Fprintf(p.out, "%s %s\n", p.label, formatByteSize(p.done))
+		}
+		return
+	}
+	if step := percent / 10 * 10; step > p.lastPercent || (final && percent != p.lastPercent) {
+		p.lastPercent = step
+		if final {
+			p.lastPercent = percent
+		}
+		fmt.Fprintf(p.out, "%s %d%% %s/%s\n", p.label, p.lastPercent, formatByteSize(p.done), formatByteSize(p.total))
+	}
+}
+
+func isTerminalWriter(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok || strings.EqualFold(strings.TrimSpace(os.Getenv("TERM")), "dumb") {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func formatByteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 4; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTP"[exp])
+}
+
+// transferChecksum is an expected digest such as "sha256:<hex>", a bare
+// SHA-256 or MD5 hex string, or empty when the API did not report one.
+type transferChecksum struct {
+	algorithm string
+	value     string
+}
+
+func parseTransferChecksum(value string, algorithm string) transferChecksum {
+	value = strings.TrimSpace(value)
+	if prefix, digest, ok := strings.Cut(value, ":"); ok {
+		algorithm, value = prefix, digest
+	}
+	algorithm = strings.ToLower(strings.ReplaceAll(algorithm, "-", ""))
+	if algorithm == "" {
+		switch len(value) {
+		case 32:
+			algorithm = "md5"
+		case 64:
+			algorithm = "sha256"
+		}
+	}
+	return transferChecksum{algorithm: algorithm, value: strings.ToLower(value)}
+}
+
+func (c transferChecksum) newHash() (hash.Hash, error) {
+	switch c.algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, errors.Errorf("unsupported checksum algorithm %q", c.algorithm)
+	}
+}
+
+func (c transferChecksum) String() string {
+	if c.value == "" {
+		return ""
+	}
+	return c.algorithm + ":" + c.value
+}
+
+func fileChecksum(path string, algorithm string) (string, error) {
+	h, err := transferChecksum{algorithm: algorithm}.newHash()
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// downloadToPartFile appends the body at signedURL to partPath, asking for
+// the missing byte range when the part file already holds a prefix. A 200
+// response to a range request restarts the file from the beginning.
+func downloadToPartFile(ctx context.Context, signedURL string, partPath string, progress func(offset int64) io.Writer) error {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, signedURL, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "download")
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		return nil
+	case resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices:
+		flags |= os.O_TRUNC
+		offset = 0
+	default:
+		return errors.Errorf("download returned status %d", resp.StatusCode)
+	}
+
+	file, err := os.OpenFile(partPath, flags, 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, copyErr := io.Copy(io.MultiWriter(file, progress(offset)), resp.Body)
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return errors.Wrap(copyErr, "download")
+}